@@ -0,0 +1,190 @@
+package fsevents
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// BufferPolicy describes what the Watcher does with an event or error when w.Events or w.Errors is full
+type BufferPolicy int
+
+const (
+	// BufferBlock waits until the channel has room. A Watcher whose w.Errors is not read stops
+	// at the first error it reports
+	BufferBlock BufferPolicy = iota
+	// BufferDrop drops the event or error, counting it in Stats
+	BufferDrop
+	// BufferCoalesce holds on to events for as long as the channel is full, merging the masks of events for the
+	// same path into one event, and sends them in order as the channel drains. Moves are never merged, and events
+	// following the move of a path are not merged into events preceding it.
+	// For errors, BufferCoalesce drops an error if an identical one was reported last and the channel is full.
+	BufferCoalesce
+)
+
+// Stats counts the events and errors the Watcher did not deliver because of its BufferPolicy
+type Stats struct {
+	// Events dropped because of BufferDrop
+	EventsDropped uint64
+	// Events merged into another event because of BufferCoalesce
+	EventsCoalesced uint64
+	// Errors dropped because of BufferDrop or BufferCoalesce, or because nothing was receiving them
+	// when they were reported in passing (such as the directories skipped by RecursiveAddWithOptions)
+	ErrorsDropped uint64
+	// Handlers the Timeout Middleware stopped waiting for, and that are still running
+	HandlersAbandoned int64
+}
+
+// coalescer holds the events waiting for room in w.Events under BufferCoalesce
+type coalescer struct {
+	sync.Mutex
+	// Events waiting to be sent, in order
+	pending []*FsEvent
+	// Pending events that can still be merged, key: path
+	mergeable map[string]*FsEvent
+	// True while a goroutine is sending the pending events, including the one it took out of pending last.
+	// New events are pending meanwhile, so that they are not sent before it
+	flushing bool
+}
+
+// Stats returns the number of events and errors dropped or coalesced by w so far
+func (w *Watcher) Stats() Stats {
+	return Stats{
+		EventsDropped:     atomic.LoadUint64(&w.stats.EventsDropped),
+		EventsCoalesced:   atomic.LoadUint64(&w.stats.EventsCoalesced),
+		ErrorsDropped:     atomic.LoadUint64(&w.stats.ErrorsDropped),
+		HandlersAbandoned: atomic.LoadInt64(&w.stats.HandlersAbandoned),
+	}
+}
+
+// sendEvent sends event on w.Events according to the Watcher's event BufferPolicy
+func (w *Watcher) sendEvent(event *FsEvent) {
+	switch w.config.eventPolicy {
+	case BufferDrop:
+		select {
+		case w.Events <- event:
+		default:
+			atomic.AddUint64(&w.stats.EventsDropped, 1)
+			w.logf("fsevents: event buffer full, dropped event %d for %q", event.ID, event.Path)
+		}
+	case BufferCoalesce:
+		w.coalesceEvent(event)
+	default:
+		w.Events <- event
+	}
+}
+
+// coalesceEvent sends event on w.Events if it has room and no event is pending or being sent,
+// and merges it into the pending events otherwise
+func (w *Watcher) coalesceEvent(event *FsEvent) {
+	c := &w.coalescer
+	c.Lock()
+	defer c.Unlock()
+	if !c.flushing {
+		select {
+		case w.Events <- event:
+			return
+		default:
+		}
+	}
+
+	if c.mergeable == nil {
+		c.mergeable = make(map[string]*FsEvent)
+	}
+	if CheckMask(Move, event.RawEvent.Mask) {
+		// Moves are paired by their cookie, and must stay separate. Later events for the path come after the move
+		c.pending = append(c.pending, event)
+		delete(c.mergeable, event.Path)
+	} else if pending, exists := c.mergeable[event.Path]; exists && pending.Descriptor == event.Descriptor {
+		pending.RawEvent.Mask |= event.RawEvent.Mask
+		atomic.AddUint64(&w.stats.EventsCoalesced, 1)
+	} else {
+		c.pending = append(c.pending, event)
+		c.mergeable[event.Path] = event
+	}
+	if !c.flushing {
+		c.flushing = true
+		go w.flushCoalesced()
+	}
+}
+
+// flushCoalesced sends the pending events on w.Events, in order, until there are none left or w is closed
+func (w *Watcher) flushCoalesced() {
+	c := &w.coalescer
+	for {
+		c.Lock()
+		if len(c.pending) == 0 {
+			c.flushing = false
+			c.Unlock()
+			return
+		}
+		event := c.pending[0]
+		c.pending = c.pending[1:]
+		if c.mergeable[event.Path] == event {
+			delete(c.mergeable, event.Path)
+		}
+		c.Unlock()
+		select {
+		case w.Events <- event:
+		case <-w.ctx.Done():
+			c.Lock()
+			c.pending = nil
+			c.mergeable = nil
+			c.flushing = false
+			c.Unlock()
+			return
+		}
+	}
+}
+
+// reportError passes err to the Watcher's error handler, or writes it to w.Errors according to the Watcher's
+// error BufferPolicy
+func (w *Watcher) reportError(err error) {
+	if w.config.errorHandler != nil {
+		w.config.errorHandler(err)
+		return
+	}
+	switch w.config.errorPolicy {
+	case BufferDrop:
+		select {
+		case w.Errors <- err:
+		default:
+			w.dropError(err)
+		}
+	case BufferCoalesce:
+		w.lastErrorLock.Lock()
+		repeated := w.lastError == err.Error()
+		w.lastError = err.Error()
+		w.lastErrorLock.Unlock()
+		if repeated {
+			select {
+			case w.Errors <- err:
+			default:
+				w.dropError(err)
+			}
+			return
+		}
+		w.Errors <- err
+	default:
+		w.Errors <- err
+	}
+}
+
+// tryReportError passes err to the Watcher's error handler, or writes it to w.Errors if it has room or something is
+// receiving from it. Used by methods that are usually called before anything reads w.Errors, and so must not block.
+func (w *Watcher) tryReportError(err error) {
+	if w.config.errorHandler != nil {
+		w.config.errorHandler(err)
+		return
+	}
+	select {
+	case w.Errors <- err:
+	default:
+		w.dropError(err)
+	}
+}
+
+// dropError counts and logs an error that could not be written to w.Errors
+func (w *Watcher) dropError(err error) {
+	atomic.AddUint64(&w.stats.ErrorsDropped, 1)
+	w.logf("fsevents: dropped error: %s", err)
+}
@@ -0,0 +1,184 @@
+package fsevents_test
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	fsevents "github.com/tywkeene/go-fsevents"
+)
+
+// waitForStats waits until cond returns true for the Watcher's Stats
+func waitForStats(w *fsevents.Watcher, cond func(fsevents.Stats) bool) fsevents.Stats {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond(w.Stats()) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	return w.Stats()
+}
+
+func TestEventBufferDrop(t *testing.T) {
+	setupDirs([]string{testRootDir})
+	defer teardownDirs([]string{testRootDir})
+
+	w, err := fsevents.NewWatcher(fsevents.WithEventBuffer(1), fsevents.WithEventPolicy(fsevents.BufferDrop))
+	assert(t, (err == nil), err)
+	defer w.Close()
+	d, err := w.AddDescriptor(testRootDir, fsevents.CloseWrite)
+	assert(t, (err == nil), err)
+	assert(t, (d.Start() == nil), fmt.Errorf("Start should not have returned an error"))
+	go w.Watch()
+
+	for i := 0; i < 3; i++ {
+		writeRandomFile(path.Join(testRootDir, fmt.Sprintf("drop%d", i)))
+	}
+	stats := waitForStats(w, func(s fsevents.Stats) bool { return s.EventsDropped >= 2 })
+	assert(t, (stats.EventsDropped == 2), fmt.Errorf("2 events should have been dropped, got %d", stats.EventsDropped))
+	event := <-w.Events
+	assert(t, (event.Name == "drop0"), fmt.Errorf("the first event should have been kept, got %q", event.Name))
+}
+
+func TestEventBufferCoalesce(t *testing.T) {
+	setupDirs([]string{testRootDir})
+	defer teardownDirs([]string{testRootDir})
+
+	w, err := fsevents.NewWatcher(fsevents.WithEventBuffer(1), fsevents.WithEventPolicy(fsevents.BufferCoalesce))
+	assert(t, (err == nil), err)
+	defer w.Close()
+	d, err := w.AddDescriptor(testRootDir, fsevents.Create|fsevents.Modified|fsevents.CloseWrite)
+	assert(t, (err == nil), err)
+	assert(t, (d.Start() == nil), fmt.Errorf("Start should not have returned an error"))
+	go w.Watch()
+
+	// The creation of "first" fills the buffer. The write to "first" and the creation of and write to "second"
+	// are merged into a pending event for each file
+	writeRandomFile(path.Join(testRootDir, "first"))
+	writeRandomFile(path.Join(testRootDir, "second"))
+	waitForStats(w, func(s fsevents.Stats) bool { return s.EventsCoalesced >= 3 })
+
+	events := make([]*fsevents.FsEvent, 0)
+	for len(events) < 3 {
+		select {
+		case event := <-w.Events:
+			events = append(events, event)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("only %d events received", len(events))
+		}
+	}
+	expected := []struct {
+		name string
+		mask uint32
+	}{
+		{"first", fsevents.Create},
+		{"first", fsevents.Modified | fsevents.CloseWrite},
+		{"second", fsevents.Create | fsevents.Modified | fsevents.CloseWrite},
+	}
+	for i, e := range expected {
+		assert(t, (events[i].Name == e.name && events[i].RawEvent.Mask == e.mask),
+			fmt.Errorf("event %d should have been %q %#x, got %q %#x", i, e.name, e.mask, events[i].Name, events[i].RawEvent.Mask))
+	}
+	assert(t, (w.Stats().EventsCoalesced == 3), fmt.Errorf("3 events should have been coalesced, got %d", w.Stats().EventsCoalesced))
+}
+
+func TestEventBufferCoalesceMove(t *testing.T) {
+	setupDirs([]string{testRootDir})
+	defer teardownDirs([]string{testRootDir})
+
+	w, err := fsevents.NewWatcher(fsevents.WithEventBuffer(1), fsevents.WithEventPolicy(fsevents.BufferCoalesce))
+	assert(t, (err == nil), err)
+	defer w.Close()
+	d, err := w.AddDescriptor(testRootDir, fsevents.Create|fsevents.Modified|fsevents.CloseWrite|fsevents.Move)
+	assert(t, (err == nil), err)
+	assert(t, (d.Start() == nil), fmt.Errorf("Start should not have returned an error"))
+	go w.Watch()
+
+	// The events of the new "first" SHOULD NOT be merged into those of the file moved away before
+	writeRandomFile(path.Join(testRootDir, "first"))
+	os.Rename(path.Join(testRootDir, "first"), path.Join(testRootDir, "second"))
+	file, _ := os.Create(path.Join(testRootDir, "first"))
+	file.Close()
+	waitForStats(w, func(s fsevents.Stats) bool { return s.EventsCoalesced >= 2 })
+
+	expected := []struct {
+		name string
+		mask uint32
+	}{
+		{"first", fsevents.Create},
+		{"first", fsevents.Modified | fsevents.CloseWrite},
+		{"first", fsevents.MovedFrom},
+		{"second", fsevents.MovedTo},
+		{"first", fsevents.Create | fsevents.CloseWrite},
+	}
+	for i, e := range expected {
+		select {
+		case event := <-w.Events:
+			assert(t, (event.Name == e.name && event.RawEvent.Mask == e.mask),
+				fmt.Errorf("event %d should have been %q %#x, got %q %#x", i, e.name, e.mask, event.Name, event.RawEvent.Mask))
+		case <-time.After(5 * time.Second):
+			t.Fatalf("only %d events received", i)
+		}
+	}
+}
+
+func TestEventBufferCoalesceClose(t *testing.T) {
+	setupDirs([]string{testRootDir})
+	defer teardownDirs([]string{testRootDir})
+
+	w, err := fsevents.NewWatcher(fsevents.WithEventBuffer(1), fsevents.WithEventPolicy(fsevents.BufferCoalesce))
+	assert(t, (err == nil), err)
+	d, err := w.AddDescriptor(testRootDir, fsevents.Create|fsevents.CloseWrite)
+	assert(t, (err == nil), err)
+	assert(t, (d.Start() == nil), fmt.Errorf("Start should not have returned an error"))
+	watching := make(chan struct{})
+	go func() {
+		w.Watch()
+		close(watching)
+	}()
+
+	// Events are left pending, since nothing reads w.Events
+	writeRandomFile(path.Join(testRootDir, "first"))
+	writeRandomFile(path.Join(testRootDir, "second"))
+	waitForStats(w, func(s fsevents.Stats) bool { return s.EventsCoalesced >= 1 })
+	w.Close()
+
+	select {
+	case <-watching:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the Watch loop should have returned on Close")
+	}
+	flushing := func() bool {
+		buf := make([]byte, 1<<20)
+		return strings.Contains(string(buf[:runtime.Stack(buf, true)]), "flushCoalesced")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for flushing() && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert(t, (!flushing()), fmt.Errorf("the goroutine sending pending events should have exited on Close"))
+}
+
+func TestErrorHandler(t *testing.T) {
+	errs := make([]error, 0)
+	w, err := fsevents.NewWatcher(fsevents.WithErrorHandler(func(err error) { errs = append(errs, err) }))
+	assert(t, (err == nil), err)
+	defer w.Close()
+
+	// Returns at once, reporting both ErrNoRunningDescriptors and ErrNoEventHandles
+	w.WatchAndHandle()
+	assert(t, (len(errs) == 2 && errs[0] == fsevents.ErrNoRunningDescriptors && errs[1] == fsevents.ErrNoEventHandles),
+		fmt.Errorf("the error handler should have received 2 errors, got %v", errs))
+}
+
+func TestErrorBufferDrop(t *testing.T) {
+	w, err := fsevents.NewWatcher(fsevents.WithErrorPolicy(fsevents.BufferDrop))
+	assert(t, (err == nil), err)
+	defer w.Close()
+
+	// Would block forever under BufferBlock, since nothing reads w.Errors
+	w.WatchAndHandle()
+	assert(t, (w.Stats().ErrorsDropped == 2), fmt.Errorf("2 errors should have been dropped, got %d", w.Stats().ErrorsDropped))
+}
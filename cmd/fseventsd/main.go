@@ -0,0 +1,50 @@
+// Command fseventsd watches directory trees on behalf of local clients, sharing a single Watcher per tree between
+// them, and serves their events and tree views over a Unix domain socket. See the daemon package for the protocol.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+
+	"github.com/tywkeene/go-fsevents/daemon"
+)
+
+// defaultSocket returns the socket path used when -socket is not given
+func defaultSocket() string {
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return filepath.Join(dir, "fseventsd.sock")
+	}
+	return filepath.Join(os.TempDir(), fmt.Sprintf("fseventsd-%d.sock", os.Getuid()))
+}
+
+func main() {
+	socket := flag.String("socket", defaultSocket(), "path of the Unix domain socket to listen on")
+	buffer := flag.Int("buffer", 0, "events held for a slow subscriber before it is disconnected (default 1024)")
+	quiet := flag.Bool("quiet", false, "do not log errors")
+	flag.Parse()
+
+	logger := log.New(os.Stderr, "fseventsd: ", log.LstdFlags)
+	opts := daemon.ServerOptions{SubscriptionBuffer: *buffer}
+	if !*quiet {
+		opts.Logger = logger
+	}
+	server := daemon.NewServer(opts)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-signals
+		server.Close()
+	}()
+
+	logger.Printf("listening on %s", *socket)
+	if err := server.ListenAndServe(*socket); err != nil && err != daemon.ErrServerClosed {
+		logger.Fatal(err)
+	}
+	os.Remove(*socket)
+}
@@ -0,0 +1,224 @@
+// Package client connects to a daemon.Server, and mirrors the event API of fsevents.Watcher for the directory trees
+// the server watches: events of subscriptions are sent on Client.Events, and errors on Client.Errors.
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+
+	fsevents "github.com/tywkeene/go-fsevents"
+	"github.com/tywkeene/go-fsevents/daemon"
+)
+
+var (
+	ErrClientClosed = errors.New("client closed")
+)
+
+// Options configures a Client
+type Options struct {
+	// Number of events Client.Events holds. While it is full, answers to requests are not read either,
+	// so Events must be read like the Events of an fsevents.Watcher
+	EventBuffer int
+	// Number of errors Client.Errors holds. Errors are dropped while it is full
+	ErrorBuffer int
+}
+
+// Client is a connection to a daemon.Server
+type Client struct {
+	sync.Mutex
+	// Receives the events of every subscription of the Client
+	Events chan *fsevents.FsEvent
+	// Receives the errors of subscriptions, such as their closing by the server, and of the connection
+	Errors chan error
+	conn   net.Conn
+	// Protects encoder
+	writeLock sync.Mutex
+	encoder   *json.Encoder
+	// Requests waiting for an answer, key: ID
+	pending map[uint64]chan *daemon.Message
+	lastID  uint64
+	// Closed once the connection is lost
+	done chan struct{}
+	err  error
+	// Closed by Close
+	closing   chan struct{}
+	closeOnce sync.Once
+}
+
+// Dial connects to the server listening on the Unix domain socket at socketPath
+func Dial(socketPath string) (*Client, error) {
+	return DialWithOptions(socketPath, Options{EventBuffer: 64, ErrorBuffer: 16})
+}
+
+// DialWithOptions connects to the server listening on the Unix domain socket at socketPath, configured by opts
+func DialWithOptions(socketPath string, opts Options) (*Client, error) {
+	conn, err := net.Dial("unix", socketPath)
+	if err != nil {
+		return nil, err
+	}
+	c := &Client{
+		Events:  make(chan *fsevents.FsEvent, opts.EventBuffer),
+		Errors:  make(chan error, opts.ErrorBuffer),
+		conn:    conn,
+		encoder: json.NewEncoder(conn),
+		pending: make(map[uint64]chan *daemon.Message),
+		done:    make(chan struct{}),
+		closing: make(chan struct{}),
+	}
+	go c.read()
+	return c, nil
+}
+
+// read dispatches the messages of the server until the connection is lost
+func (c *Client) read() {
+	defer close(c.done)
+	decoder := json.NewDecoder(c.conn)
+	for {
+		msg := &daemon.Message{}
+		if err := decoder.Decode(msg); err != nil {
+			c.Lock()
+			if c.err == nil {
+				c.err = err
+			}
+			c.Unlock()
+			return
+		}
+		switch {
+		case msg.ID != 0:
+			c.Lock()
+			answer, exists := c.pending[msg.ID]
+			delete(c.pending, msg.ID)
+			c.Unlock()
+			if exists {
+				answer <- msg
+			}
+		case msg.Event != nil:
+			select {
+			case c.Events <- msg.Event:
+			case <-c.closing:
+				return
+			}
+		case msg.Error != "":
+			c.reportError(fmt.Errorf("subscription %s: %s", msg.Subscription, msg.Error))
+		}
+	}
+}
+
+// reportError writes err to c.Errors if it has room
+func (c *Client) reportError(err error) {
+	select {
+	case c.Errors <- err:
+	default:
+	}
+}
+
+// do sends req to the server and waits for its answer
+func (c *Client) do(req *daemon.Request) (*daemon.Message, error) {
+	answer := make(chan *daemon.Message, 1)
+	c.Lock()
+	if c.err != nil {
+		err := c.err
+		c.Unlock()
+		return nil, err
+	}
+	c.lastID++
+	req.ID = c.lastID
+	c.pending[req.ID] = answer
+	c.Unlock()
+
+	c.writeLock.Lock()
+	err := c.encoder.Encode(req)
+	c.writeLock.Unlock()
+	if err != nil {
+		c.Lock()
+		delete(c.pending, req.ID)
+		c.Unlock()
+		return nil, err
+	}
+	select {
+	case msg := <-answer:
+		if msg.Error != "" {
+			return msg, errors.New(msg.Error)
+		}
+		return msg, nil
+	case <-c.done:
+		c.Lock()
+		defer c.Unlock()
+		return nil, c.err
+	}
+}
+
+// Watch makes the server watch the directory tree at root for the events in mask, all of them if mask is zero.
+// If the tree is already watched, its Watcher is shared, and its mask extended to include mask.
+func (c *Client) Watch(root string, mask uint32) error {
+	_, err := c.do(&daemon.Request{Command: daemon.CommandWatch, Root: root, Mask: mask})
+	return err
+}
+
+// Unwatch makes the server stop watching the tree at root, for every client
+func (c *Client) Unwatch(root string) error {
+	_, err := c.do(&daemon.Request{Command: daemon.CommandUnwatch, Root: root})
+	return err
+}
+
+// Roots returns the directory trees watched by the server
+func (c *Client) Roots() ([]string, error) {
+	msg, err := c.do(&daemon.Request{Command: daemon.CommandList})
+	if err != nil {
+		return nil, err
+	}
+	return msg.Roots, nil
+}
+
+// Subscribe sends the events of the watched tree at root included in mask, all of them if mask is zero, whose
+// path relative to root matches one of patterns (see fsevents.MatchPattern), on c.Events. It returns the ID of
+// the subscription
+func (c *Client) Subscribe(root string, mask uint32, patterns ...string) (string, error) {
+	msg, err := c.do(&daemon.Request{Command: daemon.CommandSubscribe, Root: root, Mask: mask, Patterns: patterns})
+	if err != nil {
+		return "", err
+	}
+	return msg.Subscription, nil
+}
+
+// Unsubscribe closes the subscription with ID id
+func (c *Client) Unsubscribe(id string) error {
+	_, err := c.do(&daemon.Request{Command: daemon.CommandUnsubscribe, Subscription: id})
+	return err
+}
+
+// Query returns the files of the watched tree at root matching q, see fsevents.TreeView.Query
+func (c *Client) Query(root string, q fsevents.TreeQuery) (*fsevents.QueryResult, error) {
+	msg, err := c.do(&daemon.Request{
+		Command: daemon.CommandQuery,
+		Root:    root,
+		Query:   &daemon.Query{Since: q.Since, Globs: q.Globs, Suffixes: q.Suffixes, Types: q.Types},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return msg.Result, nil
+}
+
+// Clock returns the current clock of the watched tree at root
+func (c *Client) Clock(root string) (string, error) {
+	msg, err := c.do(&daemon.Request{Command: daemon.CommandClock, Root: root})
+	if err != nil {
+		return "", err
+	}
+	return msg.Clock, nil
+}
+
+// Close disconnects from the server, which closes the subscriptions of the Client
+func (c *Client) Close() error {
+	c.Lock()
+	if c.err == nil {
+		c.err = ErrClientClosed
+	}
+	c.Unlock()
+	c.closeOnce.Do(func() { close(c.closing) })
+	return c.conn.Close()
+}
@@ -0,0 +1,260 @@
+package daemon_test
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	fsevents "github.com/tywkeene/go-fsevents"
+	"github.com/tywkeene/go-fsevents/daemon"
+	"github.com/tywkeene/go-fsevents/daemon/client"
+)
+
+func assert(t *testing.T, compare bool, err error) {
+	if compare == false {
+		_, _, line, _ := runtime.Caller(1)
+		t.Logf("Comparison @ [line %d] failed\n", line)
+		if err != nil {
+			t.Fatal("Error returned:", err)
+		} else {
+			t.Fatal("Exiting")
+		}
+	}
+}
+
+// startServer serves a new Server on a socket in a temporary directory, which also holds the watched tree
+func startServer(t *testing.T) (*daemon.Server, string, string, func()) {
+	dir, err := ioutil.TempDir("", "fsevents-daemon")
+	assert(t, (err == nil), err)
+	root := filepath.Join(dir, "root")
+	assert(t, (os.Mkdir(root, 0755) == nil), fmt.Errorf("could not create the watched tree"))
+	socket := filepath.Join(dir, "fseventsd.sock")
+
+	server := daemon.NewServer(daemon.ServerOptions{})
+	served := make(chan error, 1)
+	go func() { served <- server.ListenAndServe(socket) }()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if _, err := os.Stat(socket); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return server, socket, root, func() {
+		server.Close()
+		<-served
+		os.RemoveAll(dir)
+	}
+}
+
+func dial(t *testing.T, socket string) *client.Client {
+	c, err := client.Dial(socket)
+	assert(t, (err == nil), err)
+	return c
+}
+
+func receiveEvent(t *testing.T, c *client.Client) *fsevents.FsEvent {
+	select {
+	case event := <-c.Events:
+		return event
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event received")
+	}
+	return nil
+}
+
+func TestDaemon(t *testing.T) {
+	_, socket, root, cleanup := startServer(t)
+	defer cleanup()
+	first := dial(t, socket)
+	defer first.Close()
+	second := dial(t, socket)
+	defer second.Close()
+
+	// Both clients share the Watcher of the root
+	assert(t, (first.Watch(root, fsevents.CloseWrite) == nil), fmt.Errorf("Watch should not have returned an error"))
+	assert(t, (second.Watch(root, fsevents.Delete) == nil), fmt.Errorf("Watch should not have returned an error"))
+	roots, err := second.Roots()
+	assert(t, (err == nil && len(roots) == 1 && roots[0] == root), fmt.Errorf("the root should have been watched once, got %v %v", roots, err))
+
+	clock, err := second.Clock(root)
+	assert(t, (err == nil), err)
+	id, err := first.Subscribe(root, fsevents.CloseWrite, "*.go")
+	assert(t, (err == nil), err)
+	ioutil.WriteFile(filepath.Join(root, "skipped.txt"), []byte("data"), 0644)
+	ioutil.WriteFile(filepath.Join(root, "main.go"), []byte("package main"), 0644)
+	event := receiveEvent(t, first)
+	assert(t, (event.Name == "main.go" && event.RawEvent.Mask == fsevents.CloseWrite && event.Descriptor.Path == root),
+		fmt.Errorf("expected the close of main.go, got %q %#x", event.Name, event.RawEvent.Mask))
+
+	result, err := second.Query(root, fsevents.TreeQuery{Since: clock})
+	assert(t, (err == nil), err)
+	assert(t, (!result.IsFreshInstance && len(result.Files) == 2 && result.Files[0].Name == "main.go" && result.Files[1].Name == "skipped.txt"),
+		fmt.Errorf("the query should have returned both files, got %+v", result))
+
+	assert(t, (first.Unsubscribe(id) == nil), fmt.Errorf("Unsubscribe should not have returned an error"))
+	err = first.Unsubscribe(id)
+	assert(t, (err != nil && strings.HasPrefix(err.Error(), fsevents.ErrNoSubscription.Error())),
+		fmt.Errorf("a second Unsubscribe should have failed, got %v", err))
+}
+
+func TestDaemonUnwatch(t *testing.T) {
+	_, socket, root, cleanup := startServer(t)
+	defer cleanup()
+	c := dial(t, socket)
+	defer c.Close()
+
+	assert(t, (c.Watch(root, 0) == nil), fmt.Errorf("Watch should not have returned an error"))
+	_, err := c.Subscribe(root, 0)
+	assert(t, (err == nil), err)
+	assert(t, (c.Unwatch(root) == nil), fmt.Errorf("Unwatch should not have returned an error"))
+
+	// The subscription was closed by the server
+	select {
+	case err := <-c.Errors:
+		assert(t, (strings.Contains(err.Error(), fsevents.ErrSubscriptionClosed.Error())), fmt.Errorf("unexpected error %v", err))
+	case <-time.After(5 * time.Second):
+		t.Fatal("the closing of the subscription should have been reported")
+	}
+	_, err = c.Query(root, fsevents.TreeQuery{})
+	assert(t, (err != nil && strings.HasPrefix(err.Error(), daemon.ErrNotWatched.Error())),
+		fmt.Errorf("Query should have failed with ErrNotWatched, got %v", err))
+	_, err = c.Subscribe(filepath.Join(root, "missing"), 0)
+	assert(t, (err != nil), fmt.Errorf("Subscribe should have failed for a root that is not watched"))
+}
+
+func TestDaemonRecreatedDirectory(t *testing.T) {
+	_, socket, root, cleanup := startServer(t)
+	defer cleanup()
+	c := dial(t, socket)
+	defer c.Close()
+	assert(t, (c.Watch(root, 0) == nil), fmt.Errorf("Watch should not have returned an error"))
+
+	// A directory deleted and created again at the same path SHOULD be watched again
+	dir := filepath.Join(root, "dir")
+	file := filepath.Join(dir, "file")
+	for _, step := range []func() error{
+		func() error { return os.Mkdir(dir, 0755) },
+		func() error { return os.Remove(dir) },
+		func() error { return os.Mkdir(dir, 0755) },
+	} {
+		assert(t, (step() == nil), fmt.Errorf("could not change the tree"))
+		time.Sleep(100 * time.Millisecond)
+	}
+	ioutil.WriteFile(file, []byte("data"), 0644)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		result, err := c.Query(root, fsevents.TreeQuery{Globs: []string{"dir/file"}})
+		assert(t, (err == nil), err)
+		if len(result.Files) == 1 && result.Files[0].Exists {
+			break
+		}
+		assert(t, (time.Now().Before(deadline)), fmt.Errorf("the file of the recreated directory should have been seen"))
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestDaemonProtocol(t *testing.T) {
+	_, socket, root, cleanup := startServer(t)
+	defer cleanup()
+	conn, err := net.Dial("unix", socket)
+	assert(t, (err == nil), err)
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	exchanges := []struct {
+		request  string
+		response string
+	}{
+		{fmt.Sprintf(`{"id":1,"command":"watch","root":%q}`, root), `{"id":1}`},
+		{`{"id":2,"command":"list"}`, fmt.Sprintf(`{"id":2,"roots":[%q]}`, root)},
+		{`{"id":3,"command":"frobnicate"}`, `{"id":3,"error":"unknown command: \"frobnicate\""}`},
+		{`{"id":4,"command":"watch"}`, `{"id":4,"error":"malformed request: no root"}`},
+		{`not json`, `{"id":0,"error":"malformed request: invalid character 'o' in literal null (expecting 'u')"}`},
+	}
+	for _, e := range exchanges {
+		fmt.Fprintln(conn, e.request)
+		line, err := reader.ReadString('\n')
+		assert(t, (err == nil), err)
+		assert(t, (strings.TrimSpace(line) == e.response), fmt.Errorf("%s: expected %s, got %s", e.request, e.response, line))
+	}
+}
+
+// Clocks change from one run to the next, and are replaced by $CLOCK in the answers of fixtures
+var clockPattern = regexp.MustCompile(`"c:[^"]*"`)
+
+// runWatchmanFixture plays a fixture of the Watchman protocol against a server watching root. Lines starting with
+// ">" are requests, written to the server, and lines starting with "<" the answers expected; consecutive answers may
+// arrive in any order, since the PDUs of subscriptions are written whenever they are ready. Lines starting with "!"
+// change the tree: "mkdir <path>", "write <path> <content>" or "remove <path>". In requests and answers, $ROOT is
+// replaced by root, and $CLOCK in requests by the last clock answered.
+func runWatchmanFixture(t *testing.T, fixture string, socket string, root string) {
+	data, err := ioutil.ReadFile(fixture)
+	assert(t, (err == nil), err)
+	conn, err := net.Dial("unix", socket)
+	assert(t, (err == nil), err)
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	var clock string
+	lines := strings.Split(string(data), "\n")
+	for i := 0; i < len(lines); i++ {
+		line := strings.Replace(lines[i], "$ROOT", root, -1)
+		switch {
+		case strings.HasPrefix(line, "> "):
+			fmt.Fprintln(conn, strings.Replace(line[2:], "$CLOCK", clock, -1))
+		case strings.HasPrefix(line, "< "):
+			var expected, received []string
+			for ; i < len(lines) && strings.HasPrefix(lines[i], "< "); i++ {
+				expected = append(expected, strings.Replace(lines[i][2:], "$ROOT", root, -1))
+				conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+				answer, err := reader.ReadString('\n')
+				assert(t, (err == nil), fmt.Errorf("line %d: %s", i+1, err))
+				if found := clockPattern.FindAllString(answer, -1); len(found) > 0 {
+					clock = strings.Trim(found[len(found)-1], `"`)
+				}
+				received = append(received, clockPattern.ReplaceAllString(strings.TrimSpace(answer), `"$$CLOCK"`))
+			}
+			i--
+			sort.Strings(expected)
+			sort.Strings(received)
+			assert(t, (strings.Join(expected, "\n") == strings.Join(received, "\n")),
+				fmt.Errorf("line %d: expected\n%s\ngot\n%s", i+1, strings.Join(expected, "\n"), strings.Join(received, "\n")))
+		case strings.HasPrefix(line, "! "):
+			fields := strings.SplitN(line[2:], " ", 3)
+			target := filepath.Join(root, fields[1])
+			switch fields[0] {
+			case "mkdir":
+				err = os.MkdirAll(target, 0755)
+			case "write":
+				err = ioutil.WriteFile(target, []byte(fields[2]), 0644)
+			case "remove":
+				err = os.Remove(target)
+			}
+			assert(t, (err == nil), fmt.Errorf("line %d: %s", i+1, err))
+		}
+	}
+}
+
+func TestWatchmanFixtures(t *testing.T) {
+	fixtures, err := filepath.Glob("testdata/watchman/*.txt")
+	assert(t, (err == nil && len(fixtures) > 0), fmt.Errorf("no fixtures found"))
+	for _, fixture := range fixtures {
+		fixture := fixture
+		t.Run(strings.TrimSuffix(filepath.Base(fixture), ".txt"), func(t *testing.T) {
+			_, socket, root, cleanup := startServer(t)
+			defer cleanup()
+			runWatchmanFixture(t, fixture, socket, root)
+		})
+	}
+}
@@ -0,0 +1,74 @@
+// Package daemon serves the events and tree views of shared Watchers to local clients over a Unix domain socket,
+// so that several tools watching the same directory trees need a single set of inotify watches.
+//
+// The protocol is JSON lines: clients write one Request per line, and the server answers each with a Message
+// carrying the same ID. Events of subscriptions are written as Messages with an ID of 0, a Subscription, a Root
+// and an Event, and can arrive between answers. Events are in the versioned JSON encoding of fsevents.FsEvent.
+//
+// The same socket also accepts a subset of the Watchman protocol, whose requests are JSON arrays, so that existing
+// Watchman clients can use the server.
+package daemon
+
+import (
+	fsevents "github.com/tywkeene/go-fsevents"
+)
+
+// Commands of the protocol
+const (
+	// Watch the tree at Root with Mask, sharing the Watcher of Root if it is already watched
+	CommandWatch = "watch"
+	// Stop watching Root, closing the subscriptions of every client to it
+	CommandUnwatch = "unwatch"
+	// List the watched roots in Roots
+	CommandList = "list"
+	// Subscribe to the events of the watched Root matching Mask and Patterns. The answer has the Subscription
+	CommandSubscribe = "subscribe"
+	// Close the Subscription
+	CommandUnsubscribe = "unsubscribe"
+	// Query the files of Root changed since Query.Since, see fsevents.TreeView.Query
+	CommandQuery = "query"
+	// Get the current clock of Root in Clock
+	CommandClock = "clock"
+)
+
+// Request is a command sent by a client
+type Request struct {
+	// Chosen by the client, and repeated in the answer
+	ID      uint64 `json:"id"`
+	Command string `json:"command"`
+	// Directory tree the command applies to
+	Root string `json:"root,omitempty"`
+	// Events to watch or subscribe to. Zero means all of them
+	Mask uint32 `json:"mask,omitempty"`
+	// Patterns the paths of subscribed events must match one of, relative to Root, see fsevents.MatchPattern
+	Patterns []string `json:"patterns,omitempty"`
+	// Subscription to close
+	Subscription string `json:"subscription,omitempty"`
+	// Query to run
+	Query *Query `json:"query,omitempty"`
+}
+
+// Query is the wire form of fsevents.TreeQuery
+type Query struct {
+	Since    string   `json:"since,omitempty"`
+	Globs    []string `json:"globs,omitempty"`
+	Suffixes []string `json:"suffixes,omitempty"`
+	Types    []string `json:"types,omitempty"`
+}
+
+// Message is written by the server: the answer to a Request, or an event of a subscription
+type Message struct {
+	// ID of the Request answered, 0 for events and for errors of subscriptions
+	ID uint64 `json:"id"`
+	// Why the Request failed, or why the Subscription was closed
+	Error        string                `json:"error,omitempty"`
+	Subscription string                `json:"subscription,omitempty"`
+	Roots        []string              `json:"roots,omitempty"`
+	Clock        string                `json:"clock,omitempty"`
+	Result       *fsevents.QueryResult `json:"result,omitempty"`
+	// Watched root the Event happened below
+	Root string `json:"root,omitempty"`
+	// Event of the Subscription, see fsevents.FsEvent.MarshalJSON. Its Descriptor, if any, is a stopped
+	// WatchDescriptor that belongs to no Watcher
+	Event *fsevents.FsEvent `json:"event,omitempty"`
+}
@@ -0,0 +1,512 @@
+package daemon
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	fsevents "github.com/tywkeene/go-fsevents"
+	"golang.org/x/sys/unix"
+)
+
+var (
+	ErrServerClosed   = errors.New("server closed")
+	ErrNotWatched     = errors.New("root not watched")
+	ErrUnknownCommand = errors.New("unknown command")
+	ErrBadRequest     = errors.New("malformed request")
+)
+
+// Events every root is watched for, whatever the clients ask for, to keep its TreeView up to date and to watch
+// the directories created below it
+var treeMask = fsevents.Create | fsevents.Delete | fsevents.Move | fsevents.Modified | fsevents.CloseWrite |
+	fsevents.AttrChange | fsevents.RootDelete
+
+// Default ServerOptions.SubscriptionBuffer
+const defaultSubscriptionBuffer = 1024
+
+// ServerOptions configures a Server
+type ServerOptions struct {
+	// Number of events a subscription holds for a client that is not reading them, after which the subscription
+	// is closed with fsevents.ErrSubscriberTooSlow. Zero means 1024
+	SubscriptionBuffer int
+	// Logs the errors of Watchers and connections. Nil means no logging
+	Logger fsevents.Logger
+}
+
+// root is a directory tree watched by the server
+type root struct {
+	sync.Mutex
+	path    string
+	mask    uint32
+	watcher *fsevents.Watcher
+	view    *fsevents.TreeView
+	// Cookie files waited for by sync, key: name
+	cookies    map[string]chan struct{}
+	lastCookie uint64
+}
+
+// Server owns one Watcher per watched directory tree, and serves their events and tree views to clients
+type Server struct {
+	sync.Mutex
+	opts      ServerOptions
+	roots     map[string]*root
+	listeners []net.Listener
+	conns     map[*conn]bool
+	closed    bool
+	// Serving connections
+	wg sync.WaitGroup
+}
+
+// NewServer returns a Server configured by opts
+func NewServer(opts ServerOptions) *Server {
+	if opts.SubscriptionBuffer <= 0 {
+		opts.SubscriptionBuffer = defaultSubscriptionBuffer
+	}
+	return &Server{
+		opts:  opts,
+		roots: make(map[string]*root),
+		conns: make(map[*conn]bool),
+	}
+}
+
+func (s *Server) logf(format string, v ...interface{}) {
+	if s.opts.Logger != nil {
+		s.opts.Logger.Printf(format, v...)
+	}
+}
+
+// ListenAndServe listens on the Unix domain socket at socketPath, readable and writable by the current user only,
+// and serves the clients connecting to it until Close. A stale socket left at socketPath is replaced.
+func (s *Server) ListenAndServe(socketPath string) error {
+	if conn, err := net.Dial("unix", socketPath); err == nil {
+		conn.Close()
+		return fmt.Errorf("%s: already in use", socketPath)
+	}
+	os.Remove(socketPath)
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(socketPath, 0600); err != nil {
+		listener.Close()
+		return err
+	}
+	return s.Serve(listener)
+}
+
+// Serve serves the clients connecting to listener until Close
+func (s *Server) Serve(listener net.Listener) error {
+	s.Lock()
+	if s.closed {
+		s.Unlock()
+		listener.Close()
+		return ErrServerClosed
+	}
+	s.listeners = append(s.listeners, listener)
+	s.Unlock()
+
+	for {
+		netConn, err := listener.Accept()
+		if err != nil {
+			s.Lock()
+			closed := s.closed
+			s.Unlock()
+			if closed {
+				return ErrServerClosed
+			}
+			return err
+		}
+		c := &conn{
+			server:        s,
+			netConn:       netConn,
+			encoder:       json.NewEncoder(netConn),
+			subscriptions: make(map[string]*subscription),
+		}
+		s.Lock()
+		if s.closed {
+			s.Unlock()
+			netConn.Close()
+			return ErrServerClosed
+		}
+		s.conns[c] = true
+		s.wg.Add(1)
+		s.Unlock()
+		go c.serve()
+	}
+}
+
+// Close stops listening, disconnects every client and closes every Watcher
+func (s *Server) Close() error {
+	s.Lock()
+	if s.closed {
+		s.Unlock()
+		return nil
+	}
+	s.closed = true
+	for _, listener := range s.listeners {
+		listener.Close()
+	}
+	for c := range s.conns {
+		c.netConn.Close()
+	}
+	roots := s.roots
+	s.roots = make(map[string]*root)
+	s.Unlock()
+
+	for _, r := range roots {
+		r.watcher.Close()
+	}
+	s.wg.Wait()
+	return nil
+}
+
+// Roots returns the watched directory trees
+func (s *Server) Roots() []string {
+	s.Lock()
+	defer s.Unlock()
+	roots := make([]string, 0, len(s.roots))
+	for rootPath := range s.roots {
+		roots = append(roots, rootPath)
+	}
+	sort.Strings(roots)
+	return roots
+}
+
+// rootPath returns the absolute form of a root given by a client
+func rootPath(requested string) (string, error) {
+	if requested == "" {
+		return "", fmt.Errorf("%s: no root", ErrBadRequest)
+	}
+	return filepath.Abs(requested)
+}
+
+// getRoot returns the watched root at rootPath
+func (s *Server) getRoot(requested string) (*root, error) {
+	rootPath, err := rootPath(requested)
+	if err != nil {
+		return nil, err
+	}
+	s.Lock()
+	defer s.Unlock()
+	r, exists := s.roots[rootPath]
+	if !exists {
+		return nil, fmt.Errorf("%s: %q", ErrNotWatched, rootPath)
+	}
+	return r, nil
+}
+
+// watch watches the tree at requested for mask, or extends the mask of its Watcher if it is already watched.
+// The tree is crawled without holding the lock of s, so that other clients are not held up by a large tree
+func (s *Server) watch(requested string, mask uint32) (*root, error) {
+	rootPath, err := rootPath(requested)
+	if err != nil {
+		return nil, err
+	}
+	if mask == 0 {
+		mask = fsevents.AllEvents
+	}
+	s.Lock()
+	if s.closed {
+		s.Unlock()
+		return nil, ErrServerClosed
+	}
+	r, exists := s.roots[rootPath]
+	s.Unlock()
+	if exists {
+		return r, r.extendMask(mask)
+	}
+
+	w, err := fsevents.NewWatcher(
+		fsevents.WithInitFlags(unix.IN_CLOEXEC|unix.IN_NONBLOCK),
+		fsevents.WithErrorHandler(func(err error) { s.logf("fsevents: %s: %s", rootPath, err) }),
+	)
+	if err != nil {
+		return nil, err
+	}
+	r = &root{path: rootPath, mask: mask | treeMask, watcher: w, cookies: make(map[string]chan struct{})}
+	if err := w.RecursiveAdd(rootPath, r.mask); err != nil {
+		w.Close()
+		return nil, err
+	}
+	if r.view, err = w.NewTreeView(rootPath); err != nil {
+		w.Close()
+		return nil, err
+	}
+
+	s.Lock()
+	if s.closed {
+		s.Unlock()
+		w.Close()
+		return nil, ErrServerClosed
+	}
+	if existing, exists := s.roots[rootPath]; exists {
+		// Watched by another client in the meantime
+		s.Unlock()
+		w.Close()
+		return existing, existing.extendMask(mask)
+	}
+	s.roots[rootPath] = r
+	s.Unlock()
+
+	// Watch the directories created below the root, forget those removed, and see the cookie files of sync.
+	// Subscribed before Watch runs, so that events are never sent on w.Events, which nothing reads
+	dirs := w.Subscribe(func(event *fsevents.FsEvent) bool {
+		return event.IsDirCreated() || event.RawEvent.Mask&fsevents.Ignored != 0 ||
+			(r.isCookie(event) && event.RawEvent.Mask&fsevents.Create != 0)
+	}, fsevents.SubscribeOptions{BufferSize: 64})
+	go func() {
+		for event := range dirs.Events {
+			if r.isCookie(event) {
+				r.cookieSeen(event.Name)
+				continue
+			}
+			if event.RawEvent.Mask&fsevents.Ignored != 0 {
+				// The directory was removed along with its watch. Its descriptor would keep a directory created
+				// later at the same path from being watched
+				if w.GetDescriptorByPath(event.Descriptor.Path) == event.Descriptor {
+					w.RemoveDescriptor(event.Descriptor.Path)
+				}
+				continue
+			}
+			r.Lock()
+			mask := r.mask
+			r.Unlock()
+			if err := w.RecursiveAdd(event.Path, mask); err != nil {
+				s.logf("fsevents: %s: %s", rootPath, err)
+			}
+		}
+	}()
+	go w.Watch()
+	return r, nil
+}
+
+// extendMask adds mask to the events watched in r
+func (r *root) extendMask(mask uint32) error {
+	r.Lock()
+	defer r.Unlock()
+	if mask&^r.mask == 0 {
+		return nil
+	}
+	r.mask |= mask
+	return r.watcher.SetMaskAll(r.mask)
+}
+
+// unwatch closes the Watcher of the tree at requested, which closes its subscriptions
+func (s *Server) unwatch(requested string) error {
+	r, err := s.getRoot(requested)
+	if err != nil {
+		return err
+	}
+	s.Lock()
+	delete(s.roots, r.path)
+	s.Unlock()
+	return r.watcher.Close()
+}
+
+// subscription is a client's subscription to the events of a root
+type subscription struct {
+	id   string
+	root *root
+	sub  *fsevents.Subscription
+}
+
+// conn is a connected client
+type conn struct {
+	sync.Mutex
+	server  *Server
+	netConn net.Conn
+	// Protects encoder, written to by the connection and its subscriptions
+	writeLock sync.Mutex
+	encoder   *json.Encoder
+	// Open subscriptions, key: ID
+	subscriptions map[string]*subscription
+	// Last subscription ID given out
+	lastID uint64
+}
+
+// serve answers the requests of the client until it disconnects
+func (c *conn) serve() {
+	defer c.server.wg.Done()
+	defer c.close()
+	decoder := json.NewDecoder(c.netConn)
+	for {
+		var raw json.RawMessage
+		if err := decoder.Decode(&raw); err != nil {
+			if _, malformed := err.(*json.SyntaxError); malformed {
+				c.write(&Message{Error: fmt.Sprintf("%s: %s", ErrBadRequest, err)})
+			}
+			return
+		}
+		// Requests of the Watchman protocol are arrays
+		if trimmed := bytes.TrimSpace(raw); len(trimmed) > 0 && trimmed[0] == '[' {
+			answer, started := c.handleWatchman(trimmed)
+			if err := c.write(answer); err != nil {
+				return
+			}
+			if started != nil {
+				go started()
+			}
+			continue
+		}
+		req := &Request{}
+		msg := &Message{}
+		if err := json.Unmarshal(raw, req); err != nil {
+			msg.Error = fmt.Sprintf("%s: %s", ErrBadRequest, err)
+		} else {
+			msg = c.handle(req)
+			msg.ID = req.ID
+		}
+		if err := c.write(msg); err != nil {
+			return
+		}
+	}
+}
+
+// write writes msg, a Message or a Watchman PDU, to the client
+func (c *conn) write(msg interface{}) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	return c.encoder.Encode(msg)
+}
+
+// close closes the subscriptions of the client and disconnects it
+func (c *conn) close() {
+	c.Lock()
+	subscriptions := c.subscriptions
+	c.subscriptions = make(map[string]*subscription)
+	c.Unlock()
+	for _, sub := range subscriptions {
+		sub.root.watcher.Unsubscribe(sub.sub)
+	}
+	c.netConn.Close()
+	c.server.Lock()
+	delete(c.server.conns, c)
+	c.server.Unlock()
+}
+
+// handle runs req and returns its answer
+func (c *conn) handle(req *Request) *Message {
+	msg := &Message{}
+	var err error
+	switch req.Command {
+	case CommandWatch:
+		_, err = c.server.watch(req.Root, req.Mask)
+	case CommandUnwatch:
+		err = c.server.unwatch(req.Root)
+	case CommandList:
+		msg.Roots = c.server.Roots()
+	case CommandSubscribe:
+		msg.Subscription, err = c.subscribe(req)
+	case CommandUnsubscribe:
+		err = c.unsubscribe(req.Subscription)
+	case CommandQuery:
+		msg.Result, err = c.query(req)
+	case CommandClock:
+		var r *root
+		if r, err = c.server.getRoot(req.Root); err == nil {
+			msg.Clock = r.view.Clock()
+		}
+	default:
+		err = fmt.Errorf("%s: %q", ErrUnknownCommand, req.Command)
+	}
+	if err != nil {
+		msg.Error = err.Error()
+	}
+	return msg
+}
+
+// subscribe subscribes the client to the events of a watched root, and forwards them until the subscription
+// is closed
+func (c *conn) subscribe(req *Request) (string, error) {
+	r, err := c.server.getRoot(req.Root)
+	if err != nil {
+		return "", err
+	}
+	mask := req.Mask
+	patterns := req.Patterns
+	filter := func(event *fsevents.FsEvent) bool {
+		if r.isCookie(event) {
+			return false
+		}
+		if mask != 0 && event.RawEvent.Mask&mask&^fsevents.IsDir == 0 {
+			return false
+		}
+		if len(patterns) == 0 {
+			return true
+		}
+		relative := strings.TrimPrefix(strings.TrimPrefix(event.Path, r.path), "/")
+		for _, pattern := range patterns {
+			if fsevents.MatchPattern(pattern, relative) {
+				return true
+			}
+		}
+		return false
+	}
+
+	c.Lock()
+	c.lastID++
+	sub := &subscription{
+		id:   strconv.FormatUint(c.lastID, 10),
+		root: r,
+		sub: r.watcher.Subscribe(filter, fsevents.SubscribeOptions{
+			BufferSize: c.server.opts.SubscriptionBuffer,
+			Overflow:   fsevents.OverflowDisconnect,
+		}),
+	}
+	c.subscriptions[sub.id] = sub
+	c.Unlock()
+	go c.forward(sub)
+	return sub.id, nil
+}
+
+// forward writes the events of sub to the client. If the subscription was closed by anything but the client,
+// such as the root being unwatched or the client being too slow, the client is told why
+func (c *conn) forward(sub *subscription) {
+	for event := range sub.sub.Events {
+		c.write(&Message{Subscription: sub.id, Root: sub.root.path, Event: event})
+	}
+	c.Lock()
+	_, open := c.subscriptions[sub.id]
+	delete(c.subscriptions, sub.id)
+	c.Unlock()
+	if open {
+		err := sub.sub.Err()
+		if err == nil {
+			err = fsevents.ErrSubscriptionClosed
+		}
+		c.write(&Message{Subscription: sub.id, Error: err.Error()})
+	}
+}
+
+// unsubscribe closes a subscription of the client
+func (c *conn) unsubscribe(id string) error {
+	c.Lock()
+	sub, exists := c.subscriptions[id]
+	delete(c.subscriptions, id)
+	c.Unlock()
+	if !exists {
+		return fmt.Errorf("%s: %q", fsevents.ErrNoSubscription, id)
+	}
+	return sub.root.watcher.Unsubscribe(sub.sub)
+}
+
+// query runs the query of req on the TreeView of its root
+func (c *conn) query(req *Request) (*fsevents.QueryResult, error) {
+	r, err := c.server.getRoot(req.Root)
+	if err != nil {
+		return nil, err
+	}
+	q := fsevents.TreeQuery{}
+	if req.Query != nil {
+		q = fsevents.TreeQuery{Since: req.Query.Since, Globs: req.Query.Globs, Suffixes: req.Query.Suffixes, Types: req.Query.Types}
+	}
+	return r.view.Query(q)
+}
@@ -0,0 +1,890 @@
+package daemon
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	fsevents "github.com/tywkeene/go-fsevents"
+	"golang.org/x/sys/unix"
+)
+
+// The server also speaks a subset of the JSON protocol of Watchman, so that existing Watchman clients work against
+// it: a request is a JSON array holding the command and its arguments, such as ["query", "/src", {...}], and the
+// answer a JSON object. The commands supported are version, watch, watch-project, watch-list, watch-del, clock,
+// query, subscribe and unsubscribe. Queries support the since, expression, fields, relative_root, suffix, glob,
+// sync_timeout and empty_on_fresh_instance keys.
+
+var (
+	ErrBadExpression = errors.New("invalid expression")
+	ErrSyncTimeout   = errors.New("timed out waiting for the cookie file")
+	ErrCapability    = errors.New("required capability not supported")
+)
+
+// Version reported to Watchman clients, which some of them compare to decide what they can use
+const watchmanVersion = "4.9.0"
+
+const (
+	// Prefix of the cookie files created in a root to synchronize with its Watcher
+	cookiePrefix = ".watchman-cookie-"
+	// Default sync_timeout of queries
+	defaultSyncTimeout = time.Minute
+	// Time a subscription waits for the tree to be quiet before querying it
+	watchmanSettle = 20 * time.Millisecond
+)
+
+// Files marking the root of a project for watch-project, as in the default Watchman configuration
+var watchmanRootFiles = []string{".watchmanconfig", ".git", ".hg", ".svn"}
+
+// Capabilities reported by the version command
+var watchmanCapabilities = map[string]bool{
+	"relative_root":      true,
+	"wildmatch":          true,
+	"clock-sync-timeout": true,
+	"term-allof":         true,
+	"term-anyof":         true,
+	"term-not":           true,
+	"term-true":          true,
+	"term-false":         true,
+	"term-exists":        true,
+	"term-type":          true,
+	"term-suffix":        true,
+	"term-name":          true,
+	"term-iname":         true,
+	"term-match":         true,
+	"term-imatch":        true,
+	"term-dirname":       true,
+	"term-idirname":      true,
+	"term-size":          true,
+}
+
+// Fields of the files returned by queries that don't ask for any
+var defaultFields = []string{"name", "exists", "new", "size", "mode"}
+
+// watchmanPDU is a message of the Watchman protocol. Its keys are encoded in order, which keeps answers stable
+type watchmanPDU map[string]interface{}
+
+// handleWatchman runs a Watchman request and returns its answer. started is run once the answer is written, if
+// not nil
+func (c *conn) handleWatchman(raw []byte) (answer watchmanPDU, started func()) {
+	var args []json.RawMessage
+	var command string
+	err := json.Unmarshal(raw, &args)
+	if err == nil && len(args) > 0 {
+		err = json.Unmarshal(args[0], &command)
+	} else if err == nil {
+		err = errors.New("no command")
+	}
+	if err != nil {
+		answer = watchmanPDU{"error": fmt.Sprintf("%s: %s", ErrBadRequest, err)}
+		answer["version"] = watchmanVersion
+		return answer, nil
+	}
+
+	args = args[1:]
+	switch command {
+	case "version":
+		answer, err = watchmanVersionCommand(args)
+	case "watch", "watch-project":
+		var dir string
+		if err = unmarshalArgs(args, 1, &dir); err != nil {
+			break
+		}
+		var r *root
+		var relative string
+		if command == "watch" {
+			r, err = c.server.watch(dir, treeMask)
+		} else {
+			r, relative, err = c.server.watchProject(dir)
+		}
+		if err == nil {
+			answer = watchmanPDU{"watch": r.path, "watcher": "inotify"}
+			if relative != "" {
+				answer["relative_path"] = relative
+			}
+		}
+	case "watch-list":
+		answer = watchmanPDU{"roots": c.server.Roots()}
+	case "watch-del":
+		var dir string
+		if err = unmarshalArgs(args, 1, &dir); err == nil {
+			if err = c.server.unwatch(dir); err == nil {
+				answer = watchmanPDU{"watch-del": true, "root": dir}
+			}
+		}
+	case "clock":
+		answer, err = c.watchmanClock(args)
+	case "query":
+		answer, err = c.watchmanQuery(args)
+	case "subscribe":
+		answer, started, err = c.watchmanSubscribe(args)
+	case "unsubscribe":
+		var dir, name string
+		if err = unmarshalArgs(args, 2, &dir, &name); err == nil {
+			var r *root
+			if r, err = c.server.getRoot(dir); err == nil {
+				deleted := c.unsubscribe(watchmanSubscriptionID(r, name)) == nil
+				answer = watchmanPDU{"unsubscribe": name, "deleted": deleted}
+			}
+		}
+	default:
+		err = fmt.Errorf("%s: %q", ErrUnknownCommand, command)
+	}
+	if err != nil {
+		answer = watchmanPDU{"error": err.Error()}
+		started = nil
+	}
+	answer["version"] = watchmanVersion
+	return answer, started
+}
+
+// unmarshalArgs decodes args into values, of which the first required must be given
+func unmarshalArgs(args []json.RawMessage, required int, values ...interface{}) error {
+	if len(args) < required {
+		return fmt.Errorf("%s: missing arguments: expected %d, got %d", ErrBadRequest, required, len(args))
+	}
+	for i := range values {
+		if i == len(args) {
+			break
+		}
+		if err := json.Unmarshal(args[i], values[i]); err != nil {
+			return fmt.Errorf("%s: argument %d: %s", ErrBadRequest, i+1, err)
+		}
+	}
+	return nil
+}
+
+// watchmanVersionCommand answers the version command, reporting the capabilities the client asked about
+func watchmanVersionCommand(args []json.RawMessage) (watchmanPDU, error) {
+	var check struct {
+		Optional []string `json:"optional"`
+		Required []string `json:"required"`
+	}
+	if err := unmarshalArgs(args, 0, &check); err != nil {
+		return nil, err
+	}
+	answer := watchmanPDU{}
+	if len(check.Optional) == 0 && len(check.Required) == 0 {
+		return answer, nil
+	}
+	capabilities := make(map[string]bool)
+	for _, name := range check.Optional {
+		capabilities[name] = watchmanCapabilities[name]
+	}
+	for _, name := range check.Required {
+		if !watchmanCapabilities[name] {
+			return nil, fmt.Errorf("%s: %q", ErrCapability, name)
+		}
+		capabilities[name] = true
+	}
+	answer["capabilities"] = capabilities
+	return answer, nil
+}
+
+// watchProject watches the project requested is part of: the closest directory above it, or itself, that is
+// already watched or holds one of watchmanRootFiles, and requested itself if there is none. It returns the root
+// and the path of requested relative to it.
+func (s *Server) watchProject(requested string) (*root, string, error) {
+	dir, err := rootPath(requested)
+	if err != nil {
+		return nil, "", err
+	}
+	project := dir
+search:
+	for candidate := dir; ; candidate = filepath.Dir(candidate) {
+		s.Lock()
+		_, watched := s.roots[candidate]
+		s.Unlock()
+		if watched {
+			project = candidate
+			break
+		}
+		for _, name := range watchmanRootFiles {
+			if _, err := os.Lstat(filepath.Join(candidate, name)); err == nil {
+				project = candidate
+				break search
+			}
+		}
+		if candidate == filepath.Dir(candidate) {
+			break
+		}
+	}
+	r, err := s.watch(project, treeMask)
+	if err != nil {
+		return nil, "", err
+	}
+	relative, err := filepath.Rel(project, dir)
+	if err != nil || relative == "." {
+		relative = ""
+	}
+	return r, relative, nil
+}
+
+// watchmanClock answers ["clock", root, {"sync_timeout": milliseconds}]
+func (c *conn) watchmanClock(args []json.RawMessage) (watchmanPDU, error) {
+	var dir string
+	var opts struct {
+		SyncTimeout int `json:"sync_timeout"`
+	}
+	if err := unmarshalArgs(args, 1, &dir, &opts); err != nil {
+		return nil, err
+	}
+	r, err := c.server.getRoot(dir)
+	if err != nil {
+		return nil, err
+	}
+	if opts.SyncTimeout > 0 {
+		if err := r.sync(time.Duration(opts.SyncTimeout) * time.Millisecond); err != nil {
+			return nil, err
+		}
+	}
+	return watchmanPDU{"clock": r.view.Clock()}, nil
+}
+
+// watchmanQuery answers ["query", root, spec]
+func (c *conn) watchmanQuery(args []json.RawMessage) (watchmanPDU, error) {
+	var dir string
+	var spec json.RawMessage
+	if err := unmarshalArgs(args, 2, &dir, &spec); err != nil {
+		return nil, err
+	}
+	r, err := c.server.getRoot(dir)
+	if err != nil {
+		return nil, err
+	}
+	q, err := compileQuery(spec)
+	if err != nil {
+		return nil, err
+	}
+	if q.syncTimeout > 0 {
+		if err := r.sync(q.syncTimeout); err != nil {
+			return nil, err
+		}
+	}
+	result, err := q.run(r, q.since)
+	if err != nil {
+		return nil, err
+	}
+	return result.pdu(), nil
+}
+
+// watchmanSubscriptionID returns the ID of the subscription named name to r, among the subscriptions of a client
+func watchmanSubscriptionID(r *root, name string) string {
+	return "watchman:" + r.path + ":" + name
+}
+
+// watchmanSubscribe answers ["subscribe", root, name, spec]. The subscription replaces any subscription of the
+// client with the same name, and sends the results of its query once its answer is written, then each time the
+// tree changed and has been quiet for watchmanSettle, if the query has new results.
+func (c *conn) watchmanSubscribe(args []json.RawMessage) (watchmanPDU, func(), error) {
+	var dir, name string
+	var spec json.RawMessage
+	if err := unmarshalArgs(args, 3, &dir, &name, &spec); err != nil {
+		return nil, nil, err
+	}
+	r, err := c.server.getRoot(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	q, err := compileQuery(spec)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	id := watchmanSubscriptionID(r, name)
+	c.unsubscribe(id)
+	// Subscribed before the first query, so that no change goes unnoticed. A single pending event is enough to
+	// know the tree must be queried again
+	sub := &subscription{
+		id:   id,
+		root: r,
+		sub: r.watcher.Subscribe(func(event *fsevents.FsEvent) bool { return !r.isCookie(event) }, fsevents.SubscribeOptions{
+			BufferSize: 1,
+			Overflow:   fsevents.OverflowDropNewest,
+		}),
+	}
+	initial, err := q.run(r, q.since)
+	if err != nil {
+		r.watcher.Unsubscribe(sub.sub)
+		return nil, nil, err
+	}
+	c.Lock()
+	c.subscriptions[id] = sub
+	c.Unlock()
+	return watchmanPDU{"subscribe": name, "clock": initial.clock}, func() { c.forwardWatchman(sub, name, q, initial) }, nil
+}
+
+// forwardWatchman writes the results of the query of a Watchman subscription to the client, starting with
+// initial, until the subscription is closed. If it was closed by anything but the client, the client is told it
+// was canceled
+func (c *conn) forwardWatchman(sub *subscription, name string, q *watchmanQuery, initial *watchmanResult) {
+	unilateral := func(pdu watchmanPDU) {
+		pdu["version"] = watchmanVersion
+		pdu["subscription"] = name
+		pdu["root"] = sub.root.path
+		pdu["unilateral"] = true
+		c.write(pdu)
+	}
+	unilateral(initial.pdu())
+	since := initial.clock
+	for range sub.sub.Events {
+		if !settle(sub.sub.Events) {
+			break
+		}
+		result, err := q.run(sub.root, since)
+		if err != nil {
+			c.server.logf("fsevents: subscription %s: %s", name, err)
+			continue
+		}
+		since = result.clock
+		if len(result.files) > 0 {
+			unilateral(result.pdu())
+		}
+	}
+	c.Lock()
+	_, open := c.subscriptions[sub.id]
+	delete(c.subscriptions, sub.id)
+	c.Unlock()
+	if open {
+		unilateral(watchmanPDU{"canceled": true})
+	}
+}
+
+// settle waits until no event was received on events for watchmanSettle. It returns false if events was closed
+func settle(events <-chan *fsevents.FsEvent) bool {
+	timer := time.NewTimer(watchmanSettle)
+	defer timer.Stop()
+	for {
+		select {
+		case _, open := <-events:
+			if !open {
+				return false
+			}
+			if !timer.Stop() {
+				<-timer.C
+			}
+			timer.Reset(watchmanSettle)
+		case <-timer.C:
+			return true
+		}
+	}
+}
+
+// isCookie returns true if event is about a cookie file of r
+func (r *root) isCookie(event *fsevents.FsEvent) bool {
+	return strings.HasPrefix(event.Name, cookiePrefix) && filepath.Dir(event.Path) == r.path
+}
+
+// cookieSeen releases the sync waiting for the cookie file named name
+func (r *root) cookieSeen(name string) {
+	r.Lock()
+	defer r.Unlock()
+	if seen, exists := r.cookies[name]; exists {
+		close(seen)
+		delete(r.cookies, name)
+	}
+}
+
+// sync creates a cookie file in r and waits for its event, after which the TreeView of r reflects every change
+// made before sync was called
+func (r *root) sync(timeout time.Duration) error {
+	hostname, _ := os.Hostname()
+	r.Lock()
+	r.lastCookie++
+	name := fmt.Sprintf("%s%s-%d-%d", cookiePrefix, hostname, os.Getpid(), r.lastCookie)
+	seen := make(chan struct{})
+	r.cookies[name] = seen
+	r.Unlock()
+
+	cookie := filepath.Join(r.path, name)
+	defer func() {
+		r.Lock()
+		delete(r.cookies, name)
+		r.Unlock()
+		os.Remove(cookie)
+	}()
+	file, err := os.Create(cookie)
+	if err != nil {
+		return err
+	}
+	file.Close()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-seen:
+		return nil
+	case <-timer.C:
+		return fmt.Errorf("%s: %s", ErrSyncTimeout, timeout)
+	}
+}
+
+// watchmanQuery is a compiled Watchman query specification
+type watchmanQuery struct {
+	since        string
+	relativeRoot string
+	suffixes     []string
+	globs        []string
+	expression   term
+	fields       []string
+	syncTimeout  time.Duration
+	emptyOnFresh bool
+}
+
+// compileQuery compiles a Watchman query specification
+func compileQuery(raw json.RawMessage) (*watchmanQuery, error) {
+	var spec struct {
+		Since                string      `json:"since"`
+		Expression           interface{} `json:"expression"`
+		Fields               []string    `json:"fields"`
+		RelativeRoot         string      `json:"relative_root"`
+		Suffix               interface{} `json:"suffix"`
+		Glob                 []string    `json:"glob"`
+		SyncTimeout          *int        `json:"sync_timeout"`
+		EmptyOnFreshInstance bool        `json:"empty_on_fresh_instance"`
+	}
+	if err := json.Unmarshal(raw, &spec); err != nil {
+		return nil, fmt.Errorf("%s: query: %s", ErrBadRequest, err)
+	}
+	q := &watchmanQuery{
+		since:        spec.Since,
+		globs:        spec.Glob,
+		fields:       spec.Fields,
+		syncTimeout:  defaultSyncTimeout,
+		emptyOnFresh: spec.EmptyOnFreshInstance,
+	}
+	if spec.RelativeRoot != "" {
+		q.relativeRoot = path.Clean(spec.RelativeRoot)
+		if path.IsAbs(q.relativeRoot) || q.relativeRoot == ".." || strings.HasPrefix(q.relativeRoot, "../") {
+			return nil, fmt.Errorf("%s: relative_root %q is outside of the root", ErrBadRequest, spec.RelativeRoot)
+		}
+		if q.relativeRoot == "." {
+			q.relativeRoot = ""
+		}
+	}
+	if spec.Suffix != nil {
+		suffixes, err := stringArgs(spec.Suffix)
+		if err != nil {
+			return nil, fmt.Errorf("%s: suffix: %s", ErrBadRequest, err)
+		}
+		for _, suffix := range suffixes {
+			q.suffixes = append(q.suffixes, strings.ToLower(suffix))
+		}
+	}
+	if spec.SyncTimeout != nil {
+		q.syncTimeout = time.Duration(*spec.SyncTimeout) * time.Millisecond
+	}
+	if spec.Expression != nil {
+		var err error
+		if q.expression, err = parseTerm(spec.Expression); err != nil {
+			return nil, err
+		}
+	}
+	if len(q.fields) == 0 {
+		q.fields = defaultFields
+	}
+	for _, field := range q.fields {
+		if _, known := fieldValue(field, &fsevents.FileState{}, "", "", false); !known {
+			return nil, fmt.Errorf("%s: unknown field %q", ErrBadRequest, field)
+		}
+	}
+	return q, nil
+}
+
+// watchmanResult holds the results of a query
+type watchmanResult struct {
+	clock string
+	fresh bool
+	files []interface{}
+}
+
+func (result *watchmanResult) pdu() watchmanPDU {
+	return watchmanPDU{"clock": result.clock, "is_fresh_instance": result.fresh, "files": result.files}
+}
+
+// run returns the files of the TreeView of r changed since the clock since, and matching q
+func (q *watchmanQuery) run(r *root, since string) (*watchmanResult, error) {
+	found, err := r.view.Query(fsevents.TreeQuery{Since: since})
+	if err != nil {
+		return nil, err
+	}
+	result := &watchmanResult{clock: found.Clock, fresh: found.IsFreshInstance, files: make([]interface{}, 0)}
+	if result.fresh && q.emptyOnFresh {
+		return result, nil
+	}
+	var sinceTick uint64
+	if !result.fresh {
+		sinceTick, _ = strconv.ParseUint(since[strings.LastIndex(since, ":")+1:], 10, 64)
+	}
+	instance := found.Clock[:strings.LastIndex(found.Clock, ":")+1]
+
+	for i := range found.Files {
+		file := &found.Files[i]
+		if strings.HasPrefix(file.Name, cookiePrefix) && !strings.Contains(file.Name, "/") {
+			continue
+		}
+		name := file.Name
+		if q.relativeRoot != "" {
+			if !strings.HasPrefix(name, q.relativeRoot+"/") {
+				continue
+			}
+			name = name[len(q.relativeRoot)+1:]
+		}
+		if !q.matches(file, name) {
+			continue
+		}
+		isNew := !result.fresh && file.Created > sinceTick
+		if len(q.fields) == 1 {
+			value, _ := fieldValue(q.fields[0], file, name, instance, isNew)
+			result.files = append(result.files, value)
+			continue
+		}
+		fields := make(map[string]interface{}, len(q.fields))
+		for _, field := range q.fields {
+			fields[field], _ = fieldValue(field, file, name, instance, isNew)
+		}
+		result.files = append(result.files, fields)
+	}
+	return result, nil
+}
+
+// matches returns true if file, at name relative to the relative root of q, passes its generators and expression
+func (q *watchmanQuery) matches(file *fsevents.FileState, name string) bool {
+	if len(q.suffixes) > 0 && !matchSuffix(q.suffixes, name) {
+		return false
+	}
+	if len(q.globs) > 0 {
+		matched := false
+		for _, glob := range q.globs {
+			if matchGlob(glob, name, true, false) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return q.expression == nil || q.expression(file, name)
+}
+
+// fieldValue returns the value of field for file, at name relative to the relative root of the query. instance
+// is the clock of the view without its tick. It returns false if field is unknown
+func fieldValue(field string, file *fsevents.FileState, name string, instance string, isNew bool) (interface{}, bool) {
+	switch field {
+	case "name":
+		return name, true
+	case "exists":
+		return file.Exists, true
+	case "new":
+		return isNew, true
+	case "type":
+		return file.Type, true
+	case "size":
+		return file.Size, true
+	case "mode":
+		return statMode(file), true
+	case "ino":
+		return file.Inode, true
+	case "mtime":
+		return file.ModTime.Unix(), true
+	case "mtime_ms":
+		return file.ModTime.UnixNano() / int64(time.Millisecond), true
+	case "cclock":
+		return instance + strconv.FormatUint(file.Created, 10), true
+	case "oclock":
+		return instance + strconv.FormatUint(file.Changed, 10), true
+	}
+	return nil, false
+}
+
+// statMode returns the mode of file as stat(2) reports it
+func statMode(file *fsevents.FileState) uint32 {
+	mode := uint32(file.Mode.Perm())
+	if file.Mode&os.ModeSetuid != 0 {
+		mode |= unix.S_ISUID
+	}
+	if file.Mode&os.ModeSetgid != 0 {
+		mode |= unix.S_ISGID
+	}
+	if file.Mode&os.ModeSticky != 0 {
+		mode |= unix.S_ISVTX
+	}
+	switch file.Type {
+	case fsevents.TypeFile:
+		mode |= unix.S_IFREG
+	case fsevents.TypeDir:
+		mode |= unix.S_IFDIR
+	case fsevents.TypeSymlink:
+		mode |= unix.S_IFLNK
+	case fsevents.TypeSocket:
+		mode |= unix.S_IFSOCK
+	case fsevents.TypePipe:
+		mode |= unix.S_IFIFO
+	case fsevents.TypeBlock:
+		mode |= unix.S_IFBLK
+	case fsevents.TypeCharacter:
+		mode |= unix.S_IFCHR
+	}
+	return mode
+}
+
+// term is a compiled term of a Watchman expression. name is the path of file relative to the relative root
+type term func(file *fsevents.FileState, name string) bool
+
+// parseTerm compiles a term of a Watchman expression, such as ["allof", ["type", "f"], ["suffix", "js"]]
+func parseTerm(expression interface{}) (term, error) {
+	if name, isName := expression.(string); isName {
+		expression = []interface{}{name}
+	}
+	args, isArray := expression.([]interface{})
+	if !isArray || len(args) == 0 {
+		return nil, fmt.Errorf("%s: expected a term, got %v", ErrBadExpression, expression)
+	}
+	name, isName := args[0].(string)
+	if !isName {
+		return nil, fmt.Errorf("%s: expected a term name, got %v", ErrBadExpression, args[0])
+	}
+	args = args[1:]
+
+	switch name {
+	case "true", "false":
+		value := name == "true"
+		return func(*fsevents.FileState, string) bool { return value }, nil
+	case "exists":
+		return func(file *fsevents.FileState, _ string) bool { return file.Exists }, nil
+	case "allof", "anyof":
+		terms := make([]term, len(args))
+		for i, arg := range args {
+			var err error
+			if terms[i], err = parseTerm(arg); err != nil {
+				return nil, err
+			}
+		}
+		anyOf := name == "anyof"
+		return func(file *fsevents.FileState, name string) bool {
+			for _, t := range terms {
+				if t(file, name) == anyOf {
+					return anyOf
+				}
+			}
+			return !anyOf
+		}, nil
+	case "not":
+		if len(args) != 1 {
+			return nil, fmt.Errorf("%s: \"not\" takes one term", ErrBadExpression)
+		}
+		t, err := parseTerm(args[0])
+		if err != nil {
+			return nil, err
+		}
+		return func(file *fsevents.FileState, name string) bool { return !t(file, name) }, nil
+	case "type":
+		fileType, valid := argAt(args, 0).(string)
+		if !valid || !strings.Contains("fdlspbc", fileType) || len(fileType) != 1 {
+			return nil, fmt.Errorf("%s: invalid type %v", ErrBadExpression, argAt(args, 0))
+		}
+		return func(file *fsevents.FileState, _ string) bool { return file.Type == fileType }, nil
+	case "suffix":
+		suffixes, err := stringArgs(argAt(args, 0))
+		if err != nil {
+			return nil, fmt.Errorf("%s: suffix: %s", ErrBadExpression, err)
+		}
+		for i := range suffixes {
+			suffixes[i] = strings.ToLower(suffixes[i])
+		}
+		return func(_ *fsevents.FileState, name string) bool { return matchSuffix(suffixes, name) }, nil
+	case "name", "iname":
+		names, err := stringArgs(argAt(args, 0))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s: %s", ErrBadExpression, name, err)
+		}
+		wholename, err := parseScope(argAt(args, 1))
+		if err != nil {
+			return nil, err
+		}
+		fold := name == "iname"
+		return func(_ *fsevents.FileState, name string) bool {
+			if !wholename {
+				name = path.Base(name)
+			}
+			for _, candidate := range names {
+				if candidate == name || (fold && strings.EqualFold(candidate, name)) {
+					return true
+				}
+			}
+			return false
+		}, nil
+	case "match", "imatch":
+		pattern, valid := argAt(args, 0).(string)
+		if !valid {
+			return nil, fmt.Errorf("%s: %s: expected a pattern", ErrBadExpression, name)
+		}
+		wholename, err := parseScope(argAt(args, 1))
+		if err != nil {
+			return nil, err
+		}
+		var opts struct {
+			IncludeDotFiles bool `json:"includedotfiles"`
+		}
+		if raw, err := json.Marshal(argAt(args, 2)); err == nil {
+			json.Unmarshal(raw, &opts)
+		}
+		fold := name == "imatch"
+		if fold {
+			pattern = strings.ToLower(pattern)
+		}
+		return func(_ *fsevents.FileState, name string) bool {
+			if fold {
+				name = strings.ToLower(name)
+			}
+			return matchGlob(pattern, name, wholename, opts.IncludeDotFiles)
+		}, nil
+	case "dirname", "idirname":
+		dir, valid := argAt(args, 0).(string)
+		if !valid {
+			return nil, fmt.Errorf("%s: %s: expected a directory", ErrBadExpression, name)
+		}
+		depth := func(int64) bool { return true }
+		if arg := argAt(args, 1); arg != nil {
+			relation, isArray := arg.([]interface{})
+			if !isArray || len(relation) != 3 || relation[0] != "depth" {
+				return nil, fmt.Errorf("%s: %s: expected [\"depth\", operator, value]", ErrBadExpression, name)
+			}
+			var err error
+			if depth, err = parseRelation(relation[1], relation[2]); err != nil {
+				return nil, err
+			}
+		}
+		fold := name == "idirname"
+		if fold {
+			dir = strings.ToLower(dir)
+		}
+		dir = strings.Trim(dir, "/")
+		return func(_ *fsevents.FileState, name string) bool {
+			if fold {
+				name = strings.ToLower(name)
+			}
+			below := name
+			if dir != "" {
+				if !strings.HasPrefix(name, dir+"/") {
+					return false
+				}
+				below = name[len(dir)+1:]
+			}
+			return depth(int64(strings.Count(below, "/")))
+		}, nil
+	case "size":
+		size, err := parseRelation(argAt(args, 0), argAt(args, 1))
+		if err != nil {
+			return nil, err
+		}
+		return func(file *fsevents.FileState, _ string) bool { return file.Exists && size(file.Size) }, nil
+	}
+	return nil, fmt.Errorf("%s: unknown term %q", ErrBadExpression, name)
+}
+
+// argAt returns the argument of a term at index i, nil if there is none
+func argAt(args []interface{}, i int) interface{} {
+	if i < len(args) {
+		return args[i]
+	}
+	return nil
+}
+
+// stringArgs returns arg, a string or an array of strings, as a slice
+func stringArgs(arg interface{}) ([]string, error) {
+	if s, isString := arg.(string); isString {
+		return []string{s}, nil
+	}
+	values, isArray := arg.([]interface{})
+	if !isArray {
+		return nil, fmt.Errorf("expected a string or an array of strings, got %v", arg)
+	}
+	strs := make([]string, len(values))
+	for i, value := range values {
+		s, isString := value.(string)
+		if !isString {
+			return nil, fmt.Errorf("expected a string, got %v", value)
+		}
+		strs[i] = s
+	}
+	return strs, nil
+}
+
+// parseScope returns true if scope is "wholename", false if it is "basename" or not given
+func parseScope(scope interface{}) (bool, error) {
+	switch scope {
+	case nil, "basename":
+		return false, nil
+	case "wholename":
+		return true, nil
+	}
+	return false, fmt.Errorf("%s: invalid scope %v", ErrBadExpression, scope)
+}
+
+// parseRelation returns a function comparing a value to operand with operator, one of eq, ne, gt, ge, lt or le
+func parseRelation(operator interface{}, operand interface{}) (func(int64) bool, error) {
+	number, isNumber := operand.(float64)
+	if !isNumber {
+		return nil, fmt.Errorf("%s: expected a number, got %v", ErrBadExpression, operand)
+	}
+	n := int64(number)
+	switch operator {
+	case "eq":
+		return func(v int64) bool { return v == n }, nil
+	case "ne":
+		return func(v int64) bool { return v != n }, nil
+	case "gt":
+		return func(v int64) bool { return v > n }, nil
+	case "ge":
+		return func(v int64) bool { return v >= n }, nil
+	case "lt":
+		return func(v int64) bool { return v < n }, nil
+	case "le":
+		return func(v int64) bool { return v <= n }, nil
+	}
+	return nil, fmt.Errorf("%s: invalid operator %v", ErrBadExpression, operator)
+}
+
+// matchSuffix returns true if the extension of name, without its dot, is one of suffixes, ignoring case
+func matchSuffix(suffixes []string, name string) bool {
+	ext := strings.ToLower(path.Ext(name))
+	for _, suffix := range suffixes {
+		if ext == "."+suffix {
+			return true
+		}
+	}
+	return false
+}
+
+// matchGlob returns true if name, or its last element unless wholename is true, matches pattern. "*" doesn't
+// match a slash, and "**" matches any number of path elements. Unless includeDotFiles is true, names with an
+// element starting with a dot only match patterns with such an element too
+func matchGlob(pattern string, name string, wholename bool, includeDotFiles bool) bool {
+	if !wholename {
+		name = path.Base(name)
+	}
+	if !includeDotFiles && hasDotElement(name) && !hasDotElement(pattern) {
+		return false
+	}
+	if wholename && strings.Contains(pattern, "/") {
+		return fsevents.MatchPattern(pattern, name)
+	}
+	if pattern == "**" {
+		return true
+	}
+	matched, _ := path.Match(pattern, name)
+	return matched
+}
+
+// hasDotElement returns true if an element of name starts with a dot
+func hasDotElement(name string) bool {
+	return strings.HasPrefix(name, ".") || strings.Contains(name, "/.")
+}
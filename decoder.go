@@ -0,0 +1,109 @@
+package fsevents
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+var (
+	ErrTruncatedHeader   = errors.New("inotify event header truncated")
+	ErrTruncatedName     = errors.New("inotify event name truncated")
+	ErrNameLength        = errors.New("inotify event name too long")
+	ErrNameNotTerminated = errors.New("inotify event name not NUL-terminated")
+	ErrNamePadding       = errors.New("inotify event name padded with non-NUL bytes")
+)
+
+// Longest name of an event, NAME_MAX and its NUL terminator rounded up to the size of an event header like the
+// kernel pads names
+const maxEventNameLen = (unix.NAME_MAX + unix.SizeofInotifyEvent) / unix.SizeofInotifyEvent * unix.SizeofInotifyEvent
+
+// RawRecord is an event decoded from a buffer read from an inotify descriptor
+type RawRecord struct {
+	Event unix.InotifyEvent
+	// Name of the file inside the watched directory, without its NUL padding. Empty for events on the watched path
+	Name string
+	// Offset of the event in the buffer
+	Offset int
+	// Size of the event in the buffer, header and padded name
+	Size int
+}
+
+// DecodeError is returned for a buffer that does not hold a valid sequence of inotify events
+type DecodeError struct {
+	// Offset of the invalid event in the buffer
+	Offset int
+	// Bytes the event needs and bytes left in the buffer, set for truncated events
+	Need, Have int
+	// One of the decoding errors, such as ErrTruncatedName
+	Err error
+}
+
+func (e *DecodeError) Error() string {
+	if e.Need > 0 {
+		return fmt.Sprintf("%s at offset %d: need %d bytes, have %d", e.Err, e.Offset, e.Need, e.Have)
+	}
+	return fmt.Sprintf("%s at offset %d", e.Err, e.Offset)
+}
+
+// Unwrap returns the decoding error, for errors.Is
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+// DecodeEvent decodes the event at offset in buf, which holds events as read from an inotify descriptor.
+// The error, if any, is a *DecodeError.
+func DecodeEvent(buf []byte, offset int) (RawRecord, error) {
+	record := RawRecord{Offset: offset}
+	have := len(buf) - offset
+	if offset < 0 || have < unix.SizeofInotifyEvent {
+		return record, &DecodeError{Offset: offset, Need: unix.SizeofInotifyEvent, Have: have, Err: ErrTruncatedHeader}
+	}
+	header := buf[offset : offset+unix.SizeofInotifyEvent]
+	record.Event = unix.InotifyEvent{
+		Wd:     int32(nativeEndian.Uint32(header[0:4])),
+		Mask:   nativeEndian.Uint32(header[4:8]),
+		Cookie: nativeEndian.Uint32(header[8:12]),
+		Len:    nativeEndian.Uint32(header[12:16]),
+	}
+	if record.Event.Len > maxEventNameLen {
+		return record, &DecodeError{Offset: offset, Err: ErrNameLength}
+	}
+	record.Size = unix.SizeofInotifyEvent + int(record.Event.Len)
+	if have < record.Size {
+		return record, &DecodeError{Offset: offset, Need: record.Size, Have: have, Err: ErrTruncatedName}
+	}
+	if record.Event.Len == 0 {
+		return record, nil
+	}
+
+	name := buf[offset+unix.SizeofInotifyEvent : offset+record.Size]
+	end := bytes.IndexByte(name, 0)
+	if end < 0 {
+		return record, &DecodeError{Offset: offset, Err: ErrNameNotTerminated}
+	}
+	for _, b := range name[end:] {
+		if b != 0 {
+			return record, &DecodeError{Offset: offset, Err: ErrNamePadding}
+		}
+	}
+	record.Name = string(name[:end])
+	return record, nil
+}
+
+// DecodeEvents decodes every event in buf, which holds events as read from an inotify descriptor, such as a
+// captured buffer. On error, it returns the events decoded before the invalid one along with a *DecodeError.
+func DecodeEvents(buf []byte) ([]RawRecord, error) {
+	records := make([]RawRecord, 0)
+	for offset := 0; offset < len(buf); {
+		record, err := DecodeEvent(buf, offset)
+		if err != nil {
+			return records, err
+		}
+		records = append(records, record)
+		offset += record.Size
+	}
+	return records, nil
+}
@@ -0,0 +1,38 @@
+//go:build go1.18
+// +build go1.18
+
+package fsevents_test
+
+import (
+	"strings"
+	"testing"
+
+	fsevents "github.com/tywkeene/go-fsevents"
+	"golang.org/x/sys/unix"
+)
+
+func FuzzDecodeEvents(f *testing.F) {
+	f.Add([]byte{})
+	f.Add(rawEvent(1, fsevents.Create, "file", 16))
+	f.Add(append(rawEvent(1, fsevents.Delete, "", 0), rawEvent(2, fsevents.MovedTo, "moved", 16)...))
+	f.Add(rawEvent(1, fsevents.Create, "file", 16)[:20])
+	f.Fuzz(func(t *testing.T, buf []byte) {
+		records, err := fsevents.DecodeEvents(buf)
+		decoded := 0
+		for _, record := range records {
+			if record.Offset != decoded || record.Size != unix.SizeofInotifyEvent+int(record.Event.Len) {
+				t.Fatalf("event at offset %d does not follow the previous one: %+v", decoded, record)
+			}
+			if strings.IndexByte(record.Name, 0) >= 0 || len(record.Name) >= int(record.Event.Len) && record.Event.Len > 0 {
+				t.Fatalf("name %q was not trimmed", record.Name)
+			}
+			decoded += record.Size
+		}
+		if err == nil && decoded != len(buf) {
+			t.Fatalf("decoded %d bytes of %d without error", decoded, len(buf))
+		}
+		if decodeErr, ok := err.(*fsevents.DecodeError); err != nil && (!ok || decodeErr.Offset != decoded) {
+			t.Fatalf("unexpected error %v after %d bytes", err, decoded)
+		}
+	})
+}
@@ -0,0 +1,69 @@
+package fsevents_test
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"unsafe"
+
+	fsevents "github.com/tywkeene/go-fsevents"
+	"golang.org/x/sys/unix"
+)
+
+// rawEvent returns an inotify event as the kernel writes it, with name padded to padded bytes
+func rawEvent(wd int32, mask uint32, name string, padded int) []byte {
+	event := unix.InotifyEvent{Wd: wd, Mask: mask, Len: uint32(padded)}
+	buf := append([]byte{}, (*[unix.SizeofInotifyEvent]byte)(unsafe.Pointer(&event))[:]...)
+	return append(buf, append([]byte(name), make([]byte, padded-len(name))...)...)
+}
+
+func TestDecodeEvents(t *testing.T) {
+	buf := append(rawEvent(1, fsevents.Create, "file", 16), rawEvent(2, fsevents.RootDelete, "", 0)...)
+	buf = append(buf, rawEvent(1, fsevents.Delete, "directory-name", 32)...)
+	records, err := fsevents.DecodeEvents(buf)
+	assert(t, (err == nil), err)
+	assert(t, (len(records) == 3), fmt.Errorf("expected 3 events, got %d", len(records)))
+
+	expected := []struct {
+		wd     int32
+		mask   uint32
+		name   string
+		offset int
+	}{{1, fsevents.Create, "file", 0}, {2, fsevents.RootDelete, "", 32}, {1, fsevents.Delete, "directory-name", 48}}
+	for i, e := range expected {
+		r := records[i]
+		assert(t, (r.Event.Wd == e.wd && r.Event.Mask == e.mask && r.Name == e.name && r.Offset == e.offset),
+			fmt.Errorf("event %d: expected %+v, got %+v", i, e, r))
+	}
+	records, err = fsevents.DecodeEvents(nil)
+	assert(t, (err == nil && len(records) == 0), fmt.Errorf("an empty buffer should hold no events"))
+}
+
+func TestDecodeEventsInvalid(t *testing.T) {
+	valid := rawEvent(1, fsevents.Create, "file", 16)
+	tooLong := rawEvent(1, fsevents.Create, "file", 16)
+	tooLong[12] = 0xff
+	tooLong[13] = 0xff
+	badPadding := rawEvent(1, fsevents.Create, "file", 16)
+	badPadding[unix.SizeofInotifyEvent+10] = 'x'
+	invalid := []struct {
+		buf []byte
+		err error
+		// Offset of the invalid event, and bytes it needs and has for truncated events
+		offset, need, have int
+	}{
+		{valid[:10], fsevents.ErrTruncatedHeader, 0, 16, 10},
+		{append(append([]byte{}, valid...), valid[:20]...), fsevents.ErrTruncatedName, 32, 32, 20},
+		{tooLong, fsevents.ErrNameLength, 0, 0, 0},
+		{rawEvent(1, fsevents.Create, "sixteen-bytes!!!", 16), fsevents.ErrNameNotTerminated, 0, 0, 0},
+		{badPadding, fsevents.ErrNamePadding, 0, 0, 0},
+	}
+	for i, c := range invalid {
+		records, err := fsevents.DecodeEvents(c.buf)
+		decodeErr, ok := err.(*fsevents.DecodeError)
+		assert(t, (ok && errors.Is(err, c.err)), fmt.Errorf("case %d: expected %s, got %v", i, c.err, err))
+		assert(t, (decodeErr.Offset == c.offset && decodeErr.Need == c.need && decodeErr.Have == c.have),
+			fmt.Errorf("case %d: unexpected error %+v", i, decodeErr))
+		assert(t, (len(records) == c.offset/32), fmt.Errorf("case %d: the events before the invalid one should have been returned", i))
+	}
+}
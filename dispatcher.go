@@ -0,0 +1,215 @@
+package fsevents
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+)
+
+// OverflowPolicy describes what happens to an event that arrives when a queue is full
+type OverflowPolicy int
+
+const (
+	// OverflowBlock waits for room in the queue. This holds up reading from inotify, and may eventually make the
+	// kernel drop events instead (see Overflow)
+	OverflowBlock OverflowPolicy = iota
+	// OverflowDropNewest drops the event that just arrived
+	OverflowDropNewest
+	// OverflowDropOldest drops the oldest event in the queue to make room for the one that just arrived
+	OverflowDropOldest
+	// OverflowDisconnect closes a Subscription whose buffer is full, see Subscription.Err.
+	// Dispatchers treat it as OverflowBlock
+	OverflowDisconnect
+)
+
+var (
+	// Dispatcher errors
+	ErrEventDropped      = errors.New("queue full, event dropped")
+	ErrDispatcherStopped = errors.New("dispatcher stopped")
+)
+
+// DispatcherOptions configures a Dispatcher
+type DispatcherOptions struct {
+	// Number of goroutines handling events. Defaults to 1
+	Workers int
+	// Number of events each worker can have waiting. Zero means events are handed over to workers unbuffered
+	QueueSize int
+	// What to do with an event when the queue of its worker is full
+	Overflow OverflowPolicy
+}
+
+// Dispatcher runs EventHandlers on a bounded pool of goroutines, so that a slow handler does not hold up reading
+// events from inotify. Events for the same path always go to the same worker, and so are handled one at a time
+// in the order they were read, while events for different paths are handled in parallel.
+// A Dispatcher is installed with Watcher.SetDispatcher.
+type Dispatcher struct {
+	sync.RWMutex
+	opts DispatcherOptions
+	// Queue of each worker. Never closed, so that an event being queued while d stops is not sent on a closed channel
+	queues []chan *FsEvent
+	// Running workers
+	workers sync.WaitGroup
+	// Set under the write lock, so that no event is being queued once it is set
+	stopped bool
+	// Closed when d stops, releasing events blocked on a full queue
+	done chan struct{}
+	// Closed once stopped is set, after which the workers handle the events left and exit
+	drained   chan struct{}
+	closeOnce sync.Once
+	// Number of events dropped because of Overflow
+	dropped uint64
+}
+
+// NewDispatcher returns a Dispatcher configured with opts. Its workers are started by Watcher.SetDispatcher
+func NewDispatcher(opts DispatcherOptions) *Dispatcher {
+	if opts.Workers < 1 {
+		opts.Workers = 1
+	}
+	if opts.QueueSize < 0 {
+		opts.QueueSize = 0
+	}
+	d := &Dispatcher{
+		opts:    opts,
+		queues:  make([]chan *FsEvent, opts.Workers),
+		done:    make(chan struct{}),
+		drained: make(chan struct{}),
+	}
+	for i := range d.queues {
+		d.queues[i] = make(chan *FsEvent, opts.QueueSize)
+	}
+	return d
+}
+
+// start starts the workers of d, handling events for w. Once d stops, each worker handles the events left in its
+// queue and exits
+func (d *Dispatcher) start(w *Watcher) {
+	for _, queue := range d.queues {
+		d.workers.Add(1)
+		go func(queue chan *FsEvent) {
+			defer d.workers.Done()
+			for {
+				select {
+				case event := <-queue:
+					w.applyEventHandler(event)
+				case <-d.drained:
+					for {
+						select {
+						case event := <-queue:
+							w.applyEventHandler(event)
+						default:
+							return
+						}
+					}
+				}
+			}
+		}(queue)
+	}
+}
+
+// queueFor returns the queue of the worker handling the events for eventPath
+func (d *Dispatcher) queueFor(eventPath string) chan *FsEvent {
+	h := fnv.New32a()
+	h.Write([]byte(eventPath))
+	return d.queues[h.Sum32()%uint32(len(d.queues))]
+}
+
+// dispatch queues event according to d.opts.Overflow. It returns ErrEventDropped if an event was dropped, and
+// ErrDispatcherStopped if d stopped, including while waiting for room in a full queue
+func (d *Dispatcher) dispatch(event *FsEvent) error {
+	// Held while queueing, so that the workers do not exit before the event is in their queue
+	d.RLock()
+	defer d.RUnlock()
+	if d.stopped {
+		return ErrDispatcherStopped
+	}
+	queue := d.queueFor(event.Path)
+
+	switch d.opts.Overflow {
+	case OverflowDropNewest:
+		select {
+		case queue <- event:
+			return nil
+		default:
+			atomic.AddUint64(&d.dropped, 1)
+			return fmt.Errorf("%s: %q", ErrEventDropped, event.Path)
+		}
+	case OverflowDropOldest:
+		var dropped *FsEvent
+		for {
+			select {
+			case queue <- event:
+				if dropped != nil {
+					return fmt.Errorf("%s: %q", ErrEventDropped, dropped.Path)
+				}
+				return nil
+			default:
+			}
+			select {
+			case dropped = <-queue:
+				atomic.AddUint64(&d.dropped, 1)
+			default:
+				// A worker took the oldest event first, try again
+			}
+		}
+	default:
+		// close releases the event from d.done before taking the write lock, so a stuck worker cannot keep d
+		// from stopping
+		select {
+		case queue <- event:
+			return nil
+		case <-d.done:
+			return ErrDispatcherStopped
+		}
+	}
+}
+
+// close stops d from accepting events. The workers exit once they have handled the events already queued
+func (d *Dispatcher) close() {
+	d.closeOnce.Do(func() {
+		// Releases the events waiting for room in a full queue, which hold the read lock
+		close(d.done)
+		d.Lock()
+		d.stopped = true
+		d.Unlock()
+		close(d.drained)
+	})
+}
+
+// Stop stops d from accepting events and waits for the events already queued to be handled
+func (d *Dispatcher) Stop() {
+	d.close()
+	d.workers.Wait()
+}
+
+// Dropped returns the number of events dropped because a queue was full
+func (d *Dispatcher) Dropped() uint64 {
+	return atomic.LoadUint64(&d.dropped)
+}
+
+// Queued returns the number of events waiting to be handled
+func (d *Dispatcher) Queued() int {
+	n := 0
+	for _, queue := range d.queues {
+		n += len(queue)
+	}
+	return n
+}
+
+// SetDispatcher makes WatchAndHandle, and events delivered to EventHandlers while it runs, go through d instead of
+// calling the EventHandlers synchronously. Errors returned by EventHandlers are still written to w.Errors, from the
+// workers of d. A nil d makes EventHandlers synchronous again. The previous Dispatcher, if any, stops accepting events
+// and exits once it has handled those already queued. Close does the same to the current one.
+func (w *Watcher) SetDispatcher(d *Dispatcher) {
+	if d != nil {
+		d.start(w)
+	}
+	w.Lock()
+	previous := w.dispatcher
+	w.dispatcher = d
+	w.Unlock()
+	if previous != nil {
+		previous.close()
+	}
+}
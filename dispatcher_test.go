@@ -0,0 +1,194 @@
+package fsevents_test
+
+import (
+	"fmt"
+	"hash/fnv"
+	"path"
+	"sync"
+	"testing"
+	"time"
+
+	fsevents "github.com/tywkeene/go-fsevents"
+)
+
+// sameWorker returns true if a Dispatcher with the given number of workers handles a and b on the same worker
+func sameWorker(a string, b string, workers int) bool {
+	ha, hb := fnv.New32a(), fnv.New32a()
+	ha.Write([]byte(a))
+	hb.Write([]byte(b))
+	return ha.Sum32()%uint32(workers) == hb.Sum32()%uint32(workers)
+}
+
+func dispatcherTestWatcher(t *testing.T, fn fsevents.HandlerFunc, opts fsevents.DispatcherOptions) (*fsevents.Watcher, *fsevents.Dispatcher) {
+	w, err := fsevents.NewWatcher()
+	assert(t, (err == nil), err)
+	assert(t, (w.RegisterFunc(fsevents.CloseWrite, fn) == nil), fmt.Errorf("RegisterFunc should not have returned an error"))
+	d := fsevents.NewDispatcher(opts)
+	w.SetDispatcher(d)
+
+	desc, err := w.AddDescriptor(testRootDir, fsevents.CloseWrite)
+	assert(t, (err == nil), err)
+	assert(t, (desc.Start() == nil), fmt.Errorf("Start should not have returned an error"))
+	go w.WatchAndHandle()
+	return w, d
+}
+
+func TestDispatcherParallel(t *testing.T) {
+	setupDirs([]string{testRootDir})
+	defer teardownDirs([]string{testRootDir})
+
+	const workers = 4
+	slow := path.Join(testRootDir, "slow")
+	fast := path.Join(testRootDir, "fast")
+	for i := 0; sameWorker(path.Clean(slow), path.Clean(fast), workers); i++ {
+		fast = path.Join(testRootDir, fmt.Sprintf("fast%d", i))
+	}
+
+	release := make(chan struct{})
+	handled := make(chan string, 2)
+	w, _ := dispatcherTestWatcher(t, func(w *fsevents.Watcher, event *fsevents.FsEvent) error {
+		if event.Path == path.Clean(slow) {
+			<-release
+		}
+		handled <- event.Path
+		return nil
+	}, fsevents.DispatcherOptions{Workers: workers, QueueSize: 8})
+	defer w.Close()
+
+	assert(t, (writeRandomFile(slow) == nil), fmt.Errorf("could not write file"))
+	assert(t, (writeRandomFile(fast) == nil), fmt.Errorf("could not write file"))
+	select {
+	case p := <-handled:
+		assert(t, (p == path.Clean(fast)), fmt.Errorf("%q should have been handled while %q was blocked, got %q", fast, slow, p))
+	case <-time.After(5 * time.Second):
+		t.Fatal("a slow handler held up events for another path")
+	}
+	close(release)
+	assert(t, (<-handled == path.Clean(slow)), fmt.Errorf("the slow event should have been handled once released"))
+}
+
+func TestDispatcherOrdering(t *testing.T) {
+	setupDirs([]string{testRootDir})
+	defer teardownDirs([]string{testRootDir})
+
+	const writes = 20
+	var lock sync.Mutex
+	ids := make(map[string][]uint32)
+	done := make(chan struct{}, 2*writes)
+	w, d := dispatcherTestWatcher(t, func(w *fsevents.Watcher, event *fsevents.FsEvent) error {
+		lock.Lock()
+		ids[event.Path] = append(ids[event.Path], event.ID)
+		lock.Unlock()
+		done <- struct{}{}
+		return nil
+	}, fsevents.DispatcherOptions{Workers: 4, QueueSize: 2 * writes})
+	defer w.Close()
+
+	for i := 0; i < writes; i++ {
+		writeRandomFile(path.Join(testRootDir, "a"))
+		writeRandomFile(path.Join(testRootDir, "b"))
+	}
+	for i := 0; i < 2*writes; i++ {
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("only %d of %d events were handled", i, 2*writes)
+		}
+	}
+	d.Stop()
+
+	for p, list := range ids {
+		for i := 1; i < len(list); i++ {
+			assert(t, (list[i] > list[i-1]), fmt.Errorf("events for %q were handled out of order: %v", p, list))
+		}
+	}
+}
+
+func TestDispatcherDropNewest(t *testing.T) {
+	setupDirs([]string{testRootDir})
+	defer teardownDirs([]string{testRootDir})
+
+	started := make(chan struct{}, 5)
+	release := make(chan struct{})
+	w, d := dispatcherTestWatcher(t, func(w *fsevents.Watcher, event *fsevents.FsEvent) error {
+		started <- struct{}{}
+		<-release
+		return nil
+	}, fsevents.DispatcherOptions{Workers: 1, QueueSize: 1, Overflow: fsevents.OverflowDropNewest})
+	defer w.Close()
+
+	// The first event blocks the worker, the second fills the queue and the others are dropped.
+	// Different files, since the kernel merges identical events that were not read yet
+	writeRandomFile(path.Join(testRootDir, "drop0"))
+	<-started
+	for i := 1; i < 5; i++ {
+		writeRandomFile(path.Join(testRootDir, fmt.Sprintf("drop%d", i)))
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for d.Dropped() < 3 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert(t, (d.Dropped() == 3), fmt.Errorf("3 events should have been dropped, got %d", d.Dropped()))
+	assert(t, (d.Queued() == 1), fmt.Errorf("1 event should be queued, got %d", d.Queued()))
+	close(release)
+}
+
+func TestDispatcherDropOldest(t *testing.T) {
+	setupDirs([]string{testRootDir})
+	defer teardownDirs([]string{testRootDir})
+
+	started := make(chan string, 5)
+	release := make(chan struct{})
+	w, d := dispatcherTestWatcher(t, func(w *fsevents.Watcher, event *fsevents.FsEvent) error {
+		started <- event.Name
+		<-release
+		return nil
+	}, fsevents.DispatcherOptions{Workers: 1, QueueSize: 1, Overflow: fsevents.OverflowDropOldest})
+	defer w.Close()
+
+	// The first event blocks the worker, the second fills the queue and is dropped for the third
+	writeRandomFile(path.Join(testRootDir, "drop0"))
+	<-started
+	writeRandomFile(path.Join(testRootDir, "drop1"))
+	writeRandomFile(path.Join(testRootDir, "drop2"))
+	deadline := time.Now().Add(5 * time.Second)
+	for d.Dropped() < 1 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	assert(t, (d.Dropped() == 1), fmt.Errorf("1 event should have been dropped, got %d", d.Dropped()))
+	assert(t, (d.Queued() == 1), fmt.Errorf("1 event should be queued, got %d", d.Queued()))
+	close(release)
+	select {
+	case name := <-started:
+		assert(t, (name == "drop2"), fmt.Errorf("the newest event should have been handled, got %q", name))
+	case <-time.After(5 * time.Second):
+		t.Fatal("the newest event was not handled")
+	}
+}
+
+func TestDispatcherCloseStuckWorker(t *testing.T) {
+	setupDirs([]string{testRootDir})
+	defer teardownDirs([]string{testRootDir})
+
+	started := make(chan struct{}, 5)
+	w, _ := dispatcherTestWatcher(t, func(w *fsevents.Watcher, event *fsevents.FsEvent) error {
+		started <- struct{}{}
+		// Reported on w.Errors, which nobody reads
+		return fmt.Errorf("handler failed")
+	}, fsevents.DispatcherOptions{Workers: 1})
+
+	// The worker is stuck reporting the first error, and the second event waits for it
+	writeRandomFile(path.Join(testRootDir, "stuck0"))
+	<-started
+	writeRandomFile(path.Join(testRootDir, "stuck1"))
+	time.Sleep(100 * time.Millisecond)
+
+	closed := make(chan error)
+	go func() { closed <- w.Close() }()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close deadlocked on an event waiting for a stuck worker")
+	}
+}
@@ -0,0 +1,370 @@
+package fsevents
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+var (
+	ErrEventVersion  = errors.New("unsupported event encoding version")
+	ErrEventEncoding = errors.New("malformed encoded event")
+	ErrUnknownOp     = errors.New("unknown event operation")
+)
+
+const (
+	// Version of the JSON and binary encodings of FsEvent written by this package. Encodings of later versions,
+	// or without a version, are rejected with ErrEventVersion
+	EventEncodingVersion = 1
+	// Largest binary encoded event EventReader accepts
+	maxEncodedEventSize = 1 << 20
+)
+
+// Names of the inotify event flags, in the order OpNames lists them
+var opNames = []struct {
+	mask uint32
+	name string
+}{
+	{unix.IN_ACCESS, "ACCESS"},
+	{unix.IN_MODIFY, "MODIFY"},
+	{unix.IN_ATTRIB, "ATTRIB"},
+	{unix.IN_CLOSE_WRITE, "CLOSE_WRITE"},
+	{unix.IN_CLOSE_NOWRITE, "CLOSE_NOWRITE"},
+	{unix.IN_OPEN, "OPEN"},
+	{unix.IN_MOVED_FROM, "MOVED_FROM"},
+	{unix.IN_MOVED_TO, "MOVED_TO"},
+	{unix.IN_CREATE, "CREATE"},
+	{unix.IN_DELETE, "DELETE"},
+	{unix.IN_DELETE_SELF, "DELETE_SELF"},
+	{unix.IN_MOVE_SELF, "MOVE_SELF"},
+	{unix.IN_UNMOUNT, "UNMOUNT"},
+	{unix.IN_Q_OVERFLOW, "Q_OVERFLOW"},
+	{unix.IN_IGNORED, "IGNORED"},
+}
+
+// OpNames returns the names of the inotify event flags in mask, such as "CREATE" for IN_CREATE. IN_ISDIR is not
+// included, and bits without a name are returned in hexadecimal, such as "0x8000000".
+func OpNames(mask uint32) []string {
+	names := make([]string, 0, 2)
+	mask &^= IsDir
+	for _, op := range opNames {
+		if mask&op.mask != 0 {
+			names = append(names, op.name)
+			mask &^= op.mask
+		}
+	}
+	for bit := uint32(1); mask != 0; bit <<= 1 {
+		if mask&bit != 0 {
+			names = append(names, "0x"+strconv.FormatUint(uint64(bit), 16))
+			mask &^= bit
+		}
+	}
+	return names
+}
+
+// ParseOpNames returns the mask of the inotify event flags named in names, as returned by OpNames
+func ParseOpNames(names []string) (uint32, error) {
+	var mask uint32
+next:
+	for _, name := range names {
+		for _, op := range opNames {
+			if op.name == name {
+				mask |= op.mask
+				continue next
+			}
+		}
+		if strings.HasPrefix(name, "0x") {
+			if bit, err := strconv.ParseUint(name[2:], 16, 32); err == nil {
+				mask |= uint32(bit)
+				continue
+			}
+		}
+		return 0, fmt.Errorf("%s: %q", ErrUnknownOp, name)
+	}
+	return mask, nil
+}
+
+// eventJSON is the JSON encoding of an FsEvent
+type eventJSON struct {
+	Version int    `json:"v"`
+	ID      uint32 `json:"id"`
+	Path    string `json:"path"`
+	Name    string `json:"name"`
+	// OpNames of the mask of the inotify event, nil if the event has none
+	Ops    []string `json:"ops"`
+	IsDir  bool     `json:"is_dir,omitempty"`
+	Cookie uint32   `json:"cookie,omitempty"`
+	// Inotify watch descriptor the event was read from
+	Wd int32 `json:"wd,omitempty"`
+	// Path of the WatchDescriptor of the event
+	Descriptor string    `json:"descriptor,omitempty"`
+	Timestamp  time.Time `json:"timestamp"`
+}
+
+// MarshalJSON encodes the event as a JSON object holding its ID, path, name, the names of the flags of its mask
+// (see OpNames), whether it is about a directory, its cookie, its watch descriptor, the path of its WatchDescriptor
+// and its timestamp, along with the version of the encoding. Like MarshalBinary, it has a value receiver so that
+// events are encoded the same whether they are held by value or by pointer
+func (e FsEvent) MarshalJSON() ([]byte, error) {
+	encoded := eventJSON{
+		Version:   EventEncodingVersion,
+		ID:        e.ID,
+		Path:      e.Path,
+		Name:      e.Name,
+		Timestamp: e.Timestamp,
+	}
+	if e.RawEvent != nil {
+		encoded.Ops = OpNames(e.RawEvent.Mask)
+		encoded.IsDir = CheckMask(IsDir, e.RawEvent.Mask)
+		encoded.Cookie = e.RawEvent.Cookie
+		encoded.Wd = e.RawEvent.Wd
+	}
+	if e.Descriptor != nil {
+		encoded.Descriptor = e.Descriptor.Path
+	}
+	return json.Marshal(&encoded)
+}
+
+// UnmarshalJSON decodes an event encoded by MarshalJSON. The event gets a RawEvent if the encoding has ops, and a
+// stopped WatchDescriptor that belongs to no Watcher if it has the path of one
+func (e *FsEvent) UnmarshalJSON(data []byte) error {
+	var encoded eventJSON
+	if err := json.Unmarshal(data, &encoded); err != nil {
+		return fmt.Errorf("%s: %s", ErrEventEncoding, err)
+	}
+	if encoded.Version <= 0 || encoded.Version > EventEncodingVersion {
+		return fmt.Errorf("%s: %d", ErrEventVersion, encoded.Version)
+	}
+	*e = FsEvent{
+		ID:        encoded.ID,
+		Path:      encoded.Path,
+		Name:      encoded.Name,
+		Timestamp: encoded.Timestamp,
+	}
+	if encoded.Ops != nil {
+		mask, err := ParseOpNames(encoded.Ops)
+		if err != nil {
+			return err
+		}
+		if encoded.IsDir {
+			mask |= IsDir
+		}
+		e.RawEvent = &unix.InotifyEvent{Wd: encoded.Wd, Mask: mask, Cookie: encoded.Cookie}
+	}
+	if encoded.Descriptor != "" {
+		e.Descriptor = newWatchDescriptor(encoded.Descriptor, 0, -1)
+		e.Descriptor.WatchDescriptor = int(encoded.Wd)
+		if e.RawEvent != nil {
+			e.Descriptor.Mask = e.RawEvent.Mask
+		}
+	}
+	return nil
+}
+
+// Flags of the binary encoding, telling which optional parts follow
+const (
+	binaryHasRawEvent   = 1 << 0
+	binaryHasDescriptor = 1 << 1
+	binaryHasTimestamp  = 1 << 2
+)
+
+// MarshalBinary encodes the event compactly. The encoding starts with its version and a byte of flags, followed
+// by varints for the ID, the timestamp in nanoseconds, and the mask, cookie and watch descriptor of the inotify
+// event, then the path and name, each prefixed with its length, and the path and inotify watch descriptor of the
+// WatchDescriptor. Absent parts are left out.
+func (e FsEvent) MarshalBinary() ([]byte, error) {
+	buf := make([]byte, 0, 32+len(e.Path)+len(e.Name))
+	var flags byte
+	if e.RawEvent != nil {
+		flags |= binaryHasRawEvent
+	}
+	if e.Descriptor != nil {
+		flags |= binaryHasDescriptor
+	}
+	if !e.Timestamp.IsZero() {
+		flags |= binaryHasTimestamp
+	}
+	buf = append(buf, EventEncodingVersion, flags)
+	buf = appendUvarint(buf, uint64(e.ID))
+	if flags&binaryHasTimestamp != 0 {
+		buf = appendVarint(buf, e.Timestamp.UnixNano())
+	}
+	if flags&binaryHasRawEvent != 0 {
+		buf = appendUvarint(buf, uint64(e.RawEvent.Mask))
+		buf = appendUvarint(buf, uint64(e.RawEvent.Cookie))
+		buf = appendVarint(buf, int64(e.RawEvent.Wd))
+	}
+	buf = appendString(buf, e.Path)
+	buf = appendString(buf, e.Name)
+	if flags&binaryHasDescriptor != 0 {
+		buf = appendString(buf, e.Descriptor.Path)
+		buf = appendVarint(buf, int64(e.Descriptor.WatchDescriptor))
+	}
+	return buf, nil
+}
+
+func appendUvarint(buf []byte, v uint64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	return append(buf, tmp[:binary.PutUvarint(tmp[:], v)]...)
+}
+
+func appendVarint(buf []byte, v int64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	return append(buf, tmp[:binary.PutVarint(tmp[:], v)]...)
+}
+
+func appendString(buf []byte, s string) []byte {
+	return append(appendUvarint(buf, uint64(len(s))), s...)
+}
+
+// binaryDecoder reads the parts of a binary encoded event, remembering the first error
+type binaryDecoder struct {
+	data []byte
+	err  error
+}
+
+func (d *binaryDecoder) fail(what string) {
+	if d.err == nil {
+		d.err = fmt.Errorf("%s: truncated %s", ErrEventEncoding, what)
+	}
+}
+
+func (d *binaryDecoder) uvarint(what string) uint64 {
+	v, n := binary.Uvarint(d.data)
+	if n <= 0 {
+		d.fail(what)
+		return 0
+	}
+	d.data = d.data[n:]
+	return v
+}
+
+func (d *binaryDecoder) varint(what string) int64 {
+	v, n := binary.Varint(d.data)
+	if n <= 0 {
+		d.fail(what)
+		return 0
+	}
+	d.data = d.data[n:]
+	return v
+}
+
+func (d *binaryDecoder) string(what string) string {
+	length := d.uvarint(what)
+	if d.err != nil || length > uint64(len(d.data)) {
+		d.fail(what)
+		return ""
+	}
+	s := string(d.data[:length])
+	d.data = d.data[length:]
+	return s
+}
+
+// UnmarshalBinary decodes an event encoded by MarshalBinary. Like UnmarshalJSON, the event gets a stopped
+// WatchDescriptor that belongs to no Watcher if it had one
+func (e *FsEvent) UnmarshalBinary(data []byte) error {
+	if len(data) < 2 {
+		return fmt.Errorf("%s: truncated header", ErrEventEncoding)
+	}
+	if data[0] == 0 || data[0] > EventEncodingVersion {
+		return fmt.Errorf("%s: %d", ErrEventVersion, data[0])
+	}
+	flags := data[1]
+	d := &binaryDecoder{data: data[2:]}
+	event := FsEvent{ID: uint32(d.uvarint("id"))}
+	if flags&binaryHasTimestamp != 0 {
+		event.Timestamp = time.Unix(0, d.varint("timestamp")).UTC()
+	}
+	if flags&binaryHasRawEvent != 0 {
+		event.RawEvent = &unix.InotifyEvent{
+			Mask:   uint32(d.uvarint("mask")),
+			Cookie: uint32(d.uvarint("cookie")),
+			Wd:     int32(d.varint("watch descriptor")),
+		}
+	}
+	event.Path = d.string("path")
+	event.Name = d.string("name")
+	if flags&binaryHasDescriptor != 0 {
+		event.Descriptor = newWatchDescriptor(d.string("descriptor"), 0, -1)
+		event.Descriptor.WatchDescriptor = int(d.varint("descriptor watch descriptor"))
+		if event.RawEvent != nil {
+			event.Descriptor.Mask = event.RawEvent.Mask
+		}
+	}
+	if d.err != nil {
+		return d.err
+	}
+	if len(d.data) > 0 {
+		return fmt.Errorf("%s: %d trailing bytes", ErrEventEncoding, len(d.data))
+	}
+	*e = event
+	return nil
+}
+
+// EventWriter writes binary encoded events to a stream, each prefixed with its length as a varint
+type EventWriter struct {
+	w io.Writer
+}
+
+// NewEventWriter returns an EventWriter writing to w
+func NewEventWriter(w io.Writer) *EventWriter {
+	return &EventWriter{w: w}
+}
+
+// Write writes event to the stream
+func (ew *EventWriter) Write(event *FsEvent) error {
+	data, err := event.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	_, err = ew.w.Write(append(appendUvarint(make([]byte, 0, len(data)+3), uint64(len(data))), data...))
+	return err
+}
+
+// EventReader reads events written by an EventWriter
+type EventReader struct {
+	r *bufio.Reader
+}
+
+// NewEventReader returns an EventReader reading from r
+func NewEventReader(r io.Reader) *EventReader {
+	return &EventReader{r: bufio.NewReader(r)}
+}
+
+// Read returns the next event of the stream. It returns io.EOF at the end of the stream, and io.ErrUnexpectedEOF
+// if it ends within an event
+func (er *EventReader) Read() (*FsEvent, error) {
+	length, err := binary.ReadUvarint(er.r)
+	if err != nil {
+		if err == io.EOF {
+			return nil, io.EOF
+		}
+		if err == io.ErrUnexpectedEOF {
+			return nil, err
+		}
+		return nil, fmt.Errorf("%s: %s", ErrEventEncoding, err)
+	}
+	if length > maxEncodedEventSize {
+		return nil, fmt.Errorf("%s: event of %d bytes", ErrEventEncoding, length)
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(er.r, data); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	event := &FsEvent{}
+	if err := event.UnmarshalBinary(data); err != nil {
+		return nil, err
+	}
+	return event, nil
+}
@@ -0,0 +1,116 @@
+package fsevents_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	fsevents "github.com/tywkeene/go-fsevents"
+	"golang.org/x/sys/unix"
+)
+
+func encodingTestEvents() []*fsevents.FsEvent {
+	return []*fsevents.FsEvent{
+		{
+			Name:       "sub",
+			Path:       "/tmp/test/sub",
+			RawEvent:   &unix.InotifyEvent{Wd: 3, Mask: fsevents.MovedTo | fsevents.IsDir, Cookie: 42},
+			Descriptor: &fsevents.WatchDescriptor{Path: "/tmp/test", WatchDescriptor: 3, Mask: fsevents.MovedTo | fsevents.IsDir},
+			ID:         7,
+			Timestamp:  time.Date(2020, 1, 2, 3, 4, 5, 6, time.UTC),
+		},
+		// A synthetic event, without inotify event, descriptor or timestamp
+		{Name: "file", Path: "/tmp/test/file"},
+	}
+}
+
+// sameEvent returns true if a and b hold the same encoded fields
+func sameEvent(a *fsevents.FsEvent, b *fsevents.FsEvent) bool {
+	if a.Name != b.Name || a.Path != b.Path || a.ID != b.ID || !a.Timestamp.Equal(b.Timestamp) ||
+		!reflect.DeepEqual(a.RawEvent, b.RawEvent) || (a.Descriptor == nil) != (b.Descriptor == nil) {
+		return false
+	}
+	return a.Descriptor == nil || (a.Descriptor.Path == b.Descriptor.Path && a.Descriptor.WatchDescriptor == b.Descriptor.WatchDescriptor)
+}
+
+func TestEventJSON(t *testing.T) {
+	events := encodingTestEvents()
+	data, err := json.Marshal(events[0])
+	assert(t, (err == nil), err)
+	expected := `{"v":1,"id":7,"path":"/tmp/test/sub","name":"sub","ops":["MOVED_TO"],"is_dir":true,"cookie":42,"wd":3,` +
+		`"descriptor":"/tmp/test","timestamp":"2020-01-02T03:04:05.000000006Z"}`
+	assert(t, (string(data) == expected), fmt.Errorf("unexpected encoding %s", data))
+
+	for _, event := range events {
+		data, err := json.Marshal(*event)
+		assert(t, (err == nil), err)
+		decoded := &fsevents.FsEvent{}
+		assert(t, (json.Unmarshal(data, decoded) == nil), fmt.Errorf("Unmarshal should not have returned an error"))
+		assert(t, (sameEvent(event, decoded)), fmt.Errorf("%s did not round-trip, got %+v", data, decoded))
+	}
+
+	for _, data := range []string{`{"v":2,"path":"/tmp"}`, `{"path":"/tmp"}`} {
+		err = json.Unmarshal([]byte(data), &fsevents.FsEvent{})
+		assert(t, (err != nil && strings.HasPrefix(err.Error(), fsevents.ErrEventVersion.Error())), fmt.Errorf("%s should have been rejected, got %v", data, err))
+	}
+	err = json.Unmarshal([]byte(`{"v":1,"ops":["CREATE","TELEPORT"]}`), &fsevents.FsEvent{})
+	assert(t, (err != nil && strings.HasPrefix(err.Error(), fsevents.ErrUnknownOp.Error())), fmt.Errorf("an unknown op should have been rejected, got %v", err))
+}
+
+func TestOpNames(t *testing.T) {
+	mask := fsevents.Create | fsevents.CloseWrite | fsevents.IsDir | 0x8000000
+	names := fsevents.OpNames(mask)
+	assert(t, (strings.Join(names, " ") == "CLOSE_WRITE CREATE 0x8000000"), fmt.Errorf("unexpected names %v", names))
+	parsed, err := fsevents.ParseOpNames(names)
+	assert(t, (err == nil && parsed == mask&^fsevents.IsDir), fmt.Errorf("the names should have parsed back, got %#x %v", parsed, err))
+}
+
+func TestEventBinary(t *testing.T) {
+	for _, event := range encodingTestEvents() {
+		data, err := event.MarshalBinary()
+		assert(t, (err == nil), err)
+		decoded := &fsevents.FsEvent{}
+		assert(t, (decoded.UnmarshalBinary(data) == nil), fmt.Errorf("UnmarshalBinary should not have returned an error"))
+		assert(t, (sameEvent(event, decoded)), fmt.Errorf("%x did not round-trip, got %+v", data, decoded))
+
+		// Every truncation is reported as an error
+		for i := 0; i < len(data); i++ {
+			err := decoded.UnmarshalBinary(data[:i])
+			assert(t, (err != nil && strings.HasPrefix(err.Error(), fsevents.ErrEventEncoding.Error())),
+				fmt.Errorf("the encoding truncated to %d bytes should have been rejected, got %v", i, err))
+		}
+	}
+	for _, version := range []byte{0, fsevents.EventEncodingVersion + 1} {
+		err := (&fsevents.FsEvent{}).UnmarshalBinary([]byte{version, 0, 0})
+		assert(t, (err != nil && strings.HasPrefix(err.Error(), fsevents.ErrEventVersion.Error())), fmt.Errorf("version %d should have been rejected, got %v", version, err))
+	}
+}
+
+func TestEventStream(t *testing.T) {
+	events := encodingTestEvents()
+	stream := &bytes.Buffer{}
+	writer := fsevents.NewEventWriter(stream)
+	for _, event := range events {
+		assert(t, (writer.Write(event) == nil), fmt.Errorf("Write should not have returned an error"))
+	}
+	encoded := stream.Bytes()
+
+	reader := fsevents.NewEventReader(bytes.NewReader(encoded))
+	for _, event := range events {
+		decoded, err := reader.Read()
+		assert(t, (err == nil && sameEvent(event, decoded)), fmt.Errorf("the stream did not round-trip, got %+v %v", decoded, err))
+	}
+	_, err := reader.Read()
+	assert(t, (err == io.EOF), fmt.Errorf("expected io.EOF at the end of the stream, got %v", err))
+
+	reader = fsevents.NewEventReader(bytes.NewReader(encoded[:len(encoded)-1]))
+	_, err = reader.Read()
+	assert(t, (err == nil), err)
+	_, err = reader.Read()
+	assert(t, (err == io.ErrUnexpectedEOF), fmt.Errorf("expected io.ErrUnexpectedEOF within an event, got %v", err))
+}
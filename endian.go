@@ -0,0 +1,17 @@
+package fsevents
+
+import (
+	"encoding/binary"
+	"unsafe"
+)
+
+// Byte order of the structures read from the kernel, such as inotify events and directory entries: the one of
+// the host
+var nativeEndian binary.ByteOrder = binary.LittleEndian
+
+func init() {
+	probe := uint16(1)
+	if *(*byte)(unsafe.Pointer(&probe)) == 0 {
+		nativeEndian = binary.BigEndian
+	}
+}
@@ -0,0 +1,170 @@
+package fsevents_test
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	fsevents "github.com/tywkeene/go-fsevents"
+	"golang.org/x/sys/unix"
+)
+
+// flagsTestWatcher returns a Watcher whose ReadSingleEvent is released by Close, so that tests expecting no event
+// do not leave a goroutine blocked in read(2)
+func flagsTestWatcher(t *testing.T) *fsevents.Watcher {
+	w, err := fsevents.NewWatcher(fsevents.WithInitFlags(unix.IN_CLOEXEC | unix.IN_NONBLOCK))
+	assert(t, (err == nil), err)
+	return w
+}
+
+func TestOnlyDirFlag(t *testing.T) {
+	setupDirs([]string{testRootDir})
+	defer teardownDirs([]string{testRootDir})
+	w := flagsTestWatcher(t)
+	defer w.Close()
+
+	file := path.Join(testRootDir, "file")
+	writeRandomFile(file)
+	d, err := w.AddDescriptorWithFlags(file, fsevents.AllEvents, fsevents.OnlyDir)
+	assert(t, (err == nil), err)
+	assert(t, (d.Start() != nil), fmt.Errorf("Start should have refused to watch a file with OnlyDir"))
+
+	d, err = w.AddDescriptorWithFlags(testRootDir, fsevents.AllEvents, fsevents.OnlyDir)
+	assert(t, (err == nil), err)
+	assert(t, (d.Start() == nil), fmt.Errorf("Start should have watched a directory with OnlyDir"))
+}
+
+func TestDontFollowFlag(t *testing.T) {
+	target := path.Join(testRootDir, "target")
+	setupDirs([]string{testRootDir, target})
+	defer teardownDirs([]string{testRootDir})
+	w := flagsTestWatcher(t)
+	defer w.Close()
+
+	link := path.Join(testRootDir, "link")
+	assert(t, (os.Symlink("target", link) == nil), fmt.Errorf("could not create symlink"))
+	d, err := w.AddDescriptorWithFlags(link, fsevents.Create|fsevents.AttrChange, fsevents.DontFollow)
+	assert(t, (err == nil), err)
+	assert(t, (d.Start() == nil), fmt.Errorf("Start should not have returned an error"))
+
+	// The link itself is watched, not the directory it points to
+	writeRandomFile(path.Join(target, "file"))
+	assert(t, (unix.Lchown(link, os.Getuid(), os.Getgid()) == nil), fmt.Errorf("could not change the link's owner"))
+	event, err := readSingleEventTimeout(w, time.Second)
+	assert(t, (err == nil), err)
+	assert(t, (fsevents.CheckMask(fsevents.AttrChange, event.RawEvent.Mask) && event.Name == ""),
+		fmt.Errorf("expected an attribute change of the link itself, got %q %#x", event.Name, event.RawEvent.Mask))
+}
+
+func TestExclUnlinkFlag(t *testing.T) {
+	for _, flags := range []uint32{0, fsevents.ExclUnlink} {
+		setupDirs([]string{testRootDir})
+		w := flagsTestWatcher(t)
+
+		file := path.Join(testRootDir, "unlinked")
+		fd, err := os.Create(file)
+		assert(t, (err == nil), err)
+		d, err := w.AddDescriptorWithFlags(testRootDir, fsevents.Modified, flags)
+		assert(t, (err == nil), err)
+		assert(t, (d.Start() == nil), fmt.Errorf("Start should not have returned an error"))
+
+		// Written to after it was unlinked from the directory
+		os.Remove(file)
+		fd.Write([]byte("data"))
+		fd.Close()
+		_, err = readSingleEventTimeout(w, 200*time.Millisecond)
+		if flags == 0 {
+			assert(t, (err == nil), fmt.Errorf("the write should have been reported without ExclUnlink: %s", err))
+		} else {
+			assert(t, (err != nil), fmt.Errorf("the write should not have been reported with ExclUnlink"))
+		}
+		w.Close()
+		teardownDirs([]string{testRootDir})
+	}
+}
+
+func TestOneShotFlag(t *testing.T) {
+	setupDirs([]string{testRootDir})
+	defer teardownDirs([]string{testRootDir})
+	w := flagsTestWatcher(t)
+	defer w.Close()
+
+	d, err := w.AddDescriptorWithFlags(testRootDir, fsevents.CloseWrite, fsevents.OneShot)
+	assert(t, (err == nil), err)
+	assert(t, (d.Start() == nil), fmt.Errorf("Start should not have returned an error"))
+
+	writeRandomFile(path.Join(testRootDir, "first"))
+	event, err := readSingleEventTimeout(w, time.Second)
+	assert(t, (err == nil && event.Name == "first"), fmt.Errorf("the first event should have been reported: %v", err))
+	assert(t, (!d.Running), fmt.Errorf("the descriptor should have been marked not running after its event"))
+	assert(t, (w.GetRunningDescriptors() == 0), fmt.Errorf("the Watcher should have no running descriptors"))
+
+	writeRandomFile(path.Join(testRootDir, "second"))
+	event, err = readSingleEventTimeout(w, 200*time.Millisecond)
+	assert(t, (err != nil || fsevents.CheckMask(fsevents.Ignored, event.RawEvent.Mask)),
+		fmt.Errorf("no event should have been reported after the first, got %q", event.Name))
+}
+
+func TestMaskAddFlag(t *testing.T) {
+	setupDirs([]string{testRootDir})
+	defer teardownDirs([]string{testRootDir})
+	w := flagsTestWatcher(t)
+	defer w.Close()
+
+	// A watch of the same directory on the same inotify instance, made outside of the Watcher
+	_, err := unix.InotifyAddWatch(w.InotifyDescriptor, testRootDir, unix.IN_DELETE)
+	assert(t, (err == nil), err)
+	d, err := w.AddDescriptorWithFlags(testRootDir, fsevents.Create, fsevents.MaskAdd)
+	assert(t, (err == nil), err)
+	assert(t, (d.Start() == nil), fmt.Errorf("Start should not have returned an error"))
+
+	file := path.Join(testRootDir, "file")
+	writeRandomFile(file)
+	os.Remove(file)
+	for _, mask := range []uint32{fsevents.Create, fsevents.Delete} {
+		event, err := readSingleEventTimeout(w, time.Second)
+		assert(t, (err == nil), err)
+		assert(t, (fsevents.CheckMask(mask, event.RawEvent.Mask)), fmt.Errorf("expected event %#x, got %#x", mask, event.RawEvent.Mask))
+	}
+}
+
+func TestMaskCreateFlag(t *testing.T) {
+	setupDirs([]string{testRootDir})
+	defer teardownDirs([]string{testRootDir})
+	w := flagsTestWatcher(t)
+	defer w.Close()
+
+	d, err := w.AddDescriptorWithFlags(testRootDir, fsevents.Create, fsevents.MaskCreate)
+	assert(t, (err == nil), err)
+	assert(t, (d.Start() == nil), fmt.Errorf("Start should not have returned an error"))
+
+	// The same directory through another path
+	link := path.Join(os.TempDir(), fmt.Sprintf("fsevents-link-%d", os.Getpid()))
+	assert(t, (os.Symlink(path.Join(wd(t), testRootDir), link) == nil), fmt.Errorf("could not create symlink"))
+	defer os.Remove(link)
+	alias, err := w.AddDescriptorWithFlags(link, fsevents.Delete, fsevents.MaskCreate)
+	assert(t, (err == nil), err)
+	err = alias.Start()
+	assert(t, (err != nil && strings.HasPrefix(err.Error(), fsevents.ErrAlreadyWatched.Error())),
+		fmt.Errorf("Start should have returned ErrAlreadyWatched, got %v", err))
+
+	// Watched outside of the Watcher's bookkeeping: the kernel reports EEXIST
+	other := path.Join(testRootDir, "other")
+	setupDirs([]string{other})
+	_, err = unix.InotifyAddWatch(w.InotifyDescriptor, other, unix.IN_DELETE)
+	assert(t, (err == nil), err)
+	d, err = w.AddDescriptorWithFlags(other, fsevents.Create, fsevents.MaskCreate)
+	assert(t, (err == nil), err)
+	err = d.Start()
+	assert(t, (err != nil && strings.HasPrefix(err.Error(), fsevents.ErrAlreadyWatched.Error())),
+		fmt.Errorf("Start should have returned ErrAlreadyWatched, got %v", err))
+}
+
+func wd(t *testing.T) string {
+	dir, err := os.Getwd()
+	assert(t, (err == nil), err)
+	return dir
+}
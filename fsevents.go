@@ -3,16 +3,15 @@
 package fsevents
 
 import (
+	"context"
 	"errors"
 	"fmt"
-	"io/ioutil"
 	"os"
 	"path"
-	"strings"
+	"sort"
 	"sync"
 	"sync/atomic"
 	"time"
-	"unsafe"
 
 	"golang.org/x/sys/unix"
 )
@@ -23,12 +22,22 @@ type WatchDescriptor struct {
 	Path string
 	// This descriptor's inotify watch mask
 	Mask uint32
+	// Watch flags passed to inotify along with Mask when the descriptor is started: OnlyDir, DontFollow, ExclUnlink,
+	// OneShot, MaskAdd and MaskCreate
+	Flags uint32
 	// This descriptor's inotify watch descriptor
 	WatchDescriptor int
 	// Is this watcher currently running?
 	Running bool
 	// InotifyDescriptor of the Watcher this WatchDescriptor belongs to
 	InotifyDescriptor *int
+	// Device and inode of the directory, used to recognize the same directory reached through different paths
+	Device uint64
+	Inode  uint64
+	// Type of the filesystem containing the directory
+	Filesystem FilesystemType
+	// The Watcher this WatchDescriptor belongs to, nil for synthetic descriptors
+	watcher *Watcher
 }
 
 // FsEvent is an inotify event along with the ID and timestamp of the event
@@ -63,6 +72,32 @@ type Watcher struct {
 	sync.Mutex
 	// List of EventHandles that have been registered with this Watcher
 	eventHandlers []EventHandler
+	// The EventHandlers wrapped in middleware, see chainHandlers
+	chainedHandlers []EventHandler
+	// Middleware wrapping every registered EventHandler, see Use
+	middleware []Middleware
+	// Runs EventHandlers on a pool of goroutines, see SetDispatcher. Nil if EventHandlers are called synchronously
+	dispatcher *Dispatcher
+	// Receivers of events, see Subscribe. Events are only sent on w.Events if there are none
+	subscriptions []*Subscription
+	// Protects subscriptions. Separate from the Watcher's lock, since publishing may block
+	subscriptionsLock sync.Mutex
+	// Settings given to NewWatcher
+	config watcherConfig
+	// BackendInotify, or BackendPoll if the Watcher has no inotify instance
+	backend Backend
+	// Set to 1 by Close
+	closed int32
+	// Events and errors dropped or coalesced, see Stats
+	stats Stats
+	// Events waiting for room in w.Events under BufferCoalesce
+	coalescer coalescer
+	// Last error reported under BufferCoalesce
+	lastError     string
+	lastErrorLock sync.Mutex
+	// Context cancelled by Close, see Context
+	ctx    context.Context
+	cancel context.CancelFunc
 	// Buffer of events received from inotify
 	eventBuffer [unix.SizeofInotifyEvent + unix.PathMax + 1]byte
 	// Length of the event buffer that's been filled by the last read
@@ -71,15 +106,41 @@ type Watcher struct {
 	eventBufferOff int
 	// The main inotify descriptor
 	InotifyDescriptor int
+	// Eventfd written to by Close, which wakes up ReadSingleEvent while it waits for events
+	closeDescriptor int
 	// Watch descriptors in this watch key: watch path -> value: WatchDescriptor
 	Descriptors map[string]*WatchDescriptor
 	// How many events have been read by this watcher from the inotify descriptor
 	// This counter is incremented in ReadSingleEvent
 	EventCount uint32
-	// The event channel we send all events on
+	// The event channel we send all events on, unbuffered unless WithEventBuffer is given to NewWatcher
 	Events chan *FsEvent
-	// How we report errors
+	// How we report errors, unless WithErrorHandler is given to NewWatcher
 	Errors chan error
+	// Maximum number of inotify watches this Watcher may hold. Zero means only the kernel limits apply
+	WatchBudget int
+	// How often directory trees watched by polling are scanned for changes
+	PollInterval time.Duration
+	// Watch directories on filesystems where inotify is unreliable by polling when adding trees recursively
+	PollUnreliable bool
+	// Devices for which ErrUnreliableFilesystem was already reported
+	warnedDevices map[uint64]bool
+	// Types of the filesystems of the devices watched so far, key: device
+	filesystems map[uint64]FilesystemType
+	// Scans directory trees that could not be watched with inotify
+	poller *poller
+	// Set to 1 while WatchAndHandle is running
+	handling int32
+	// Number of running descriptors sharing each kernel watch, key: device and inode of the watched directory
+	watchRefs map[fileID]int
+	// Protects watchRefs. Separate from the Watcher's lock, since descriptors are started and stopped while it is held
+	watchRefsLock sync.Mutex
+	// Events for the other paths of a directory that is watched through several paths,
+	// returned by ReadSingleEvent before reading more from the inotify descriptor
+	pendingEvents []*FsEvent
+	// Views of watched trees kept up to date with the events read, see NewTreeView
+	views     []*TreeView
+	viewsLock sync.Mutex
 }
 
 var (
@@ -90,6 +151,18 @@ var (
 	ErrWatchNotCreated      = errors.New("watcher could not be created")
 	ErrNoRunningDescriptors = errors.New("watcher has no running descriptors")
 	ErrNoEventHandles       = errors.New("watcher has no registered event handles")
+	ErrWatchBudget          = errors.New("not enough inotify watches available")
+	ErrLimitsNotRead        = errors.New("inotify limits could not be read")
+
+	ErrWatcherClosed = errors.New("watcher closed")
+	ErrPollBackend   = errors.New("watcher uses the poll backend, use AddPollWatch")
+
+	ErrDescLoop             = errors.New("directory is its own ancestor")
+	ErrUnreliableFilesystem = errors.New("inotify does not report every change on this filesystem")
+
+	// Polling errors
+	ErrPollExists   = errors.New("a poll watch for that directory already exists")
+	ErrPollNotFound = errors.New("poll watch not found")
 
 	//Descriptor errors
 	ErrDescNotCreated       = errors.New("descriptor could not be created")
@@ -98,6 +171,7 @@ var (
 	ErrDescNotStopped       = errors.New("descriptor could not be stopped")
 	ErrDescAlreadyExists    = errors.New("descriptor for that directory already exists")
 	ErrDescNotRunning       = errors.New("descriptor not running")
+	ErrAlreadyWatched       = errors.New("directory already watched by this watcher")
 	ErrDescForEventNotFound = errors.New("descriptor for event not found")
 	ErrDescNotFound         = errors.New("descriptor not found")
 
@@ -109,6 +183,7 @@ var (
 	//Inotify interface errors
 	ErrIncompleteRead = errors.New("incomplete event read")
 	ErrReadError      = errors.New("error reading an event")
+	ErrQueueOverflow  = errors.New("inotify event queue overflowed, events were lost")
 )
 
 var (
@@ -127,6 +202,23 @@ var (
 	RootDelete uint32 = unix.IN_DELETE_SELF
 	RootMove   uint32 = unix.IN_MOVE_SELF
 	IsDir      uint32 = unix.IN_ISDIR
+	Unmount    uint32 = unix.IN_UNMOUNT
+	Ignored    uint32 = unix.IN_IGNORED
+
+	// Watch flags, changing how a watch behaves rather than which events it reports. See WatchDescriptor.Flags
+
+	// Only watch the path if it is a directory
+	OnlyDir uint32 = unix.IN_ONLYDIR
+	// Do not follow the path if it is a symbolic link, and watch the link itself
+	DontFollow uint32 = unix.IN_DONT_FOLLOW
+	// Do not report events for files after they were unlinked from the directory
+	ExclUnlink uint32 = unix.IN_EXCL_UNLINK
+	// Report a single event, after which the kernel removes the watch
+	OneShot uint32 = unix.IN_ONESHOT
+	// Add the mask to that of an existing watch of the same directory instead of replacing it
+	MaskAdd uint32 = unix.IN_MASK_ADD
+	// Fail with ErrAlreadyWatched if the directory is already watched, instead of changing the existing watch
+	MaskCreate uint32 = unix.IN_MASK_CREATE
 
 	AllEvents = (Accessed | Modified | AttrChange | CloseWrite | CloseRead | Open | MovedFrom |
 		MovedTo | MovedTo | Create | Delete | RootDelete | RootMove | IsDir)
@@ -192,6 +284,13 @@ func (e *FsEvent) IsRootMoved(rootPath string) bool {
 	return CheckMask(RootMove, e.RawEvent.Mask) && (rootPath == e.Path)
 }
 
+// IsUnmount returns true if the event contains the inotify flag IN_UNMOUNT, meaning the filesystem
+// containing the watched directory was unmounted. The kernel removes the watch, and the descriptor is no
+// longer running by the time the event is returned.
+func (e *FsEvent) IsUnmount() bool {
+	return CheckMask(Unmount, e.RawEvent.Mask)
+}
+
 // Custom directory events
 
 // IsDirChanged returns true if the event describes a directory that
@@ -212,7 +311,7 @@ func (e *FsEvent) IsDirCreated() bool {
 }
 
 // IsDirRemoved returns true if the event describes a directory that was
-//deleted or moved out of the root watch directory
+// deleted or moved out of the root watch directory
 func (e *FsEvent) IsDirRemoved() bool {
 	return e.IsDirEvent() &&
 		(CheckMask(Delete, e.RawEvent.Mask) ||
@@ -256,25 +355,65 @@ func newWatchDescriptor(dirPath string, mask uint32, inotifyDescriptor int) *Wat
 }
 
 // Start starts a WatchDescriptor inotify event watcher. If the descriptor is already running Start returns ErrDescRunning
+// If another running descriptor of the same Watcher watches the same directory through a different path,
+// both share the kernel watch, whose mask is extended to include this descriptor's mask.
 func (d *WatchDescriptor) Start() error {
+	if d.watcher != nil {
+		d.watcher.Lock()
+		defer d.watcher.Unlock()
+	}
+	return d.start()
+}
+
+// start starts d. The Watcher's lock must be held
+func (d *WatchDescriptor) start() error {
 	var err error
 	if d.Running {
 		return ErrDescRunning
 	}
-	d.WatchDescriptor, err = unix.InotifyAddWatch(*d.InotifyDescriptor, d.Path, d.Mask)
+	mask := d.Mask | d.Flags
+	if d.watcher != nil && d.watcher.watchShared(d) {
+		if CheckMask(MaskCreate, mask) {
+			return fmt.Errorf("%s: %q", ErrAlreadyWatched, d.Path)
+		}
+		mask |= unix.IN_MASK_ADD
+	}
+	d.WatchDescriptor, err = unix.InotifyAddWatch(*d.InotifyDescriptor, d.Path, mask)
 	if d.WatchDescriptor == -1 || err != nil {
 		d.Running = false
-		return fmt.Errorf("%s: %s", ErrDescNotStart, err)
+		if err == unix.EEXIST && CheckMask(MaskCreate, mask) {
+			return fmt.Errorf("%s: %q", ErrAlreadyWatched, d.Path)
+		}
+		// The errno is kept, for errors.Is
+		return fmt.Errorf("%s: %w", ErrDescNotStart, err)
+	}
+	if d.watcher != nil {
+		d.watcher.refWatch(d)
 	}
 	d.Running = true
 	return nil
 }
 
 // Stop stops a running watch descriptor. If the descriptor is not running Stop returns ErrDescNotRunning
+// The kernel watch is only removed once no other running descriptor shares it. It keeps the mask of d meanwhile,
+// but the descriptors still sharing it only receive the events of their own masks.
 func (d *WatchDescriptor) Stop() error {
+	if d.watcher != nil {
+		d.watcher.Lock()
+		defer d.watcher.Unlock()
+	}
+	return d.stop()
+}
+
+// stop stops d. The Watcher's lock must be held
+func (d *WatchDescriptor) stop() error {
 	if !d.Running {
 		return ErrDescNotRunning
 	}
+	if d.watcher != nil && d.watcher.unrefWatch(d) > 0 {
+		d.Running = false
+		return nil
+	}
 	_, err := unix.InotifyRmWatch(*d.InotifyDescriptor, uint32(d.WatchDescriptor))
 	if err != nil {
 		return fmt.Errorf("%s: %s", ErrDescNotStopped, err)
@@ -286,7 +425,7 @@ func (d *WatchDescriptor) Stop() error {
 // DoesPathExist returns true if the path described by the descriptor exists
 func (d *WatchDescriptor) DoesPathExist() bool {
 	_, err := os.Lstat(d.Path)
-	return os.IsExist(err)
+	return err == nil
 }
 
 // DescriptorExists returns true if a WatchDescriptor exists in Watcher w, false otherwise
@@ -320,8 +459,9 @@ func (w *Watcher) RemoveDescriptor(path string) error {
 	w.Lock()
 	defer w.Unlock()
 	descriptor := w.Descriptors[path]
-	if descriptor.DoesPathExist() {
-		if err := descriptor.Stop(); err != nil {
+	if descriptor.Running {
+		// If the directory is gone the kernel already removed the watch
+		if err := descriptor.stop(); err != nil && descriptor.DoesPathExist() {
 			return err
 		}
 	}
@@ -330,15 +470,43 @@ func (w *Watcher) RemoveDescriptor(path string) error {
 }
 
 // AddDescriptor adds a descriptor to Watcher w. The descriptor is not started.
+// A mask of zero watches the events of the Watcher's default mask, AllEvents unless set with WithDefaultMask.
 func (w *Watcher) AddDescriptor(dirPath string, mask uint32) (*WatchDescriptor, error) {
-	if _, err := os.Stat(dirPath); os.IsNotExist(err) {
+	return w.AddDescriptorWithFlags(dirPath, mask, 0)
+}
+
+// AddDescriptorWithFlags adds a descriptor like AddDescriptor, which inotify watches with the watch flags in flags.
+// See WatchDescriptor.Flags
+func (w *Watcher) AddDescriptorWithFlags(dirPath string, mask uint32, flags uint32) (*WatchDescriptor, error) {
+	id, err := (&WatchDescriptor{Path: dirPath, Flags: flags}).statFileID()
+	if os.IsNotExist(err) {
 		return nil, fmt.Errorf("%s: %s", ErrDescNotCreated, "directory does not exist")
 	}
+	return w.addDescriptor(dirPath, mask, flags, id)
+}
+
+// addDescriptor adds a descriptor for dirPath, whose identity id was already looked up, zero if it is unknown
+func (w *Watcher) addDescriptor(dirPath string, mask uint32, flags uint32, id fileID) (*WatchDescriptor, error) {
 	if w.DescriptorExists(dirPath) {
 		return nil, ErrDescAlreadyExists
 	}
+	if w.backend == BackendPoll {
+		return nil, ErrPollBackend
+	}
+	if mask == 0 {
+		mask = w.config.defaultMask
+	}
 
 	descriptor := newWatchDescriptor(dirPath, mask, w.InotifyDescriptor)
+	descriptor.Flags = flags
+	descriptor.watcher = w
+	descriptor.Device, descriptor.Inode = id.dev, id.ino
+	if fstype, err := w.filesystem(dirPath, id); err == nil {
+		descriptor.Filesystem = fstype
+		if !fstype.Reliable() {
+			w.warnUnreliable(descriptor)
+		}
+	}
 
 	w.Lock()
 	w.Descriptors[dirPath] = descriptor
@@ -347,52 +515,96 @@ func (w *Watcher) AddDescriptor(dirPath string, mask uint32) (*WatchDescriptor,
 	return descriptor, nil
 }
 
-// RecursiveAdd adds the directory at rootPath, and all directories below it, using the flags provided in mask
+// RecursiveAdd adds the directory at rootPath, and all directories below it, using the flags provided in mask.
+// RecursiveAdd stops at the first directory that cannot be added, leaving the descriptors already added in place.
+// Use RecursiveAddWithOptions to skip such directories or to roll back on failure.
 func (w *Watcher) RecursiveAdd(rootPath string, mask uint32) error {
-	dirStat, err := ioutil.ReadDir(rootPath)
-	if err != nil {
-		return err
-	}
-
-	rootDirDesc, err := w.AddDescriptor(rootPath, mask)
-	if err != nil {
-		return err
-	}
-
-	if err := rootDirDesc.Start(); err != nil {
-		return err
-	}
+	_, err := w.RecursiveAddWithOptions(rootPath, mask, w.config.recursive)
+	return err
+}
 
-	for _, child := range dirStat {
-		if child.IsDir() {
-			childPath := path.Clean(path.Join(rootPath, child.Name()))
-			if err := w.RecursiveAdd(childPath, mask); err != nil {
-				return fmt.Errorf("could not add recurisve-descriptor for path %q: %s", childPath, err.Error())
+// NewWatcher allocates a new watcher and initializes an inotify descriptor and the w.Events and w.Error channels,
+// so it should be ran before running descriptor.Start(). The Watcher is configured by opts, if any.
+func NewWatcher(opts ...Option) (*Watcher, error) {
+	config := defaultConfig()
+	for _, opt := range opts {
+		opt(&config)
+	}
+
+	fd, closeFd, backend := -1, -1, BackendPoll
+	if config.backend != BackendPoll {
+		var err error
+		fd, err = unix.InotifyInit1(config.initFlags)
+		if fd == -1 || err != nil {
+			if config.backend != BackendAuto {
+				return nil, fmt.Errorf("%s: %s", ErrWatchNotCreated, err)
 			}
+			fd = -1
+		} else {
+			backend = BackendInotify
 		}
 	}
-	return nil
-}
-
-// NewWatcher allocates a new watcher and initializes an inotify descriptor and the w.Events and w.Error channels,
-// so it should be ran before running descriptor.Start()
-func NewWatcher() (*Watcher, error) {
-	fd, err := unix.InotifyInit()
-	if fd == -1 || err != nil {
-		return nil, fmt.Errorf("%s: %s", ErrWatchNotCreated, err)
+	if fd != -1 {
+		var err error
+		closeFd, err = unix.Eventfd(0, unix.EFD_CLOEXEC|unix.EFD_NONBLOCK)
+		if err != nil {
+			unix.Close(fd)
+			return nil, fmt.Errorf("%s: %s", ErrWatchNotCreated, err)
+		}
 	}
 
+	ctx, cancel := context.WithCancel(context.Background())
 	w := &Watcher{
+		ctx:               ctx,
+		cancel:            cancel,
 		eventHandlers:     make([]EventHandler, 0),
 		InotifyDescriptor: fd,
+		closeDescriptor:   closeFd,
 		Descriptors:       make(map[string]*WatchDescriptor),
-		Events:            make(chan *FsEvent),
-		Errors:            make(chan error),
+		Events:            make(chan *FsEvent, config.eventBuffer),
+		Errors:            make(chan error, config.errorBuffer),
+		config:            config,
+		PollInterval:      DefaultPollInterval,
+		PollUnreliable:    config.backend == BackendAuto,
+		watchRefs:         make(map[fileID]int),
+		backend:           backend,
 	}
 
 	return w, nil
 }
 
+// Close stops every watch of the Watcher, including poll watches, and closes its inotify descriptor,
+// releasing it against the user's max_user_instances. It also cancels the Watcher's Context and closes its
+// subscriptions. A ReadSingleEvent waiting for events, such as that of Watch or WatchAndHandle, returns
+// ErrWatcherClosed. The Watcher cannot be used after Close.
+func (w *Watcher) Close() error {
+	if !atomic.CompareAndSwapInt32(&w.closed, 0, 1) {
+		// The descriptors SHOULD NOT be closed twice, their numbers may have been reused since
+		return nil
+	}
+	if w.cancel != nil {
+		w.cancel()
+	}
+	w.SetDispatcher(nil)
+	w.unsubscribeAll()
+	for _, root := range w.ListPollWatches() {
+		w.RemovePollWatch(root)
+	}
+	// Closing the inotify descriptor removes all of its watches
+	w.Lock()
+	for _, d := range w.Descriptors {
+		d.Running = false
+	}
+	w.Unlock()
+	if w.InotifyDescriptor < 0 {
+		return nil
+	}
+	// Wakes up ReadSingleEvent, which polls the eventfd along with the inotify descriptor
+	unix.Write(w.closeDescriptor, []byte{1, 0, 0, 0, 0, 0, 0, 0})
+	unix.Close(w.closeDescriptor)
+	return unix.Close(w.InotifyDescriptor)
+}
+
 // GetRunningDescriptors returns the count of currently running or Start()'d descriptors for this watcher.
 func (w *Watcher) GetRunningDescriptors() int32 {
 	w.Lock()
@@ -411,7 +623,7 @@ func (w *Watcher) StartAll() error {
 	w.Lock()
 	defer w.Unlock()
 	for _, d := range w.Descriptors {
-		if err := d.Start(); err != nil {
+		if err := d.start(); err != nil {
 			return err
 		}
 	}
@@ -424,7 +636,7 @@ func (w *Watcher) StopAll() error {
 	defer w.Unlock()
 	for _, d := range w.Descriptors {
 		if d.Running {
-			if err := d.Stop(); err != nil {
+			if err := d.stop(); err != nil {
 				return err
 			}
 		}
@@ -466,56 +678,205 @@ func (w *Watcher) GetEventCount() uint32 {
 	return atomic.LoadUint32(&w.EventCount)
 }
 
+// getDescriptorsByWatch returns every running descriptor sharing the inotify watch descriptor wd, sorted by path.
+// If none of them is running, such as for the IN_IGNORED event following Stop, the stopped ones are returned.
+// The Watcher's lock must be held
+func (w *Watcher) getDescriptorsByWatch(wd int) []*WatchDescriptor {
+	descriptors := make([]*WatchDescriptor, 0, 1)
+	stopped := make([]*WatchDescriptor, 0)
+	for _, d := range w.Descriptors {
+		if d.WatchDescriptor != wd {
+			continue
+		}
+		if d.Running {
+			descriptors = append(descriptors, d)
+		} else {
+			stopped = append(stopped, d)
+		}
+	}
+	if len(descriptors) == 0 {
+		descriptors = stopped
+	}
+	sort.Slice(descriptors, func(i, j int) bool { return descriptors[i].Path < descriptors[j].Path })
+	return descriptors
+}
+
 // ReadSingleEvent reads and returns a single event from the watch descriptor.
+// If the watched directory is watched through several paths, an event is returned for each path whose descriptor's
+// mask includes it, one per call.
 func (w *Watcher) ReadSingleEvent() (*FsEvent, error) {
-	if w.eventBufferOff == w.eventBufferLen {
-		bytesRead, err := unix.Read(w.InotifyDescriptor, w.eventBuffer[:])
+	for len(w.pendingEvents) == 0 {
+		if w.eventBufferOff == w.eventBufferLen {
+			// Waiting in read(2) could not be interrupted by Close
+			if err := w.waitReadable(); err != nil {
+				return nil, err
+			}
+			bytesRead, err := unix.Read(w.InotifyDescriptor, w.eventBuffer[:])
+			if err == unix.EAGAIN {
+				// Opened with IN_NONBLOCK, and there was nothing to read after all
+				continue
+			}
+			if err != nil {
+				if atomic.LoadInt32(&w.closed) == 1 {
+					return nil, ErrWatcherClosed
+				}
+				return nil, fmt.Errorf("%s: %s", ErrReadError.Error(), err)
+			}
+			w.eventBufferLen = bytesRead
+			w.eventBufferOff = 0
+		}
+
+		// The record is copied out of the buffer, which is overwritten by the next read
+		record, err := DecodeEvent(w.eventBuffer[:w.eventBufferLen], w.eventBufferOff)
 		if err != nil {
-			return nil, fmt.Errorf("%s: %s", ErrReadError.Error(), err)
+			// The rest of the buffer cannot be decoded either. The sentinel is returned as is, so that callers
+			// can compare it, and the *DecodeError describing the buffer is logged
+			w.eventBufferOff = w.eventBufferLen
+			w.logf("fsevents: %s: %s", ErrIncompleteRead, err)
+			return nil, ErrIncompleteRead
+		}
+		rawEvent := record.Event
+		eventName := record.Name
+		w.eventBufferOff += record.Size
+
+		if CheckMask(unix.IN_Q_OVERFLOW, rawEvent.Mask) {
+			w.overflowViews()
+			return nil, ErrQueueOverflow
+		}
+		descriptors, err := w.eventDescriptors(&rawEvent)
+		if err != nil {
+			return nil, err
 		}
-		w.eventBufferLen = bytesRead
-		w.eventBufferOff = 0
-	}
 
-	if w.eventBufferLen-w.eventBufferOff < unix.SizeofInotifyEvent {
-		return nil, ErrIncompleteRead
+		for _, descriptor := range descriptors {
+			raw := rawEvent
+			w.pendingEvents = append(w.pendingEvents, &FsEvent{
+				Name:       eventName,
+				Path:       path.Clean(path.Join(descriptor.Path, eventName)),
+				Descriptor: descriptor,
+				RawEvent:   &raw,
+				ID:         w.GetEventCount(),
+				Timestamp:  w.now(),
+			})
+			w.incrementEventCount()
+		}
+		w.pendingEvents = w.filterEvents(w.pendingEvents)
 	}
 
-	rawEvent := (*unix.InotifyEvent)(unsafe.Pointer(&w.eventBuffer[w.eventBufferOff]))
+	event := w.pendingEvents[0]
+	w.pendingEvents = w.pendingEvents[1:]
+	w.updateViews(event)
+	return event, nil
+}
 
-	descriptor := w.GetDescriptorByWatch(int(rawEvent.Wd))
-	if descriptor == nil {
+// eventDescriptors returns the descriptors of the inotify watch of rawEvent that receive it, and marks them as
+// stopped if the kernel removed the watch. They are selected under the lock, since Stop and UpdateMask may
+// change them meanwhile.
+func (w *Watcher) eventDescriptors(rawEvent *unix.InotifyEvent) ([]*WatchDescriptor, error) {
+	w.Lock()
+	defer w.Unlock()
+	descriptors := w.getDescriptorsByWatch(int(rawEvent.Wd))
+	if len(descriptors) == 0 {
 		return nil, ErrDescForEventNotFound
 	}
+	if CheckMask(Ignored|Unmount, rawEvent.Mask) || oneShot(descriptors) {
+		// The kernel removed the watch, or is about to
+		w.watchRemoved(descriptors)
+	}
+
+	receivers := make([]*WatchDescriptor, 0, len(descriptors))
+	for _, descriptor := range descriptors {
+		if (len(descriptors) > 1 || !CheckMask(MaskAdd, descriptor.Flags)) &&
+			!CheckMask(descriptor.Mask|Ignored|Unmount, rawEvent.Mask&^IsDir) {
+			// A shared kernel watch includes the masks of the other descriptors, and keeps those of the
+			// descriptors stopped since. Only a descriptor alone with MaskAdd asked for the whole kernel mask
+			continue
+		}
+		receivers = append(receivers, descriptor)
+	}
+	return receivers, nil
+}
+
+// waitReadable waits until the inotify descriptor has events to read, or the Watcher is closed
+func (w *Watcher) waitReadable() error {
+	fds := []unix.PollFd{
+		{Fd: int32(w.InotifyDescriptor), Events: unix.POLLIN},
+		{Fd: int32(w.closeDescriptor), Events: unix.POLLIN},
+	}
+	for {
+		if atomic.LoadInt32(&w.closed) == 1 {
+			return ErrWatcherClosed
+		}
+		_, err := unix.Poll(fds, -1)
+		if err != nil && err != unix.EINTR {
+			return fmt.Errorf("%s: %s", ErrReadError.Error(), err)
+		}
+		if atomic.LoadInt32(&w.closed) == 0 && fds[0].Revents != 0 {
+			// An error condition is left for read(2) to report
+			return nil
+		}
+	}
+}
 
-	bytes := (*[unix.PathMax]byte)(unsafe.Pointer(&w.eventBuffer[w.eventBufferOff+unix.SizeofInotifyEvent]))
-	eventName := strings.TrimRight(string(bytes[0:rawEvent.Len]), "\000")
-	eventPath := path.Clean(path.Join(descriptor.Path, eventName))
+// now returns the time to timestamp events with
+func (w *Watcher) now() time.Time {
+	if w.config.clock == nil {
+		return time.Now().UTC()
+	}
+	return w.config.clock.Now().UTC()
+}
 
-	event := &FsEvent{
-		Name:       eventName,
-		Path:       eventPath,
-		Descriptor: descriptor,
-		RawEvent:   rawEvent,
-		ID:         w.GetEventCount(),
-		Timestamp:  time.Now().UTC(),
+// filterEvents returns the events of list that pass every filter given to NewWatcher
+func (w *Watcher) filterEvents(list []*FsEvent) []*FsEvent {
+	if len(w.config.filters) == 0 {
+		return list
 	}
-	w.incrementEventCount()
-	w.eventBufferOff += unix.SizeofInotifyEvent + int(rawEvent.Len)
-	return event, nil
+	kept := list[:0]
+	for _, event := range list {
+		if w.passesFilters(event) {
+			kept = append(kept, event)
+		}
+	}
+	return kept
+}
+
+// passesFilters returns true if event passes every filter given to NewWatcher
+func (w *Watcher) passesFilters(event *FsEvent) bool {
+	for _, filter := range w.config.filters {
+		if !filter(event) {
+			return false
+		}
+	}
+	return true
+}
+
+// logf logs a message with the Logger given to NewWatcher, if any
+func (w *Watcher) logf(format string, v ...interface{}) {
+	if w.config.logger != nil {
+		w.config.logger.Printf(format, v...)
+	}
+}
+
+// Backend returns how the Watcher finds out about changes: BackendInotify, or BackendPoll if it has no inotify
+// instance, because of WithBackend or because BackendAuto could not create one
+func (w *Watcher) Backend() Backend {
+	return w.backend
 }
 
 // Watch calls ReadSingleEvent (which read-blocks) in a loop while there are running WatchDescriptors in Watcher w
-// Writes events and errors to the channels w.Errors and w.Events
+// Writes events and errors to the channels w.Errors and w.Events.
+// If w has subscriptions, events are published to them instead of w.Events, see Subscribe.
 func (w *Watcher) Watch() {
 	for w.GetRunningDescriptors() > 0 {
 		event, err := w.ReadSingleEvent()
-		if err != nil {
-			w.Errors <- err
+		if err == ErrWatcherClosed {
+			return
+		} else if err != nil {
+			w.reportError(err)
 			continue
 		}
 		if event != nil {
-			w.Events <- event
+			w.emit(event)
 		}
 	}
 }
@@ -532,6 +893,7 @@ func (w *Watcher) RegisterEventHandler(handle EventHandler) error {
 		}
 	}
 	w.eventHandlers = append(w.eventHandlers, handle)
+	w.chainHandlers()
 	return nil
 }
 
@@ -549,6 +911,7 @@ func (w *Watcher) UnregisterEventHandler(removeMask uint32) error {
 			} else {
 				w.eventHandlers = append(w.eventHandlers[:index], w.eventHandlers[index+1:]...)
 			}
+			w.chainHandlers()
 			return nil
 		}
 	}
@@ -559,7 +922,7 @@ func (w *Watcher) UnregisterEventHandler(removeMask uint32) error {
 func (w *Watcher) getEventHandle(event *FsEvent) EventHandler {
 	w.Lock()
 	defer w.Unlock()
-	for _, handle := range w.eventHandlers {
+	for _, handle := range w.chainedHandlers {
 		if handle.Check(event) {
 			return handle
 		}
@@ -573,31 +936,83 @@ func (w *Watcher) getEventHandle(event *FsEvent) EventHandler {
 // If there is no handle registered to handle a specific event in the Watcher, WatchAndHandle immediately writes
 // ErrNoSuchHandle to the w.Errors channel and returns.
 // If there are no running watch descriptors, WatchAndHandle immediately writes ErrNoRunningDescriptors to w.Errors and returns.
+// Poll watches count as running descriptors: while the Watcher only has poll watches, as with BackendPoll, their
+// events are handled from the polling goroutine and WatchAndHandle blocks until they are removed or w is closed.
 // If there are no registered EventHandles in the Watcher, WatchAndHandle immediately writes ErrNoEventHandles to w.Errors and returns.
+// EventHandlers are called from WatchAndHandle's goroutine, unless a Dispatcher was installed with SetDispatcher.
 func (w *Watcher) WatchAndHandle() {
-	for w.GetRunningDescriptors() > 0 && len(w.eventHandlers) > 0 {
+	atomic.StoreInt32(&w.handling, 1)
+	defer atomic.StoreInt32(&w.handling, 0)
+
+	for len(w.eventHandlers) > 0 {
+		if w.GetRunningDescriptors() == 0 {
+			// The events of poll watches are handled from the polling goroutine, through deliver, so only wait
+			// for the poll watches to be removed or the Watcher to be closed
+			if len(w.ListPollWatches()) == 0 || !sleep(w.ctx, w.PollInterval) {
+				break
+			}
+			continue
+		}
 		event, err := w.ReadSingleEvent()
-		if err != nil {
-			w.Errors <- err
+		if err == ErrWatcherClosed {
+			return
+		} else if err != nil {
+			w.reportError(err)
 			continue
 		}
 		if event != nil {
-			if h := w.getEventHandle(event); h != nil {
-				err := h.Handle(w, event)
-
-				if err != nil {
-					w.Errors <- errors.New(ErrHandleError.Error() + ": " + err.Error())
-				}
-			} else {
-				w.Errors <- fmt.Errorf("%s: event mask: %d", ErrNoSuchHandle, event.RawEvent.Mask)
-			}
+			w.handleEvent(event)
 		}
 	}
 
-	if w.GetRunningDescriptors() == 0 {
-		w.Errors <- ErrNoRunningDescriptors
+	if w.GetRunningDescriptors() == 0 && len(w.ListPollWatches()) == 0 {
+		w.reportError(ErrNoRunningDescriptors)
 	}
 	if len(w.eventHandlers) == 0 {
-		w.Errors <- ErrNoEventHandles
+		w.reportError(ErrNoEventHandles)
+	}
+}
+
+// handleEvent passes event to the Watcher's Dispatcher, or applies the EventHandler matching event if there is none
+func (w *Watcher) handleEvent(event *FsEvent) {
+	w.Lock()
+	d := w.dispatcher
+	w.Unlock()
+	if d == nil {
+		w.applyEventHandler(event)
+		return
+	}
+	switch err := d.dispatch(event); err {
+	case nil:
+	case ErrDispatcherStopped:
+		// Replaced by SetDispatcher in the meantime
+		w.applyEventHandler(event)
+	default:
+		w.tryReportError(err)
+	}
+}
+
+// applyEventHandler applies the EventHandler matching event, writing any error to w.Errors
+func (w *Watcher) applyEventHandler(event *FsEvent) {
+	if h := w.getEventHandle(event); h != nil {
+		if err := h.Handle(w, event); err != nil {
+			w.reportError(errors.New(ErrHandleError.Error() + ": " + err.Error()))
+		}
+	} else {
+		w.reportError(fmt.Errorf("%s: event mask: %d", ErrNoSuchHandle, event.RawEvent.Mask))
+	}
+}
+
+// deliver passes an event that was not read from the inotify descriptor to whatever is consuming
+// this Watcher: the registered EventHandlers while WatchAndHandle is running, subscriptions or w.Events otherwise
+func (w *Watcher) deliver(event *FsEvent) {
+	if !w.passesFilters(event) {
+		return
+	}
+	w.updateViews(event)
+	if atomic.LoadInt32(&w.handling) == 1 {
+		w.handleEvent(event)
+		return
 	}
+	w.emit(event)
 }
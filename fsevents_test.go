@@ -1,6 +1,7 @@
 package fsevents_test
 
 import (
+	"errors"
 	"fmt"
 	"math/rand"
 	"os"
@@ -336,6 +337,14 @@ func TestStart(t *testing.T) {
 	err = d.Start()
 	assert(t, (err != nil), fmt.Errorf("Start should have returned error %q", fsevents.ErrDescNotStart))
 
+	// The error of inotify_add_watch(2) is kept for a directory removed since it was added
+	setupDirs([]string{testRootDir2})
+	gone, err := w.AddDescriptor(testRootDir2, fsevents.AllEvents)
+	assert(t, (err == nil), err)
+	os.Remove(testRootDir2)
+	err = gone.Start()
+	assert(t, (err != nil && errors.Is(err, unix.ENOENT)), fmt.Errorf("Start should have returned an error matching ENOENT, got %v", err))
+
 	teardownDirs([]string{testRootDir})
 }
 
@@ -0,0 +1,472 @@
+// Package fsnotify provides the API of github.com/fsnotify/fsnotify on top of go-fsevents, so that code written
+// against fsnotify can move to go-fsevents by changing its import path. Directories can also be watched
+// recursively, with AddWith and WithRecursive.
+package fsnotify
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+
+	fsevents "github.com/tywkeene/go-fsevents"
+	"golang.org/x/sys/unix"
+)
+
+var (
+	// Returned by Remove for a path that is not watched
+	ErrNonExistentWatch = errors.New("fsnotify: can't remove non-existent watch")
+	// Sent on Watcher.Errors when the kernel dropped events
+	ErrEventOverflow = errors.New("fsnotify: queue or buffer overflow")
+	// Returned by Add and AddWith after Close
+	ErrClosed = errors.New("fsnotify: watcher already closed")
+)
+
+// Op describes a set of file operations
+type Op uint32
+
+// Operations reported in Event.Op
+const (
+	// A new path was created, or moved into a watched directory
+	Create Op = 1 << iota
+	// The file was written to
+	Write
+	// The path was removed
+	Remove
+	// The path was renamed, or moved out of a watched directory
+	Rename
+	// The attributes of the path changed
+	Chmod
+)
+
+// Has returns true if o includes h
+func (o Op) Has(h Op) bool {
+	return o&h != 0
+}
+
+// String returns the operations of o separated by "|", such as "CREATE|WRITE"
+func (o Op) String() string {
+	names := make([]string, 0, 5)
+	for _, op := range []struct {
+		op   Op
+		name string
+	}{{Create, "CREATE"}, {Remove, "REMOVE"}, {Write, "WRITE"}, {Rename, "RENAME"}, {Chmod, "CHMOD"}} {
+		if o.Has(op.op) {
+			names = append(names, op.name)
+		}
+	}
+	if len(names) == 0 {
+		return "[no events]"
+	}
+	return strings.Join(names, "|")
+}
+
+// Event is a file operation
+type Event struct {
+	// Path of the file, the path given to Add joined with the name of the file for a watched directory
+	Name string
+	Op   Op
+}
+
+// Has returns true if the operations of e include op
+func (e Event) Has(op Op) bool {
+	return e.Op.Has(op)
+}
+
+// String returns the operations and path of e
+func (e Event) String() string {
+	return fmt.Sprintf("%-13s %q", e.Op.String(), e.Name)
+}
+
+// Events translated to Ops
+var watchMask = fsevents.Create | fsevents.MovedTo | fsevents.MovedFrom | fsevents.Delete | fsevents.RootDelete |
+	fsevents.RootMove | fsevents.Modified | fsevents.AttrChange
+
+// translate returns the Ops of an inotify mask
+func translate(mask uint32) Op {
+	var op Op
+	if fsevents.CheckMask(fsevents.Create|fsevents.MovedTo, mask) {
+		op |= Create
+	}
+	if fsevents.CheckMask(fsevents.Delete|fsevents.RootDelete, mask) {
+		op |= Remove
+	}
+	if fsevents.CheckMask(fsevents.Modified, mask) {
+		op |= Write
+	}
+	if fsevents.CheckMask(fsevents.MovedFrom|fsevents.RootMove, mask) {
+		op |= Rename
+	}
+	if fsevents.CheckMask(fsevents.AttrChange, mask) {
+		op |= Chmod
+	}
+	return op
+}
+
+// AddOption configures a path added with AddWith
+type AddOption func(*addOptions)
+
+type addOptions struct {
+	recursive bool
+}
+
+// WithRecursive watches the directory added and every directory below it, including the directories created
+// later. The entries of a directory created below it are reported with Create once the directory is watched,
+// since they may have been created before. Each entry is reported once, whether by inotify or by this walk.
+func WithRecursive() AddOption {
+	return func(opts *addOptions) {
+		opts.recursive = true
+	}
+}
+
+// Watcher watches files and directories, and sends their operations on Events
+type Watcher struct {
+	// Receives the operations on watched paths
+	Events chan Event
+	// Receives the errors of the Watcher
+	Errors  chan error
+	watcher *fsevents.Watcher
+	lock    sync.Mutex
+	// Paths given to Add, key: cleaned path, value: watched recursively
+	watches map[string]bool
+	closed  bool
+	// Entries reported by the walk of a created directory, key: path, value: inode. inotify may report the
+	// creation of the same entry once more, since the directory was watched before the walk
+	walked map[string]uint64
+	// Closed by Close
+	done chan struct{}
+	// Closed once the reading goroutine returned
+	stopped chan struct{}
+}
+
+// NewWatcher returns a new Watcher with unbuffered channels
+func NewWatcher() (*Watcher, error) {
+	return NewBufferedWatcher(0)
+}
+
+// NewBufferedWatcher returns a new Watcher whose Events channel holds size events
+func NewBufferedWatcher(size uint) (*Watcher, error) {
+	watcher, err := fsevents.NewWatcher(fsevents.WithInitFlags(unix.IN_CLOEXEC | unix.IN_NONBLOCK))
+	if err != nil {
+		return nil, err
+	}
+	w := &Watcher{
+		Events:  make(chan Event, size),
+		Errors:  make(chan error),
+		watcher: watcher,
+		watches: make(map[string]bool),
+		walked:  make(map[string]uint64),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	go w.read()
+	return w, nil
+}
+
+// Add watches the file or directory at name. The files directly inside a directory are watched, but not the
+// directories below it, see WithRecursive. Adding a path already watched does nothing.
+func (w *Watcher) Add(name string) error {
+	return w.AddWith(name)
+}
+
+// AddWith watches the file or directory at name like Add, configured by opts
+func (w *Watcher) AddWith(name string, opts ...AddOption) error {
+	options := addOptions{}
+	for _, opt := range opts {
+		opt(&options)
+	}
+	name = filepath.Clean(name)
+	info, err := os.Stat(name)
+	if err != nil {
+		return err
+	}
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.closed {
+		return ErrClosed
+	}
+	if options.recursive && info.IsDir() {
+		err = w.addRecursive(name)
+	} else {
+		err = w.addPath(name)
+	}
+	if err != nil {
+		return err
+	}
+	w.watches[name] = w.watches[name] || (options.recursive && info.IsDir())
+	return nil
+}
+
+// addPath adds and starts a descriptor for name, unless it is already watched
+func (w *Watcher) addPath(name string) error {
+	if w.watcher.DescriptorExists(name) {
+		return nil
+	}
+	d, err := w.watcher.AddDescriptor(name, watchMask)
+	if err != nil {
+		return err
+	}
+	if err = d.Start(); err != nil {
+		w.watcher.RemoveDescriptor(name)
+	}
+	return err
+}
+
+// addRecursive watches the directory at name and every directory below it that is not watched yet
+func (w *Watcher) addRecursive(name string) error {
+	if !w.watcher.DescriptorExists(name) {
+		return w.watcher.RecursiveAdd(name, watchMask)
+	}
+	children, err := ioutil.ReadDir(name)
+	if err != nil {
+		return err
+	}
+	for _, child := range children {
+		if child.IsDir() {
+			if err := w.addRecursive(filepath.Join(name, child.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Remove stops watching the path added at name, and the directories below it if it was added recursively
+func (w *Watcher) Remove(name string) error {
+	name = filepath.Clean(name)
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	recursive, exists := w.watches[name]
+	if !exists {
+		return fmt.Errorf("%w: %s", ErrNonExistentWatch, name)
+	}
+	delete(w.watches, name)
+	if w.recursiveParent(name) {
+		// Still watched as part of the tree above
+		return nil
+	}
+	if recursive {
+		w.removeTree(name)
+		return nil
+	}
+	return w.watcher.RemoveDescriptor(name)
+}
+
+// removeTree removes the descriptors of dir and of the directories below it, except for the paths given to Add.
+// The caller must hold w.lock
+func (w *Watcher) removeTree(dir string) {
+	for name := range w.walked {
+		if name == dir || strings.HasPrefix(name, dir+"/") {
+			delete(w.walked, name)
+		}
+	}
+	for _, descriptor := range w.watcher.ListDescriptors() {
+		if _, added := w.watches[descriptor]; !added && (descriptor == dir || strings.HasPrefix(descriptor, dir+"/")) {
+			w.watcher.RemoveDescriptor(descriptor)
+		}
+	}
+}
+
+// WatchList returns the paths given to Add that are still watched
+func (w *Watcher) WatchList() []string {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	list := make([]string, 0, len(w.watches))
+	for name := range w.watches {
+		list = append(list, name)
+	}
+	return list
+}
+
+// Close stops watching every path, and closes Events and Errors
+func (w *Watcher) Close() error {
+	w.lock.Lock()
+	if w.closed {
+		w.lock.Unlock()
+		return nil
+	}
+	w.closed = true
+	close(w.done)
+	w.lock.Unlock()
+
+	err := w.watcher.Close()
+	<-w.stopped
+	close(w.Events)
+	close(w.Errors)
+	return err
+}
+
+// recursiveParent returns true if a directory above name was added recursively. The caller must hold w.lock
+func (w *Watcher) recursiveParent(name string) bool {
+	for dir := filepath.Dir(name); ; dir = filepath.Dir(dir) {
+		if w.watches[dir] {
+			return true
+		}
+		if dir == filepath.Dir(dir) {
+			return false
+		}
+	}
+}
+
+// sendEvent sends event on w.Events. It returns false if the Watcher was closed meanwhile
+func (w *Watcher) sendEvent(event Event) bool {
+	select {
+	case <-w.done:
+		return false
+	default:
+	}
+	select {
+	case w.Events <- event:
+		return true
+	case <-w.done:
+		return false
+	}
+}
+
+// sendError sends err on w.Errors. It returns false if the Watcher was closed meanwhile
+func (w *Watcher) sendError(err error) bool {
+	select {
+	case <-w.done:
+		return false
+	default:
+	}
+	select {
+	case w.Errors <- err:
+		return true
+	case <-w.done:
+		return false
+	}
+}
+
+// read translates the events of the go-fsevents Watcher until it is closed
+func (w *Watcher) read() {
+	defer close(w.stopped)
+	for {
+		event, err := w.watcher.ReadSingleEvent()
+		switch {
+		case err == fsevents.ErrWatcherClosed:
+			return
+		case err == fsevents.ErrQueueOverflow:
+			if !w.sendError(ErrEventOverflow) {
+				return
+			}
+			continue
+		case err == fsevents.ErrDescForEventNotFound:
+			// Left over from a removed watch
+			continue
+		case err != nil:
+			if !w.sendError(err) {
+				return
+			}
+			continue
+		}
+		if !w.handle(event) {
+			return
+		}
+	}
+}
+
+// handle translates event, keeping the watches up to date. It returns false if the Watcher was closed meanwhile
+func (w *Watcher) handle(event *fsevents.FsEvent) bool {
+	mask := event.RawEvent.Mask
+	if fsevents.CheckMask(fsevents.Ignored, mask) {
+		// The kernel removed the watch, because its path was deleted or unmounted
+		w.lock.Lock()
+		delete(w.watches, event.Descriptor.Path)
+		w.watcher.RemoveDescriptor(event.Descriptor.Path)
+		w.lock.Unlock()
+		return true
+	}
+	if w.duplicate(event.Path, mask) {
+		return true
+	}
+	w.lock.Lock()
+	_, parentWatched := w.watches[filepath.Dir(event.Path)]
+	recursive := w.recursiveParent(event.Path)
+	w.lock.Unlock()
+	if fsevents.CheckMask(fsevents.RootDelete, mask) && (parentWatched || recursive) {
+		// Already reported by the watch of the parent directory
+		return true
+	}
+	if fsevents.CheckMask(fsevents.RootMove, mask) && recursive {
+		return true
+	}
+	if fsevents.CheckMask(fsevents.MovedFrom, mask) && event.IsDirEvent() && recursive {
+		// The watches below the directory would report events under its old path
+		w.lock.Lock()
+		w.removeTree(event.Path)
+		w.lock.Unlock()
+	}
+
+	op := translate(mask)
+	if op == 0 {
+		return true
+	}
+	if !w.sendEvent(Event{Name: event.Path, Op: op}) {
+		return false
+	}
+	if event.IsDirCreated() && recursive {
+		return w.addCreated(event.Path)
+	}
+	return true
+}
+
+// duplicate returns true if mask reports the creation of name, an entry already reported by the walk of a created
+// directory. The entry was created after its directory was watched, or replaced since the walk if its inode
+// changed. Any event on name ends the lookout for its creation: a later Create is a new entry.
+func (w *Watcher) duplicate(name string, mask uint32) bool {
+	w.lock.Lock()
+	inode, walked := w.walked[name]
+	delete(w.walked, name)
+	w.lock.Unlock()
+	if !walked || !fsevents.CheckMask(fsevents.Create|fsevents.MovedTo, mask) {
+		return false
+	}
+	info, err := os.Lstat(name)
+	// An entry already gone is reported removed by the events that follow
+	return err != nil || inodeOf(info) == inode
+}
+
+// inodeOf returns the inode number of the file described by info
+func inodeOf(info os.FileInfo) uint64 {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return uint64(stat.Ino)
+	}
+	return 0
+}
+
+// addCreated watches the directory dir created below a recursive watch, and reports what it already contains.
+// It returns false if the Watcher was closed meanwhile
+func (w *Watcher) addCreated(dir string) bool {
+	w.lock.Lock()
+	err := w.addRecursive(dir)
+	w.lock.Unlock()
+	if err != nil && !os.IsNotExist(err) {
+		return w.sendError(err)
+	}
+	created := make([]string, 0)
+	inodes := make(map[string]uint64)
+	filepath.Walk(dir, func(entry string, info os.FileInfo, err error) error {
+		if err == nil && entry != dir {
+			created = append(created, entry)
+			inodes[entry] = inodeOf(info)
+		}
+		return nil
+	})
+	w.lock.Lock()
+	for entry, inode := range inodes {
+		w.walked[entry] = inode
+	}
+	w.lock.Unlock()
+	for _, entry := range created {
+		if !w.sendEvent(Event{Name: entry, Op: Create}) {
+			return false
+		}
+	}
+	return true
+}
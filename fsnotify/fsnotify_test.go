@@ -0,0 +1,191 @@
+package fsnotify_test
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/tywkeene/go-fsevents/fsnotify"
+)
+
+func assert(t *testing.T, compare bool, err error) {
+	if compare == false {
+		_, _, line, _ := runtime.Caller(1)
+		t.Logf("Comparison @ [line %d] failed\n", line)
+		if err != nil {
+			t.Fatal("Error returned:", err)
+		} else {
+			t.Fatal("Exiting")
+		}
+	}
+}
+
+func testWatcher(t *testing.T) (*fsnotify.Watcher, string, func()) {
+	dir, err := ioutil.TempDir("", "fsevents-fsnotify")
+	assert(t, (err == nil), err)
+	w, err := fsnotify.NewBufferedWatcher(64)
+	assert(t, (err == nil), err)
+	return w, dir, func() {
+		w.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+// appendFile writes to the file at name with a single write, reported once
+func appendFile(name string) {
+	file, _ := os.OpenFile(name, os.O_WRONLY|os.O_APPEND, 0)
+	file.Write([]byte("data"))
+	file.Close()
+}
+
+// expectEvent waits for the next event, which must be op on name
+func expectEvent(t *testing.T, w *fsnotify.Watcher, name string, op fsnotify.Op) {
+	select {
+	case event := <-w.Events:
+		assert(t, (event.Name == name && event.Op == op), fmt.Errorf("expected %s, got %s", fsnotify.Event{Name: name, Op: op}, event))
+	case err := <-w.Errors:
+		t.Fatal("Error returned:", err)
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no event for %s", fsnotify.Event{Name: name, Op: op})
+	}
+}
+
+func TestWatcher(t *testing.T) {
+	w, dir, cleanup := testWatcher(t)
+	defer cleanup()
+	file := filepath.Join(dir, "file")
+
+	assert(t, (w.Add(dir+"/") == nil), fmt.Errorf("Add should not have returned an error"))
+	assert(t, (w.Add(dir) == nil), fmt.Errorf("adding a path twice should not have returned an error"))
+	assert(t, (len(w.WatchList()) == 1 && w.WatchList()[0] == dir), fmt.Errorf("unexpected watch list %v", w.WatchList()))
+
+	os.Create(file)
+	expectEvent(t, w, file, fsnotify.Create)
+	appendFile(file)
+	expectEvent(t, w, file, fsnotify.Write)
+	os.Chmod(file, 0600)
+	expectEvent(t, w, file, fsnotify.Chmod)
+	os.Rename(file, file+".moved")
+	expectEvent(t, w, file, fsnotify.Rename)
+	expectEvent(t, w, file+".moved", fsnotify.Create)
+	os.Remove(file + ".moved")
+	expectEvent(t, w, file+".moved", fsnotify.Remove)
+
+	assert(t, (w.Remove(dir) == nil), fmt.Errorf("Remove should not have returned an error"))
+	err := w.Remove(dir)
+	assert(t, (errors.Is(err, fsnotify.ErrNonExistentWatch)), fmt.Errorf("a second Remove should have failed, got %v", err))
+	err = w.Add(filepath.Join(dir, "missing"))
+	assert(t, (os.IsNotExist(err)), fmt.Errorf("adding a missing path should have failed like Stat, got %v", err))
+
+	assert(t, (w.Close() == nil && w.Close() == nil), fmt.Errorf("Close should not have returned an error"))
+	_, open := <-w.Events
+	assert(t, (!open), fmt.Errorf("Close should have closed Events"))
+	assert(t, (w.Add(dir) == fsnotify.ErrClosed), fmt.Errorf("Add should have failed after Close"))
+}
+
+func TestWatcherFile(t *testing.T) {
+	w, dir, cleanup := testWatcher(t)
+	defer cleanup()
+	file := filepath.Join(dir, "file")
+	ioutil.WriteFile(file, []byte("data"), 0644)
+
+	assert(t, (w.Add(file) == nil), fmt.Errorf("Add should not have returned an error"))
+	appendFile(file)
+	expectEvent(t, w, file, fsnotify.Write)
+	os.Remove(file)
+	expectEvent(t, w, file, fsnotify.Chmod)
+	expectEvent(t, w, file, fsnotify.Remove)
+
+	// The kernel removed the watch of the deleted file
+	deadline := time.Now().Add(5 * time.Second)
+	for len(w.WatchList()) > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert(t, (len(w.WatchList()) == 0), fmt.Errorf("the deleted file should have left the watch list"))
+}
+
+func TestWatcherRecursive(t *testing.T) {
+	w, dir, cleanup := testWatcher(t)
+	defer cleanup()
+	sub := filepath.Join(dir, "sub")
+	os.Mkdir(sub, 0755)
+
+	assert(t, (w.AddWith(dir, fsnotify.WithRecursive()) == nil), fmt.Errorf("AddWith should not have returned an error"))
+	os.Create(filepath.Join(sub, "existing"))
+	expectEvent(t, w, filepath.Join(sub, "existing"), fsnotify.Create)
+
+	created := filepath.Join(sub, "created")
+	os.Mkdir(created, 0755)
+	expectEvent(t, w, created, fsnotify.Create)
+	os.Create(filepath.Join(created, "file"))
+	expectEvent(t, w, filepath.Join(created, "file"), fsnotify.Create)
+
+	assert(t, (w.Remove(dir) == nil), fmt.Errorf("Remove should not have returned an error"))
+	os.Create(filepath.Join(created, "unwatched"))
+	select {
+	case event := <-w.Events:
+		t.Fatalf("no event should have been reported after Remove, got %s", event)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestWatcherRecursiveCreated(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fsevents-fsnotify")
+	assert(t, (err == nil), err)
+	defer os.RemoveAll(dir)
+	// Unbuffered, so that each file is created as soon as its directory was reported, while it is being watched
+	w, err := fsnotify.NewWatcher()
+	assert(t, (err == nil), err)
+	defer w.Close()
+	assert(t, (w.AddWith(dir, fsnotify.WithRecursive()) == nil), fmt.Errorf("AddWith should not have returned an error"))
+
+	reported := make(map[string]int)
+	receive := func(timeout time.Duration) (fsnotify.Event, bool) {
+		select {
+		case event := <-w.Events:
+			reported[event.Name]++
+			return event, true
+		case <-time.After(timeout):
+			return fsnotify.Event{}, false
+		}
+	}
+	for i := 0; i < 100; i++ {
+		created := filepath.Join(dir, fmt.Sprintf("created%d", i))
+		os.Mkdir(created, 0755)
+		for {
+			event, ok := receive(5 * time.Second)
+			assert(t, (ok), fmt.Errorf("no event for %s", created))
+			if event.Name == created {
+				break
+			}
+		}
+		os.Create(filepath.Join(created, "file"))
+	}
+	for _, ok := receive(time.Second); ok; _, ok = receive(time.Second) {
+	}
+
+	assert(t, (len(reported) == 200), fmt.Errorf("expected 200 entries to be reported, got %d", len(reported)))
+	for name, count := range reported {
+		assert(t, (count == 1), fmt.Errorf("%s was reported %d times", name, count))
+	}
+}
+
+func TestOp(t *testing.T) {
+	ops := map[fsnotify.Op]string{
+		0:                                 "[no events]",
+		fsnotify.Create:                   "CREATE",
+		fsnotify.Create | fsnotify.Write:  "CREATE|WRITE",
+		fsnotify.Remove | fsnotify.Rename: "REMOVE|RENAME",
+	}
+	for op, expected := range ops {
+		assert(t, (op.String() == expected), fmt.Errorf("expected %q, got %q", expected, op.String()))
+	}
+	event := fsnotify.Event{Name: "/tmp/file", Op: fsnotify.Write | fsnotify.Chmod}
+	assert(t, (event.Has(fsnotify.Write) && !event.Has(fsnotify.Create)), fmt.Errorf("Has returned the wrong result"))
+	assert(t, (event.String() == `WRITE|CHMOD   "/tmp/file"`), fmt.Errorf("unexpected string %q", event.String()))
+}
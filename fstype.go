@@ -0,0 +1,142 @@
+package fsevents
+
+import (
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+// FilesystemType is the magic number statfs(2) reports for a filesystem in f_type
+type FilesystemType uint32
+
+// Filesystem magic numbers missing from the unix package
+const (
+	fuseSuperMagic FilesystemType = 0x65735546
+	cifsMagic      FilesystemType = 0xff534d42
+	smb2Magic      FilesystemType = 0xfe534d42
+	cephSuperMagic FilesystemType = 0x00c36400
+)
+
+// Names of the filesystems most likely to be watched
+var filesystemNames = map[FilesystemType]string{
+	unix.EXT4_SUPER_MAGIC:      "ext2/ext3/ext4",
+	unix.XFS_SUPER_MAGIC:       "xfs",
+	unix.BTRFS_SUPER_MAGIC:     "btrfs",
+	unix.F2FS_SUPER_MAGIC:      "f2fs",
+	unix.TMPFS_MAGIC:           "tmpfs",
+	unix.RAMFS_MAGIC:           "ramfs",
+	unix.MSDOS_SUPER_MAGIC:     "vfat",
+	unix.ISOFS_SUPER_MAGIC:     "iso9660",
+	unix.SQUASHFS_MAGIC:        "squashfs",
+	unix.REISERFS_SUPER_MAGIC:  "reiserfs",
+	unix.NFS_SUPER_MAGIC:       "nfs",
+	unix.SMB_SUPER_MAGIC:       "smb",
+	cifsMagic:                  "cifs",
+	smb2Magic:                  "smb2",
+	fuseSuperMagic:             "fuse",
+	cephSuperMagic:             "ceph",
+	unix.V9FS_MAGIC:            "9p",
+	unix.AFS_SUPER_MAGIC:       "afs",
+	unix.CODA_SUPER_MAGIC:      "coda",
+	unix.PROC_SUPER_MAGIC:      "proc",
+	unix.SYSFS_MAGIC:           "sysfs",
+	unix.CGROUP_SUPER_MAGIC:    "cgroup",
+	unix.CGROUP2_SUPER_MAGIC:   "cgroup2",
+	unix.DEBUGFS_MAGIC:         "debugfs",
+	unix.TRACEFS_MAGIC:         "tracefs",
+	unix.OVERLAYFS_SUPER_MAGIC: "overlay",
+}
+
+// Filesystems on which inotify does not report every change. Network and FUSE filesystems only report changes made
+// through the local kernel, pseudo filesystems generate their contents on the fly, and overlay does not report
+// changes made to its lower layers.
+var unreliableFilesystems = map[FilesystemType]bool{
+	unix.NFS_SUPER_MAGIC:       true,
+	unix.SMB_SUPER_MAGIC:       true,
+	cifsMagic:                  true,
+	smb2Magic:                  true,
+	fuseSuperMagic:             true,
+	cephSuperMagic:             true,
+	unix.V9FS_MAGIC:            true,
+	unix.AFS_SUPER_MAGIC:       true,
+	unix.CODA_SUPER_MAGIC:      true,
+	unix.PROC_SUPER_MAGIC:      true,
+	unix.SYSFS_MAGIC:           true,
+	unix.CGROUP_SUPER_MAGIC:    true,
+	unix.CGROUP2_SUPER_MAGIC:   true,
+	unix.DEBUGFS_MAGIC:         true,
+	unix.TRACEFS_MAGIC:         true,
+	unix.OVERLAYFS_SUPER_MAGIC: true,
+}
+
+// String returns the name of the filesystem, or its magic number if it is not known
+func (t FilesystemType) String() string {
+	if name, known := filesystemNames[t]; known {
+		return name
+	}
+	return fmt.Sprintf("0x%x", uint32(t))
+}
+
+// Reliable returns false if inotify is known to miss changes on filesystems of this type
+func (t FilesystemType) Reliable() bool {
+	return !unreliableFilesystems[t]
+}
+
+// DetectFilesystem returns the type of the filesystem containing filePath
+func DetectFilesystem(filePath string) (FilesystemType, error) {
+	var stat unix.Statfs_t
+	if err := unix.Statfs(filePath, &stat); err != nil {
+		return 0, err
+	}
+	return FilesystemType(uint32(stat.Type)), nil
+}
+
+// warnUnreliable writes ErrUnreliableFilesystem to w.Errors for the descriptor d, once per filesystem
+func (w *Watcher) warnUnreliable(d *WatchDescriptor) {
+	w.Lock()
+	if w.warnedDevices == nil {
+		w.warnedDevices = make(map[uint64]bool)
+	}
+	warned := w.warnedDevices[d.Device]
+	w.warnedDevices[d.Device] = true
+	w.Unlock()
+
+	if !warned {
+		w.tryReportError(fmt.Errorf("%s: %q is on %s", ErrUnreliableFilesystem, d.Path, d.Filesystem))
+	}
+}
+
+// filesystem returns the type of the filesystem containing filePath, whose identity is id. It is only looked up
+// once per device, unless id is unknown
+func (w *Watcher) filesystem(filePath string, id fileID) (FilesystemType, error) {
+	if id.ino == 0 {
+		return DetectFilesystem(filePath)
+	}
+	w.Lock()
+	fstype, exists := w.filesystems[id.dev]
+	w.Unlock()
+	if exists {
+		return fstype, nil
+	}
+	fstype, err := DetectFilesystem(filePath)
+	if err != nil {
+		return 0, err
+	}
+	w.Lock()
+	if w.filesystems == nil {
+		w.filesystems = make(map[uint64]FilesystemType)
+	}
+	w.filesystems[id.dev] = fstype
+	w.Unlock()
+	return fstype, nil
+}
+
+// pollInstead decides whether a walk should watch the directory of job, and everything below it, by polling instead
+// of with inotify, because its filesystem is unreliable and w.PollUnreliable is set
+func (w *Watcher) pollInstead(job *walkJob) bool {
+	if !w.PollUnreliable {
+		return false
+	}
+	fstype, err := w.filesystem(job.path, job.id)
+	return err == nil && !fstype.Reliable()
+}
@@ -0,0 +1,90 @@
+package fsevents_test
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	fsevents "github.com/tywkeene/go-fsevents"
+	"golang.org/x/sys/unix"
+)
+
+func TestDetectFilesystem(t *testing.T) {
+	fstype, err := fsevents.DetectFilesystem("/proc")
+	assert(t, (err == nil), err)
+	assert(t, (fstype.String() == "proc"), fmt.Errorf("DetectFilesystem should have returned proc, got %s", fstype))
+	assert(t, (!fstype.Reliable()), fmt.Errorf("proc should not be reliable"))
+
+	setupDirs([]string{testRootDir})
+	defer teardownDirs([]string{testRootDir})
+	mountOrSkip(t, "none", testRootDir, "tmpfs", 0)
+	defer unix.Unmount(testRootDir, 0)
+
+	fstype, err = fsevents.DetectFilesystem(testRootDir)
+	assert(t, (err == nil), err)
+	assert(t, (fstype.String() == "tmpfs"), fmt.Errorf("DetectFilesystem should have returned tmpfs, got %s", fstype))
+	assert(t, (fstype.Reliable()), fmt.Errorf("tmpfs should be reliable"))
+}
+
+func TestUnreliableFilesystemWarning(t *testing.T) {
+	w, err := fsevents.NewWatcher()
+	assert(t, (err == nil), err)
+	defer w.Close()
+
+	errs := make(chan error, 2)
+	go func() {
+		for i := 0; i < 2; i++ {
+			select {
+			case err := <-w.Errors:
+				errs <- err
+			case <-time.After(100 * time.Millisecond):
+				return
+			}
+		}
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	d, err := w.AddDescriptor("/proc", fsevents.AllEvents)
+	assert(t, (err == nil), err)
+	assert(t, (d.Filesystem.String() == "proc"), fmt.Errorf("The descriptor's filesystem should be proc, got %s", d.Filesystem))
+	_, err = w.AddDescriptor("/proc/self", fsevents.AllEvents)
+	assert(t, (err == nil), err)
+
+	// The warning SHOULD be written once per filesystem
+	err = <-errs
+	assert(t, (strings.HasPrefix(err.Error(), fsevents.ErrUnreliableFilesystem.Error())), fmt.Errorf("Expected %q, got %q", fsevents.ErrUnreliableFilesystem, err))
+	time.Sleep(100 * time.Millisecond)
+	assert(t, (len(errs) == 0), fmt.Errorf("ErrUnreliableFilesystem should only have been written once"))
+}
+
+func TestPollUnreliable(t *testing.T) {
+	overlay := path.Join(testRootDir, "overlay")
+	lower := path.Join(testRootDir2, "lower")
+	testDirs := []string{testRootDir, overlay, testRootDir2, lower, path.Join(lower, "sub"),
+		path.Join(testRootDir2, "upper"), path.Join(testRootDir2, "work")}
+	setupDirs(testDirs)
+	defer teardownDirs([]string{testRootDir, testRootDir2})
+
+	if fstype, err := fsevents.DetectFilesystem(testRootDir); err != nil || !fstype.Reliable() {
+		t.Skipf("the test directory itself is on %s", fstype)
+	}
+	options := fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s", lower, path.Join(testRootDir2, "upper"), path.Join(testRootDir2, "work"))
+	if err := unix.Mount("overlay", overlay, "overlay", 0, options); err != nil {
+		t.Skipf("could not mount overlay: %s", err)
+	}
+	defer unix.Unmount(overlay, 0)
+
+	for _, workers := range []int{0, 4} {
+		w, err := fsevents.NewWatcher()
+		assert(t, (err == nil), err)
+		w.PollUnreliable = true
+
+		result, err := w.RecursiveAddWithOptions(testRootDir, fsevents.AllEvents, fsevents.RecursiveOptions{Workers: workers})
+		assert(t, (err == nil), err)
+		assert(t, (len(result.Added) == 1), fmt.Errorf("RecursiveAddWithOptions should have added 1 descriptor, got %d", len(result.Added)))
+		assert(t, (len(result.Polled) == 1 && result.Polled[0] == overlay), fmt.Errorf("RecursiveAddWithOptions should have polled %q, got %v", overlay, result.Polled))
+		w.Close()
+	}
+}
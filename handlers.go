@@ -0,0 +1,161 @@
+package fsevents
+
+import (
+	"context"
+	"time"
+)
+
+// HandlerFunc is the Handle method of an EventHandler as a function. A HandlerFunc is itself an EventHandler
+// for every event, with the mask AllEvents. Use NewFuncHandler for the events of a given mask.
+type HandlerFunc func(w *Watcher, event *FsEvent) error
+
+// Handle calls f
+func (f HandlerFunc) Handle(w *Watcher, event *FsEvent) error {
+	return f(w, event)
+}
+
+// Check returns true for every event
+func (f HandlerFunc) Check(event *FsEvent) bool {
+	return true
+}
+
+// GetMask returns AllEvents
+func (f HandlerFunc) GetMask() uint32 {
+	return AllEvents
+}
+
+// ContextHandler is an EventHandler whose Handle method takes a context.Context.
+// It is registered with Watcher.RegisterContextHandler, or wrapped with FromContextHandler to be used anywhere
+// an EventHandler is, such as in a Router.
+type ContextHandler interface {
+	// The Handle method is called by WatchAndHandle in response to a given event. ctx is cancelled when the
+	// Watcher is closed or when the handler's timeout expires
+	Handle(ctx context.Context, w *Watcher, event *FsEvent) error
+	// The Check method is called to match Events with the correct EventHandle in the Watcher
+	Check(event *FsEvent) bool
+	// The GetMask method returns the uint32 inotify mask this EventHandle handles
+	GetMask() uint32
+}
+
+// ContextHandlerFunc is the Handle method of a ContextHandler as a function. Like HandlerFunc, it is itself a
+// ContextHandler for every event. Use NewContextFuncHandler for the events of a given mask.
+type ContextHandlerFunc func(ctx context.Context, w *Watcher, event *FsEvent) error
+
+// Handle calls f
+func (f ContextHandlerFunc) Handle(ctx context.Context, w *Watcher, event *FsEvent) error {
+	return f(ctx, w, event)
+}
+
+// Check returns true for every event
+func (f ContextHandlerFunc) Check(event *FsEvent) bool {
+	return true
+}
+
+// GetMask returns AllEvents
+func (f ContextHandlerFunc) GetMask() uint32 {
+	return AllEvents
+}
+
+// funcHandler is the EventHandler returned by NewFuncHandler
+type funcHandler struct {
+	mask uint32
+	fn   HandlerFunc
+}
+
+func (h *funcHandler) Handle(w *Watcher, event *FsEvent) error {
+	return h.fn(w, event)
+}
+
+func (h *funcHandler) Check(event *FsEvent) bool {
+	return matchMask(h.mask, event.RawEvent.Mask)
+}
+
+func (h *funcHandler) GetMask() uint32 {
+	return h.mask
+}
+
+// NewFuncHandler returns an EventHandler calling fn for the events matching mask. As for Router routes, if mask
+// includes IsDir only directory events match. Use the Filter Middleware to check events any further.
+func NewFuncHandler(mask uint32, fn HandlerFunc) EventHandler {
+	return &funcHandler{mask: mask, fn: fn}
+}
+
+// contextFuncHandler is the ContextHandler returned by NewContextFuncHandler
+type contextFuncHandler struct {
+	mask uint32
+	fn   ContextHandlerFunc
+}
+
+func (h *contextFuncHandler) Handle(ctx context.Context, w *Watcher, event *FsEvent) error {
+	return h.fn(ctx, w, event)
+}
+
+func (h *contextFuncHandler) Check(event *FsEvent) bool {
+	return matchMask(h.mask, event.RawEvent.Mask)
+}
+
+func (h *contextFuncHandler) GetMask() uint32 {
+	return h.mask
+}
+
+// NewContextFuncHandler returns a ContextHandler calling fn for the events matching mask, see NewFuncHandler
+func NewContextFuncHandler(mask uint32, fn ContextHandlerFunc) ContextHandler {
+	return &contextFuncHandler{mask: mask, fn: fn}
+}
+
+// contextAdapter is the EventHandler returned by FromContextHandler
+type contextAdapter struct {
+	handler ContextHandler
+	timeout time.Duration
+}
+
+func (h *contextAdapter) Handle(w *Watcher, event *FsEvent) error {
+	ctx := context.Background()
+	if w != nil {
+		ctx = w.Context()
+	}
+	if h.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, h.timeout)
+		defer cancel()
+	}
+	return h.handler.Handle(ctx, w, event)
+}
+
+func (h *contextAdapter) Check(event *FsEvent) bool {
+	return h.handler.Check(event)
+}
+
+func (h *contextAdapter) GetMask() uint32 {
+	return h.handler.GetMask()
+}
+
+// FromContextHandler returns an EventHandler calling handler with the Context of the Watcher handling the event.
+// If timeout is above zero, the context is also cancelled once timeout has passed.
+// Unlike the Timeout Middleware, Handle waits for handler to return.
+func FromContextHandler(handler ContextHandler, timeout time.Duration) EventHandler {
+	return &contextAdapter{handler: handler, timeout: timeout}
+}
+
+// Context returns a context that is cancelled when w is closed
+func (w *Watcher) Context() context.Context {
+	if w.ctx == nil {
+		return context.Background()
+	}
+	return w.ctx
+}
+
+// RegisterFunc registers fn with w as an EventHandler for the events matching mask, see NewFuncHandler
+func (w *Watcher) RegisterFunc(mask uint32, fn HandlerFunc) error {
+	return w.RegisterEventHandler(NewFuncHandler(mask, fn))
+}
+
+// RegisterContextHandler registers handler with w alongside regular EventHandlers, see FromContextHandler
+func (w *Watcher) RegisterContextHandler(handler ContextHandler, timeout time.Duration) error {
+	return w.RegisterEventHandler(FromContextHandler(handler, timeout))
+}
+
+// RouteFunc registers fn for the events matching mask on paths matching pattern, see Route
+func (r *Router) RouteFunc(pattern string, mask uint32, fn HandlerFunc, middleware ...Middleware) error {
+	return r.Route(pattern, mask, NewFuncHandler(mask, fn), middleware...)
+}
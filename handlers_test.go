@@ -0,0 +1,109 @@
+package fsevents_test
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"testing"
+	"time"
+
+	fsevents "github.com/tywkeene/go-fsevents"
+)
+
+func TestFuncHandler(t *testing.T) {
+	var handled []string
+	h := fsevents.NewFuncHandler(fsevents.DirCreatedEvent, func(w *fsevents.Watcher, event *fsevents.FsEvent) error {
+		handled = append(handled, event.Path)
+		return nil
+	})
+	assert(t, (h.GetMask() == fsevents.DirCreatedEvent), fmt.Errorf("GetMask should have returned the handler's mask"))
+	assert(t, (h.Check(routerTestEvent("test/dir", fsevents.Create|fsevents.IsDir))), fmt.Errorf("Check should have matched a directory creation"))
+	assert(t, (!h.Check(routerTestEvent("test/file", fsevents.Create))), fmt.Errorf("Check should not have matched a file creation"))
+
+	h.Handle(nil, routerTestEvent("test/dir", fsevents.Create|fsevents.IsDir))
+	assert(t, (len(handled) == 1), fmt.Errorf("fn should have been called"))
+
+	r := fsevents.NewRouter()
+	err := r.RouteFunc("*.go", fsevents.Create, func(w *fsevents.Watcher, event *fsevents.FsEvent) error {
+		handled = append(handled, event.Path)
+		return nil
+	})
+	assert(t, (err == nil), err)
+	r.Handle(nil, routerTestEvent("test/main.go", fsevents.Create))
+	assert(t, (len(handled) == 2 && handled[1] == "test/main.go"), fmt.Errorf("routed fn should have been called, got %v", handled))
+}
+
+func TestHandlerFunc(t *testing.T) {
+	var handled []string
+	var h fsevents.EventHandler = fsevents.HandlerFunc(func(w *fsevents.Watcher, event *fsevents.FsEvent) error {
+		handled = append(handled, event.Path)
+		return nil
+	})
+	assert(t, (h.GetMask() == fsevents.AllEvents), fmt.Errorf("GetMask should have returned AllEvents"))
+	assert(t, (h.Check(routerTestEvent("test/file", fsevents.Create))), fmt.Errorf("Check should have matched every event"))
+	h.Handle(nil, routerTestEvent("test/file", fsevents.Create))
+	assert(t, (len(handled) == 1), fmt.Errorf("fn should have been called"))
+
+	w, err := fsevents.NewWatcher()
+	assert(t, (err == nil), err)
+	defer w.Close()
+	assert(t, (w.RegisterEventHandler(h) == nil), fmt.Errorf("RegisterEventHandler should not have returned an error"))
+
+	var c fsevents.ContextHandler = fsevents.ContextHandlerFunc(func(ctx context.Context, w *fsevents.Watcher, event *fsevents.FsEvent) error {
+		handled = append(handled, event.Path)
+		return nil
+	})
+	fsevents.FromContextHandler(c, 0).Handle(nil, routerTestEvent("test/other", fsevents.Create))
+	assert(t, (len(handled) == 2 && handled[1] == "test/other"), fmt.Errorf("the context fn should have been called, got %v", handled))
+}
+
+func TestContextHandlerTimeout(t *testing.T) {
+	h := fsevents.FromContextHandler(fsevents.NewContextFuncHandler(fsevents.Create,
+		func(ctx context.Context, w *fsevents.Watcher, event *fsevents.FsEvent) error {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(5 * time.Second):
+				return nil
+			}
+		}), 10*time.Millisecond)
+
+	err := h.Handle(nil, routerTestEvent("test/a", fsevents.Create))
+	assert(t, (err == context.DeadlineExceeded), fmt.Errorf("Handle should have returned context.DeadlineExceeded, got %v", err))
+}
+
+func TestContextHandlerClose(t *testing.T) {
+	setupDirs([]string{testRootDir})
+	defer teardownDirs([]string{testRootDir})
+
+	w, err := fsevents.NewWatcher()
+	assert(t, (err == nil), err)
+
+	started := make(chan struct{})
+	result := make(chan error, 1)
+	err = w.RegisterContextHandler(fsevents.NewContextFuncHandler(fsevents.CloseWrite,
+		func(ctx context.Context, w *fsevents.Watcher, event *fsevents.FsEvent) error {
+			close(started)
+			<-ctx.Done()
+			result <- ctx.Err()
+			return nil
+		}), 0)
+	assert(t, (err == nil), err)
+	err = w.RegisterFunc(fsevents.Delete, func(w *fsevents.Watcher, event *fsevents.FsEvent) error { return nil })
+	assert(t, (err == nil), err)
+
+	d, err := w.AddDescriptor(testRootDir, fsevents.CloseWrite)
+	assert(t, (err == nil), err)
+	assert(t, (d.Start() == nil), fmt.Errorf("Start should not have returned an error"))
+	go w.WatchAndHandle()
+
+	assert(t, (writeRandomFile(path.Join(testRootDir, "context")) == nil), fmt.Errorf("could not write file"))
+	<-started
+	w.Close()
+	select {
+	case err := <-result:
+		assert(t, (err == context.Canceled), fmt.Errorf("context should have been cancelled, got %v", err))
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close did not cancel the handler's context")
+	}
+}
@@ -0,0 +1,372 @@
+// Package httpstream streams the events of a go-fsevents Watcher to HTTP clients, as Server-Sent Events or
+// WebSocket messages.
+//
+// Each event is sent as its JSON encoding (see fsevents.FsEvent.MarshalJSON). Server-Sent Events are identified
+// by the instance of the Handler and the ID of the event, as "<instance>-<ID>", since IDs start again at 0 with
+// every Watcher. Clients filter the events they receive with query parameters:
+//
+//	path           Only events on this path, below this directory, or matching this glob. Repeatable
+//	op             Only events with one of these flags, named like fsevents.OpNames, comma-separated. Repeatable
+//	last_event_id  Resume after this event, like the Last-Event-ID header that EventSource sends when it reconnects.
+//	               An event of another instance, such as before the server restarted, resumes from the oldest event
+//	               of the history. A bare ID, as WebSocket clients find in the events, is taken to be of this instance
+//
+// For example, /events?path=/srv/www&op=CREATE,MOVED_TO streams the files created or moved below /srv/www.
+package httpstream
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	fsevents "github.com/tywkeene/go-fsevents"
+)
+
+var (
+	ErrHandlerClosed   = errors.New("handler closed")
+	ErrClientTooSlow   = errors.New("client buffer full, client disconnected")
+	ErrBadFilter       = errors.New("malformed filter")
+	ErrStreamingFailed = errors.New("response does not support streaming")
+)
+
+// Defaults of Options
+const (
+	defaultHistory      = 1024
+	defaultClientBuffer = 256
+	defaultKeepAlive    = 30 * time.Second
+)
+
+// Options configures a Handler
+type Options struct {
+	// Number of recent events kept to resume clients from the last event they received. Zero means 1024
+	History int
+	// Number of events held for a client that is not reading them, after which the client is disconnected.
+	// Zero means 256
+	ClientBuffer int
+	// Interval of the comments sent to idle SSE clients and of the pings sent to WebSocket clients, which keep
+	// proxies from closing the connection. Zero means 30 seconds, and a negative KeepAlive sends none
+	KeepAlive time.Duration
+	// Logs the errors of clients. Nil means no logging
+	Logger fsevents.Logger
+}
+
+// client is a connection streaming events from a Handler
+type client struct {
+	filter fsevents.EventFilter
+	events chan *fsevents.FsEvent
+	// Closed by the Handler when it disconnects the client
+	gone chan struct{}
+	// Why the Handler disconnected the client
+	err error
+}
+
+// Handler is an http.Handler streaming the events of a Watcher. Requests asking for a WebSocket upgrade get
+// WebSocket messages, and any other request Server-Sent Events.
+//
+// The Handler receives the events of its Watcher through a Subscription, so events are only streamed while
+// Watch runs, and are no longer sent on the Events channel of the Watcher until the Handler is closed.
+type Handler struct {
+	lock    sync.Mutex
+	opts    Options
+	watcher *fsevents.Watcher
+	sub     *fsevents.Subscription
+	// Recent events, oldest first
+	history []*fsevents.FsEvent
+	clients map[*client]bool
+	closed  bool
+	// Identifies the Handler in the IDs of Server-Sent Events
+	instance string
+}
+
+// NewHandler returns a Handler streaming the events of w, configured by opts
+func NewHandler(w *fsevents.Watcher, opts Options) *Handler {
+	if opts.History <= 0 {
+		opts.History = defaultHistory
+	}
+	if opts.ClientBuffer <= 0 {
+		opts.ClientBuffer = defaultClientBuffer
+	}
+	if opts.KeepAlive == 0 {
+		opts.KeepAlive = defaultKeepAlive
+	}
+	h := &Handler{
+		opts:    opts,
+		watcher: w,
+		history: make([]*fsevents.FsEvent, 0, opts.History),
+		clients: make(map[*client]bool),
+		// Unlikely to be used again by a later Handler
+		instance: strconv.FormatInt(time.Now().UnixNano(), 36),
+	}
+	// Never drops an event of the history, clients too slow for it are disconnected instead
+	h.sub = w.Subscribe(nil, fsevents.SubscribeOptions{BufferSize: opts.ClientBuffer})
+	go h.publish()
+	return h
+}
+
+func (h *Handler) logf(format string, v ...interface{}) {
+	if h.opts.Logger != nil {
+		h.opts.Logger.Printf(format, v...)
+	}
+}
+
+// Close disconnects every client and stops receiving the events of the Watcher
+func (h *Handler) Close() error {
+	err := h.watcher.Unsubscribe(h.sub)
+	if err == fsevents.ErrNoSubscription {
+		// Already closed, or the Watcher was closed
+		return nil
+	}
+	return err
+}
+
+// Clients returns the number of clients streaming events
+func (h *Handler) Clients() int {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return len(h.clients)
+}
+
+// publish records the events of the Watcher in the history and passes them to the clients, until the
+// Subscription is closed
+func (h *Handler) publish() {
+	for event := range h.sub.Events {
+		h.lock.Lock()
+		if len(h.history) == h.opts.History {
+			copy(h.history, h.history[1:])
+			h.history = h.history[:len(h.history)-1]
+		}
+		h.history = append(h.history, event)
+		for c := range h.clients {
+			if !c.filter(event) {
+				continue
+			}
+			select {
+			case c.events <- event:
+			default:
+				h.disconnect(c, ErrClientTooSlow)
+			}
+		}
+		h.lock.Unlock()
+	}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.closed = true
+	for c := range h.clients {
+		h.disconnect(c, ErrHandlerClosed)
+	}
+}
+
+// disconnect removes c from the clients, telling it why with err. The caller must hold h.lock
+func (h *Handler) disconnect(c *client, err error) {
+	delete(h.clients, c)
+	c.err = err
+	close(c.gone)
+}
+
+// connect adds a client receiving the events for which filter returns true, and returns the events of the history
+// it should receive first: those after the event with ID lastID if resume is true. If that event is no longer in
+// the history, or lastID is -1, the client receives the whole history and the events older than it are lost.
+func (h *Handler) connect(filter fsevents.EventFilter, resume bool, lastID int64) (*client, []*fsevents.FsEvent, error) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.closed {
+		return nil, nil, ErrHandlerClosed
+	}
+	backlog := make([]*fsevents.FsEvent, 0)
+	if resume {
+		start := 0
+		for i := len(h.history) - 1; i >= 0; i-- {
+			if int64(h.history[i].ID) == lastID {
+				start = i + 1
+				break
+			}
+		}
+		for _, event := range h.history[start:] {
+			if filter(event) {
+				backlog = append(backlog, event)
+			}
+		}
+	}
+	c := &client{
+		filter: filter,
+		events: make(chan *fsevents.FsEvent, h.opts.ClientBuffer),
+		gone:   make(chan struct{}),
+	}
+	h.clients[c] = true
+	return c, backlog, nil
+}
+
+// leave removes c from the clients once its connection ended
+func (h *Handler) leave(c *client) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.clients[c] {
+		delete(h.clients, c)
+		close(c.gone)
+	}
+}
+
+// parseFilter returns the filter of the events a request asked for with its query parameters
+func parseFilter(r *http.Request) (fsevents.EventFilter, error) {
+	query := r.URL.Query()
+	paths := make([]string, 0, len(query["path"]))
+	for _, p := range query["path"] {
+		if p == "" {
+			continue
+		}
+		if _, err := path.Match(p, ""); err != nil {
+			return nil, fmt.Errorf("%s: path %q: %s", ErrBadFilter, p, err)
+		}
+		paths = append(paths, path.Clean(p))
+	}
+	names := make([]string, 0)
+	for _, op := range query["op"] {
+		for _, name := range strings.Split(op, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, strings.ToUpper(name))
+			}
+		}
+	}
+	mask, err := fsevents.ParseOpNames(names)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", ErrBadFilter, err)
+	}
+
+	return func(event *fsevents.FsEvent) bool {
+		if mask != 0 && (event.RawEvent == nil || event.RawEvent.Mask&mask == 0) {
+			return false
+		}
+		if len(paths) == 0 {
+			return true
+		}
+		for _, p := range paths {
+			if event.Path == p || strings.HasPrefix(event.Path, strings.TrimSuffix(p, "/")+"/") {
+				return true
+			}
+			if matched, _ := path.Match(p, event.Path); matched {
+				return true
+			}
+		}
+		return false
+	}, nil
+}
+
+// eventID returns the ID of a Server-Sent Event of h
+func (h *Handler) eventID(event *fsevents.FsEvent) string {
+	return h.instance + "-" + strconv.FormatUint(uint64(event.ID), 10)
+}
+
+// lastEventID returns the ID of the last event a request received, from its Last-Event-ID header or its
+// last_event_id query parameter, or -1 for an event of another instance. It returns false if the request does
+// not resume a stream.
+func (h *Handler) lastEventID(r *http.Request) (int64, bool, error) {
+	id := r.Header.Get("Last-Event-ID")
+	if id == "" {
+		id = r.URL.Query().Get("last_event_id")
+	}
+	if id == "" {
+		return 0, false, nil
+	}
+	instance, number := h.instance, id
+	if sep := strings.LastIndex(id, "-"); sep >= 0 {
+		instance, number = id[:sep], id[sep+1:]
+	}
+	parsed, err := strconv.ParseUint(number, 10, 32)
+	if err != nil || instance == "" {
+		return 0, false, fmt.Errorf("%s: last event ID %q", ErrBadFilter, id)
+	}
+	if instance != h.instance {
+		// Its ID may be that of any event of the history, which all follow it
+		return -1, true, nil
+	}
+	return int64(parsed), true, nil
+}
+
+// ServeHTTP streams events to the client of r until it disconnects, or is disconnected by the Handler
+func (h *Handler) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	filter, err := parseFilter(r)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+	lastID, resume, err := h.lastEventID(r)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if isWebSocket(r) {
+		h.serveWebSocket(rw, r, filter, resume, lastID)
+		return
+	}
+	h.serveSSE(rw, r, filter, resume, lastID)
+}
+
+// serveSSE streams events as Server-Sent Events
+func (h *Handler) serveSSE(rw http.ResponseWriter, r *http.Request, filter fsevents.EventFilter, resume bool, lastID int64) {
+	flusher, ok := rw.(http.Flusher)
+	if !ok {
+		http.Error(rw, ErrStreamingFailed.Error(), http.StatusInternalServerError)
+		return
+	}
+	c, backlog, err := h.connect(filter, resume, lastID)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	defer h.leave(c)
+
+	rw.Header().Set("Content-Type", "text/event-stream")
+	rw.Header().Set("Cache-Control", "no-cache")
+	rw.Header().Set("X-Accel-Buffering", "no")
+	rw.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	send := func(event *fsevents.FsEvent) error {
+		data, err := event.MarshalJSON()
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(rw, "id: %s\ndata: %s\n\n", h.eventID(event), data); err != nil {
+			return err
+		}
+		flusher.Flush()
+		return nil
+	}
+	for _, event := range backlog {
+		if err := send(event); err != nil {
+			return
+		}
+	}
+
+	var keepAlive <-chan time.Time
+	if h.opts.KeepAlive > 0 {
+		ticker := time.NewTicker(h.opts.KeepAlive)
+		defer ticker.Stop()
+		keepAlive = ticker.C
+	}
+	for {
+		select {
+		case event := <-c.events:
+			if err := send(event); err != nil {
+				return
+			}
+		case <-keepAlive:
+			if _, err := fmt.Fprint(rw, ": keep-alive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-c.gone:
+			h.logf("httpstream: client %s disconnected: %s", r.RemoteAddr, c.err)
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,241 @@
+package httpstream_test
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	fsevents "github.com/tywkeene/go-fsevents"
+	"github.com/tywkeene/go-fsevents/httpstream"
+)
+
+func assert(t *testing.T, compare bool, err error) {
+	if compare == false {
+		_, _, line, _ := runtime.Caller(1)
+		t.Logf("Comparison @ [line %d] failed\n", line)
+		if err != nil {
+			t.Fatal("Error returned:", err)
+		} else {
+			t.Fatal("Exiting")
+		}
+	}
+}
+
+// testServer serves the events of a Watcher of a temporary directory
+func testServer(t *testing.T) (*httpstream.Handler, *httptest.Server, string, func()) {
+	dir, err := ioutil.TempDir("", "fsevents-httpstream")
+	assert(t, (err == nil), err)
+	w, err := fsevents.NewWatcher()
+	assert(t, (err == nil), err)
+	d, err := w.AddDescriptor(dir, fsevents.Create|fsevents.Delete)
+	assert(t, (err == nil), err)
+	assert(t, (d.Start() == nil), fmt.Errorf("Start should not have returned an error"))
+	h := httpstream.NewHandler(w, httpstream.Options{History: 16, KeepAlive: -1})
+	go w.Watch()
+	server := httptest.NewServer(h)
+	return h, server, dir, func() {
+		server.Close()
+		w.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+// waitClients waits until h streams to n clients
+func waitClients(t *testing.T, h *httpstream.Handler, n int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for h.Clients() != n && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert(t, (h.Clients() == n), fmt.Errorf("expected %d clients, got %d", n, h.Clients()))
+}
+
+// sseStream reads the Server-Sent Events of a response
+type sseStream struct {
+	body   io.ReadCloser
+	events chan [2]string
+}
+
+func openSSE(t *testing.T, address string, lastEventID string) *sseStream {
+	req, _ := http.NewRequest(http.MethodGet, address, nil)
+	if lastEventID != "" {
+		req.Header.Set("Last-Event-ID", lastEventID)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	assert(t, (err == nil), err)
+	assert(t, (resp.StatusCode == http.StatusOK && resp.Header.Get("Content-Type") == "text/event-stream"),
+		fmt.Errorf("unexpected response %s", resp.Status))
+	s := &sseStream{body: resp.Body, events: make(chan [2]string, 16)}
+	go func() {
+		defer close(s.events)
+		scanner := bufio.NewScanner(resp.Body)
+		var id, data string
+		for scanner.Scan() {
+			line := scanner.Text()
+			switch {
+			case strings.HasPrefix(line, "id: "):
+				id = strings.TrimPrefix(line, "id: ")
+			case strings.HasPrefix(line, "data: "):
+				data = strings.TrimPrefix(line, "data: ")
+			case line == "":
+				s.events <- [2]string{id, data}
+			}
+		}
+	}()
+	return s
+}
+
+// expectEvent waits for the next event of s, which must be about name, and returns its ID
+func (s *sseStream) expectEvent(t *testing.T, name string) string {
+	select {
+	case e, ok := <-s.events:
+		assert(t, (ok), fmt.Errorf("the stream ended before %s", name))
+		event := &fsevents.FsEvent{}
+		assert(t, (event.UnmarshalJSON([]byte(e[1])) == nil), fmt.Errorf("malformed event %q", e[1]))
+		assert(t, (event.Name == name && strings.HasSuffix(e[0], fmt.Sprintf("-%d", event.ID))), fmt.Errorf("expected an event for %s, got %q", name, e))
+		return e[0]
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no event for %s", name)
+		return ""
+	}
+}
+
+func TestServerSentEvents(t *testing.T) {
+	h, server, dir, cleanup := testServer(t)
+	defer cleanup()
+
+	query := url.Values{"path": {filepath.Join(dir, "*.txt")}, "op": {"create"}}
+	address := server.URL + "/?" + query.Encode()
+	s := openSSE(t, address, "")
+	waitClients(t, h, 1)
+
+	for _, name := range []string{"a.md", "b.txt"} {
+		ioutil.WriteFile(filepath.Join(dir, name), nil, 0644)
+	}
+	os.Remove(filepath.Join(dir, "b.txt"))
+	id := s.expectEvent(t, "b.txt")
+
+	// The events missed while disconnected are sent from the history
+	s.body.Close()
+	waitClients(t, h, 0)
+	ioutil.WriteFile(filepath.Join(dir, "c.txt"), nil, 0644)
+	time.Sleep(100 * time.Millisecond)
+	s = openSSE(t, address, id)
+	s.expectEvent(t, "c.txt")
+	ioutil.WriteFile(filepath.Join(dir, "d.txt"), nil, 0644)
+	s.expectEvent(t, "d.txt")
+
+	assert(t, (h.Close() == nil), fmt.Errorf("Close should not have returned an error"))
+	_, open := <-s.events
+	assert(t, (!open), fmt.Errorf("Close should have ended the stream"))
+	waitClients(t, h, 0)
+}
+
+func TestResumeOtherInstance(t *testing.T) {
+	h, server, dir, cleanup := testServer(t)
+	defer cleanup()
+
+	address := server.URL + "/?op=create"
+	s := openSSE(t, address, "")
+	waitClients(t, h, 1)
+	for _, name := range []string{"a", "b"} {
+		ioutil.WriteFile(filepath.Join(dir, name), nil, 0644)
+	}
+	id := s.expectEvent(t, "a")
+	s.expectEvent(t, "b")
+	s.body.Close()
+	waitClients(t, h, 0)
+
+	// The IDs of another instance, such as before a restart, SHOULD NOT be matched with the events of the history
+	number := id[strings.LastIndex(id, "-")+1:]
+	s = openSSE(t, address, "previous-"+number)
+	s.expectEvent(t, "a")
+	s.expectEvent(t, "b")
+	s.body.Close()
+}
+
+func TestBadFilter(t *testing.T) {
+	_, server, _, cleanup := testServer(t)
+	defer cleanup()
+
+	for _, query := range []string{"op=NOT_AN_OP", "path=[", "last_event_id=x", "last_event_id=-1"} {
+		resp, err := http.Get(server.URL + "/?" + query)
+		assert(t, (err == nil), err)
+		resp.Body.Close()
+		assert(t, (resp.StatusCode == http.StatusBadRequest), fmt.Errorf("%s: expected 400, got %s", query, resp.Status))
+	}
+}
+
+// writeClientFrame writes a masked frame, as clients do
+func writeClientFrame(conn net.Conn, opcode byte, payload []byte) {
+	mask := []byte{1, 2, 3, 4}
+	frame := []byte{0x80 | opcode, 0x80 | byte(len(payload))}
+	frame = append(frame, mask...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+	conn.Write(frame)
+}
+
+// readServerFrame reads a frame shorter than 64KiB, as servers write them
+func readServerFrame(t *testing.T, r *bufio.Reader) (byte, []byte) {
+	header := make([]byte, 2)
+	_, err := io.ReadFull(r, header)
+	assert(t, (err == nil), err)
+	length := int(header[1] & 0x7f)
+	if length == 126 {
+		extended := make([]byte, 2)
+		io.ReadFull(r, extended)
+		length = int(binary.BigEndian.Uint16(extended))
+	}
+	payload := make([]byte, length)
+	_, err = io.ReadFull(r, payload)
+	assert(t, (err == nil), err)
+	return header[0] & 0x0f, payload
+}
+
+func TestWebSocket(t *testing.T) {
+	h, server, dir, cleanup := testServer(t)
+	defer cleanup()
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(server.URL, "http://"))
+	assert(t, (err == nil), err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	fmt.Fprintf(conn, "GET /?op=DELETE HTTP/1.1\r\nHost: test\r\nUpgrade: websocket\r\nConnection: keep-alive, Upgrade\r\n"+
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n")
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, nil)
+	assert(t, (err == nil), err)
+	assert(t, (resp.StatusCode == http.StatusSwitchingProtocols), fmt.Errorf("unexpected response %s", resp.Status))
+	// The accept value of the example handshake of RFC 6455
+	assert(t, (resp.Header.Get("Sec-WebSocket-Accept") == "s3pPLMBiTxaQ9kYGzzhZRbK+xOo="), fmt.Errorf("wrong accept value"))
+	waitClients(t, h, 1)
+
+	file := filepath.Join(dir, "file")
+	ioutil.WriteFile(file, nil, 0644)
+	os.Remove(file)
+	opcode, payload := readServerFrame(t, r)
+	event := &fsevents.FsEvent{}
+	assert(t, (opcode == 0x1 && event.UnmarshalJSON(payload) == nil), fmt.Errorf("expected a text message, got %q", payload))
+	assert(t, (event.Path == file && event.RawEvent.Mask&fsevents.Delete != 0), fmt.Errorf("expected the deletion of %s, got %s", file, payload))
+
+	writeClientFrame(conn, 0x9, []byte("ping"))
+	opcode, payload = readServerFrame(t, r)
+	assert(t, (opcode == 0xa && string(payload) == "ping"), fmt.Errorf("expected a pong, got %d %q", opcode, payload))
+	writeClientFrame(conn, 0x8, []byte{0x03, 0xe8})
+	opcode, _ = readServerFrame(t, r)
+	assert(t, (opcode == 0x8), fmt.Errorf("expected the close frame to be echoed, got %d", opcode))
+	waitClients(t, h, 0)
+}
@@ -0,0 +1,257 @@
+package httpstream
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	fsevents "github.com/tywkeene/go-fsevents"
+)
+
+var ErrWebSocket = errors.New("websocket protocol error")
+
+// Appended to the key of a handshake to compute its accept value, see RFC 6455
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// WebSocket opcodes
+const (
+	opText  = 0x1
+	opClose = 0x8
+	opPing  = 0x9
+	opPong  = 0xa
+)
+
+// WebSocket close codes
+const (
+	closeGoingAway       = 1001
+	closePolicyViolation = 1008
+)
+
+// Largest frame read from a client, which has nothing to send but control frames
+const maxFrameSize = 64 * 1024
+
+// Time a client has to read a frame before it is disconnected
+const writeTimeout = 10 * time.Second
+
+// isWebSocket returns true if r asks for a WebSocket upgrade
+func isWebSocket(r *http.Request) bool {
+	if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		return false
+	}
+	for _, value := range r.Header["Connection"] {
+		for _, token := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// websocketAccept returns the Sec-WebSocket-Accept value answering key
+func websocketAccept(key string) string {
+	sum := sha1.Sum([]byte(key + websocketGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// wsConn is the server side of a WebSocket connection. Only the messages of the server carry data, those of the
+// client are discarded.
+type wsConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+	// Serializes the frames written by the streaming and the reading goroutines
+	lock sync.Mutex
+}
+
+// writeFrame writes an unfragmented, unmasked frame as servers do
+func (ws *wsConn) writeFrame(opcode byte, payload []byte) error {
+	ws.lock.Lock()
+	defer ws.lock.Unlock()
+	frame := make([]byte, 0, len(payload)+10)
+	frame = append(frame, 0x80|opcode)
+	switch length := len(payload); {
+	case length < 126:
+		frame = append(frame, byte(length))
+	case length <= 0xffff:
+		frame = append(frame, 126, byte(length>>8), byte(length))
+	default:
+		frame = append(frame, 127)
+		frame = append(frame, make([]byte, 8)...)
+		binary.BigEndian.PutUint64(frame[len(frame)-8:], uint64(length))
+	}
+	frame = append(frame, payload...)
+	ws.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	_, err := ws.conn.Write(frame)
+	return err
+}
+
+// writeClose writes a close frame with code and reason
+func (ws *wsConn) writeClose(code uint16, reason string) error {
+	payload := make([]byte, 2, 2+len(reason))
+	binary.BigEndian.PutUint16(payload, code)
+	if len(reason) > 123 {
+		reason = reason[:123]
+	}
+	return ws.writeFrame(opClose, append(payload, reason...))
+}
+
+// readFrame reads a frame of the client, which must be masked
+func (ws *wsConn) readFrame() (byte, []byte, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(ws.r, header); err != nil {
+		return 0, nil, err
+	}
+	opcode := header[0] & 0x0f
+	if header[1]&0x80 == 0 {
+		return 0, nil, ErrWebSocket
+	}
+	length := uint64(header[1] & 0x7f)
+	switch length {
+	case 126:
+		extended := make([]byte, 2)
+		if _, err := io.ReadFull(ws.r, extended); err != nil {
+			return 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(extended))
+	case 127:
+		extended := make([]byte, 8)
+		if _, err := io.ReadFull(ws.r, extended); err != nil {
+			return 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(extended)
+	}
+	if length > maxFrameSize || (opcode >= opClose && length > 125) {
+		return 0, nil, ErrWebSocket
+	}
+	mask := make([]byte, 4)
+	if _, err := io.ReadFull(ws.r, mask); err != nil {
+		return 0, nil, err
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(ws.r, payload); err != nil {
+		return 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return opcode, payload, nil
+}
+
+// readLoop answers the control frames of the client until it closes the connection, then closes done
+func (ws *wsConn) readLoop(done chan<- struct{}) {
+	defer close(done)
+	for {
+		opcode, payload, err := ws.readFrame()
+		if err != nil {
+			return
+		}
+		switch opcode {
+		case opPing:
+			if ws.writeFrame(opPong, payload) != nil {
+				return
+			}
+		case opClose:
+			ws.writeFrame(opClose, payload)
+			return
+		}
+	}
+}
+
+// serveWebSocket upgrades the connection of r and streams events as WebSocket text messages
+func (h *Handler) serveWebSocket(rw http.ResponseWriter, r *http.Request, filter fsevents.EventFilter, resume bool, lastID int64) {
+	if r.Method != http.MethodGet {
+		http.Error(rw, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		rw.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(rw, ErrWebSocket.Error()+": unsupported version", http.StatusUpgradeRequired)
+		return
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		http.Error(rw, ErrWebSocket.Error()+": missing key", http.StatusBadRequest)
+		return
+	}
+	hijacker, ok := rw.(http.Hijacker)
+	if !ok {
+		http.Error(rw, ErrStreamingFailed.Error(), http.StatusInternalServerError)
+		return
+	}
+	c, backlog, err := h.connect(filter, resume, lastID)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	defer h.leave(c)
+
+	conn, buf, err := hijacker.Hijack()
+	if err != nil {
+		h.logf("httpstream: client %s: %s", r.RemoteAddr, err)
+		return
+	}
+	defer conn.Close()
+	// Clears the deadlines of the http.Server. Frames the client sent along with the handshake are in buf
+	conn.SetDeadline(time.Time{})
+	ws := &wsConn{conn: conn, r: buf.Reader}
+	ws.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	_, err = io.WriteString(conn, "HTTP/1.1 101 Switching Protocols\r\n"+
+		"Upgrade: websocket\r\n"+
+		"Connection: Upgrade\r\n"+
+		"Sec-WebSocket-Accept: "+websocketAccept(key)+"\r\n\r\n")
+	if err != nil {
+		return
+	}
+	closed := make(chan struct{})
+	go ws.readLoop(closed)
+
+	send := func(event *fsevents.FsEvent) error {
+		data, err := event.MarshalJSON()
+		if err != nil {
+			return err
+		}
+		return ws.writeFrame(opText, data)
+	}
+	for _, event := range backlog {
+		if err := send(event); err != nil {
+			return
+		}
+	}
+
+	var keepAlive <-chan time.Time
+	if h.opts.KeepAlive > 0 {
+		ticker := time.NewTicker(h.opts.KeepAlive)
+		defer ticker.Stop()
+		keepAlive = ticker.C
+	}
+	for {
+		select {
+		case event := <-c.events:
+			if err := send(event); err != nil {
+				return
+			}
+		case <-keepAlive:
+			if ws.writeFrame(opPing, nil) != nil {
+				return
+			}
+		case <-c.gone:
+			h.logf("httpstream: client %s disconnected: %s", r.RemoteAddr, c.err)
+			code := uint16(closeGoingAway)
+			if c.err == ErrClientTooSlow {
+				code = closePolicyViolation
+			}
+			ws.writeClose(code, c.err.Error())
+			return
+		case <-closed:
+			return
+		}
+	}
+}
@@ -0,0 +1,492 @@
+package fsevents
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrJournalClosed     = errors.New("journal closed")
+	ErrJournalCorrupt    = errors.New("journal record corrupt")
+	ErrCursorExpired     = errors.New("cursor older than the oldest retained journal event")
+	ErrJournalNotCreated = errors.New("journal could not be opened")
+)
+
+const (
+	// Suffix of the journal's segment files, which are named after the sequence number of their first event
+	journalSegmentSuffix = ".seg"
+	// Directory of the journal's saved cursors
+	journalCursorDir = "cursors"
+	// Size of a record's header: the length of its payload and the CRC-32 of its payload
+	journalHeaderSize = 8
+	// Largest payload of a record. Events take far less, so a longer record is corrupt
+	maxJournalRecordSize = 1 << 20
+	// Default JournalOptions.SegmentSize
+	defaultSegmentSize = 16 << 20
+)
+
+// JournalOptions configures a Journal opened by OpenJournal
+type JournalOptions struct {
+	// Size in bytes above which the journal starts a new segment. Zero means 16MiB
+	SegmentSize int64
+	// Total size in bytes of the segments above which the oldest are deleted. Zero means no limit
+	MaxSize int64
+	// Age above which segments are deleted, by the time of their last event. Zero means no limit
+	MaxAge time.Duration
+	// Sync the segment to disk after every appended event
+	Sync bool
+	// Clock used to age segments. Nil means the system clock
+	Clock Clock
+}
+
+// JournalEntry is an event read back from a Journal along with its sequence number
+type JournalEntry struct {
+	Seq   uint64
+	Event *FsEvent
+}
+
+// journalSegment describes a segment file
+type journalSegment struct {
+	first   uint64
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+// Journal is an append-only on-disk log of events. Every event appended to it gets the next of a sequence of
+// numbers starting at 1, which keeps increasing across restarts. Events are written to segment files, a new one
+// being started once the current one reaches JournalOptions.SegmentSize, and the oldest segments are deleted
+// according to JournalOptions.MaxSize and MaxAge.
+//
+// Consumers read the journal with a JournalReader from the sequence number they last processed, and save it
+// with Commit once processed, so that every event is delivered to them at least once across restarts.
+type Journal struct {
+	sync.Mutex
+	dir      string
+	opts     JournalOptions
+	segments []journalSegment
+	current  *os.File
+	writer   *bufio.Writer
+	nextSeq  uint64
+	closed   bool
+}
+
+// OpenJournal opens the journal in directory dir, creating it if needed, and deletes the segments exceeding the
+// retention limits. A record left incomplete at the end of the last segment, by a crash while it was written, is
+// discarded. Any other corrupt record of the last segment is reported with ErrJournalCorrupt, and the records
+// following it are left in place.
+func OpenJournal(dir string, opts JournalOptions) (*Journal, error) {
+	if opts.SegmentSize <= 0 {
+		opts.SegmentSize = defaultSegmentSize
+	}
+	if opts.Clock == nil {
+		opts.Clock = systemClock{}
+	}
+	if err := os.MkdirAll(filepath.Join(dir, journalCursorDir), 0755); err != nil {
+		return nil, fmt.Errorf("%s: %s", ErrJournalNotCreated, err)
+	}
+	segments, err := listSegments(dir)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", ErrJournalNotCreated, err)
+	}
+	j := &Journal{dir: dir, opts: opts, segments: segments, nextSeq: 1}
+	if len(segments) == 0 {
+		err = j.startSegment()
+	} else {
+		err = j.recover()
+	}
+	if err == nil {
+		err = j.retain()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", ErrJournalNotCreated, err)
+	}
+	return j, nil
+}
+
+// listSegments returns the segments in dir ordered by their first sequence number
+func listSegments(dir string) ([]journalSegment, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	segments := make([]journalSegment, 0)
+	for _, info := range infos {
+		name := info.Name()
+		if info.IsDir() || !strings.HasSuffix(name, journalSegmentSuffix) {
+			continue
+		}
+		first, err := strconv.ParseUint(strings.TrimSuffix(name, journalSegmentSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		segments = append(segments, journalSegment{
+			first:   first,
+			path:    filepath.Join(dir, name),
+			size:    info.Size(),
+			modTime: info.ModTime(),
+		})
+	}
+	sort.Slice(segments, func(i, k int) bool { return segments[i].first < segments[k].first })
+	return segments, nil
+}
+
+// recover finds the next sequence number from the last segment, truncates the record left incomplete at its end,
+// if any, and opens it for appending
+func (j *Journal) recover() error {
+	last := &j.segments[len(j.segments)-1]
+	file, err := os.OpenFile(last.path, os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	j.nextSeq = last.first
+	reader := bufio.NewReader(file)
+	var offset int64
+	for {
+		record, size, err := readJournalRecord(reader)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		} else if err != nil {
+			file.Close()
+			return fmt.Errorf("%s: offset %d of %s", err, offset, last.path)
+		}
+		offset += size
+		j.nextSeq = record.Seq + 1
+	}
+	if err := file.Truncate(offset); err != nil {
+		file.Close()
+		return err
+	}
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		file.Close()
+		return err
+	}
+	last.size = offset
+	j.current = file
+	j.writer = bufio.NewWriter(file)
+	return nil
+}
+
+// startSegment starts a new segment with the next sequence number
+func (j *Journal) startSegment() error {
+	segmentPath := filepath.Join(j.dir, fmt.Sprintf("%020d%s", j.nextSeq, journalSegmentSuffix))
+	file, err := os.OpenFile(segmentPath, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	j.segments = append(j.segments, journalSegment{first: j.nextSeq, path: segmentPath, modTime: j.opts.Clock.Now()})
+	j.current = file
+	j.writer = bufio.NewWriter(file)
+	return nil
+}
+
+// Append writes event to the journal and returns its sequence number
+func (j *Journal) Append(event *FsEvent) (uint64, error) {
+	j.Lock()
+	defer j.Unlock()
+	if j.closed {
+		return 0, ErrJournalClosed
+	}
+	// The sequence number followed by the binary encoding of the event
+	encoded, err := event.MarshalBinary()
+	if err != nil {
+		return 0, err
+	}
+	payload := append(appendUvarint(make([]byte, 0, binary.MaxVarintLen64+len(encoded)), j.nextSeq), encoded...)
+
+	segment := &j.segments[len(j.segments)-1]
+	if segment.size > 0 && segment.size+int64(journalHeaderSize+len(payload)) > j.opts.SegmentSize {
+		if err := j.rotate(); err != nil {
+			return 0, err
+		}
+		segment = &j.segments[len(j.segments)-1]
+	}
+	var header [journalHeaderSize]byte
+	binary.BigEndian.PutUint32(header[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(header[4:8], crc32.ChecksumIEEE(payload))
+	if _, err := j.writer.Write(header[:]); err != nil {
+		return 0, err
+	}
+	if _, err := j.writer.Write(payload); err != nil {
+		return 0, err
+	}
+	if err := j.writer.Flush(); err != nil {
+		return 0, err
+	}
+	if j.opts.Sync {
+		if err := j.current.Sync(); err != nil {
+			return 0, err
+		}
+	}
+	segment.size += int64(journalHeaderSize + len(payload))
+	segment.modTime = j.opts.Clock.Now()
+	j.nextSeq++
+	if j.expired() {
+		// The current segment may take long to fill up, so the segments older than MaxAge are not left until then
+		if err := j.retain(); err != nil {
+			return 0, err
+		}
+	}
+	return j.nextSeq - 1, nil
+}
+
+// expired returns true if the oldest segment is older than JournalOptions.MaxAge and is not the current one
+func (j *Journal) expired() bool {
+	return j.opts.MaxAge > 0 && len(j.segments) > 1 && j.opts.Clock.Now().Sub(j.segments[0].modTime) > j.opts.MaxAge
+}
+
+// rotate closes the current segment, starts a new one and applies the retention limits
+func (j *Journal) rotate() error {
+	if err := j.current.Close(); err != nil {
+		return err
+	}
+	if err := j.startSegment(); err != nil {
+		return err
+	}
+	return j.retain()
+}
+
+// retain deletes the oldest segments exceeding JournalOptions.MaxSize or MaxAge. The current segment is never deleted
+func (j *Journal) retain() error {
+	var total int64
+	for _, segment := range j.segments {
+		total += segment.size
+	}
+	now := j.opts.Clock.Now()
+	for len(j.segments) > 1 {
+		oldest := j.segments[0]
+		tooBig := j.opts.MaxSize > 0 && total > j.opts.MaxSize
+		tooOld := j.opts.MaxAge > 0 && now.Sub(oldest.modTime) > j.opts.MaxAge
+		if !tooBig && !tooOld {
+			break
+		}
+		if err := os.Remove(oldest.path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		total -= oldest.size
+		j.segments = j.segments[1:]
+	}
+	return nil
+}
+
+// Consume appends the events received from events, such as w.Events or the Events of a Subscription,
+// until it is closed
+func (j *Journal) Consume(events <-chan *FsEvent) error {
+	for event := range events {
+		if _, err := j.Append(event); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LastSeq returns the sequence number of the last event appended to the journal, zero if there is none
+func (j *Journal) LastSeq() uint64 {
+	j.Lock()
+	defer j.Unlock()
+	return j.nextSeq - 1
+}
+
+// FirstSeq returns the sequence number of the oldest event retained by the journal
+func (j *Journal) FirstSeq() uint64 {
+	j.Lock()
+	defer j.Unlock()
+	return j.segments[0].first
+}
+
+// Close closes the journal. JournalReaders already opened may still be used
+func (j *Journal) Close() error {
+	j.Lock()
+	defer j.Unlock()
+	if j.closed {
+		return nil
+	}
+	j.closed = true
+	return j.current.Close()
+}
+
+// Commit saves seq as the last sequence number processed by the consumer called name
+func (j *Journal) Commit(name string, seq uint64) error {
+	cursorPath := filepath.Join(j.dir, journalCursorDir, name)
+	tmpPath := cursorPath + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, []byte(strconv.FormatUint(seq, 10)), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, cursorPath)
+}
+
+// Cursor returns the last sequence number committed by the consumer called name, zero if it never committed
+func (j *Journal) Cursor(name string) (uint64, error) {
+	data, err := ioutil.ReadFile(filepath.Join(j.dir, journalCursorDir, name))
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+}
+
+// JournalReader reads the events of a Journal in order
+type JournalReader struct {
+	journal *Journal
+	file    *os.File
+	reader  *bufio.Reader
+	// First sequence number of the segment being read
+	segment uint64
+	// Offset of the next record in the segment
+	offset int64
+	// Sequence number of the last event returned
+	last uint64
+	// Set once a newer segment was seen, after which the end of the segment being read is its actual end
+	complete bool
+}
+
+// Reader returns a JournalReader reading the events following the sequence number after, zero meaning from the
+// oldest event retained. If events following after were already deleted, the reader starts from the oldest event
+// retained and the error is ErrCursorExpired
+func (j *Journal) Reader(after uint64) (*JournalReader, error) {
+	r := &JournalReader{journal: j, last: after}
+	var err error
+	if first := j.FirstSeq(); after+1 < first {
+		r.last = first - 1
+		if after > 0 {
+			err = ErrCursorExpired
+		}
+	}
+	return r, err
+}
+
+// Next returns the next event of the journal. It returns io.EOF when there is no event past the last one returned
+// yet, after which Next may be called again once more events were appended.
+func (r *JournalReader) Next() (*JournalEntry, error) {
+	for {
+		if r.file == nil {
+			if err := r.open(); err != nil {
+				return nil, err
+			}
+		}
+		record, size, err := readJournalRecord(r.reader)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			// The end of a segment, or a record being written
+			if r.complete {
+				r.Close()
+				continue
+			}
+			r.rewind()
+			if r.nextSegment() {
+				// Records may have been appended to the segment before the newer one was started, so it is
+				// read again up to its end before moving on
+				r.complete = true
+				continue
+			}
+			return nil, io.EOF
+		} else if err != nil {
+			return nil, err
+		}
+		r.offset += size
+		if record.Seq <= r.last {
+			continue
+		}
+		r.last = record.Seq
+		return record, nil
+	}
+}
+
+// open opens the segment holding the event following the last one returned
+func (r *JournalReader) open() error {
+	r.journal.Lock()
+	segments := r.journal.segments
+	r.journal.Unlock()
+	index := sort.Search(len(segments), func(i int) bool { return segments[i].first > r.last+1 }) - 1
+	if index < 0 {
+		index = 0
+	}
+	file, err := os.Open(segments[index].path)
+	if os.IsNotExist(err) {
+		// Deleted since listed, read from the oldest retained
+		r.last = r.journal.FirstSeq() - 1
+		return ErrCursorExpired
+	} else if err != nil {
+		return err
+	}
+	r.file = file
+	r.reader = bufio.NewReader(file)
+	r.segment = segments[index].first
+	r.offset = 0
+	r.complete = false
+	return nil
+}
+
+// nextSegment returns true if the journal has a segment following the one being read
+func (r *JournalReader) nextSegment() bool {
+	r.journal.Lock()
+	segments := r.journal.segments
+	r.journal.Unlock()
+	for _, segment := range segments {
+		if segment.first > r.segment {
+			return true
+		}
+	}
+	return false
+}
+
+// rewind positions the reader after the last complete record read, so that a record being written is read whole
+func (r *JournalReader) rewind() {
+	if _, err := r.file.Seek(r.offset, io.SeekStart); err != nil {
+		r.file.Close()
+		r.file = nil
+		return
+	}
+	r.reader.Reset(r.file)
+}
+
+// Close closes the reader
+func (r *JournalReader) Close() error {
+	if r.file == nil {
+		return nil
+	}
+	err := r.file.Close()
+	r.file = nil
+	return err
+}
+
+// readJournalRecord reads a record, returning the event it holds along with its size in the segment. The event's
+// Descriptor, if any, is a stopped WatchDescriptor that belongs to no Watcher, see FsEvent.UnmarshalBinary
+func readJournalRecord(reader *bufio.Reader) (*JournalEntry, int64, error) {
+	var header [journalHeaderSize]byte
+	if _, err := io.ReadFull(reader, header[:]); err != nil {
+		return nil, 0, err
+	}
+	length := binary.BigEndian.Uint32(header[0:4])
+	if length > maxJournalRecordSize {
+		return nil, 0, fmt.Errorf("%s: record of %d bytes", ErrJournalCorrupt, length)
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return nil, 0, err
+	}
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:8]) {
+		return nil, 0, ErrJournalCorrupt
+	}
+	seq, n := binary.Uvarint(payload)
+	if n <= 0 {
+		return nil, 0, fmt.Errorf("%s: truncated sequence number", ErrJournalCorrupt)
+	}
+	event := &FsEvent{}
+	if err := event.UnmarshalBinary(payload[n:]); err != nil {
+		return nil, 0, fmt.Errorf("%s: %s", ErrJournalCorrupt, err)
+	}
+	return &JournalEntry{Seq: seq, Event: event}, int64(journalHeaderSize + len(payload)), nil
+}
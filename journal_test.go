@@ -0,0 +1,294 @@
+package fsevents_test
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	fsevents "github.com/tywkeene/go-fsevents"
+	"golang.org/x/sys/unix"
+)
+
+// settableClock tells the time it was last set to
+type settableClock struct {
+	now time.Time
+}
+
+func (c *settableClock) Now() time.Time {
+	return c.now
+}
+
+func journalTestEvent(name string) *fsevents.FsEvent {
+	return &fsevents.FsEvent{
+		Name:      name,
+		Path:      filepath.Join("/watched", name),
+		RawEvent:  &unix.InotifyEvent{Wd: 1, Mask: fsevents.Create},
+		Timestamp: time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC),
+	}
+}
+
+func journalTestDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "fsevents-journal")
+	assert(t, (err == nil), err)
+	return dir
+}
+
+// readJournal reads the events of r until io.EOF
+func readJournal(t *testing.T, r *fsevents.JournalReader) []*fsevents.JournalEntry {
+	entries := make([]*fsevents.JournalEntry, 0)
+	for {
+		entry, err := r.Next()
+		if err == io.EOF {
+			return entries
+		}
+		assert(t, (err == nil), err)
+		entries = append(entries, entry)
+	}
+}
+
+func TestJournal(t *testing.T) {
+	dir := journalTestDir(t)
+	defer os.RemoveAll(dir)
+
+	j, err := fsevents.OpenJournal(dir, fsevents.JournalOptions{})
+	assert(t, (err == nil), err)
+	for i := 1; i <= 3; i++ {
+		seq, err := j.Append(journalTestEvent(fmt.Sprintf("file%d", i)))
+		assert(t, (err == nil), err)
+		assert(t, (seq == uint64(i)), fmt.Errorf("event %d should have had sequence number %d, got %d", i, i, seq))
+	}
+	assert(t, (j.Commit("consumer", 2) == nil), fmt.Errorf("Commit should not have returned an error"))
+	assert(t, (j.Close() == nil), fmt.Errorf("Close should not have returned an error"))
+
+	// Sequence numbers and cursors survive a restart
+	j, err = fsevents.OpenJournal(dir, fsevents.JournalOptions{})
+	assert(t, (err == nil), err)
+	defer j.Close()
+	assert(t, (j.LastSeq() == 3), fmt.Errorf("LastSeq should have returned 3, got %d", j.LastSeq()))
+	seq, err := j.Append(journalTestEvent("file4"))
+	assert(t, (err == nil && seq == 4), fmt.Errorf("the sequence should have resumed at 4, got %d %v", seq, err))
+
+	cursor, err := j.Cursor("consumer")
+	assert(t, (err == nil && cursor == 2), fmt.Errorf("Cursor should have returned 2, got %d %v", cursor, err))
+	r, err := j.Reader(cursor)
+	assert(t, (err == nil), err)
+	defer r.Close()
+	entries := readJournal(t, r)
+	assert(t, (len(entries) == 2 && entries[0].Seq == 3 && entries[1].Seq == 4),
+		fmt.Errorf("the reader should have resumed after 2, got %d events", len(entries)))
+	event := entries[0].Event
+	assert(t, (event.Name == "file3" && event.Path == "/watched/file3" && event.RawEvent.Mask == fsevents.Create &&
+		event.Timestamp.Equal(journalTestEvent("").Timestamp)), fmt.Errorf("the event should have been read back as appended: %+v", event))
+
+	// The reader follows events appended after it caught up
+	_, err = j.Append(journalTestEvent("file5"))
+	assert(t, (err == nil), err)
+	entry, err := r.Next()
+	assert(t, (err == nil && entry.Seq == 5), fmt.Errorf("the reader should have returned the new event, got %v", err))
+
+	cursor, err = j.Cursor("unknown")
+	assert(t, (err == nil && cursor == 0), fmt.Errorf("Cursor should have returned 0 for an unknown consumer"))
+}
+
+func TestJournalRotation(t *testing.T) {
+	dir := journalTestDir(t)
+	defer os.RemoveAll(dir)
+
+	// About two events per segment, and two segments retained
+	opts := fsevents.JournalOptions{SegmentSize: 100, MaxSize: 200}
+	j, err := fsevents.OpenJournal(dir, opts)
+	assert(t, (err == nil), err)
+	defer j.Close()
+	for i := 1; i <= 10; i++ {
+		_, err := j.Append(journalTestEvent(fmt.Sprintf("file%d", i)))
+		assert(t, (err == nil), err)
+	}
+	segments, _ := filepath.Glob(filepath.Join(dir, "*.seg"))
+	assert(t, (len(segments) > 1 && len(segments) <= 3), fmt.Errorf("expected the journal to keep 2 or 3 segments, got %d", len(segments)))
+	first := j.FirstSeq()
+	assert(t, (first > 1), fmt.Errorf("the oldest events should have been deleted"))
+
+	r, err := j.Reader(1)
+	assert(t, (err == fsevents.ErrCursorExpired), fmt.Errorf("Reader should have returned ErrCursorExpired, got %v", err))
+	defer r.Close()
+	entries := readJournal(t, r)
+	assert(t, (len(entries) == int(10-first+1) && entries[0].Seq == first && entries[len(entries)-1].Seq == 10),
+		fmt.Errorf("the reader should have read every retained event across segments, got %d", len(entries)))
+}
+
+func TestJournalRetentionAge(t *testing.T) {
+	dir := journalTestDir(t)
+	defer os.RemoveAll(dir)
+
+	clock := &settableClock{now: time.Now()}
+	j, err := fsevents.OpenJournal(dir, fsevents.JournalOptions{SegmentSize: 1, MaxAge: time.Hour, Clock: clock})
+	assert(t, (err == nil), err)
+	defer j.Close()
+	j.Append(journalTestEvent("old"))
+	clock.now = clock.now.Add(2 * time.Hour)
+	j.Append(journalTestEvent("new"))
+	j.Append(journalTestEvent("newer"))
+	assert(t, (j.FirstSeq() == 2), fmt.Errorf("the segment older than MaxAge should have been deleted, first is %d", j.FirstSeq()))
+}
+
+func TestJournalRetentionAgeOnOpen(t *testing.T) {
+	dir := journalTestDir(t)
+	defer os.RemoveAll(dir)
+
+	j, err := fsevents.OpenJournal(dir, fsevents.JournalOptions{SegmentSize: 1})
+	assert(t, (err == nil), err)
+	for _, name := range []string{"first", "second", "third"} {
+		j.Append(journalTestEvent(name))
+	}
+	j.Close()
+
+	clock := &settableClock{now: time.Now().Add(2 * time.Hour)}
+	j, err = fsevents.OpenJournal(dir, fsevents.JournalOptions{MaxAge: time.Hour, Clock: clock})
+	assert(t, (err == nil), err)
+	defer j.Close()
+	assert(t, (j.FirstSeq() == 3), fmt.Errorf("the segments older than MaxAge should have been deleted, first is %d", j.FirstSeq()))
+}
+
+func TestJournalRetentionAgeOnAppend(t *testing.T) {
+	dir := journalTestDir(t)
+	defer os.RemoveAll(dir)
+
+	j, err := fsevents.OpenJournal(dir, fsevents.JournalOptions{SegmentSize: 1})
+	assert(t, (err == nil), err)
+	for _, name := range []string{"first", "second", "third"} {
+		j.Append(journalTestEvent(name))
+	}
+	j.Close()
+
+	// The current segment never fills up, so that no segment is started
+	clock := &settableClock{now: time.Now()}
+	j, err = fsevents.OpenJournal(dir, fsevents.JournalOptions{MaxAge: time.Hour, Clock: clock})
+	assert(t, (err == nil), err)
+	defer j.Close()
+	assert(t, (j.FirstSeq() == 1), fmt.Errorf("no segment should have been deleted yet, first is %d", j.FirstSeq()))
+	clock.now = clock.now.Add(2 * time.Hour)
+	_, err = j.Append(journalTestEvent("fourth"))
+	assert(t, (err == nil), err)
+	assert(t, (j.FirstSeq() == 3), fmt.Errorf("the segments older than MaxAge should have been deleted, first is %d", j.FirstSeq()))
+}
+
+func TestJournalTruncatedRecord(t *testing.T) {
+	dir := journalTestDir(t)
+	defer os.RemoveAll(dir)
+
+	j, err := fsevents.OpenJournal(dir, fsevents.JournalOptions{})
+	assert(t, (err == nil), err)
+	j.Append(journalTestEvent("first"))
+	j.Append(journalTestEvent("second"))
+	j.Close()
+
+	// A record cut short by a crash
+	segments, _ := filepath.Glob(filepath.Join(dir, "*.seg"))
+	file, err := os.OpenFile(segments[0], os.O_WRONLY|os.O_APPEND, 0644)
+	assert(t, (err == nil), err)
+	file.Write([]byte{0, 0, 1, 0, 1, 2})
+	file.Close()
+
+	j, err = fsevents.OpenJournal(dir, fsevents.JournalOptions{})
+	assert(t, (err == nil), err)
+	defer j.Close()
+	seq, err := j.Append(journalTestEvent("third"))
+	assert(t, (err == nil && seq == 3), fmt.Errorf("the sequence should have resumed at 3, got %d %v", seq, err))
+	r, err := j.Reader(0)
+	assert(t, (err == nil), err)
+	defer r.Close()
+	entries := readJournal(t, r)
+	assert(t, (len(entries) == 3 && entries[2].Event.Name == "third"), fmt.Errorf("expected 3 events, got %d", len(entries)))
+}
+
+func TestJournalCorruptRecord(t *testing.T) {
+	dir := journalTestDir(t)
+	defer os.RemoveAll(dir)
+
+	j, err := fsevents.OpenJournal(dir, fsevents.JournalOptions{})
+	assert(t, (err == nil), err)
+	j.Append(journalTestEvent("first"))
+	j.Append(journalTestEvent("second"))
+	j.Close()
+
+	// A byte of the first record's payload changed, which its CRC no longer matches
+	segments, _ := filepath.Glob(filepath.Join(dir, "*.seg"))
+	data, err := ioutil.ReadFile(segments[0])
+	assert(t, (err == nil), err)
+	data[10] ^= 0xff
+	assert(t, (ioutil.WriteFile(segments[0], data, 0644) == nil), fmt.Errorf("could not write the segment"))
+
+	_, err = fsevents.OpenJournal(dir, fsevents.JournalOptions{})
+	assert(t, (err != nil && strings.Contains(err.Error(), fsevents.ErrJournalCorrupt.Error())),
+		fmt.Errorf("expected %q, got %v", fsevents.ErrJournalCorrupt, err))
+	info, err := os.Stat(segments[0])
+	assert(t, (err == nil && info.Size() == int64(len(data))), fmt.Errorf("the records following the corrupt one should have been kept"))
+}
+
+func TestJournalRecordTooLong(t *testing.T) {
+	dir := journalTestDir(t)
+	defer os.RemoveAll(dir)
+
+	j, err := fsevents.OpenJournal(dir, fsevents.JournalOptions{})
+	assert(t, (err == nil), err)
+	defer j.Close()
+	j.Append(journalTestEvent("first"))
+
+	// A corrupt length, which SHOULD NOT be allocated
+	segments, _ := filepath.Glob(filepath.Join(dir, "*.seg"))
+	file, err := os.OpenFile(segments[0], os.O_WRONLY|os.O_APPEND, 0644)
+	assert(t, (err == nil), err)
+	file.Write([]byte{0xff, 0xff, 0xff, 0xff, 0, 0, 0, 0})
+	file.Close()
+
+	r, err := j.Reader(0)
+	assert(t, (err == nil), err)
+	defer r.Close()
+	entry, err := r.Next()
+	assert(t, (err == nil && entry.Event.Name == "first"), fmt.Errorf("expected the first event, got %v", err))
+	_, err = r.Next()
+	assert(t, (err != nil && strings.HasPrefix(err.Error(), fsevents.ErrJournalCorrupt.Error())),
+		fmt.Errorf("expected %q, got %v", fsevents.ErrJournalCorrupt, err))
+}
+
+func TestJournalConsume(t *testing.T) {
+	setupDirs([]string{testRootDir})
+	defer teardownDirs([]string{testRootDir})
+	dir := journalTestDir(t)
+	defer os.RemoveAll(dir)
+
+	w, err := fsevents.NewWatcher()
+	assert(t, (err == nil), err)
+	defer w.Close()
+	d, err := w.AddDescriptor(testRootDir, fsevents.CloseWrite)
+	assert(t, (err == nil), err)
+	assert(t, (d.Start() == nil), fmt.Errorf("Start should not have returned an error"))
+	j, err := fsevents.OpenJournal(dir, fsevents.JournalOptions{})
+	assert(t, (err == nil), err)
+	defer j.Close()
+
+	s := w.Subscribe(nil, fsevents.SubscribeOptions{BufferSize: 1})
+	done := make(chan error, 1)
+	go func() { done <- j.Consume(s.Events) }()
+	go w.Watch()
+
+	writeRandomFile(filepath.Join(testRootDir, "journaled"))
+	deadline := time.Now().Add(5 * time.Second)
+	for j.LastSeq() == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	w.Unsubscribe(s)
+	assert(t, ((<-done) == nil), fmt.Errorf("Consume should have returned once the subscription was closed"))
+
+	r, err := j.Reader(0)
+	assert(t, (err == nil), err)
+	defer r.Close()
+	entries := readJournal(t, r)
+	assert(t, (len(entries) == 1 && entries[0].Event.Name == "journaled" && entries[0].Event.Descriptor.Path == testRootDir),
+		fmt.Errorf("the watched event should have been journaled, got %d events", len(entries)))
+}
@@ -0,0 +1,245 @@
+package fsevents
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// The procfs directory holding the kernel's inotify limits
+const inotifyProcDir = "/proc/sys/fs/inotify"
+
+// Limits describes the inotify limits configured in the running kernel
+type Limits struct {
+	// Maximum number of watches a single user may hold across all of their inotify instances
+	MaxUserWatches int
+	// Maximum number of inotify instances a single user may create
+	MaxUserInstances int
+	// Maximum number of events queued on an instance before the kernel drops events with IN_Q_OVERFLOW
+	MaxQueuedEvents int
+}
+
+// Usage describes how much of the inotify budget is currently in use
+type Usage struct {
+	Limits
+	// Watches currently held by this Watcher
+	WatcherWatches int
+	// Watches held by every inotify instance of this process
+	ProcessWatches int
+	// inotify instances open in this process
+	ProcessInstances int
+	// Watches held by every process of the current user that could be inspected
+	UserWatches int
+	// inotify instances open in every process of the current user that could be inspected
+	UserInstances int
+}
+
+// BudgetPolicy describes what RecursiveAddBudget does when a tree does not fit in the available watches
+type BudgetPolicy int
+
+const (
+	// BudgetFail refuses to add a tree that does not fit. If the kernel limit is hit while adding anyway,
+	// every descriptor added so far is removed again
+	BudgetFail BudgetPolicy = iota
+	// BudgetDepth watches the tree only down to the deepest level that fits
+	BudgetDepth
+	// BudgetPoll watches the tree with inotify down to the deepest level that fits,
+	// and polls the directories below it
+	BudgetPoll
+)
+
+// TreeCount is the result of counting the directories of a tree with CountTree
+type TreeCount struct {
+	// Total number of directories, including the root
+	Directories int
+	// Number of directories at each depth. ByDepth[0] is always 1, the root itself
+	ByDepth []int
+}
+
+// MaxDepthWithin returns the deepest level of the tree that can be watched in full using at most budget watches.
+// It returns -1 if not even the root fits.
+func (c *TreeCount) MaxDepthWithin(budget int) int {
+	depth := -1
+	for d, n := range c.ByDepth {
+		if n > budget {
+			break
+		}
+		budget -= n
+		depth = d
+	}
+	return depth
+}
+
+func readProcInt(name string) (int, error) {
+	data, err := ioutil.ReadFile(path.Join(inotifyProcDir, name))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(data)))
+}
+
+// ReadLimits reads the inotify limits of the running kernel from /proc/sys/fs/inotify
+func ReadLimits() (*Limits, error) {
+	var err error
+	limits := &Limits{}
+	if limits.MaxUserWatches, err = readProcInt("max_user_watches"); err != nil {
+		return nil, fmt.Errorf("%s: %s", ErrLimitsNotRead, err)
+	}
+	if limits.MaxUserInstances, err = readProcInt("max_user_instances"); err != nil {
+		return nil, fmt.Errorf("%s: %s", ErrLimitsNotRead, err)
+	}
+	if limits.MaxQueuedEvents, err = readProcInt("max_queued_events"); err != nil {
+		return nil, fmt.Errorf("%s: %s", ErrLimitsNotRead, err)
+	}
+	return limits, nil
+}
+
+// countInotifyUsage counts the inotify instances and watches held by the process whose /proc directory is procDir
+func countInotifyUsage(procDir string) (instances int, watches int) {
+	fds, err := ioutil.ReadDir(path.Join(procDir, "fd"))
+	if err != nil {
+		return 0, 0
+	}
+	for _, fd := range fds {
+		target, err := os.Readlink(path.Join(procDir, "fd", fd.Name()))
+		if err != nil || target != "anon_inode:inotify" {
+			continue
+		}
+		instances++
+
+		info, err := os.Open(path.Join(procDir, "fdinfo", fd.Name()))
+		if err != nil {
+			continue
+		}
+		scanner := bufio.NewScanner(info)
+		for scanner.Scan() {
+			if strings.HasPrefix(scanner.Text(), "inotify wd:") {
+				watches++
+			}
+		}
+		info.Close()
+	}
+	return instances, watches
+}
+
+// countUserUsage counts the inotify instances and watches held by every process owned by the current user.
+// Processes that cannot be inspected are skipped, so the counts are a lower bound.
+func countUserUsage() (instances int, watches int) {
+	procs, err := ioutil.ReadDir("/proc")
+	if err != nil {
+		return 0, 0
+	}
+	uid := uint32(os.Getuid())
+	for _, proc := range procs {
+		if _, err := strconv.Atoi(proc.Name()); err != nil || !proc.IsDir() {
+			continue
+		}
+		var stat unix.Stat_t
+		procDir := path.Join("/proc", proc.Name())
+		if err := unix.Stat(procDir, &stat); err != nil || stat.Uid != uid {
+			continue
+		}
+		i, w := countInotifyUsage(procDir)
+		instances += i
+		watches += w
+	}
+	return instances, watches
+}
+
+// Usage reads the inotify limits of the running kernel and reports how many watches and instances are in use
+func (w *Watcher) Usage() (*Usage, error) {
+	limits, err := ReadLimits()
+	if err != nil {
+		return nil, err
+	}
+	usage := &Usage{
+		Limits:         *limits,
+		WatcherWatches: int(w.GetRunningDescriptors()),
+	}
+	usage.ProcessInstances, usage.ProcessWatches = countInotifyUsage("/proc/self")
+	usage.UserInstances, usage.UserWatches = countUserUsage()
+	return usage, nil
+}
+
+// AvailableWatches returns the number of watches this Watcher may still add.
+// This is the smaller of what is left of w.WatchBudget, if set, and what is left of the user's max_user_watches.
+func (w *Watcher) AvailableWatches() (int, error) {
+	usage, err := w.Usage()
+	if err != nil {
+		return 0, err
+	}
+	available := usage.MaxUserWatches - usage.UserWatches
+	if w.WatchBudget > 0 && w.WatchBudget-usage.WatcherWatches < available {
+		available = w.WatchBudget - usage.WatcherWatches
+	}
+	if available < 0 {
+		available = 0
+	}
+	return available, nil
+}
+
+// CountTree counts the directories of the tree at rootPath, without adding any watches
+func CountTree(rootPath string) (*TreeCount, error) {
+	count := &TreeCount{}
+	level := []string{rootPath}
+	for len(level) > 0 {
+		count.ByDepth = append(count.ByDepth, len(level))
+		count.Directories += len(level)
+
+		var next []string
+		for _, dir := range level {
+			children, err := ioutil.ReadDir(dir)
+			if err != nil {
+				return nil, err
+			}
+			for _, child := range children {
+				if child.IsDir() {
+					next = append(next, path.Clean(path.Join(dir, child.Name())))
+				}
+			}
+		}
+		level = next
+	}
+	return count, nil
+}
+
+// RecursiveAddBudget adds the directory at rootPath, and all directories below it, like RecursiveAdd.
+// The tree is counted before anything is added, and policy decides what happens if it needs more watches than are
+// available (see AvailableWatches). If adding fails part way, every descriptor added by this call is removed again.
+func (w *Watcher) RecursiveAddBudget(rootPath string, mask uint32, policy BudgetPolicy) error {
+	available, err := w.AvailableWatches()
+	if err != nil {
+		return err
+	}
+	count, err := CountTree(rootPath)
+	if err != nil {
+		return err
+	}
+
+	opts := RecursiveOptions{Atomic: true, PollBelowMaxDepth: policy == BudgetPoll}
+	if count.Directories > available {
+		if policy == BudgetFail {
+			return fmt.Errorf("%s: %q needs %d watches, %d available", ErrWatchBudget, rootPath, count.Directories, available)
+		}
+		depth := count.MaxDepthWithin(available)
+		if depth < 0 {
+			return fmt.Errorf("%s: %q needs at least 1 watch, %d available", ErrWatchBudget, rootPath, available)
+		}
+		opts.MaxDepth = depth + 1
+	}
+
+	if _, err := w.RecursiveAddWithOptions(rootPath, mask, opts); err != nil {
+		if errors.Is(err, unix.ENOSPC) {
+			return fmt.Errorf("%s: %w", ErrWatchBudget, err)
+		}
+		return err
+	}
+	return nil
+}
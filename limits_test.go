@@ -0,0 +1,105 @@
+package fsevents_test
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"testing"
+
+	fsevents "github.com/tywkeene/go-fsevents"
+)
+
+var budgetTestDirs = []string{
+	testRootDir,
+	path.Join(testRootDir, "a"),
+	path.Join(testRootDir, "a/aa"),
+	path.Join(testRootDir, "b"),
+	path.Join(testRootDir, "b/bb"),
+}
+
+func TestReadLimits(t *testing.T) {
+	limits, err := fsevents.ReadLimits()
+	assert(t, (err == nil), err)
+	assert(t, (limits.MaxUserWatches > 0), fmt.Errorf("MaxUserWatches should be greater than 0"))
+	assert(t, (limits.MaxUserInstances > 0), fmt.Errorf("MaxUserInstances should be greater than 0"))
+	assert(t, (limits.MaxQueuedEvents > 0), fmt.Errorf("MaxQueuedEvents should be greater than 0"))
+}
+
+func TestUsage(t *testing.T) {
+	setupDirs(budgetTestDirs)
+	defer teardownDirs(budgetTestDirs)
+
+	w, err := fsevents.NewWatcher()
+	assert(t, (err == nil), err)
+	defer w.Close()
+
+	err = w.RecursiveAdd(testRootDir, fsevents.AllEvents)
+	assert(t, (err == nil), err)
+
+	usage, err := w.Usage()
+	assert(t, (err == nil), err)
+	assert(t, (usage.WatcherWatches == len(budgetTestDirs)), fmt.Errorf("WatcherWatches should be %d, got %d", len(budgetTestDirs), usage.WatcherWatches))
+	assert(t, (usage.ProcessWatches >= usage.WatcherWatches), fmt.Errorf("ProcessWatches should include this Watcher's watches"))
+	assert(t, (usage.ProcessInstances >= 1), fmt.Errorf("ProcessInstances should include this Watcher's instance"))
+	assert(t, (usage.UserWatches >= usage.ProcessWatches), fmt.Errorf("UserWatches should include this process's watches"))
+}
+
+func TestCountTree(t *testing.T) {
+	setupDirs(budgetTestDirs)
+	defer teardownDirs(budgetTestDirs)
+
+	count, err := fsevents.CountTree(testRootDir)
+	assert(t, (err == nil), err)
+	assert(t, (count.Directories == len(budgetTestDirs)), fmt.Errorf("CountTree should have counted %d directories, got %d", len(budgetTestDirs), count.Directories))
+	assert(t, (len(count.ByDepth) == 3), fmt.Errorf("CountTree should have counted 3 levels, got %d", len(count.ByDepth)))
+
+	assert(t, (count.MaxDepthWithin(0) == -1), fmt.Errorf("MaxDepthWithin(0) should have returned -1"))
+	assert(t, (count.MaxDepthWithin(2) == 0), fmt.Errorf("MaxDepthWithin(2) should have returned 0"))
+	assert(t, (count.MaxDepthWithin(3) == 1), fmt.Errorf("MaxDepthWithin(3) should have returned 1"))
+	assert(t, (count.MaxDepthWithin(5) == 2), fmt.Errorf("MaxDepthWithin(5) should have returned 2"))
+}
+
+func TestRecursiveAddBudget(t *testing.T) {
+	setupDirs(budgetTestDirs)
+	defer teardownDirs(budgetTestDirs)
+
+	// BudgetFail SHOULD refuse a tree that does not fit and add nothing
+	w, err := fsevents.NewWatcher()
+	assert(t, (err == nil), err)
+	defer w.Close()
+	w.WatchBudget = 4
+	err = w.RecursiveAddBudget(testRootDir, fsevents.AllEvents, fsevents.BudgetFail)
+	assert(t, (err != nil && strings.HasPrefix(err.Error(), fsevents.ErrWatchBudget.Error())), fmt.Errorf("RecursiveAddBudget should have returned %q, got %v", fsevents.ErrWatchBudget, err))
+	assert(t, (len(w.ListDescriptors()) == 0), fmt.Errorf("RecursiveAddBudget should not have left any descriptors behind"))
+
+	// BudgetDepth SHOULD only watch the levels that fit
+	w, err = fsevents.NewWatcher()
+	assert(t, (err == nil), err)
+	defer w.Close()
+	w.WatchBudget = 4
+	err = w.RecursiveAddBudget(testRootDir, fsevents.AllEvents, fsevents.BudgetDepth)
+	assert(t, (err == nil), err)
+	assert(t, (w.GetRunningDescriptors() == 3), fmt.Errorf("RecursiveAddBudget should have started 3 descriptors, got %d", w.GetRunningDescriptors()))
+	assert(t, (len(w.ListPollWatches()) == 0), fmt.Errorf("BudgetDepth should not have added poll watches"))
+
+	// BudgetPoll SHOULD poll the levels that do not fit
+	w, err = fsevents.NewWatcher()
+	assert(t, (err == nil), err)
+	defer w.Close()
+	w.WatchBudget = 4
+	err = w.RecursiveAddBudget(testRootDir, fsevents.AllEvents, fsevents.BudgetPoll)
+	assert(t, (err == nil), err)
+	assert(t, (w.GetRunningDescriptors() == 3), fmt.Errorf("RecursiveAddBudget should have started 3 descriptors, got %d", w.GetRunningDescriptors()))
+	assert(t, (len(w.ListPollWatches()) == 2), fmt.Errorf("BudgetPoll should have added 2 poll watches, got %d", len(w.ListPollWatches())))
+	for _, p := range w.ListPollWatches() {
+		assert(t, (w.RemovePollWatch(p) == nil), fmt.Errorf("RemovePollWatch should have removed %q", p))
+	}
+
+	// Any policy SHOULD add the whole tree when it fits
+	w, err = fsevents.NewWatcher()
+	assert(t, (err == nil), err)
+	defer w.Close()
+	err = w.RecursiveAddBudget(testRootDir, fsevents.AllEvents, fsevents.BudgetFail)
+	assert(t, (err == nil), err)
+	assert(t, (int(w.GetRunningDescriptors()) == len(budgetTestDirs)), fmt.Errorf("Count of running descriptors is not equal to number of directories"))
+}
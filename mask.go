@@ -0,0 +1,153 @@
+package fsevents
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+var (
+	ErrMaskNotUpdated = errors.New("descriptor mask could not be updated")
+)
+
+// UpdateMask replaces the mask of d. If d is running, its inotify watch is changed in place: the watch descriptor
+// stays the same and no event is lost in between, unlike with Stop and Start.
+// If other running descriptors share the watch, the watch keeps the events they need.
+func (d *WatchDescriptor) UpdateMask(mask uint32) error {
+	if d.watcher == nil {
+		return d.updateMask(mask)
+	}
+	d.watcher.Lock()
+	defer d.watcher.Unlock()
+	return d.updateMask(mask)
+}
+
+// AddToMask adds the events in mask to the mask of d. If d is running, they are added to its inotify watch with
+// MaskAdd, in place.
+func (d *WatchDescriptor) AddToMask(mask uint32) error {
+	if d.watcher != nil {
+		d.watcher.Lock()
+		defer d.watcher.Unlock()
+	}
+	if !d.Running {
+		d.Mask |= mask
+		return nil
+	}
+	if err := d.addWatch(mask | MaskAdd); err != nil {
+		return err
+	}
+	d.Mask |= mask
+	return nil
+}
+
+// RemoveFromMask removes the events in mask from the mask of d. If d is running, its inotify watch is changed
+// in place, see UpdateMask.
+func (d *WatchDescriptor) RemoveFromMask(mask uint32) error {
+	if d.watcher != nil {
+		d.watcher.Lock()
+		defer d.watcher.Unlock()
+	}
+	return d.updateMask(d.Mask &^ mask)
+}
+
+// updateMask replaces the mask of d, and of its inotify watch if d is running. The Watcher's lock must be held
+func (d *WatchDescriptor) updateMask(mask uint32) error {
+	if !d.Running {
+		d.Mask = mask
+		return nil
+	}
+	if err := d.addWatch(mask | d.sharedMask()); err != nil {
+		return err
+	}
+	d.Mask = mask
+	return nil
+}
+
+// sharedMask returns the union of the masks of the other running descriptors sharing the inotify watch of d.
+// The Watcher's lock must be held
+func (d *WatchDescriptor) sharedMask() uint32 {
+	var mask uint32
+	if d.watcher == nil || d.Inode == 0 {
+		return mask
+	}
+	for _, other := range d.watcher.Descriptors {
+		if other != d && other.Running && other.WatchDescriptor == d.WatchDescriptor {
+			mask |= other.Mask
+		}
+	}
+	return mask
+}
+
+// addWatch re-issues inotify_add_watch(2) for the running descriptor d with mask and the watch flags of d.
+// MaskCreate is left out, since the watch exists, and so is MaskAdd unless mask has it
+func (d *WatchDescriptor) addWatch(mask uint32) error {
+	if d.Inode != 0 {
+		// Adding a watch for whatever d.Path leads to now would not change the watch of d
+		if id, err := d.statFileID(); err != nil || id != d.fileID() {
+			return fmt.Errorf("%s: %q is no longer the watched directory", ErrMaskNotUpdated, d.Path)
+		}
+	}
+	flags := d.Flags &^ (MaskAdd | MaskCreate)
+	wd, err := unix.InotifyAddWatch(*d.InotifyDescriptor, d.Path, mask|flags)
+	if err != nil {
+		return fmt.Errorf("%s: %s", ErrMaskNotUpdated, err)
+	}
+	if wd != d.WatchDescriptor {
+		return fmt.Errorf("%s: %q is no longer the watched directory", ErrMaskNotUpdated, d.Path)
+	}
+	return nil
+}
+
+// SetMaskAll replaces the mask of every descriptor of Watcher w, see UpdateMask. If a descriptor cannot be updated,
+// the descriptors already updated are given their previous mask back, and the error is returned
+func (w *Watcher) SetMaskAll(mask uint32) error {
+	w.Lock()
+	defer w.Unlock()
+	descriptors := make([]*WatchDescriptor, 0, len(w.Descriptors))
+	for _, d := range w.Descriptors {
+		descriptors = append(descriptors, d)
+	}
+	return updateMasks(descriptors, mask)
+}
+
+// SetMaskUnder replaces the mask of the descriptors of Watcher w for rootPath and the directories below it,
+// see UpdateMask. Like SetMaskAll, it either updates every one of them or none
+func (w *Watcher) SetMaskUnder(rootPath string, mask uint32) error {
+	rootPath = filepath.Clean(rootPath)
+	prefix := rootPath + "/"
+	if rootPath == "/" {
+		prefix = rootPath
+	}
+	w.Lock()
+	defer w.Unlock()
+	descriptors := make([]*WatchDescriptor, 0)
+	for p, d := range w.Descriptors {
+		p = filepath.Clean(p)
+		if p == rootPath || strings.HasPrefix(p, prefix) {
+			descriptors = append(descriptors, d)
+		}
+	}
+	return updateMasks(descriptors, mask)
+}
+
+// updateMasks replaces the mask of descriptors, in the order of their paths. If one cannot be updated, those
+// updated before it get their previous mask back, as far as inotify allows, and its error is returned.
+// The Watcher's lock must be held
+func updateMasks(descriptors []*WatchDescriptor, mask uint32) error {
+	sort.Slice(descriptors, func(i, j int) bool { return descriptors[i].Path < descriptors[j].Path })
+	previous := make([]uint32, len(descriptors))
+	for i, d := range descriptors {
+		previous[i] = d.Mask
+		if err := d.updateMask(mask); err != nil {
+			for j := i - 1; j >= 0; j-- {
+				descriptors[j].updateMask(previous[j])
+			}
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,141 @@
+package fsevents_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	fsevents "github.com/tywkeene/go-fsevents"
+)
+
+func TestUpdateMask(t *testing.T) {
+	setupDirs([]string{testRootDir})
+	defer teardownDirs([]string{testRootDir})
+	w := flagsTestWatcher(t)
+	defer w.Close()
+
+	d, err := w.AddDescriptor(testRootDir, fsevents.Create)
+	assert(t, (err == nil), err)
+	assert(t, (d.Start() == nil), fmt.Errorf("Start should not have returned an error"))
+	wd := d.WatchDescriptor
+
+	assert(t, (d.UpdateMask(fsevents.Delete) == nil), fmt.Errorf("UpdateMask should not have returned an error"))
+	assert(t, (d.Running && d.WatchDescriptor == wd), fmt.Errorf("the descriptor should have kept running with the same watch"))
+	assert(t, (d.Mask == fsevents.Delete), fmt.Errorf("the mask should have been replaced, got %#x", d.Mask))
+	file := path.Join(testRootDir, "first")
+	writeRandomFile(file)
+	os.Remove(file)
+	event, err := readSingleEventTimeout(w, time.Second)
+	assert(t, (err == nil), err)
+	assert(t, (event.RawEvent.Mask == fsevents.Delete), fmt.Errorf("only the deletion should have been reported, got %#x", event.RawEvent.Mask))
+
+	assert(t, (d.AddToMask(fsevents.Create) == nil), fmt.Errorf("AddToMask should not have returned an error"))
+	assert(t, (d.Mask == fsevents.Create|fsevents.Delete), fmt.Errorf("the mask should have been extended, got %#x", d.Mask))
+	file = path.Join(testRootDir, "second")
+	writeRandomFile(file)
+	os.Remove(file)
+	for _, mask := range []uint32{fsevents.Create, fsevents.Delete} {
+		event, err := readSingleEventTimeout(w, time.Second)
+		assert(t, (err == nil), err)
+		assert(t, (event.RawEvent.Mask == mask), fmt.Errorf("expected event %#x, got %#x", mask, event.RawEvent.Mask))
+	}
+
+	assert(t, (d.RemoveFromMask(fsevents.Delete) == nil), fmt.Errorf("RemoveFromMask should not have returned an error"))
+	assert(t, (d.Mask == fsevents.Create && d.WatchDescriptor == wd), fmt.Errorf("the mask should have been reduced, got %#x", d.Mask))
+	file = path.Join(testRootDir, "third")
+	writeRandomFile(file)
+	os.Remove(file)
+	event, err = readSingleEventTimeout(w, time.Second)
+	assert(t, (err == nil), err)
+	assert(t, (event.RawEvent.Mask == fsevents.Create), fmt.Errorf("only the creation should have been reported, got %#x", event.RawEvent.Mask))
+	_, err = readSingleEventTimeout(w, 200*time.Millisecond)
+	assert(t, (err != nil), fmt.Errorf("the deletion should not have been reported"))
+}
+
+func TestUpdateMaskStopped(t *testing.T) {
+	setupDirs([]string{testRootDir})
+	defer teardownDirs([]string{testRootDir})
+	w := flagsTestWatcher(t)
+	defer w.Close()
+
+	d, err := w.AddDescriptor(testRootDir, fsevents.Create)
+	assert(t, (err == nil), err)
+	assert(t, (d.UpdateMask(fsevents.Delete) == nil), fmt.Errorf("UpdateMask should not have returned an error"))
+	assert(t, (!d.Running && d.Mask == fsevents.Delete), fmt.Errorf("the mask of a stopped descriptor should only have been replaced"))
+}
+
+func TestSetMaskUnder(t *testing.T) {
+	inner := path.Join(testRootDir, "inner")
+	other := testRootDir + "-other"
+	setupDirs([]string{testRootDir, inner, other})
+	defer teardownDirs([]string{testRootDir, other})
+	w := flagsTestWatcher(t)
+	defer w.Close()
+
+	for _, dir := range []string{testRootDir, inner, other} {
+		d, err := w.AddDescriptor(dir, fsevents.Create)
+		assert(t, (err == nil), err)
+		assert(t, (d.Start() == nil), fmt.Errorf("Start should not have returned an error"))
+	}
+	assert(t, (w.SetMaskUnder(testRootDir, fsevents.Delete) == nil), fmt.Errorf("SetMaskUnder should not have returned an error"))
+	for dir, mask := range map[string]uint32{testRootDir: fsevents.Delete, inner: fsevents.Delete, other: fsevents.Create} {
+		d := w.GetDescriptorByPath(dir)
+		assert(t, (d.Running && d.Mask == mask), fmt.Errorf("the mask for %s should have been %#x, got %#x", dir, mask, d.Mask))
+	}
+
+	assert(t, (w.SetMaskAll(fsevents.CloseWrite) == nil), fmt.Errorf("SetMaskAll should not have returned an error"))
+	writeRandomFile(path.Join(other, "file"))
+	event, err := readSingleEventTimeout(w, time.Second)
+	assert(t, (err == nil), err)
+	assert(t, (event.RawEvent.Mask == fsevents.CloseWrite), fmt.Errorf("only the close should have been reported, got %#x", event.RawEvent.Mask))
+}
+
+func TestSetMaskUnderRollback(t *testing.T) {
+	inner := path.Join(testRootDir, "inner")
+	setupDirs([]string{testRootDir, inner})
+	defer teardownDirs([]string{testRootDir})
+	w := flagsTestWatcher(t)
+	defer w.Close()
+
+	for _, dir := range []string{testRootDir, inner} {
+		d, err := w.AddDescriptor(dir, fsevents.Create)
+		assert(t, (err == nil), err)
+		assert(t, (d.Start() == nil), fmt.Errorf("Start should not have returned an error"))
+	}
+	// The watch of inner can no longer be updated once the directory is replaced
+	os.Remove(inner)
+	os.Mkdir(inner, 0755)
+
+	err := w.SetMaskUnder(testRootDir, fsevents.Delete)
+	assert(t, (err != nil), fmt.Errorf("SetMaskUnder should have returned an error"))
+	for _, dir := range []string{testRootDir, inner} {
+		d := w.GetDescriptorByPath(dir)
+		assert(t, (d.Mask == fsevents.Create), fmt.Errorf("the mask for %s should have been kept, got %#x", dir, d.Mask))
+	}
+	writeRandomFile(path.Join(testRootDir, "file"))
+	event, err := readSingleEventTimeout(w, time.Second)
+	for err == nil && event.Name != "file" {
+		// The events of the replaced directory
+		event, err = readSingleEventTimeout(w, time.Second)
+	}
+	assert(t, (err == nil), err)
+	assert(t, (event.RawEvent.Mask == fsevents.Create), fmt.Errorf("the watch should have kept its mask, got %#x", event.RawEvent.Mask))
+}
+
+func TestSetMaskUnderRoot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fsevents-mask")
+	assert(t, (err == nil), err)
+	defer os.RemoveAll(dir)
+	w := flagsTestWatcher(t)
+	defer w.Close()
+
+	d, err := w.AddDescriptor(dir, fsevents.Create)
+	assert(t, (err == nil), err)
+	assert(t, (d.Start() == nil), fmt.Errorf("Start should not have returned an error"))
+	// Every absolute path is below the root
+	assert(t, (w.SetMaskUnder("/", fsevents.Delete) == nil), fmt.Errorf("SetMaskUnder should not have returned an error"))
+	assert(t, (d.Mask == fsevents.Delete), fmt.Errorf("the mask for %s should have been updated, got %#x", dir, d.Mask))
+}
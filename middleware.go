@@ -0,0 +1,264 @@
+package fsevents
+
+import (
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// Middleware errors
+	ErrHandlerPanic   = errors.New("handler panicked")
+	ErrHandlerTimeout = errors.New("handler timed out")
+)
+
+// Middleware wraps an EventHandler in another, to run code before or after its Handle method,
+// or to change which events it handles
+type Middleware func(EventHandler) EventHandler
+
+// EventFilter returns true if an event should be handled
+type EventFilter func(event *FsEvent) bool
+
+// Logger is implemented by *log.Logger, and by most logging packages through an adapter
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+// PanicError is returned by handlers wrapped with Recover when they panic
+type PanicError struct {
+	// The value the handler panicked with
+	Value interface{}
+	// Stack trace of the goroutine at the time of the panic
+	Stack []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("%s: %v", ErrHandlerPanic, e.Value)
+}
+
+// middlewareHandler is the EventHandler returned by the built-in Middleware.
+// A nil handle or check falls through to the wrapped EventHandler.
+type middlewareHandler struct {
+	next   EventHandler
+	handle func(w *Watcher, event *FsEvent) error
+	check  func(event *FsEvent) bool
+}
+
+func (h *middlewareHandler) Handle(w *Watcher, event *FsEvent) error {
+	if h.handle == nil {
+		return h.next.Handle(w, event)
+	}
+	return h.handle(w, event)
+}
+
+func (h *middlewareHandler) Check(event *FsEvent) bool {
+	if h.check == nil {
+		return h.next.Check(event)
+	}
+	return h.check(event)
+}
+
+func (h *middlewareHandler) GetMask() uint32 {
+	return h.next.GetMask()
+}
+
+// Chain wraps handler in middleware. The first Middleware is the outermost: it is the first to see an event,
+// and the last to see the error returned by handler.
+func Chain(handler EventHandler, middleware ...Middleware) EventHandler {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		handler = middleware[i](handler)
+	}
+	return handler
+}
+
+// Recover returns a Middleware that turns a panic in Handle into a *PanicError, which WatchAndHandle writes to
+// w.Errors instead of crashing the process
+func Recover() Middleware {
+	return func(next EventHandler) EventHandler {
+		return &middlewareHandler{
+			next: next,
+			handle: func(w *Watcher, event *FsEvent) (err error) {
+				defer func() {
+					if value := recover(); value != nil {
+						err = &PanicError{Value: value, Stack: debug.Stack()}
+					}
+				}()
+				return next.Handle(w, event)
+			},
+		}
+	}
+}
+
+// Logging returns a Middleware that logs every event handled, with how long it took and the error returned,
+// as key=value pairs
+func Logging(logger Logger) Middleware {
+	return func(next EventHandler) EventHandler {
+		return &middlewareHandler{
+			next: next,
+			handle: func(w *Watcher, event *FsEvent) error {
+				start := time.Now()
+				err := next.Handle(w, event)
+				if err != nil {
+					logger.Printf("event id=%d path=%q mask=%#x duration=%s error=%q",
+						event.ID, event.Path, event.RawEvent.Mask, time.Since(start), err)
+				} else {
+					logger.Printf("event id=%d path=%q mask=%#x duration=%s",
+						event.ID, event.Path, event.RawEvent.Mask, time.Since(start))
+				}
+				return err
+			},
+		}
+	}
+}
+
+// Latency returns a Middleware that calls observe with how long Handle took for every event, and the error it returned
+func Latency(observe func(event *FsEvent, duration time.Duration, err error)) Middleware {
+	return func(next EventHandler) EventHandler {
+		return &middlewareHandler{
+			next: next,
+			handle: func(w *Watcher, event *FsEvent) error {
+				start := time.Now()
+				err := next.Handle(w, event)
+				observe(event, time.Since(start), err)
+				return err
+			},
+		}
+	}
+}
+
+// Filter returns a Middleware for which Check is false, and Handle does nothing, for events filter rejects
+func Filter(filter EventFilter) Middleware {
+	return func(next EventHandler) EventHandler {
+		return &middlewareHandler{
+			next: next,
+			handle: func(w *Watcher, event *FsEvent) error {
+				if !filter(event) {
+					return nil
+				}
+				return next.Handle(w, event)
+			},
+			check: func(event *FsEvent) bool {
+				return filter(event) && next.Check(event)
+			},
+		}
+	}
+}
+
+// matchAny returns true if eventPath matches one of patterns
+func matchAny(patterns []string, eventPath string) bool {
+	for _, pattern := range patterns {
+		if MatchPattern(pattern, eventPath) {
+			return true
+		}
+	}
+	return false
+}
+
+// IncludePaths returns a Middleware that only lets through events whose path matches one of patterns.
+// Patterns are matched with MatchPattern.
+func IncludePaths(patterns ...string) Middleware {
+	return Filter(func(event *FsEvent) bool {
+		return matchAny(patterns, event.Path)
+	})
+}
+
+// ExcludePaths returns a Middleware that drops events whose path matches one of patterns.
+// Patterns are matched with MatchPattern.
+func ExcludePaths(patterns ...string) Middleware {
+	return Filter(func(event *FsEvent) bool {
+		return !matchAny(patterns, event.Path)
+	})
+}
+
+// States of a handler run by the Timeout Middleware
+const (
+	handlerRunning int32 = iota
+	handlerReturned
+	handlerAbandoned
+)
+
+// Timeout returns a Middleware that stops waiting for Handle after timeout and returns ErrHandlerTimeout.
+// Handle keeps running in the background until it returns. Meanwhile it is counted in the HandlersAbandoned
+// Stats of the Watcher, and its error is then logged with the Watcher's Logger, see WithLogger.
+// Use a ContextHandler registered with a timeout for handlers that should stop once it has passed.
+func Timeout(timeout time.Duration) Middleware {
+	return func(next EventHandler) EventHandler {
+		return &middlewareHandler{
+			next: next,
+			handle: func(w *Watcher, event *FsEvent) error {
+				done := make(chan error, 1)
+				state := handlerRunning
+				go func() {
+					var err error
+					defer func() {
+						// A panic in this goroutine could not be recovered by Middleware wrapping this one
+						if value := recover(); value != nil {
+							err = &PanicError{Value: value, Stack: debug.Stack()}
+						}
+						if atomic.CompareAndSwapInt32(&state, handlerRunning, handlerReturned) {
+							done <- err
+						} else {
+							w.abandonedHandlerReturned(event, err)
+						}
+					}()
+					err = next.Handle(w, event)
+				}()
+				timer := time.NewTimer(timeout)
+				defer timer.Stop()
+				select {
+				case err := <-done:
+					return err
+				case <-timer.C:
+					// Counted first, so that the handler returning meanwhile never takes the count below zero
+					w.addAbandonedHandlers(1)
+					if !atomic.CompareAndSwapInt32(&state, handlerRunning, handlerAbandoned) {
+						w.addAbandonedHandlers(-1)
+						return <-done
+					}
+					return fmt.Errorf("%s: %q after %s", ErrHandlerTimeout, event.Path, timeout)
+				}
+			},
+		}
+	}
+}
+
+// addAbandonedHandlers adds delta to the count of handlers the Timeout Middleware stopped waiting for.
+// w is nil for handlers called outside of a Watcher
+func (w *Watcher) addAbandonedHandlers(delta int64) {
+	if w != nil {
+		atomic.AddInt64(&w.stats.HandlersAbandoned, delta)
+	}
+}
+
+// abandonedHandlerReturned accounts for a handler returning after the Timeout Middleware stopped waiting for it
+func (w *Watcher) abandonedHandlerReturned(event *FsEvent, err error) {
+	if w == nil {
+		return
+	}
+	w.addAbandonedHandlers(-1)
+	if err != nil {
+		w.logf("fsevents: handler for event %d for %q returned after timing out: %s", event.ID, event.Path, err)
+	} else {
+		w.logf("fsevents: handler for event %d for %q returned after timing out", event.ID, event.Path)
+	}
+}
+
+// Use adds middleware wrapping every EventHandler registered with w, in addition to any middleware they are
+// already wrapped in. Middleware added by earlier calls to Use is outermost.
+func (w *Watcher) Use(middleware ...Middleware) {
+	w.Lock()
+	defer w.Unlock()
+	w.middleware = append(w.middleware, middleware...)
+	w.chainHandlers()
+}
+
+// chainHandlers wraps every registered EventHandler in the Watcher's middleware, once rather than for every event.
+// The Watcher's lock must be held
+func (w *Watcher) chainHandlers() {
+	w.chainedHandlers = make([]EventHandler, len(w.eventHandlers))
+	for i, handle := range w.eventHandlers {
+		w.chainedHandlers[i] = Chain(handle, w.middleware...)
+	}
+}
@@ -0,0 +1,209 @@
+package fsevents_test
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"path"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	fsevents "github.com/tywkeene/go-fsevents"
+)
+
+// panicHandler panics when handling any event
+type panicHandler struct{}
+
+func (h *panicHandler) Handle(w *fsevents.Watcher, event *fsevents.FsEvent) error {
+	panic("handler bug")
+}
+
+func (h *panicHandler) GetMask() uint32 {
+	return fsevents.CloseWrite
+}
+
+func (h *panicHandler) Check(event *fsevents.FsEvent) bool {
+	return true
+}
+
+// slowHandler sleeps before returning
+type slowHandler struct {
+	delay time.Duration
+}
+
+func (h *slowHandler) Handle(w *fsevents.Watcher, event *fsevents.FsEvent) error {
+	time.Sleep(h.delay)
+	return nil
+}
+
+func (h *slowHandler) GetMask() uint32 {
+	return fsevents.Create
+}
+
+func (h *slowHandler) Check(event *fsevents.FsEvent) bool {
+	return true
+}
+
+// orderMiddleware appends name to order before and after the handler it wraps
+func orderMiddleware(name string, order *[]string) fsevents.Middleware {
+	return func(next fsevents.EventHandler) fsevents.EventHandler {
+		return fsevents.Chain(next, fsevents.Latency(func(event *fsevents.FsEvent, duration time.Duration, err error) {
+			*order = append(*order, name)
+		}))
+	}
+}
+
+func TestChain(t *testing.T) {
+	var order []string
+	h := &recordingHandler{Mask: fsevents.Create}
+	chained := fsevents.Chain(h, orderMiddleware("outer", &order), orderMiddleware("inner", &order))
+
+	assert(t, (chained.GetMask() == fsevents.Create), fmt.Errorf("Chain should not change the mask"))
+	assert(t, (chained.Handle(nil, routerTestEvent("test/a", fsevents.Create)) == nil), fmt.Errorf("Handle should not have returned an error"))
+	assert(t, (len(h.Handled) == 1), fmt.Errorf("wrapped handler should have been called"))
+	assert(t, (strings.Join(order, ",") == "inner,outer"), fmt.Errorf("middleware should have returned inner first, got %v", order))
+}
+
+func TestRecoverMiddleware(t *testing.T) {
+	h := fsevents.Chain(&panicHandler{}, fsevents.Recover())
+	err := h.Handle(nil, routerTestEvent("test/a", fsevents.CloseWrite))
+	panicErr, ok := err.(*fsevents.PanicError)
+	assert(t, (ok), fmt.Errorf("Handle should have returned a *PanicError, got %v", err))
+	assert(t, (panicErr.Value == "handler bug"), fmt.Errorf("PanicError should hold the panic value, got %v", panicErr.Value))
+	assert(t, (len(panicErr.Stack) > 0), fmt.Errorf("PanicError should hold a stack trace"))
+}
+
+func TestLoggingMiddleware(t *testing.T) {
+	var buf bytes.Buffer
+	h := fsevents.Chain(&recordingHandler{Err: fmt.Errorf("failed")}, fsevents.Logging(log.New(&buf, "", 0)))
+	h.Handle(nil, routerTestEvent("test/a.go", fsevents.Create))
+
+	line := buf.String()
+	assert(t, (strings.Contains(line, `path="test/a.go"`)), fmt.Errorf("log line should contain the path: %q", line))
+	assert(t, (strings.Contains(line, `error="failed"`)), fmt.Errorf("log line should contain the error: %q", line))
+	assert(t, (strings.Contains(line, "duration=")), fmt.Errorf("log line should contain the duration: %q", line))
+}
+
+func TestFilterMiddleware(t *testing.T) {
+	h := &recordingHandler{}
+	filtered := fsevents.Chain(h, fsevents.IncludePaths("*.go"), fsevents.ExcludePaths("vendor/**"))
+
+	for _, p := range []string{"test/a.go", "test/a.md", "vendor/b/b.go"} {
+		event := routerTestEvent(p, fsevents.Create)
+		if filtered.Check(event) {
+			filtered.Handle(nil, event)
+		}
+		// Handle must not let filtered events through either
+		filtered.Handle(nil, event)
+	}
+	assert(t, (len(h.Handled) == 2 && h.Handled[0] == "test/a.go"), fmt.Errorf("only test/a.go should have been handled, got %v", h.Handled))
+}
+
+func TestTimeoutMiddleware(t *testing.T) {
+	h := fsevents.Chain(&slowHandler{delay: time.Second}, fsevents.Timeout(10*time.Millisecond))
+	start := time.Now()
+	err := h.Handle(nil, routerTestEvent("test/a", fsevents.Create))
+	assert(t, (err != nil && strings.HasPrefix(err.Error(), fsevents.ErrHandlerTimeout.Error())),
+		fmt.Errorf("Handle should have returned ErrHandlerTimeout, got %v", err))
+	assert(t, (time.Since(start) < time.Second), fmt.Errorf("Handle should not have waited for the handler"))
+
+	h = fsevents.Chain(&slowHandler{}, fsevents.Timeout(time.Second))
+	assert(t, (h.Handle(nil, routerTestEvent("test/a", fsevents.Create)) == nil), fmt.Errorf("Handle should not have timed out"))
+}
+
+func TestTimeoutMiddlewareAbandoned(t *testing.T) {
+	w, err := fsevents.NewWatcher()
+	assert(t, (err == nil), err)
+	defer w.Close()
+
+	release := make(chan struct{})
+	returned := make(chan struct{})
+	h := fsevents.Chain(fsevents.NewFuncHandler(fsevents.Create, func(w *fsevents.Watcher, event *fsevents.FsEvent) error {
+		<-release
+		close(returned)
+		return nil
+	}), fsevents.Timeout(10*time.Millisecond))
+	err = h.Handle(w, routerTestEvent("test/a", fsevents.Create))
+	assert(t, (err != nil && strings.HasPrefix(err.Error(), fsevents.ErrHandlerTimeout.Error())),
+		fmt.Errorf("Handle should have returned ErrHandlerTimeout, got %v", err))
+	assert(t, (w.Stats().HandlersAbandoned == 1), fmt.Errorf("1 handler should still be running, got %d", w.Stats().HandlersAbandoned))
+
+	close(release)
+	<-returned
+	stats := waitForStats(w, func(s fsevents.Stats) bool { return s.HandlersAbandoned == 0 })
+	assert(t, (stats.HandlersAbandoned == 0), fmt.Errorf("no handler should be running anymore, got %d", stats.HandlersAbandoned))
+}
+
+func TestRouteMiddleware(t *testing.T) {
+	var order []string
+	r := fsevents.NewRouter()
+	r.Use(orderMiddleware("router", &order))
+	sub := r.Subrouter("test")
+	sub.Use(orderMiddleware("subrouter", &order))
+	sub.Route("*.go", fsevents.Create, &recordingHandler{}, orderMiddleware("route", &order))
+	sub.Route("*.md", fsevents.Create, &recordingHandler{}, fsevents.ExcludePaths("*.md"))
+
+	assert(t, (!r.Check(routerTestEvent("test/a.md", fsevents.Create))), fmt.Errorf("route middleware should have filtered the event"))
+	r.Handle(nil, routerTestEvent("test/a.go", fsevents.Create))
+	assert(t, (strings.Join(order, ",") == "route,subrouter,router"), fmt.Errorf("unexpected middleware order: %v", order))
+}
+
+func TestWatcherUseRecover(t *testing.T) {
+	setupDirs([]string{testRootDir})
+	defer teardownDirs([]string{testRootDir})
+
+	w, err := fsevents.NewWatcher()
+	assert(t, (err == nil), err)
+	defer w.Close()
+
+	w.Use(fsevents.Recover())
+	assert(t, (w.RegisterEventHandler(&panicHandler{}) == nil), fmt.Errorf("RegisterEventHandler should not have returned an error"))
+	d, err := w.AddDescriptor(testRootDir, fsevents.CloseWrite)
+	assert(t, (err == nil), err)
+	assert(t, (d.Start() == nil), fmt.Errorf("Start should not have returned an error"))
+	go w.WatchAndHandle()
+
+	assert(t, (writeRandomFile(path.Join(testRootDir, "panic")) == nil), fmt.Errorf("could not write file"))
+	select {
+	case err := <-w.Errors:
+		assert(t, (strings.Contains(err.Error(), fsevents.ErrHandlerPanic.Error())), fmt.Errorf("expected a handler panic error, got %v", err))
+	case <-time.After(5 * time.Second):
+		t.Fatal("no error reported for the handler panic")
+	}
+}
+
+func TestWatcherUseChainsOnce(t *testing.T) {
+	setupDirs([]string{testRootDir})
+	defer teardownDirs([]string{testRootDir})
+
+	w, err := fsevents.NewWatcher()
+	assert(t, (err == nil), err)
+	defer w.Close()
+
+	var chained int32
+	w.Use(func(next fsevents.EventHandler) fsevents.EventHandler {
+		atomic.AddInt32(&chained, 1)
+		return next
+	})
+	handled := make(chan struct{}, 3)
+	assert(t, (w.RegisterFunc(fsevents.CloseWrite, func(w *fsevents.Watcher, event *fsevents.FsEvent) error {
+		handled <- struct{}{}
+		return nil
+	}) == nil), fmt.Errorf("RegisterFunc should not have returned an error"))
+	d, err := w.AddDescriptor(testRootDir, fsevents.CloseWrite)
+	assert(t, (err == nil), err)
+	assert(t, (d.Start() == nil), fmt.Errorf("Start should not have returned an error"))
+	go w.WatchAndHandle()
+
+	for i := 0; i < 3; i++ {
+		writeRandomFile(path.Join(testRootDir, fmt.Sprintf("chain%d", i)))
+		select {
+		case <-handled:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("only %d events handled", i)
+		}
+	}
+	assert(t, (atomic.LoadInt32(&chained) == 1), fmt.Errorf("the middleware should have wrapped the handler once, got %d", chained))
+}
@@ -0,0 +1,152 @@
+package fsevents
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+// fileID identifies a file independently of the path it is reached through
+type fileID struct {
+	dev uint64
+	ino uint64
+}
+
+func statFileID(filePath string) (fileID, error) {
+	var stat unix.Stat_t
+	if err := unix.Stat(filePath, &stat); err != nil {
+		return fileID{}, err
+	}
+	return fileID{dev: uint64(stat.Dev), ino: stat.Ino}, nil
+}
+
+// statFileID returns the identity of the file d watches, which is the symbolic link itself if d has DontFollow
+func (d *WatchDescriptor) statFileID() (fileID, error) {
+	if !CheckMask(DontFollow, d.Flags) {
+		return statFileID(d.Path)
+	}
+	var stat unix.Stat_t
+	if err := unix.Lstat(d.Path, &stat); err != nil {
+		return fileID{}, err
+	}
+	return fileID{dev: uint64(stat.Dev), ino: stat.Ino}, nil
+}
+
+func (d *WatchDescriptor) fileID() fileID {
+	return fileID{dev: d.Device, ino: d.Inode}
+}
+
+// watchShared returns true if another running descriptor already watches the same directory as d
+func (w *Watcher) watchShared(d *WatchDescriptor) bool {
+	if d.Inode == 0 {
+		return false
+	}
+	w.watchRefsLock.Lock()
+	defer w.watchRefsLock.Unlock()
+	return w.watchRefs[d.fileID()] > 0
+}
+
+// refWatch records that d, which was just started, uses the kernel watch for its directory
+func (w *Watcher) refWatch(d *WatchDescriptor) {
+	if d.Inode == 0 {
+		return
+	}
+	w.watchRefsLock.Lock()
+	w.watchRefs[d.fileID()]++
+	w.watchRefsLock.Unlock()
+}
+
+// unrefWatch records that d is being stopped, and returns how many running descriptors still use its kernel watch
+func (w *Watcher) unrefWatch(d *WatchDescriptor) int {
+	if d.Inode == 0 {
+		return 0
+	}
+	w.watchRefsLock.Lock()
+	defer w.watchRefsLock.Unlock()
+	id := d.fileID()
+	if w.watchRefs[id] > 0 {
+		w.watchRefs[id]--
+	}
+	refs := w.watchRefs[id]
+	if refs == 0 {
+		delete(w.watchRefs, id)
+	}
+	return refs
+}
+
+// oneShot returns true if one of the descriptors of a kernel watch has OneShot, in which case the kernel removes
+// the watch after its first event
+func oneShot(descriptors []*WatchDescriptor) bool {
+	for _, d := range descriptors {
+		if CheckMask(OneShot, d.Mask|d.Flags) {
+			return true
+		}
+	}
+	return false
+}
+
+// watchRemoved marks the descriptors of a kernel watch the kernel removed by itself, because the directory was
+// deleted or its filesystem unmounted, as stopped. The Watcher's lock must be held, as for every change of Running
+func (w *Watcher) watchRemoved(descriptors []*WatchDescriptor) {
+	w.watchRefsLock.Lock()
+	defer w.watchRefsLock.Unlock()
+	for _, d := range descriptors {
+		if d.Running {
+			d.Running = false
+			delete(w.watchRefs, d.fileID())
+		}
+	}
+}
+
+// Aliases returns the paths of the other descriptors of Watcher w watching the same directory as the descriptor
+// for watchPath, such as the same directory reached through a bind mount. Events in that directory are
+// returned once for each of these paths.
+func (w *Watcher) Aliases(watchPath string) []string {
+	aliases := make([]string, 0)
+	w.Lock()
+	defer w.Unlock()
+	d, exists := w.Descriptors[watchPath]
+	if !exists || d.Inode == 0 {
+		return aliases
+	}
+	for p, other := range w.Descriptors {
+		if p != watchPath && other.fileID() == d.fileID() {
+			aliases = append(aliases, p)
+		}
+	}
+	return aliases
+}
+
+// rootDevice returns the device of rootPath if opts.SameFilesystem is set
+func (opts *RecursiveOptions) rootDevice(rootPath string) (uint64, error) {
+	if !opts.SameFilesystem {
+		return 0, nil
+	}
+	id, err := statFileID(rootPath)
+	return id.dev, err
+}
+
+// enter identifies the directory of job and decides whether the walk should add it. It returns false and a nil
+// error for a directory on another filesystem than rootDev when opts.SameFilesystem is set, and ErrDescLoop for a
+// directory that is its own ancestor, which can only be reached through a bind mount.
+func (opts *RecursiveOptions) enter(job *walkJob, rootDev uint64) (bool, error) {
+	id, err := statFileID(job.path)
+	if err != nil {
+		return false, err
+	}
+	job.id = id
+	if opts.SameFilesystem && id.dev != rootDev {
+		return false, nil
+	}
+	for _, ancestor := range job.ancestors {
+		if ancestor == id {
+			return false, ErrDescLoop
+		}
+	}
+	return true, nil
+}
+
+// child returns the job for the subdirectory childPath of the directory of job
+func (job *walkJob) child(childPath string) walkJob {
+	ancestors := make([]fileID, len(job.ancestors), len(job.ancestors)+1)
+	copy(ancestors, job.ancestors)
+	return walkJob{path: childPath, depth: job.depth + 1, ancestors: append(ancestors, job.id)}
+}
@@ -0,0 +1,190 @@
+package fsevents_test
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"sync"
+	"testing"
+	"time"
+
+	fsevents "github.com/tywkeene/go-fsevents"
+	"golang.org/x/sys/unix"
+)
+
+// mountOrSkip mounts source at target, skipping the test if mounting is not permitted
+func mountOrSkip(t *testing.T, source string, target string, fstype string, flags uintptr) {
+	if err := unix.Mount(source, target, fstype, flags, ""); err != nil {
+		t.Skipf("could not mount %q at %q: %s", source, target, err)
+	}
+}
+
+// readResult is an event or error returned by ReadSingleEvent
+type readResult struct {
+	event *fsevents.FsEvent
+	err   error
+}
+
+var (
+	readersLock sync.Mutex
+	// The results of the goroutine reading the events of each Watcher, see readSingleEventTimeout
+	readers = make(map[*fsevents.Watcher]chan readResult)
+)
+
+// readSingleEventTimeout returns the next event of w, or an error if none is read within timeout. A single
+// goroutine reads the events of w until it is closed, so that an event read after a timeout is returned by the
+// next call instead of being lost, and ReadSingleEvent is never called concurrently
+func readSingleEventTimeout(w *fsevents.Watcher, timeout time.Duration) (*fsevents.FsEvent, error) {
+	readersLock.Lock()
+	results, exists := readers[w]
+	if !exists {
+		results = make(chan readResult)
+		readers[w] = results
+		go func() {
+			done := w.Context().Done()
+			defer func() {
+				readersLock.Lock()
+				delete(readers, w)
+				readersLock.Unlock()
+			}()
+			for {
+				event, err := w.ReadSingleEvent()
+				select {
+				case results <- readResult{event, err}:
+				case <-done:
+					return
+				}
+			}
+		}()
+	}
+	readersLock.Unlock()
+
+	select {
+	case r := <-results:
+		return r.event, r.err
+	case <-time.After(timeout):
+		return nil, fmt.Errorf("no event read after %s", timeout)
+	}
+}
+
+func TestAliasedDescriptors(t *testing.T) {
+	realDir := path.Join(testRootDir, "real")
+	setupDirs([]string{testRootDir, realDir, testRootDir2})
+	defer teardownDirs([]string{testRootDir, testRootDir2})
+
+	// The same directory reached through a second path
+	linkDir := path.Join(testRootDir2, "link")
+	err := os.Symlink("../test/real", linkDir)
+	assert(t, (err == nil), err)
+
+	w, err := fsevents.NewWatcher()
+	assert(t, (err == nil), err)
+	defer w.Close()
+
+	realDesc, err := w.AddDescriptor(realDir, fsevents.Create)
+	assert(t, (err == nil), err)
+	linkDesc, err := w.AddDescriptor(linkDir, fsevents.Delete)
+	assert(t, (err == nil), err)
+	assert(t, (realDesc.Start() == nil), fmt.Errorf("Start should not have returned an error"))
+	assert(t, (linkDesc.Start() == nil), fmt.Errorf("Start should not have returned an error"))
+	assert(t, (realDesc.WatchDescriptor == linkDesc.WatchDescriptor), fmt.Errorf("Both descriptors should share a kernel watch"))
+
+	aliases := w.Aliases(realDir)
+	assert(t, (len(aliases) == 1 && aliases[0] == linkDir), fmt.Errorf("Aliases should have returned %q, got %v", linkDir, aliases))
+
+	// The second Start SHOULD NOT have replaced the mask of the first
+	err = writeRandomFile(path.Join(realDir, "created"))
+	assert(t, (err == nil), err)
+	event, err := readSingleEventTimeout(w, time.Second)
+	assert(t, (err == nil), err)
+	assert(t, (event.IsFileCreated() && event.Path == path.Join(realDir, "created")), fmt.Errorf("Expected a create event for %q, got %q", path.Join(realDir, "created"), event.Path))
+
+	// Events SHOULD be fanned out to every path whose mask includes them
+	err = os.Remove(path.Join(realDir, "created"))
+	assert(t, (err == nil), err)
+	event, err = readSingleEventTimeout(w, time.Second)
+	assert(t, (err == nil), err)
+	assert(t, (event.IsFileRemoved() && event.Path == path.Join(linkDir, "created")), fmt.Errorf("Expected a delete event for %q, got %q", path.Join(linkDir, "created"), event.Path))
+
+	// Stopping one descriptor SHOULD NOT remove the kernel watch used by the other
+	assert(t, (linkDesc.Stop() == nil), fmt.Errorf("Stop should not have returned an error"))
+	err = writeRandomFile(path.Join(realDir, "created-again"))
+	assert(t, (err == nil), err)
+	event, err = readSingleEventTimeout(w, time.Second)
+	assert(t, (err == nil), err)
+	assert(t, (event.Path == path.Join(realDir, "created-again")), fmt.Errorf("Expected an event for %q, got %q", path.Join(realDir, "created-again"), event.Path))
+
+	// The remaining descriptor SHOULD NOT receive the events the kernel watch still has for the stopped one
+	err = os.Remove(path.Join(realDir, "created-again"))
+	assert(t, (err == nil), err)
+	err = writeRandomFile(path.Join(realDir, "created-last"))
+	assert(t, (err == nil), err)
+	event, err = readSingleEventTimeout(w, time.Second)
+	assert(t, (err == nil), err)
+	assert(t, (event.IsFileCreated() && event.Path == path.Join(realDir, "created-last")), fmt.Errorf("Expected a create event for %q, got %q", path.Join(realDir, "created-last"), event.Path))
+}
+
+func TestRecursiveAddSameFilesystem(t *testing.T) {
+	mountDir := path.Join(testRootDir, "mnt")
+	setupDirs([]string{testRootDir, mountDir})
+	defer teardownDirs([]string{testRootDir})
+
+	mountOrSkip(t, "none", mountDir, "tmpfs", 0)
+	defer unix.Unmount(mountDir, 0)
+	setupDirs([]string{path.Join(mountDir, "inside")})
+
+	w, err := fsevents.NewWatcher()
+	assert(t, (err == nil), err)
+	defer w.Close()
+
+	for _, workers := range []int{0, 4} {
+		result, err := w.RecursiveAddWithOptions(testRootDir, fsevents.AllEvents, fsevents.RecursiveOptions{SameFilesystem: true, Workers: workers})
+		assert(t, (err == nil), err)
+		assert(t, (len(result.Added) == 1), fmt.Errorf("RecursiveAddWithOptions should have added 1 descriptor, got %d", len(result.Added)))
+		assert(t, (len(result.Boundaries) == 1 && result.Boundaries[0] == mountDir), fmt.Errorf("RecursiveAddWithOptions should have stopped at %q, got %v", mountDir, result.Boundaries))
+		assert(t, (w.RemoveDescriptor(testRootDir) == nil), fmt.Errorf("RemoveDescriptor should not have returned an error"))
+	}
+}
+
+func TestRecursiveAddBindLoop(t *testing.T) {
+	loopDir := path.Join(testRootDir, "a", "loop")
+	setupDirs([]string{testRootDir, path.Join(testRootDir, "a"), loopDir})
+	defer teardownDirs([]string{testRootDir})
+
+	mountOrSkip(t, testRootDir, loopDir, "", unix.MS_BIND)
+	defer unix.Unmount(loopDir, 0)
+
+	w, err := fsevents.NewWatcher()
+	assert(t, (err == nil), err)
+	defer w.Close()
+
+	result, err := w.RecursiveAddWithOptions(testRootDir, fsevents.AllEvents, fsevents.RecursiveOptions{})
+	assert(t, (err == nil), err)
+	assert(t, (len(result.Skipped) == 1 && result.Skipped[0].Err == fsevents.ErrDescLoop), fmt.Errorf("RecursiveAddWithOptions should have skipped the bind mount loop, got %v", result.Skipped))
+	assert(t, (len(result.Added) == 2), fmt.Errorf("RecursiveAddWithOptions should have added 2 descriptors, got %d", len(result.Added)))
+}
+
+func TestUnmountEvent(t *testing.T) {
+	mountDir := path.Join(testRootDir, "mnt")
+	setupDirs([]string{testRootDir, mountDir})
+	defer teardownDirs([]string{testRootDir})
+
+	mountOrSkip(t, "none", mountDir, "tmpfs", 0)
+
+	w, err := fsevents.NewWatcher()
+	assert(t, (err == nil), err)
+	defer w.Close()
+
+	d, err := w.AddDescriptor(mountDir, fsevents.AllEvents)
+	assert(t, (err == nil), err)
+	assert(t, (d.Start() == nil), fmt.Errorf("Start should not have returned an error"))
+
+	err = unix.Unmount(mountDir, 0)
+	assert(t, (err == nil), err)
+
+	event, err := readSingleEventTimeout(w, time.Second)
+	assert(t, (err == nil), err)
+	assert(t, (event.IsUnmount()), fmt.Errorf("Expected an unmount event, got mask %d", event.RawEvent.Mask))
+	assert(t, (d.Running == false), fmt.Errorf("The descriptor should no longer be running after an unmount"))
+	assert(t, (w.GetRunningDescriptors() == 0), fmt.Errorf("GetRunningDescriptors should have returned 0"))
+}
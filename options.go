@@ -0,0 +1,152 @@
+package fsevents
+
+import (
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Backend is the mechanism a Watcher uses to find out about changes
+type Backend int
+
+const (
+	// BackendInotify watches directories with inotify. NewWatcher fails if an inotify instance cannot be created
+	BackendInotify Backend = iota
+	// BackendPoll watches directory trees by scanning them every Watcher.PollInterval, see AddPollWatch.
+	// No inotify instance is created, AddDescriptor fails with ErrPollBackend and RecursiveAdd adds poll watches
+	BackendPoll
+	// BackendAuto uses inotify if an instance can be created, and polling otherwise. With inotify, directories on
+	// filesystems where it is unreliable are polled when adding trees recursively, see Watcher.PollUnreliable
+	BackendAuto
+)
+
+// Clock tells the time events are timestamped with
+type Clock interface {
+	Now() time.Time
+}
+
+// systemClock is the Clock of Watchers not given WithClock
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+// watcherConfig holds the settings NewWatcher builds a Watcher with
+type watcherConfig struct {
+	eventBuffer  int
+	errorBuffer  int
+	eventPolicy  BufferPolicy
+	errorPolicy  BufferPolicy
+	errorHandler func(err error)
+	initFlags    int
+	defaultMask  uint32
+	recursive    RecursiveOptions
+	filters      []EventFilter
+	clock        Clock
+	logger       Logger
+	backend      Backend
+}
+
+// Option configures a Watcher created by NewWatcher
+type Option func(*watcherConfig)
+
+// defaultConfig returns the settings of a Watcher created without options
+func defaultConfig() watcherConfig {
+	return watcherConfig{
+		initFlags:   unix.IN_CLOEXEC,
+		defaultMask: AllEvents,
+		clock:       systemClock{},
+		backend:     BackendInotify,
+	}
+}
+
+// WithInitFlags sets the flags the inotify instance is created with, see inotify_init1(2).
+// The default is IN_CLOEXEC, so that child processes do not inherit the inotify descriptor.
+// ReadSingleEvent waits for events with poll(2) whatever the flags, so that Close releases it.
+func WithInitFlags(flags int) Option {
+	return func(c *watcherConfig) {
+		c.initFlags = flags
+	}
+}
+
+// WithDefaultMask sets the mask used by AddDescriptor, RecursiveAdd, RecursiveAddWithOptions and AddPollWatch
+// when they are given a mask of zero. The default is AllEvents
+func WithDefaultMask(mask uint32) Option {
+	return func(c *watcherConfig) {
+		c.defaultMask = mask
+	}
+}
+
+// WithRecursiveOptions sets the RecursiveOptions RecursiveAdd walks directory trees with
+func WithRecursiveOptions(opts RecursiveOptions) Option {
+	return func(c *watcherConfig) {
+		c.recursive = opts
+	}
+}
+
+// WithFilter drops the events filter rejects before they reach w.Events, subscriptions or EventHandlers.
+// Given several times, an event must pass every filter.
+func WithFilter(filter EventFilter) Option {
+	return func(c *watcherConfig) {
+		c.filters = append(c.filters, filter)
+	}
+}
+
+// WithClock makes the Watcher timestamp events with clock instead of the system clock
+func WithClock(clock Clock) Option {
+	return func(c *watcherConfig) {
+		c.clock = clock
+	}
+}
+
+// WithLogger makes the Watcher log what it cannot report otherwise, such as dropped events and errors,
+// disconnected subscriptions and errors no one was receiving
+func WithLogger(logger Logger) Option {
+	return func(c *watcherConfig) {
+		c.logger = logger
+	}
+}
+
+// WithBackend selects how the Watcher finds out about changes, see Backend. The default is BackendInotify
+func WithBackend(backend Backend) Option {
+	return func(c *watcherConfig) {
+		c.backend = backend
+	}
+}
+
+// WithEventBuffer makes w.Events a channel buffered for size events. By default it is unbuffered
+func WithEventBuffer(size int) Option {
+	return func(c *watcherConfig) {
+		c.eventBuffer = size
+	}
+}
+
+// WithErrorBuffer makes w.Errors a channel buffered for size errors. By default it is unbuffered
+func WithErrorBuffer(size int) Option {
+	return func(c *watcherConfig) {
+		c.errorBuffer = size
+	}
+}
+
+// WithEventPolicy sets what happens to events when w.Events is full, see BufferPolicy. The default is BufferBlock
+func WithEventPolicy(policy BufferPolicy) Option {
+	return func(c *watcherConfig) {
+		c.eventPolicy = policy
+	}
+}
+
+// WithErrorPolicy sets what happens to errors when w.Errors is full, see BufferPolicy. The default is BufferBlock
+func WithErrorPolicy(policy BufferPolicy) Option {
+	return func(c *watcherConfig) {
+		c.errorPolicy = policy
+	}
+}
+
+// WithErrorHandler makes the Watcher call handler with every error, instead of writing them to w.Errors.
+// handler is called from the goroutine the error happened in, and must not block.
+func WithErrorHandler(handler func(err error)) Option {
+	return func(c *watcherConfig) {
+		c.errorHandler = handler
+	}
+}
@@ -0,0 +1,200 @@
+package fsevents_test
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	fsevents "github.com/tywkeene/go-fsevents"
+	"golang.org/x/sys/unix"
+)
+
+// syncLogger records the messages logged to it
+type syncLogger struct {
+	sync.Mutex
+	messages []string
+}
+
+func (l *syncLogger) Printf(format string, v ...interface{}) {
+	l.Lock()
+	defer l.Unlock()
+	l.messages = append(l.messages, fmt.Sprintf(format, v...))
+}
+
+func (l *syncLogger) String() string {
+	l.Lock()
+	defer l.Unlock()
+	return strings.Join(l.messages, "\n")
+}
+
+// fixedClock always tells the same time
+type fixedClock struct {
+	now time.Time
+}
+
+func (c fixedClock) Now() time.Time {
+	return c.now
+}
+
+func TestInitFlags(t *testing.T) {
+	w, err := fsevents.NewWatcher()
+	assert(t, (err == nil), err)
+	defer w.Close()
+	flags, err := unix.FcntlInt(uintptr(w.InotifyDescriptor), unix.F_GETFD, 0)
+	assert(t, (err == nil), err)
+	assert(t, (flags&unix.FD_CLOEXEC != 0), fmt.Errorf("the inotify descriptor should be close-on-exec by default"))
+
+	setupDirs([]string{testRootDir})
+	defer teardownDirs([]string{testRootDir})
+
+	nonblock, err := fsevents.NewWatcher(fsevents.WithInitFlags(unix.IN_CLOEXEC | unix.IN_NONBLOCK))
+	assert(t, (err == nil), err)
+	d, err := nonblock.AddDescriptor(testRootDir, fsevents.CloseWrite)
+	assert(t, (err == nil), err)
+	assert(t, (d.Start() == nil), fmt.Errorf("Start should not have returned an error"))
+
+	writeRandomFile(path.Join(testRootDir, "nonblock"))
+	event, err := nonblock.ReadSingleEvent()
+	assert(t, (err == nil && event.Name == "nonblock"), fmt.Errorf("ReadSingleEvent should have waited for the event, got %v", err))
+
+	// Close releases a ReadSingleEvent waiting for events
+	result := make(chan error, 1)
+	go func() {
+		_, err := nonblock.ReadSingleEvent()
+		result <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	nonblock.Close()
+	select {
+	case err := <-result:
+		assert(t, (err == fsevents.ErrWatcherClosed), fmt.Errorf("ReadSingleEvent should have returned ErrWatcherClosed, got %v", err))
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close did not release ReadSingleEvent")
+	}
+
+	// And so it does without IN_NONBLOCK
+	d, err = w.AddDescriptor(testRootDir, fsevents.CloseWrite)
+	assert(t, (err == nil), err)
+	assert(t, (d.Start() == nil), fmt.Errorf("Start should not have returned an error"))
+	go func() {
+		_, err := w.ReadSingleEvent()
+		result <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	w.Close()
+	select {
+	case err := <-result:
+		assert(t, (err == fsevents.ErrWatcherClosed), fmt.Errorf("ReadSingleEvent should have returned ErrWatcherClosed, got %v", err))
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close did not release ReadSingleEvent")
+	}
+}
+
+func TestWatcherOptions(t *testing.T) {
+	setupDirs([]string{testRootDir})
+	defer teardownDirs([]string{testRootDir})
+
+	logger := &syncLogger{}
+	clock := fixedClock{now: time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)}
+	w, err := fsevents.NewWatcher(
+		fsevents.WithDefaultMask(fsevents.CloseWrite),
+		fsevents.WithFilter(func(event *fsevents.FsEvent) bool { return !strings.HasSuffix(event.Name, ".tmp") }),
+		fsevents.WithClock(clock),
+		fsevents.WithLogger(logger),
+		fsevents.WithEventBuffer(1),
+		fsevents.WithEventPolicy(fsevents.BufferDrop),
+	)
+	assert(t, (err == nil), err)
+	defer w.Close()
+
+	d, err := w.AddDescriptor(testRootDir, 0)
+	assert(t, (err == nil), err)
+	assert(t, (d.Mask == fsevents.CloseWrite), fmt.Errorf("AddDescriptor should have used the default mask, got %#x", d.Mask))
+	assert(t, (d.Start() == nil), fmt.Errorf("Start should not have returned an error"))
+
+	writeRandomFile(path.Join(testRootDir, "skipped.tmp"))
+	writeRandomFile(path.Join(testRootDir, "kept"))
+	event, err := w.ReadSingleEvent()
+	assert(t, (err == nil), err)
+	assert(t, (event.Name == "kept"), fmt.Errorf("the filter should have dropped skipped.tmp, got %q", event.Name))
+	assert(t, (event.Timestamp.Equal(clock.now)), fmt.Errorf("the event should have been timestamped by the clock, got %s", event.Timestamp))
+
+	// The first event fills the buffer, the second is dropped and logged
+	go w.Watch()
+	writeRandomFile(path.Join(testRootDir, "first"))
+	writeRandomFile(path.Join(testRootDir, "second"))
+	waitForStats(w, func(s fsevents.Stats) bool { return s.EventsDropped >= 1 })
+	assert(t, (strings.Contains(logger.String(), "dropped event")), fmt.Errorf("the dropped event should have been logged: %q", logger.String()))
+}
+
+func TestPollBackend(t *testing.T) {
+	setupDirs([]string{testRootDir})
+	defer teardownDirs([]string{testRootDir})
+
+	w, err := fsevents.NewWatcher(fsevents.WithBackend(fsevents.BackendPoll))
+	assert(t, (err == nil), err)
+	defer w.Close()
+	w.PollInterval = 20 * time.Millisecond
+
+	assert(t, (w.Backend() == fsevents.BackendPoll), fmt.Errorf("Backend should have returned BackendPoll"))
+	assert(t, (w.InotifyDescriptor == -1), fmt.Errorf("no inotify instance should have been created"))
+	_, err = w.AddDescriptor(testRootDir, fsevents.AllEvents)
+	assert(t, (err == fsevents.ErrPollBackend), fmt.Errorf("AddDescriptor should have returned ErrPollBackend, got %v", err))
+
+	assert(t, (w.RecursiveAdd(testRootDir, fsevents.Create) == nil), fmt.Errorf("RecursiveAdd should not have returned an error"))
+	assert(t, (len(w.ListPollWatches()) == 1), fmt.Errorf("RecursiveAdd should have added a poll watch"))
+	writeRandomFile(path.Join(testRootDir, "polled"))
+	event, err := readEventTimeout(w, 5*time.Second)
+	assert(t, (err == nil), err)
+	assert(t, (event.Name == "polled" && fsevents.CheckMask(fsevents.Create, event.RawEvent.Mask)),
+		fmt.Errorf("expected the creation of polled, got %q %#x", event.Name, event.RawEvent.Mask))
+
+	auto, err := fsevents.NewWatcher(fsevents.WithBackend(fsevents.BackendAuto))
+	assert(t, (err == nil), err)
+	defer auto.Close()
+	assert(t, (auto.Backend() == fsevents.BackendInotify), fmt.Errorf("BackendAuto should have used inotify"))
+	assert(t, (auto.PollUnreliable), fmt.Errorf("BackendAuto should poll unreliable filesystems"))
+}
+
+func TestPollBackendWatchAndHandle(t *testing.T) {
+	setupDirs([]string{testRootDir})
+	defer teardownDirs([]string{testRootDir})
+
+	errs := make(chan error, 16)
+	w, err := fsevents.NewWatcher(fsevents.WithBackend(fsevents.BackendPoll), fsevents.WithErrorHandler(func(err error) { errs <- err }))
+	assert(t, (err == nil), err)
+	w.PollInterval = 20 * time.Millisecond
+	assert(t, (w.RecursiveAdd(testRootDir, fsevents.Create) == nil), fmt.Errorf("RecursiveAdd should not have returned an error"))
+
+	handled := make(chan *fsevents.FsEvent, 1)
+	w.RegisterEventHandler(fsevents.NewFuncHandler(fsevents.Create, func(w *fsevents.Watcher, event *fsevents.FsEvent) error {
+		handled <- event
+		return nil
+	}))
+	done := make(chan struct{})
+	go func() {
+		w.WatchAndHandle()
+		close(done)
+	}()
+
+	// The poll watch keeps WatchAndHandle running, and its events go to the handlers
+	writeRandomFile(path.Join(testRootDir, "handled"))
+	select {
+	case event := <-handled:
+		assert(t, (event.Name == "handled"), fmt.Errorf("expected the creation of handled, got %q", event.Name))
+	case err := <-errs:
+		t.Fatalf("unexpected error %s", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the event was not handled")
+	}
+
+	w.Close()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("WatchAndHandle should have returned once the Watcher was closed")
+	}
+}
@@ -0,0 +1,320 @@
+package fsevents
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// DefaultPollInterval is how often directory trees watched by polling are scanned, unless Watcher.PollInterval is set
+const DefaultPollInterval = time.Second
+
+// Set in the cookies of the moves found by comparing scans, so that they never pair with moves read from inotify,
+// whose cookies come from a counter that would have to count 2^31 moves to reach it
+const syntheticCookie = 1 << 31
+
+// pollEntry is the state of a file or directory as seen by the last scan of a poll watch
+type pollEntry struct {
+	ino   uint64
+	size  int64
+	mtime time.Time
+	mode  os.FileMode
+	// Content hash, only set for snapshots taken with SnapshotOptions.Hash
+	hash string
+}
+
+// pollWatch is a directory tree that is watched by periodically scanning it instead of through inotify
+type pollWatch struct {
+	// Synthetic descriptor attached to the events of this tree. Its WatchDescriptor is always -1
+	descriptor *WatchDescriptor
+	// State of every file and directory below the root as of the last scan, key: path
+	entries map[string]pollEntry
+}
+
+// poller scans the poll watches of a Watcher every Watcher.PollInterval
+type poller struct {
+	sync.Mutex
+	// Poll watches, key: root path
+	watches map[string]*pollWatch
+	// Closed to stop the scanning goroutine
+	stop chan struct{}
+	// Last cookie used to pair MovedFrom and MovedTo events
+	cookie uint32
+}
+
+// pollChange is a single change found by comparing two scans
+type pollChange struct {
+	path   string
+	mask   uint32
+	cookie uint32
+}
+
+// scanTree records the state of every file and directory below rootPath
+func scanTree(rootPath string) (map[string]pollEntry, error) {
+	entries := make(map[string]pollEntry)
+	pending := []string{rootPath}
+	for len(pending) > 0 {
+		dir := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+
+		children, err := ioutil.ReadDir(dir)
+		if err != nil {
+			if dir != rootPath && os.IsNotExist(err) {
+				// Removed between listing its parent and reading it
+				continue
+			}
+			return nil, err
+		}
+		for _, child := range children {
+			childPath := path.Clean(path.Join(dir, child.Name()))
+			entry := pollEntry{
+				size:  child.Size(),
+				mtime: child.ModTime(),
+				mode:  child.Mode(),
+			}
+			if stat, ok := child.Sys().(*syscall.Stat_t); ok {
+				entry.ino = stat.Ino
+			}
+			entries[childPath] = entry
+			if child.IsDir() {
+				pending = append(pending, childPath)
+			}
+		}
+	}
+	return entries, nil
+}
+
+// newSyntheticEvent builds an FsEvent for a change that was not read from the inotify descriptor
+func (w *Watcher) newSyntheticEvent(descriptor *WatchDescriptor, eventPath string, mask uint32, cookie uint32) *FsEvent {
+	event := &FsEvent{
+		Name:       path.Base(eventPath),
+		Path:       eventPath,
+		Descriptor: descriptor,
+		RawEvent:   &unix.InotifyEvent{Wd: -1, Mask: mask, Cookie: cookie},
+		ID:         w.GetEventCount(),
+		Timestamp:  w.now(),
+	}
+	w.incrementEventCount()
+	return event
+}
+
+// diff compares two scans of a poll watch and returns the events describing the changes between them,
+// keeping only the events included in the poll watch's mask
+func (p *poller) diff(pw *pollWatch, current map[string]pollEntry) []*pollChange {
+	return diffEntries(pw.entries, current, pw.descriptor.Mask, func() uint32 {
+		p.cookie++
+		return p.cookie
+	})
+}
+
+// diffEntries compares two states of a tree and returns the events describing the changes between them, keeping
+// only the events included in mask. Files that kept their inode under another path are reported as moves, with
+// cookies from nextCookie, with syntheticCookie set
+func diffEntries(previous map[string]pollEntry, current map[string]pollEntry, mask uint32, nextCookie func() uint32) []*pollChange {
+	changes := make([]*pollChange, 0)
+	add := func(eventPath string, entry pollEntry, flags uint32, cookie uint32) {
+		if flags &= mask; flags == 0 {
+			return
+		}
+		if entry.mode.IsDir() {
+			flags |= IsDir
+		}
+		changes = append(changes, &pollChange{path: eventPath, mask: flags, cookie: cookie})
+	}
+
+	created := make(map[uint64]string)
+	for p, entry := range current {
+		if _, exists := previous[p]; !exists {
+			created[entry.ino] = p
+		}
+	}
+
+	movedTo := make(map[string]bool)
+	removed := make([]string, 0)
+	for p := range previous {
+		if _, exists := current[p]; !exists {
+			removed = append(removed, p)
+		}
+	}
+	sort.Strings(removed)
+	for _, oldPath := range removed {
+		entry := previous[oldPath]
+		if newPath, moved := created[entry.ino]; moved && entry.ino != 0 {
+			cookie := nextCookie() | syntheticCookie
+			add(oldPath, entry, MovedFrom, cookie)
+			add(newPath, current[newPath], MovedTo, cookie)
+			movedTo[newPath] = true
+			delete(created, entry.ino)
+			continue
+		}
+		add(oldPath, entry, Delete, 0)
+	}
+
+	paths := make([]string, 0, len(current))
+	for p := range current {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	for _, newPath := range paths {
+		entry := current[newPath]
+		old, existed := previous[newPath]
+		if !existed {
+			if !movedTo[newPath] {
+				add(newPath, entry, Create, 0)
+			}
+			continue
+		}
+		if old.mode != entry.mode {
+			add(newPath, entry, AttrChange, 0)
+		}
+		contentChanged := old.size != entry.size || !old.mtime.Equal(entry.mtime) ||
+			(old.hash != "" && entry.hash != "" && old.hash != entry.hash)
+		if !entry.mode.IsDir() && contentChanged {
+			add(newPath, entry, Modified|CloseWrite, 0)
+		}
+	}
+	return changes
+}
+
+// pollOnce scans every poll watch of the Watcher and delivers the changes found
+func (w *Watcher) pollOnce(p *poller) {
+	p.Lock()
+	roots := make([]string, 0, len(p.watches))
+	for root := range p.watches {
+		roots = append(roots, root)
+	}
+	p.Unlock()
+	sort.Strings(roots)
+
+	for _, root := range roots {
+		current, err := scanTree(root)
+
+		p.Lock()
+		pw, exists := p.watches[root]
+		if !exists {
+			p.Unlock()
+			continue
+		}
+		if err != nil {
+			p.Unlock()
+			if os.IsNotExist(err) {
+				w.RemovePollWatch(root)
+				if CheckMask(RootDelete, pw.descriptor.Mask) {
+					w.deliver(w.newSyntheticEvent(pw.descriptor, root, RootDelete, 0))
+				}
+				continue
+			}
+			w.reportError(fmt.Errorf("%s: %q: %s", ErrReadError, root, err))
+			continue
+		}
+		changes := p.diff(pw, current)
+		pw.entries = current
+		p.Unlock()
+
+		for _, change := range changes {
+			w.deliver(w.newSyntheticEvent(pw.descriptor, change.path, change.mask, change.cookie))
+		}
+	}
+}
+
+// runPoller calls pollOnce every w.PollInterval until stop is closed
+func (w *Watcher) runPoller(p *poller, stop chan struct{}) {
+	ticker := time.NewTicker(w.PollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			w.pollOnce(p)
+		}
+	}
+}
+
+// AddPollWatch watches the directory at rootPath, and everything below it, by scanning it every w.PollInterval
+// instead of using inotify. This costs no inotify watches and works on filesystems where inotify does not,
+// at the price of latency and I/O. Changes are delivered as regular FsEvents whose Descriptor is a WatchDescriptor
+// for rootPath with a WatchDescriptor of -1. Only the changes included in mask are delivered.
+func (w *Watcher) AddPollWatch(rootPath string, mask uint32) error {
+	if mask == 0 {
+		mask = w.config.defaultMask
+	}
+	if _, err := os.Stat(rootPath); os.IsNotExist(err) {
+		return fmt.Errorf("%s: %s", ErrDescNotCreated, "directory does not exist")
+	}
+	entries, err := scanTree(rootPath)
+	if err != nil {
+		return fmt.Errorf("%s: %s", ErrDescNotCreated, err)
+	}
+
+	w.Lock()
+	defer w.Unlock()
+	if w.poller == nil {
+		w.poller = &poller{watches: make(map[string]*pollWatch)}
+	}
+	p := w.poller
+
+	p.Lock()
+	defer p.Unlock()
+	if _, exists := p.watches[rootPath]; exists {
+		return ErrPollExists
+	}
+	descriptor := newWatchDescriptor(rootPath, mask, -1)
+	descriptor.Running = true
+	p.watches[rootPath] = &pollWatch{descriptor: descriptor, entries: entries}
+
+	if p.stop == nil {
+		p.stop = make(chan struct{})
+		go w.runPoller(p, p.stop)
+	}
+	return nil
+}
+
+// RemovePollWatch stops polling the directory tree at rootPath
+func (w *Watcher) RemovePollWatch(rootPath string) error {
+	w.Lock()
+	p := w.poller
+	w.Unlock()
+	if p == nil {
+		return ErrPollNotFound
+	}
+
+	p.Lock()
+	defer p.Unlock()
+	pw, exists := p.watches[rootPath]
+	if !exists {
+		return ErrPollNotFound
+	}
+	pw.descriptor.Running = false
+	delete(p.watches, rootPath)
+
+	if len(p.watches) == 0 && p.stop != nil {
+		close(p.stop)
+		p.stop = nil
+	}
+	return nil
+}
+
+// ListPollWatches returns the root paths of every directory tree watched by polling
+func (w *Watcher) ListPollWatches() []string {
+	list := make([]string, 0)
+	w.Lock()
+	p := w.poller
+	w.Unlock()
+	if p == nil {
+		return list
+	}
+	p.Lock()
+	defer p.Unlock()
+	for root := range p.watches {
+		list = append(list, root)
+	}
+	return list
+}
@@ -0,0 +1,77 @@
+package fsevents_test
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	fsevents "github.com/tywkeene/go-fsevents"
+)
+
+func readEventTimeout(w *fsevents.Watcher, timeout time.Duration) (*fsevents.FsEvent, error) {
+	select {
+	case event := <-w.Events:
+		return event, nil
+	case err := <-w.Errors:
+		return nil, err
+	case <-time.After(timeout):
+		return nil, fmt.Errorf("no event received after %s", timeout)
+	}
+}
+
+func TestPollWatch(t *testing.T) {
+	testDirs := []string{testRootDir, path.Join(testRootDir, "sub"), testRootDir2}
+	setupDirs(testDirs)
+	defer teardownDirs(testDirs)
+
+	w, err := fsevents.NewWatcher()
+	assert(t, (err == nil), err)
+	defer w.Close()
+	w.PollInterval = 10 * time.Millisecond
+
+	err = w.AddPollWatch(testRootDir, fsevents.FileCreatedEvent|fsevents.FileRemovedEvent|fsevents.FileChangedEvent)
+	assert(t, (err == nil), err)
+	defer w.RemovePollWatch(testRootDir)
+
+	// AddPollWatch SHOULD return ErrPollExists for a tree that is already polled
+	err = w.AddPollWatch(testRootDir, fsevents.AllEvents)
+	assert(t, (err == fsevents.ErrPollExists), fmt.Errorf("AddPollWatch should have returned %q", fsevents.ErrPollExists))
+
+	// Write the file outside of the tree first so a scan can't see it half written
+	filePath := path.Join(testRootDir, "sub", "poll-file")
+	err = writeRandomFile(path.Join(testRootDir2, "poll-file"))
+	assert(t, (err == nil), err)
+	err = os.Rename(path.Join(testRootDir2, "poll-file"), filePath)
+	assert(t, (err == nil), err)
+
+	event, err := readEventTimeout(w, time.Second)
+	assert(t, (err == nil), err)
+	assert(t, (event.IsFileCreated()), fmt.Errorf("Expected a file created event, got mask %d", event.RawEvent.Mask))
+	assert(t, (event.Path == path.Clean(filePath)), fmt.Errorf("Expected event path %q, got %q", path.Clean(filePath), event.Path))
+	assert(t, (event.Descriptor.WatchDescriptor == -1), fmt.Errorf("Poll events should have a WatchDescriptor of -1"))
+
+	movedPath := path.Join(testRootDir, "poll-file-moved")
+	err = os.Rename(filePath, movedPath)
+	assert(t, (err == nil), err)
+
+	from, err := readEventTimeout(w, time.Second)
+	assert(t, (err == nil), err)
+	to, err := readEventTimeout(w, time.Second)
+	assert(t, (err == nil), err)
+	assert(t, (fsevents.CheckMask(fsevents.MovedFrom, from.RawEvent.Mask)), fmt.Errorf("Expected a MovedFrom event, got mask %d", from.RawEvent.Mask))
+	assert(t, (fsevents.CheckMask(fsevents.MovedTo, to.RawEvent.Mask)), fmt.Errorf("Expected a MovedTo event, got mask %d", to.RawEvent.Mask))
+	assert(t, (from.RawEvent.Cookie == to.RawEvent.Cookie), fmt.Errorf("MovedFrom and MovedTo events should share a cookie"))
+
+	err = os.Remove(movedPath)
+	assert(t, (err == nil), err)
+
+	event, err = readEventTimeout(w, time.Second)
+	assert(t, (err == nil), err)
+	assert(t, (event.IsFileRemoved()), fmt.Errorf("Expected a file removed event, got mask %d", event.RawEvent.Mask))
+
+	// RemovePollWatch SHOULD return ErrPollNotFound for a tree that is not polled
+	err = w.RemovePollWatch("not_there")
+	assert(t, (err == fsevents.ErrPollNotFound), fmt.Errorf("RemovePollWatch should have returned %q", fsevents.ErrPollNotFound))
+}
@@ -0,0 +1,231 @@
+package fsevents
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+)
+
+// RecursiveOptions configures how RecursiveAddWithOptions walks a directory tree
+type RecursiveOptions struct {
+	// Skip directories that cannot be read or watched because of their permissions, instead of failing
+	SkipUnreadable bool
+	// Skip directories that are removed while the tree is being walked, instead of failing
+	SkipVanished bool
+	// Maximum number of levels of the tree to watch, rootPath being the first. Zero means no limit
+	MaxDepth int
+	// Watch the directories just below MaxDepth, and everything below them, by polling (see AddPollWatch)
+	PollBelowMaxDepth bool
+	// Stop at the first error and remove every descriptor and poll watch added so far
+	Atomic bool
+	// Number of directories listed and added concurrently. Values above 1 walk the tree with a pool of
+	// Workers goroutines reading directories with getdents(2), which avoids stat'ing every entry
+	Workers int
+	// Called with the progress of the walk after every directory. Only used when Workers is above 1.
+	// Calls are serialized, and the walk waits for Progress to return.
+	Progress func(WalkProgress)
+	// Do not descend into directories on other filesystems than rootPath, like find -xdev
+	SameFilesystem bool
+}
+
+// SkippedPath is a directory RecursiveAddWithOptions did not watch, and why
+type SkippedPath struct {
+	Path string
+	Err  error
+}
+
+// RecursiveResult lists what RecursiveAddWithOptions did to the Watcher
+type RecursiveResult struct {
+	// Paths of the descriptors that were added and started
+	Added []string
+	// Root paths of the poll watches that were added
+	Polled []string
+	// Directories that were skipped because of SkipUnreadable or SkipVanished, or because they are their own
+	// ancestor through a bind mount (ErrDescLoop)
+	Skipped []SkippedPath
+	// Directories that were not entered because they are on another filesystem, see SameFilesystem
+	Boundaries []string
+	// True if an error caused everything in Added and Polled to be removed again
+	RolledBack bool
+}
+
+// isVanished returns true if the error err, returned while adding dirPath, happened because dirPath no longer exists
+func isVanished(dirPath string, err error) bool {
+	if os.IsNotExist(err) {
+		return true
+	}
+	_, statErr := os.Lstat(dirPath)
+	return os.IsNotExist(statErr)
+}
+
+// isUnreadable returns true if the error err happened because of a lack of permissions
+func isUnreadable(err error) bool {
+	return errors.Is(err, os.ErrPermission)
+}
+
+// skip returns true if the error err, returned while adding dirPath, should be skipped according to opts
+func (opts *RecursiveOptions) skip(dirPath string, err error) bool {
+	return (opts.SkipVanished && isVanished(dirPath, err)) || (opts.SkipUnreadable && isUnreadable(err))
+}
+
+// addDirectory adds and starts a descriptor for the directory of job, which enter identified, and returns the
+// directories directly below it
+func (w *Watcher) addDirectory(job *walkJob, mask uint32) ([]string, error) {
+	dirPath := job.path
+	children, err := ioutil.ReadDir(dirPath)
+	if err != nil {
+		return nil, err
+	}
+	d, err := w.addDescriptor(dirPath, mask, 0, job.id)
+	if err != nil {
+		return nil, err
+	}
+	// Started under the lock, since events of the Watcher may be read meanwhile
+	w.Lock()
+	err = d.start()
+	if err != nil {
+		delete(w.Descriptors, dirPath)
+	}
+	w.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	dirs := make([]string, 0)
+	for _, child := range children {
+		if child.IsDir() {
+			dirs = append(dirs, path.Clean(path.Join(dirPath, child.Name())))
+		}
+	}
+	return dirs, nil
+}
+
+// rollback stops and removes the descriptors and poll watches listed in result
+func (w *Watcher) rollback(result *RecursiveResult) {
+	w.Lock()
+	for _, p := range result.Added {
+		if d, exists := w.Descriptors[p]; exists {
+			if d.Running {
+				// The directory may have been removed in the meantime, in which case the kernel already dropped the watch
+				d.stop()
+			}
+			delete(w.Descriptors, p)
+		}
+	}
+	w.Unlock()
+	for _, p := range result.Polled {
+		w.RemovePollWatch(p)
+	}
+	result.RolledBack = true
+}
+
+// reportSkipped writes the error for a skipped directory to w.Errors, if something is receiving from it
+func (w *Watcher) reportSkipped(skipped SkippedPath) {
+	w.tryReportError(fmt.Errorf("skipped recursive-descriptor for path %q: %s", skipped.Path, skipped.Err))
+}
+
+// RecursiveAddWithOptions adds the directory at rootPath, and directories below it, using the flags provided in mask.
+// The tree is walked breadth first, and opts decides what happens when a directory cannot be added.
+// Errors concerning rootPath itself are never skipped. The returned RecursiveResult is never nil, and lists
+// what was added even when an error is returned.
+//
+// If w.PollUnreliable is set, directories on filesystems where inotify is unreliable are watched by polling,
+// along with everything below them. If the Watcher uses BackendPoll, the whole tree is watched by polling.
+//
+// When opts.Workers is above 1, each directory is watched before it is listed, and directories that changed while
+// the tree was walked are listed again once it is done, so that directories created during the walk are not missed.
+func (w *Watcher) RecursiveAddWithOptions(rootPath string, mask uint32, opts RecursiveOptions) (*RecursiveResult, error) {
+	if mask == 0 {
+		mask = w.config.defaultMask
+	}
+	if w.backend == BackendPoll {
+		result := newRecursiveResult()
+		if err := w.AddPollWatch(rootPath, mask); err != nil {
+			return result, err
+		}
+		result.Polled = append(result.Polled, rootPath)
+		return result, nil
+	}
+	if opts.Workers > 1 {
+		return w.walkParallel(rootPath, mask, opts)
+	}
+
+	result := newRecursiveResult()
+	rootDev, err := opts.rootDevice(rootPath)
+	if err != nil {
+		return result, err
+	}
+
+	level := []walkJob{{path: rootPath, depth: 1}}
+	for len(level) > 0 {
+		var next []walkJob
+		for _, job := range level {
+			beyond := opts.MaxDepth > 0 && job.depth > opts.MaxDepth
+			if beyond && !opts.PollBelowMaxDepth {
+				continue
+			}
+
+			enter, err := opts.enter(&job, rootDev)
+			if err == nil && !enter {
+				result.Boundaries = append(result.Boundaries, job.path)
+				continue
+			}
+			if err == nil && (beyond || w.pollInstead(&job)) {
+				if err = w.AddPollWatch(job.path, mask); err == nil {
+					result.Polled = append(result.Polled, job.path)
+					continue
+				}
+			} else if err == nil {
+				var children []string
+				if children, err = w.addDirectory(&job, mask); err == nil {
+					result.Added = append(result.Added, job.path)
+					for _, child := range children {
+						next = append(next, job.child(child))
+					}
+					continue
+				}
+			}
+
+			if err == ErrDescLoop {
+				result.Skipped = append(result.Skipped, SkippedPath{Path: job.path, Err: err})
+				continue
+			}
+			if job.path != rootPath && opts.skip(job.path, err) {
+				skipped := SkippedPath{Path: job.path, Err: err}
+				result.Skipped = append(result.Skipped, skipped)
+				w.reportSkipped(skipped)
+				continue
+			}
+			return result, w.recursiveAddFailed(result, opts, rootPath, job.path, err)
+		}
+		level = next
+	}
+	return result, nil
+}
+
+func newRecursiveResult() *RecursiveResult {
+	return &RecursiveResult{
+		Added:      make([]string, 0),
+		Polled:     make([]string, 0),
+		Skipped:    make([]SkippedPath, 0),
+		Boundaries: make([]string, 0),
+	}
+}
+
+// recursiveAddFailed rolls back result if opts asks for it and returns the error describing the failure at dirPath
+func (w *Watcher) recursiveAddFailed(result *RecursiveResult, opts RecursiveOptions, rootPath string, dirPath string, err error) error {
+	if opts.Atomic {
+		w.rollback(result)
+	}
+	return recursiveAddError(rootPath, dirPath, err)
+}
+
+// recursiveAddError returns the error describing a failure to add dirPath while adding the tree at rootPath
+func recursiveAddError(rootPath string, dirPath string, err error) error {
+	if dirPath == rootPath {
+		return err
+	}
+	return fmt.Errorf("could not add recursive-descriptor for path %q: %w", dirPath, err)
+}
@@ -0,0 +1,97 @@
+package fsevents_test
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"testing"
+
+	fsevents "github.com/tywkeene/go-fsevents"
+)
+
+var recursiveTestDirs = []string{
+	testRootDir,
+	path.Join(testRootDir, "a"),
+	path.Join(testRootDir, "a/aa"),
+	path.Join(testRootDir, "b"),
+	path.Join(testRootDir, "b/bb"),
+}
+
+func TestRecursiveAddAtomic(t *testing.T) {
+	setupDirs(recursiveTestDirs)
+	defer teardownDirs(recursiveTestDirs)
+
+	w, err := fsevents.NewWatcher()
+	assert(t, (err == nil), err)
+	defer w.Close()
+
+	// A descriptor that already exists makes the walk fail when it reaches "b"
+	_, err = w.AddDescriptor(path.Join(testRootDir, "b"), fsevents.AllEvents)
+	assert(t, (err == nil), err)
+
+	result, err := w.RecursiveAddWithOptions(testRootDir, fsevents.AllEvents, fsevents.RecursiveOptions{Atomic: true})
+	assert(t, (err != nil), fmt.Errorf("RecursiveAddWithOptions should have returned an error"))
+	assert(t, (result.RolledBack), fmt.Errorf("RecursiveAddWithOptions should have rolled back"))
+	assert(t, (len(result.Added) == 2), fmt.Errorf("RecursiveAddWithOptions should have listed 2 added descriptors, got %d", len(result.Added)))
+	assert(t, (w.GetRunningDescriptors() == 0), fmt.Errorf("RecursiveAddWithOptions should not have left running descriptors behind"))
+	assert(t, (len(w.ListDescriptors()) == 1), fmt.Errorf("RecursiveAddWithOptions should only have removed the descriptors it added"))
+}
+
+func TestRecursiveAddNotAtomic(t *testing.T) {
+	setupDirs(recursiveTestDirs)
+	defer teardownDirs(recursiveTestDirs)
+
+	w, err := fsevents.NewWatcher()
+	assert(t, (err == nil), err)
+	defer w.Close()
+
+	_, err = w.AddDescriptor(path.Join(testRootDir, "b"), fsevents.AllEvents)
+	assert(t, (err == nil), err)
+
+	// Without Atomic, the descriptors added before the failure SHOULD be left in place
+	result, err := w.RecursiveAddWithOptions(testRootDir, fsevents.AllEvents, fsevents.RecursiveOptions{})
+	assert(t, (err != nil), fmt.Errorf("RecursiveAddWithOptions should have returned an error"))
+	assert(t, (!result.RolledBack), fmt.Errorf("RecursiveAddWithOptions should not have rolled back"))
+	assert(t, (int(w.GetRunningDescriptors()) == len(result.Added)), fmt.Errorf("Every added descriptor should still be running"))
+}
+
+func TestRecursiveAddMaxDepth(t *testing.T) {
+	setupDirs(recursiveTestDirs)
+	defer teardownDirs(recursiveTestDirs)
+
+	w, err := fsevents.NewWatcher()
+	assert(t, (err == nil), err)
+	defer w.Close()
+
+	result, err := w.RecursiveAddWithOptions(testRootDir, fsevents.AllEvents, fsevents.RecursiveOptions{MaxDepth: 2})
+	assert(t, (err == nil), err)
+	assert(t, (len(result.Added) == 3), fmt.Errorf("RecursiveAddWithOptions should have added 3 descriptors, got %d", len(result.Added)))
+	assert(t, (w.DescriptorExists(path.Join(testRootDir, "a/aa")) == false), fmt.Errorf("RecursiveAddWithOptions should not have added a descriptor below MaxDepth"))
+}
+
+func TestRecursiveAddSkipUnreadable(t *testing.T) {
+	if os.Getuid() == 0 {
+		t.Skip("permissions are not enforced for root")
+	}
+	setupDirs(recursiveTestDirs)
+	defer teardownDirs(recursiveTestDirs)
+
+	unreadable := path.Join(testRootDir, "a")
+	err := os.Chmod(unreadable, 0)
+	assert(t, (err == nil), err)
+	defer os.Chmod(unreadable, 0777)
+
+	w, err := fsevents.NewWatcher()
+	assert(t, (err == nil), err)
+	defer w.Close()
+
+	// Without SkipUnreadable the walk SHOULD fail
+	_, err = w.RecursiveAddWithOptions(testRootDir, fsevents.AllEvents, fsevents.RecursiveOptions{Atomic: true})
+	assert(t, (err != nil && errors.Is(err, os.ErrPermission)), fmt.Errorf("RecursiveAddWithOptions should have returned a permission error, got %v", err))
+
+	result, err := w.RecursiveAddWithOptions(testRootDir, fsevents.AllEvents, fsevents.RecursiveOptions{SkipUnreadable: true})
+	assert(t, (err == nil), err)
+	assert(t, (len(result.Skipped) == 1 && result.Skipped[0].Path == unreadable), fmt.Errorf("RecursiveAddWithOptions should have skipped %q", unreadable))
+	assert(t, (len(result.Added) == 3), fmt.Errorf("RecursiveAddWithOptions should have added 3 descriptors, got %d", len(result.Added)))
+}
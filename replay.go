@@ -0,0 +1,293 @@
+package fsevents
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+var (
+	ErrNotRecording     = errors.New("not a recording of events")
+	ErrRecordingVersion = errors.New("unsupported recording version")
+	ErrRecorderClosed   = errors.New("recorder closed")
+)
+
+// Version of the recordings written by Recorder
+const RecordingVersion = 1
+
+// Start of every recording, followed by its version
+var recordingMagic = []byte("FSEVREC")
+
+// Recorder writes events to a recording, along with when they were recorded, for a Replayer to play them back.
+// A recording is a header followed by, for each event, its offset from the start of the recording in nanoseconds
+// as a varint and the event as written by EventWriter.
+type Recorder struct {
+	sync.Mutex
+	w      *bufio.Writer
+	events *EventWriter
+	// Closed by Close, if the recording was created by CreateRecording
+	file   *os.File
+	clock  Clock
+	start  time.Time
+	closed bool
+}
+
+// NewRecorder returns a Recorder writing a recording to w. Offsets of events are measured with clock, nil meaning
+// the system clock, from the call to NewRecorder.
+func NewRecorder(w io.Writer, clock Clock) (*Recorder, error) {
+	if clock == nil {
+		clock = systemClock{}
+	}
+	r := &Recorder{w: bufio.NewWriter(w), clock: clock, start: clock.Now()}
+	r.events = NewEventWriter(r.w)
+	r.w.Write(recordingMagic)
+	r.w.WriteByte(RecordingVersion)
+	if err := r.w.Flush(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// CreateRecording creates the file at file, replacing any existing file, and returns a Recorder writing to it
+func CreateRecording(file string) (*Recorder, error) {
+	f, err := os.Create(file)
+	if err != nil {
+		return nil, err
+	}
+	r, err := NewRecorder(f, nil)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	r.file = f
+	return r, nil
+}
+
+// Record writes event to the recording. Every event is flushed to the underlying writer, so that a recording
+// is complete up to the last event recorded when the process dies.
+func (r *Recorder) Record(event *FsEvent) error {
+	r.Lock()
+	defer r.Unlock()
+	if r.closed {
+		return ErrRecorderClosed
+	}
+	offset := r.clock.Now().Sub(r.start)
+	if offset < 0 {
+		offset = 0
+	}
+	r.w.Write(appendUvarint(nil, uint64(offset)))
+	if err := r.events.Write(event); err != nil {
+		return err
+	}
+	return r.w.Flush()
+}
+
+// Consume records the events received on events until it is closed, such as the Events of a Subscription
+func (r *Recorder) Consume(events <-chan *FsEvent) error {
+	for event := range events {
+		if err := r.Record(event); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close flushes the recording, and closes its file if it was created by CreateRecording
+func (r *Recorder) Close() error {
+	r.Lock()
+	defer r.Unlock()
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+	err := r.w.Flush()
+	if r.file != nil {
+		if closeErr := r.file.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// Recording returns a Middleware that records every event handled with r before handling it. An error recording
+// the event is returned once the event was handled, unless handling it failed too.
+func Recording(r *Recorder) Middleware {
+	return func(next EventHandler) EventHandler {
+		return &middlewareHandler{
+			next: next,
+			handle: func(w *Watcher, event *FsEvent) error {
+				recordErr := r.Record(event)
+				if err := next.Handle(w, event); err != nil {
+					return err
+				}
+				return recordErr
+			},
+		}
+	}
+}
+
+// ReplayOptions configures how a Replayer plays a recording back
+type ReplayOptions struct {
+	// Factor the delays between events are divided by: 1 replays at the original speed, 10 ten times as fast.
+	// Zero means 1, and a negative Speed replays without delays
+	Speed float64
+	// If not nil, each event is replayed once a value is received on Step, and Speed is ignored
+	Step <-chan struct{}
+}
+
+// RecordedEvent is an event read from a recording
+type RecordedEvent struct {
+	// When the event was recorded, from the start of the recording
+	Offset time.Duration
+	Event  *FsEvent
+}
+
+// Replayer plays back a recording written by a Recorder
+type Replayer struct {
+	r      *bufio.Reader
+	events *EventReader
+	// Closed by Close, if the recording was opened by OpenRecording
+	file *os.File
+	opts ReplayOptions
+	// Offset of the last event read
+	last time.Duration
+}
+
+// NewReplayer returns a Replayer reading a recording from r
+func NewReplayer(r io.Reader, opts ReplayOptions) (*Replayer, error) {
+	p := &Replayer{r: bufio.NewReader(r), opts: opts}
+	// Shares the buffered reader
+	p.events = NewEventReader(p.r)
+	header := make([]byte, len(recordingMagic)+1)
+	if _, err := io.ReadFull(p.r, header); err != nil || string(header[:len(recordingMagic)]) != string(recordingMagic) {
+		return nil, ErrNotRecording
+	}
+	if version := header[len(recordingMagic)]; version == 0 || version > RecordingVersion {
+		return nil, fmt.Errorf("%s: %d", ErrRecordingVersion, version)
+	}
+	return p, nil
+}
+
+// OpenRecording opens the recording at file
+func OpenRecording(file string, opts ReplayOptions) (*Replayer, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	p, err := NewReplayer(f, opts)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	p.file = f
+	return p, nil
+}
+
+// Next returns the next event of the recording without waiting. It returns io.EOF at the end of the recording,
+// and io.ErrUnexpectedEOF if the recording ends within an event
+func (p *Replayer) Next() (*RecordedEvent, error) {
+	offset, err := binary.ReadUvarint(p.r)
+	if err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, err
+		}
+		return nil, fmt.Errorf("%s: %s", ErrEventEncoding, err)
+	}
+	event, err := p.events.Read()
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &RecordedEvent{Offset: time.Duration(offset), Event: event}, nil
+}
+
+// wait waits until the event recorded at offset is due, according to the options of p
+func (p *Replayer) wait(ctx context.Context, offset time.Duration) error {
+	delay := offset - p.last
+	p.last = offset
+	if p.opts.Step != nil {
+		select {
+		case <-p.opts.Step:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	if p.opts.Speed < 0 || delay <= 0 {
+		return ctx.Err()
+	}
+	if p.opts.Speed > 0 {
+		delay = time.Duration(float64(delay) / p.opts.Speed)
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// replay passes each event of the rest of the recording to deliver when it is due
+func (p *Replayer) replay(ctx context.Context, deliver func(event *FsEvent) error) error {
+	for {
+		recorded, err := p.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := p.wait(ctx, recorded.Offset); err != nil {
+			return err
+		}
+		if err := deliver(recorded.Event); err != nil {
+			return err
+		}
+	}
+}
+
+// Replay sends the events of the rest of the recording on events, like Watch sends events on w.Events, with the
+// delays between them given by the options of p. It returns once the recording was played back, or with the
+// error of ctx once it is done.
+func (p *Replayer) Replay(ctx context.Context, events chan<- *FsEvent) error {
+	return p.replay(ctx, func(event *FsEvent) error {
+		select {
+		case events <- event:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	})
+}
+
+// ReplayHandlers passes the events of the rest of the recording to the EventHandlers registered with w, through
+// its middleware and Dispatcher like WatchAndHandle does, with the delays between them given by the options of p.
+// Errors of the handlers are reported on w.Errors. Events recorded without an inotify event, which handlers cannot
+// be matched to, are skipped. It returns once the recording was played back, or with the error of ctx once it is
+// done.
+func (p *Replayer) ReplayHandlers(ctx context.Context, w *Watcher) error {
+	return p.replay(ctx, func(event *FsEvent) error {
+		if event.RawEvent != nil {
+			w.handleEvent(event)
+		}
+		return nil
+	})
+}
+
+// Close closes the file of the recording if it was opened by OpenRecording
+func (p *Replayer) Close() error {
+	if p.file == nil {
+		return nil
+	}
+	return p.file.Close()
+}
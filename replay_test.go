@@ -0,0 +1,130 @@
+package fsevents_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	fsevents "github.com/tywkeene/go-fsevents"
+)
+
+// recordTestEvents records an event named after each offset, at that offset from the start of the recording
+func recordTestEvents(t *testing.T, offsets ...time.Duration) []byte {
+	recording := &bytes.Buffer{}
+	clock := &settableClock{now: time.Now()}
+	start := clock.now
+	r, err := fsevents.NewRecorder(recording, clock)
+	assert(t, (err == nil), err)
+	for _, offset := range offsets {
+		clock.now = start.Add(offset)
+		assert(t, (r.Record(journalTestEvent(offset.String())) == nil), fmt.Errorf("Record should not have returned an error"))
+	}
+	assert(t, (r.Close() == nil), fmt.Errorf("Close should not have returned an error"))
+	assert(t, (r.Record(journalTestEvent("closed")) == fsevents.ErrRecorderClosed), fmt.Errorf("Record should have failed after Close"))
+	return recording.Bytes()
+}
+
+func TestRecording(t *testing.T) {
+	recording := recordTestEvents(t, 0, 50*time.Millisecond, 80*time.Millisecond)
+
+	p, err := fsevents.NewReplayer(bytes.NewReader(recording), fsevents.ReplayOptions{})
+	assert(t, (err == nil), err)
+	for _, offset := range []time.Duration{0, 50 * time.Millisecond, 80 * time.Millisecond} {
+		recorded, err := p.Next()
+		assert(t, (err == nil), err)
+		assert(t, (recorded.Offset == offset && recorded.Event.Name == offset.String() && recorded.Event.RawEvent.Mask == fsevents.Create),
+			fmt.Errorf("expected the event recorded at %s, got %+v", offset, recorded))
+	}
+	_, err = p.Next()
+	assert(t, (err == io.EOF), fmt.Errorf("expected io.EOF at the end of the recording, got %v", err))
+
+	p, _ = fsevents.NewReplayer(bytes.NewReader(recording[:len(recording)-1]), fsevents.ReplayOptions{})
+	p.Next()
+	p.Next()
+	_, err = p.Next()
+	assert(t, (err == io.ErrUnexpectedEOF), fmt.Errorf("expected io.ErrUnexpectedEOF within an event, got %v", err))
+	_, err = fsevents.NewReplayer(strings.NewReader("not a recording"), fsevents.ReplayOptions{})
+	assert(t, (err == fsevents.ErrNotRecording), fmt.Errorf("expected ErrNotRecording, got %v", err))
+}
+
+func TestReplaySpeed(t *testing.T) {
+	recording := recordTestEvents(t, 0, 200*time.Millisecond, 400*time.Millisecond)
+	speeds := map[float64][2]time.Duration{
+		1:  {400 * time.Millisecond, 2 * time.Second},
+		10: {40 * time.Millisecond, 300 * time.Millisecond},
+		-1: {0, 40 * time.Millisecond},
+	}
+	for speed, bounds := range speeds {
+		p, err := fsevents.NewReplayer(bytes.NewReader(recording), fsevents.ReplayOptions{Speed: speed})
+		assert(t, (err == nil), err)
+		events := make(chan *fsevents.FsEvent, 3)
+		start := time.Now()
+		assert(t, (p.Replay(context.Background(), events) == nil), fmt.Errorf("Replay should not have returned an error"))
+		elapsed := time.Since(start)
+		assert(t, (len(events) == 3), fmt.Errorf("every event should have been replayed"))
+		assert(t, (elapsed >= bounds[0] && elapsed < bounds[1]), fmt.Errorf("replaying at speed %g took %s", speed, elapsed))
+	}
+}
+
+func TestReplayStep(t *testing.T) {
+	step := make(chan struct{})
+	p, err := fsevents.NewReplayer(bytes.NewReader(recordTestEvents(t, 0, time.Hour)), fsevents.ReplayOptions{Step: step})
+	assert(t, (err == nil), err)
+	ctx, cancel := context.WithCancel(context.Background())
+	events := make(chan *fsevents.FsEvent, 2)
+	replayed := make(chan error)
+	go func() { replayed <- p.Replay(ctx, events) }()
+
+	for i := 0; i < 2; i++ {
+		select {
+		case <-events:
+			t.Fatal("an event was replayed before its step")
+		case <-time.After(50 * time.Millisecond):
+		}
+		step <- struct{}{}
+		select {
+		case <-events:
+		case <-time.After(5 * time.Second):
+			t.Fatal("the step did not replay an event")
+		}
+	}
+	cancel()
+	assert(t, (<-replayed == nil), fmt.Errorf("Replay should have returned at the end of the recording"))
+}
+
+func TestReplayHandlers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fsevents-replay")
+	assert(t, (err == nil), err)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "recording")
+
+	// Record what a handler sees, then replay it to the handlers of a Watcher
+	r, err := fsevents.CreateRecording(file)
+	assert(t, (err == nil), err)
+	h := fsevents.Chain(&recordingHandler{Mask: fsevents.Create}, fsevents.Recording(r))
+	for _, name := range []string{"first", "second"} {
+		assert(t, (h.Handle(nil, journalTestEvent(name)) == nil), fmt.Errorf("Handle should not have returned an error"))
+	}
+	assert(t, (r.Close() == nil), fmt.Errorf("Close should not have returned an error"))
+
+	replayed := make([]string, 0)
+	w, err := fsevents.NewWatcher()
+	assert(t, (err == nil), err)
+	defer w.Close()
+	w.RegisterFunc(fsevents.Create, func(w *fsevents.Watcher, event *fsevents.FsEvent) error {
+		replayed = append(replayed, event.Name)
+		return nil
+	})
+	p, err := fsevents.OpenRecording(file, fsevents.ReplayOptions{Speed: -1})
+	assert(t, (err == nil), err)
+	defer p.Close()
+	assert(t, (p.ReplayHandlers(context.Background(), w) == nil), fmt.Errorf("ReplayHandlers should not have returned an error"))
+	assert(t, (strings.Join(replayed, " ") == "first second"), fmt.Errorf("expected both events to be handled, got %v", replayed))
+}
@@ -0,0 +1,258 @@
+package fsevents
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+var (
+	// Retry errors
+	ErrRetriesExhausted = errors.New("handler failed on every attempt")
+	ErrNoDeadLetter     = errors.New("dead letter not found")
+)
+
+// RetryPolicy describes how often, and how long apart, a failing EventHandler is retried by the Retry Middleware
+type RetryPolicy struct {
+	// Maximum number of calls to Handle for an event, the first one included. Values below 1 mean 1
+	MaxAttempts int
+	// How long to wait before the second attempt
+	InitialBackoff time.Duration
+	// Upper bound for the wait between two attempts. Zero means no bound
+	MaxBackoff time.Duration
+	// Factor the wait is multiplied by after every attempt. Values below 1 mean 2
+	Multiplier float64
+	// Fraction of every wait that is randomized, from 0 (none) to 1 (anywhere between zero and the full wait),
+	// so that handlers failing together are not retried together
+	Jitter float64
+	// Returns true if an error is worth retrying. Nil means every error except those wrapped with Permanent
+	Retryable func(err error) bool
+}
+
+// Attempt is a failed call to an EventHandler's Handle
+type Attempt struct {
+	Time time.Time
+	Err  error
+}
+
+// DeadLetter is an event that an EventHandler failed to handle, along with every failed attempt
+type DeadLetter struct {
+	// Identifies the DeadLetter within a DeadLetterQueue
+	ID       uint64
+	Event    *FsEvent
+	Handler  EventHandler
+	Attempts []Attempt
+}
+
+// DeadLetterSink stores the events the Retry Middleware gave up on
+type DeadLetterSink interface {
+	Put(letter *DeadLetter) error
+}
+
+// permanentError wraps an error that should not be retried
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e *permanentError) Unwrap() error {
+	return e.err
+}
+
+// Permanent wraps err so that the Retry Middleware does not retry it, unless RetryPolicy.Retryable says otherwise
+func Permanent(err error) error {
+	return &permanentError{err: err}
+}
+
+// IsRetryable returns false if err was wrapped with Permanent, or if a handler panicked, including when err wraps
+// such an error
+func IsRetryable(err error) bool {
+	var permanent *permanentError
+	var panicked *PanicError
+	return !errors.As(err, &permanent) && !errors.As(err, &panicked)
+}
+
+// attempts returns the maximum number of attempts allowed by p
+func (p RetryPolicy) attempts() int {
+	if p.MaxAttempts < 1 {
+		return 1
+	}
+	return p.MaxAttempts
+}
+
+// retryable returns true if err should be retried according to p
+func (p RetryPolicy) retryable(err error) bool {
+	if p.Retryable != nil {
+		return p.Retryable(err)
+	}
+	return IsRetryable(err)
+}
+
+// Backoff returns how long to wait after the given failed attempt, the first attempt being 1, jitter included
+func (p RetryPolicy) Backoff(attempt int) time.Duration {
+	multiplier := p.Multiplier
+	if multiplier < 1 {
+		multiplier = 2
+	}
+	backoff := float64(p.InitialBackoff)
+	for i := 1; i < attempt; i++ {
+		backoff *= multiplier
+		if p.MaxBackoff > 0 && backoff >= float64(p.MaxBackoff) {
+			break
+		}
+	}
+	if p.MaxBackoff > 0 && backoff > float64(p.MaxBackoff) {
+		backoff = float64(p.MaxBackoff)
+	}
+	if p.Jitter > 0 {
+		jitter := p.Jitter
+		if jitter > 1 {
+			jitter = 1
+		}
+		backoff -= backoff * jitter * rand.Float64()
+	}
+	return time.Duration(backoff)
+}
+
+// sleep waits for d, or until ctx is cancelled, in which case it returns false
+func sleep(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// Retry returns a Middleware that calls Handle again when it fails, as described by policy. Events that still fail,
+// or fail with an error that is not retryable, are put in sink if it is not nil, and the last error is returned.
+// Waiting between attempts stops early if the Watcher is closed. Without a Dispatcher (see SetDispatcher), the wait
+// happens on the goroutine running WatchAndHandle, which reads no events from inotify meanwhile: install one when
+// handlers are retried with long backoffs.
+func Retry(policy RetryPolicy, sink DeadLetterSink) Middleware {
+	return func(next EventHandler) EventHandler {
+		return &middlewareHandler{
+			next: next,
+			handle: func(w *Watcher, event *FsEvent) error {
+				ctx := context.Background()
+				if w != nil {
+					ctx = w.Context()
+				}
+				var attempts []Attempt
+				for {
+					err := next.Handle(w, event)
+					if err == nil {
+						return nil
+					}
+					attempts = append(attempts, Attempt{Time: time.Now(), Err: err})
+					n := len(attempts)
+					if n >= policy.attempts() || !policy.retryable(err) || !sleep(ctx, policy.Backoff(n)) {
+						break
+					}
+				}
+
+				last := attempts[len(attempts)-1].Err
+				if sink != nil {
+					if err := sink.Put(&DeadLetter{Event: event, Handler: next, Attempts: attempts}); err != nil {
+						return fmt.Errorf("%s: %s (dead letter not stored: %s)", ErrRetriesExhausted, last, err)
+					}
+				}
+				if len(attempts) == 1 {
+					return last
+				}
+				return fmt.Errorf("%s: %d attempts: %s", ErrRetriesExhausted, len(attempts), last)
+			},
+		}
+	}
+}
+
+// DeadLetterQueue is a DeadLetterSink keeping dead letters in memory, so that they can be listed and replayed
+type DeadLetterQueue struct {
+	sync.Mutex
+	// Maximum number of dead letters kept. When full the oldest is dropped. Zero means no limit
+	max     int
+	letters []*DeadLetter
+	lastID  uint64
+}
+
+// NewDeadLetterQueue returns an empty DeadLetterQueue keeping at most max dead letters, zero meaning no limit
+func NewDeadLetterQueue(max int) *DeadLetterQueue {
+	return &DeadLetterQueue{
+		max:     max,
+		letters: make([]*DeadLetter, 0),
+	}
+}
+
+// Put adds letter to the queue, dropping the oldest dead letter if the queue is full. Put implements DeadLetterSink
+func (q *DeadLetterQueue) Put(letter *DeadLetter) error {
+	q.Lock()
+	defer q.Unlock()
+	q.lastID++
+	letter.ID = q.lastID
+	q.letters = append(q.letters, letter)
+	if q.max > 0 && len(q.letters) > q.max {
+		q.letters = q.letters[len(q.letters)-q.max:]
+	}
+	return nil
+}
+
+// List returns the dead letters in the queue, oldest first
+func (q *DeadLetterQueue) List() []*DeadLetter {
+	q.Lock()
+	defer q.Unlock()
+	list := make([]*DeadLetter, len(q.letters))
+	copy(list, q.letters)
+	return list
+}
+
+// Len returns the number of dead letters in the queue
+func (q *DeadLetterQueue) Len() int {
+	q.Lock()
+	defer q.Unlock()
+	return len(q.letters)
+}
+
+// Remove removes the dead letter id from the queue
+func (q *DeadLetterQueue) Remove(id uint64) error {
+	q.Lock()
+	defer q.Unlock()
+	for i, letter := range q.letters {
+		if letter.ID == id {
+			q.letters = append(q.letters[:i], q.letters[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("%s: %d", ErrNoDeadLetter, id)
+}
+
+// Replay calls the Handler of every dead letter in the queue with its Event once more. Dead letters that are
+// handled successfully are removed from the queue, the others stay in it with the new attempt recorded.
+// Replay returns the number of dead letters that were handled successfully.
+func (q *DeadLetterQueue) Replay(w *Watcher) int {
+	handled := 0
+	for _, letter := range q.List() {
+		err := letter.Handler.Handle(w, letter.Event)
+		q.Lock()
+		if err == nil {
+			for i, l := range q.letters {
+				if l == letter {
+					q.letters = append(q.letters[:i], q.letters[i+1:]...)
+					break
+				}
+			}
+			handled++
+		} else {
+			letter.Attempts = append(letter.Attempts, Attempt{Time: time.Now(), Err: err})
+		}
+		q.Unlock()
+	}
+	return handled
+}
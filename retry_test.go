@@ -0,0 +1,103 @@
+package fsevents_test
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	fsevents "github.com/tywkeene/go-fsevents"
+)
+
+// flakyHandler fails until it was called failures times
+type flakyHandler struct {
+	failures int
+	calls    int
+	err      error
+}
+
+func (h *flakyHandler) Handle(w *fsevents.Watcher, event *fsevents.FsEvent) error {
+	h.calls++
+	if h.calls <= h.failures {
+		return h.err
+	}
+	return nil
+}
+
+func (h *flakyHandler) GetMask() uint32 {
+	return fsevents.Create
+}
+
+func (h *flakyHandler) Check(event *fsevents.FsEvent) bool {
+	return true
+}
+
+func TestRetryBackoff(t *testing.T) {
+	policy := fsevents.RetryPolicy{InitialBackoff: 10 * time.Millisecond, MaxBackoff: 50 * time.Millisecond}
+	expected := []time.Duration{10, 20, 40, 50, 50}
+	for i, e := range expected {
+		backoff := policy.Backoff(i + 1)
+		assert(t, (backoff == e*time.Millisecond), fmt.Errorf("Backoff(%d) should have returned %s, got %s", i+1, e*time.Millisecond, backoff))
+	}
+
+	policy.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		backoff := policy.Backoff(2)
+		assert(t, (backoff > 10*time.Millisecond && backoff <= 20*time.Millisecond), fmt.Errorf("Backoff with jitter out of range: %s", backoff))
+	}
+}
+
+func TestRetry(t *testing.T) {
+	policy := fsevents.RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond}
+	queue := fsevents.NewDeadLetterQueue(0)
+
+	h := &flakyHandler{failures: 2, err: errors.New("busy")}
+	err := fsevents.Chain(h, fsevents.Retry(policy, queue)).Handle(nil, routerTestEvent("test/a", fsevents.Create))
+	assert(t, (err == nil), err)
+	assert(t, (h.calls == 3), fmt.Errorf("Handle should have been called 3 times, got %d", h.calls))
+	assert(t, (queue.Len() == 0), fmt.Errorf("no dead letter should have been stored"))
+
+	h = &flakyHandler{failures: 5, err: errors.New("busy")}
+	err = fsevents.Chain(h, fsevents.Retry(policy, queue)).Handle(nil, routerTestEvent("test/b", fsevents.Create))
+	assert(t, (err != nil && strings.HasPrefix(err.Error(), fsevents.ErrRetriesExhausted.Error())),
+		fmt.Errorf("Handle should have returned ErrRetriesExhausted, got %v", err))
+	assert(t, (h.calls == 3), fmt.Errorf("Handle should have been called 3 times, got %d", h.calls))
+
+	letters := queue.List()
+	assert(t, (len(letters) == 1), fmt.Errorf("1 dead letter should have been stored, got %d", len(letters)))
+	assert(t, (letters[0].Event.Path == "test/b"), fmt.Errorf("wrong dead letter event: %q", letters[0].Event.Path))
+	assert(t, (len(letters[0].Attempts) == 3), fmt.Errorf("dead letter should record 3 attempts, got %d", len(letters[0].Attempts)))
+
+	// The handler fails twice more, then succeeds on the second replay
+	assert(t, (queue.Replay(nil) == 0), fmt.Errorf("Replay should not have handled the dead letter"))
+	assert(t, (len(queue.List()[0].Attempts) == 4), fmt.Errorf("Replay should have recorded the failed attempt"))
+	queue.Replay(nil)
+	assert(t, (queue.Replay(nil) == 1), fmt.Errorf("Replay should have handled the dead letter"))
+	assert(t, (queue.Len() == 0), fmt.Errorf("Replay should have removed the dead letter"))
+}
+
+func TestRetryPermanent(t *testing.T) {
+	policy := fsevents.RetryPolicy{MaxAttempts: 5, InitialBackoff: time.Millisecond}
+	queue := fsevents.NewDeadLetterQueue(1)
+
+	h := &flakyHandler{failures: 5, err: fsevents.Permanent(errors.New("invalid file"))}
+	err := fsevents.Chain(h, fsevents.Retry(policy, queue)).Handle(nil, routerTestEvent("test/a", fsevents.Create))
+	assert(t, (err != nil && err.Error() == "invalid file"), fmt.Errorf("Handle should have returned the handler's error, got %v", err))
+	assert(t, (h.calls == 1), fmt.Errorf("a permanent error should not have been retried, got %d calls", h.calls))
+
+	// Wrapped by another middleware
+	h = &flakyHandler{failures: 5, err: fmt.Errorf("handling failed: %w", fsevents.Permanent(errors.New("invalid file")))}
+	fsevents.Chain(h, fsevents.Retry(policy, nil)).Handle(nil, routerTestEvent("test/a", fsevents.Create))
+	assert(t, (h.calls == 1), fmt.Errorf("a wrapped permanent error should not have been retried, got %d calls", h.calls))
+
+	policy.Retryable = func(err error) bool { return false }
+	h = &flakyHandler{failures: 5, err: errors.New("not retryable")}
+	fsevents.Chain(h, fsevents.Retry(policy, queue)).Handle(nil, routerTestEvent("test/b", fsevents.Create))
+	assert(t, (h.calls == 1), fmt.Errorf("Retryable should have prevented retries, got %d calls", h.calls))
+
+	letters := queue.List()
+	assert(t, (len(letters) == 1 && letters[0].Event.Path == "test/b"), fmt.Errorf("the queue should only have kept the newest dead letter"))
+	assert(t, (queue.Remove(letters[0].ID) == nil), fmt.Errorf("Remove should not have returned an error"))
+	assert(t, (queue.Remove(letters[0].ID) != nil), fmt.Errorf("Remove should have returned an error"))
+}
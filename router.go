@@ -0,0 +1,292 @@
+package fsevents
+
+import (
+	"errors"
+	"path"
+	"strings"
+	"sync"
+)
+
+// RouterMode describes which of the routes matching an event a Router dispatches it to
+type RouterMode int
+
+const (
+	// RouteAll dispatches events to the handler of every matching route, in the order the routes were added
+	RouteAll RouterMode = iota
+	// RouteMostSpecific dispatches events to the handler of the most specific matching route only.
+	// A route is more specific than another if its prefix and pattern contain more literal characters.
+	// Ties go to the route that was added first.
+	RouteMostSpecific
+)
+
+var (
+	// Router errors
+	ErrBadPattern  = errors.New("syntax error in route pattern")
+	ErrNoRouteMask = errors.New("route mask has no events")
+)
+
+// RouteErrors is returned by Router.Handle when the handlers of one or more routes returned an error
+type RouteErrors []error
+
+func (e RouteErrors) Error() string {
+	messages := make([]string, 0, len(e))
+	for _, err := range e {
+		messages = append(messages, err.Error())
+	}
+	return strings.Join(messages, "; ")
+}
+
+// route is an EventHandler registered with a Router for a path pattern and event mask
+type route struct {
+	pattern string
+	mask    uint32
+	handler EventHandler
+	// Number of literal characters in the pattern
+	specificity int
+}
+
+// Router is an EventHandler that dispatches events to other EventHandlers by path pattern and event mask,
+// much like http.ServeMux does for requests. Several handlers may be routed for the same mask, and an event may be
+// dispatched to several of them. A Router is registered with a Watcher like any other EventHandler.
+type Router struct {
+	sync.Mutex
+	// Which matching routes events are dispatched to. Only the mode of the top-level Router is used
+	Mode RouterMode
+	// Path that the patterns of this Router are relative to. Empty for the top-level Router
+	prefix string
+	routes []*route
+	// Routers for directory prefixes, see Subrouter
+	subrouters []*Router
+	// Middleware wrapping the handlers of every route of this Router and its Subrouters, see Use
+	middleware []Middleware
+}
+
+// routeMatch is a route matching a given event
+type routeMatch struct {
+	// The route's handler, wrapped in the middleware of the Routers above it
+	handler     EventHandler
+	specificity int
+}
+
+// NewRouter returns an empty Router that dispatches events to every matching route
+func NewRouter() *Router {
+	return &Router{
+		routes:     make([]*route, 0),
+		subrouters: make([]*Router, 0),
+	}
+}
+
+// literalLength returns the number of characters of pattern that are not wildcards
+func literalLength(pattern string) int {
+	n := 0
+	for _, c := range pattern {
+		if !strings.ContainsRune("*?[]\\", c) {
+			n++
+		}
+	}
+	return n
+}
+
+// validPattern returns false if a segment of pattern is malformed
+func validPattern(pattern string) bool {
+	for _, segment := range strings.Split(pattern, "/") {
+		if _, err := path.Match(segment, ""); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// matchSegments matches the path segments against the pattern segments, "**" matching any number of segments
+func matchSegments(pattern []string, segments []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := len(segments); i >= 0; i-- {
+				if matchSegments(pattern[1:], segments[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(segments) == 0 {
+			return false
+		}
+		if matched, _ := path.Match(pattern[0], segments[0]); !matched {
+			return false
+		}
+		pattern, segments = pattern[1:], segments[1:]
+	}
+	return len(segments) == 0
+}
+
+// MatchPattern returns true if filePath matches pattern. A pattern without a slash, such as "*.go", is matched
+// against the last element of filePath. Other patterns are matched against the whole of filePath one path element at
+// a time using path.Match, with "**" matching any number of elements, as in "src/**/*.go".
+// The empty pattern matches every path.
+func MatchPattern(pattern string, filePath string) bool {
+	if pattern == "" {
+		return true
+	}
+	if !strings.Contains(pattern, "/") {
+		matched, _ := path.Match(pattern, path.Base(filePath))
+		return matched
+	}
+	return matchSegments(strings.Split(path.Clean(pattern), "/"), strings.Split(path.Clean(filePath), "/"))
+}
+
+// Route registers handler for the events matching mask on paths matching pattern (see MatchPattern).
+// If mask includes IsDir only directory events match. The handler's Check method is consulted as well.
+// Patterns of a Subrouter are relative to its prefix. The handler is wrapped in middleware, if any.
+func (r *Router) Route(pattern string, mask uint32, handler EventHandler, middleware ...Middleware) error {
+	if !validPattern(pattern) {
+		return ErrBadPattern
+	}
+	if mask&^IsDir == 0 {
+		return ErrNoRouteMask
+	}
+	r.Lock()
+	defer r.Unlock()
+	r.routes = append(r.routes, &route{
+		pattern:     pattern,
+		mask:        mask,
+		handler:     Chain(handler, middleware...),
+		specificity: literalLength(pattern),
+	})
+	return nil
+}
+
+// Subrouter returns a Router for the events below the directory prefix, relative to this Router's prefix.
+// Routes added to the Subrouter have patterns relative to prefix. Calling Subrouter again with the same prefix
+// returns the same Router.
+func (r *Router) Subrouter(prefix string) *Router {
+	prefix = path.Clean(prefix)
+	r.Lock()
+	defer r.Unlock()
+	for _, sub := range r.subrouters {
+		if sub.prefix == prefix {
+			return sub
+		}
+	}
+	sub := NewRouter()
+	sub.prefix = prefix
+	r.subrouters = append(r.subrouters, sub)
+	return sub
+}
+
+// matchMask returns true if the event mask matches the route mask
+func matchMask(routeMask uint32, eventMask uint32) bool {
+	if CheckMask(IsDir, routeMask) && !CheckMask(IsDir, eventMask) {
+		return false
+	}
+	return CheckMask(routeMask&^IsDir, eventMask)
+}
+
+// relativePath returns filePath relative to prefix, and false if it is not below prefix
+func relativePath(prefix string, filePath string) (string, bool) {
+	if prefix == "" || prefix == "." {
+		return filePath, true
+	}
+	filePath = path.Clean(filePath)
+	if !strings.HasPrefix(filePath, prefix+"/") {
+		return "", false
+	}
+	return filePath[len(prefix)+1:], true
+}
+
+// match returns the routes of this Router and its Subrouters matching event, whose path is eventPath
+// relative to this Router's parent
+func (r *Router) match(event *FsEvent, eventPath string) []routeMatch {
+	relative, below := relativePath(r.prefix, eventPath)
+	if !below {
+		return nil
+	}
+	r.Lock()
+	routes := r.routes
+	subrouters := r.subrouters
+	middleware := r.middleware
+	r.Unlock()
+
+	prefixLength := 0
+	if r.prefix != "" {
+		prefixLength = len(r.prefix) + 1
+	}
+	matches := make([]routeMatch, 0)
+	for _, rt := range routes {
+		if !matchMask(rt.mask, event.RawEvent.Mask) || !MatchPattern(rt.pattern, relative) {
+			continue
+		}
+		handler := Chain(rt.handler, middleware...)
+		if handler.Check(event) {
+			matches = append(matches, routeMatch{handler: handler, specificity: prefixLength + rt.specificity})
+		}
+	}
+	for _, sub := range subrouters {
+		for _, m := range sub.match(event, relative) {
+			m.handler = Chain(m.handler, middleware...)
+			if !m.handler.Check(event) {
+				continue
+			}
+			m.specificity += prefixLength
+			matches = append(matches, m)
+		}
+	}
+	return matches
+}
+
+// dispatchTo returns the routes event is dispatched to according to r.Mode
+func (r *Router) dispatchTo(event *FsEvent) []routeMatch {
+	matches := r.match(event, event.Path)
+	if r.Mode != RouteMostSpecific || len(matches) < 2 {
+		return matches
+	}
+	best := matches[0]
+	for _, m := range matches[1:] {
+		if m.specificity > best.specificity {
+			best = m
+		}
+	}
+	return []routeMatch{best}
+}
+
+// Handle dispatches event to the handlers of the matching routes, and returns RouteErrors if any of them failed.
+// Handle implements EventHandler.
+func (r *Router) Handle(w *Watcher, event *FsEvent) error {
+	var errs RouteErrors
+	for _, m := range r.dispatchTo(event) {
+		if err := m.handler.Handle(w, event); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// Check returns true if at least one route matches event. Check implements EventHandler.
+func (r *Router) Check(event *FsEvent) bool {
+	return len(r.match(event, event.Path)) > 0
+}
+
+// Use adds middleware wrapping the handlers of every route of r and its Subrouters, inside the middleware of the
+// Routers above r. Middleware added by earlier calls to Use is outermost.
+func (r *Router) Use(middleware ...Middleware) {
+	r.Lock()
+	defer r.Unlock()
+	r.middleware = append(r.middleware, middleware...)
+}
+
+// GetMask returns the union of the masks of every route of this Router and its Subrouters.
+// GetMask implements EventHandler.
+func (r *Router) GetMask() uint32 {
+	r.Lock()
+	defer r.Unlock()
+	var mask uint32
+	for _, rt := range r.routes {
+		mask |= rt.mask
+	}
+	for _, sub := range r.subrouters {
+		mask |= sub.GetMask()
+	}
+	return mask
+}
@@ -0,0 +1,174 @@
+package fsevents_test
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"testing"
+
+	fsevents "github.com/tywkeene/go-fsevents"
+	"golang.org/x/sys/unix"
+)
+
+// recordingHandler records the paths of the events it handled
+type recordingHandler struct {
+	Mask    uint32
+	Err     error
+	Handled []string
+}
+
+func (h *recordingHandler) Handle(w *fsevents.Watcher, event *fsevents.FsEvent) error {
+	h.Handled = append(h.Handled, event.Path)
+	return h.Err
+}
+
+func (h *recordingHandler) GetMask() uint32 {
+	return h.Mask
+}
+
+func (h *recordingHandler) Check(event *fsevents.FsEvent) bool {
+	return true
+}
+
+func routerTestEvent(eventPath string, mask uint32) *fsevents.FsEvent {
+	return &fsevents.FsEvent{
+		Name:     path.Base(eventPath),
+		Path:     eventPath,
+		RawEvent: &unix.InotifyEvent{Mask: mask},
+	}
+}
+
+func TestMatchPattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		path    string
+		match   bool
+	}{
+		{"*.go", "test/a/main.go", true},
+		{"*.go", "test/a/README.md", false},
+		{"test/*.go", "test/main.go", true},
+		{"test/*.go", "test/a/main.go", false},
+		{"test/**/*.go", "test/main.go", true},
+		{"test/**/*.go", "test/a/b/main.go", true},
+		{"test/**", "test/a/b/main.go", true},
+		{"test/**", "other/main.go", false},
+		{"test/?.go", "test/a.go", true},
+		{"", "anything", true},
+	}
+	for _, test := range tests {
+		match := fsevents.MatchPattern(test.pattern, test.path)
+		assert(t, (match == test.match), fmt.Errorf("MatchPattern(%q, %q) should have returned %t", test.pattern, test.path, test.match))
+	}
+}
+
+func TestRouter(t *testing.T) {
+	r := fsevents.NewRouter()
+	goFiles := &recordingHandler{}
+	mdFiles := &recordingHandler{}
+	allFiles := &recordingHandler{}
+	dirs := &recordingHandler{}
+
+	assert(t, (r.Route("*.go", fsevents.Create, goFiles) == nil), fmt.Errorf("Route should not have returned an error"))
+	assert(t, (r.Route("*.md", fsevents.Create, mdFiles) == nil), fmt.Errorf("Route should not have returned an error"))
+	assert(t, (r.Route("**", fsevents.Create|fsevents.Delete, allFiles) == nil), fmt.Errorf("Route should not have returned an error"))
+	assert(t, (r.Route("", fsevents.DirCreatedEvent, dirs) == nil), fmt.Errorf("Route should not have returned an error"))
+
+	err := r.Route("[", fsevents.Create, goFiles)
+	assert(t, (err == fsevents.ErrBadPattern), fmt.Errorf("Route should have returned ErrBadPattern, got %v", err))
+	err = r.Route("*.go", fsevents.IsDir, goFiles)
+	assert(t, (err == fsevents.ErrNoRouteMask), fmt.Errorf("Route should have returned ErrNoRouteMask, got %v", err))
+
+	expected := fsevents.Create | fsevents.Delete | fsevents.DirCreatedEvent
+	assert(t, (r.GetMask() == expected), fmt.Errorf("GetMask should have returned %d, got %d", expected, r.GetMask()))
+
+	for _, event := range []*fsevents.FsEvent{
+		routerTestEvent("test/main.go", fsevents.Create),
+		routerTestEvent("test/README.md", fsevents.Create),
+		routerTestEvent("test/main.go", fsevents.Delete),
+		routerTestEvent("test/dir", fsevents.Create|fsevents.IsDir),
+	} {
+		assert(t, (r.Check(event)), fmt.Errorf("Check should have matched %q", event.Path))
+		assert(t, (r.Handle(nil, event) == nil), fmt.Errorf("Handle should not have returned an error"))
+	}
+	assert(t, (!r.Check(routerTestEvent("test/main.go", fsevents.Modified))), fmt.Errorf("Check should not have matched"))
+
+	assert(t, (len(goFiles.Handled) == 1), fmt.Errorf("*.go handler should have handled 1 event, got %d", len(goFiles.Handled)))
+	assert(t, (len(mdFiles.Handled) == 1), fmt.Errorf("*.md handler should have handled 1 event, got %d", len(mdFiles.Handled)))
+	assert(t, (len(allFiles.Handled) == 4), fmt.Errorf("** handler should have handled 4 events, got %d", len(allFiles.Handled)))
+	assert(t, (len(dirs.Handled) == 1), fmt.Errorf("directory handler should have handled 1 event, got %d", len(dirs.Handled)))
+}
+
+func TestRouterMostSpecific(t *testing.T) {
+	r := fsevents.NewRouter()
+	r.Mode = fsevents.RouteMostSpecific
+	general := &recordingHandler{}
+	goFiles := &recordingHandler{}
+	srcGoFiles := &recordingHandler{}
+
+	r.Route("**", fsevents.Create, general)
+	r.Route("*.go", fsevents.Create, goFiles)
+	r.Subrouter("test").Subrouter("src").Route("*.go", fsevents.Create, srcGoFiles)
+
+	r.Handle(nil, routerTestEvent("test/src/main.go", fsevents.Create))
+	r.Handle(nil, routerTestEvent("test/main.go", fsevents.Create))
+	r.Handle(nil, routerTestEvent("test/README.md", fsevents.Create))
+
+	assert(t, (len(srcGoFiles.Handled) == 1), fmt.Errorf("subrouter handler should have handled 1 event, got %d", len(srcGoFiles.Handled)))
+	assert(t, (len(goFiles.Handled) == 1), fmt.Errorf("*.go handler should have handled 1 event, got %d", len(goFiles.Handled)))
+	assert(t, (len(general.Handled) == 1), fmt.Errorf("** handler should have handled 1 event, got %d", len(general.Handled)))
+	assert(t, (srcGoFiles.Handled[0] == "test/src/main.go"), fmt.Errorf("subrouter handler handled the wrong event: %q", srcGoFiles.Handled[0]))
+}
+
+func TestRouterErrors(t *testing.T) {
+	r := fsevents.NewRouter()
+	r.Route("*.go", fsevents.Create, &recordingHandler{Err: errors.New("first")})
+	r.Route("*.go", fsevents.Create, &recordingHandler{Err: errors.New("second")})
+
+	err := r.Handle(nil, routerTestEvent("test/main.go", fsevents.Create))
+	routeErrors, ok := err.(fsevents.RouteErrors)
+	assert(t, (ok && len(routeErrors) == 2), fmt.Errorf("Handle should have returned both errors, got %v", err))
+}
+
+func TestRouterWatchAndHandle(t *testing.T) {
+	setupDirs([]string{testRootDir})
+	defer teardownDirs([]string{testRootDir})
+
+	w, err := fsevents.NewWatcher()
+	assert(t, (err == nil), err)
+	defer w.Close()
+
+	handled := make(chan string, 2)
+	r := fsevents.NewRouter()
+	r.Route("*.go", fsevents.CloseWrite, &channelHandler{ch: handled, prefix: "go:"})
+	r.Route("*.md", fsevents.CloseWrite, &channelHandler{ch: handled, prefix: "md:"})
+	assert(t, (w.RegisterEventHandler(r) == nil), fmt.Errorf("RegisterEventHandler should not have returned an error"))
+
+	d, err := w.AddDescriptor(testRootDir, fsevents.CloseWrite)
+	assert(t, (err == nil), err)
+	assert(t, (d.Start() == nil), fmt.Errorf("Start should not have returned an error"))
+	go w.WatchAndHandle()
+
+	assert(t, (writeRandomFile(path.Join(testRootDir, "main.go")) == nil), fmt.Errorf("could not write file"))
+	assert(t, (writeRandomFile(path.Join(testRootDir, "README.md")) == nil), fmt.Errorf("could not write file"))
+	first, second := <-handled, <-handled
+	assert(t, (first == "go:main.go" && second == "md:README.md"), fmt.Errorf("unexpected events handled: %q, %q", first, second))
+}
+
+// channelHandler sends the name of the events it handled to ch
+type channelHandler struct {
+	ch     chan string
+	prefix string
+}
+
+func (h *channelHandler) Handle(w *fsevents.Watcher, event *fsevents.FsEvent) error {
+	h.ch <- h.prefix + event.Name
+	return nil
+}
+
+func (h *channelHandler) GetMask() uint32 {
+	return fsevents.CloseWrite
+}
+
+func (h *channelHandler) Check(event *fsevents.FsEvent) bool {
+	return true
+}
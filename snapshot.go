@@ -0,0 +1,240 @@
+package fsevents
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+)
+
+var (
+	ErrNoSnapshot      = errors.New("no snapshot saved")
+	ErrSnapshotCorrupt = errors.New("snapshot could not be decoded")
+	ErrSnapshotRoot    = errors.New("snapshot taken of another directory")
+)
+
+// SnapshotOptions configures how snapshots are taken
+type SnapshotOptions struct {
+	// Record a SHA-256 hash of the content of every regular file, so that modifications keeping the size and
+	// modification time of a file are detected. Costs reading every file
+	Hash bool
+}
+
+// SnapshotEntry is the state of a file or directory in a Snapshot
+type SnapshotEntry struct {
+	Inode   uint64      `json:"inode"`
+	Size    int64       `json:"size"`
+	ModTime time.Time   `json:"mtime"`
+	Mode    os.FileMode `json:"mode"`
+	Hash    string      `json:"hash,omitempty"`
+}
+
+// Snapshot is the state of every file and directory below a directory at some point in time
+type Snapshot struct {
+	// The directory the snapshot was taken of
+	Root string `json:"root"`
+	// When the snapshot was taken
+	Taken time.Time `json:"taken"`
+	// State of the files and directories below Root, key: path relative to Root
+	Entries map[string]SnapshotEntry `json:"entries"`
+}
+
+// TakeSnapshot records the state of every file and directory below rootPath
+func TakeSnapshot(rootPath string, opts SnapshotOptions) (*Snapshot, error) {
+	rootPath = path.Clean(rootPath)
+	taken := time.Now().UTC()
+	entries, err := scanTree(rootPath)
+	if err != nil {
+		return nil, err
+	}
+	snapshot := &Snapshot{Root: rootPath, Taken: taken, Entries: make(map[string]SnapshotEntry, len(entries))}
+	for entryPath, entry := range entries {
+		relative, err := filepath.Rel(rootPath, entryPath)
+		if err != nil {
+			return nil, err
+		}
+		if opts.Hash && entry.mode.IsRegular() {
+			if entry.hash, err = hashFile(entryPath); err != nil {
+				if os.IsNotExist(err) {
+					// Removed since the scan
+					continue
+				}
+				return nil, err
+			}
+		}
+		snapshot.Entries[relative] = SnapshotEntry{
+			Inode:   entry.ino,
+			Size:    entry.size,
+			ModTime: entry.mtime,
+			Mode:    entry.mode,
+			Hash:    entry.hash,
+		}
+	}
+	return snapshot, nil
+}
+
+// hashFile returns the hex encoded SHA-256 hash of the content of the file at filePath
+func hashFile(filePath string) (string, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// LoadSnapshot reads a snapshot saved with Snapshot.Save. It returns ErrNoSnapshot if there is none at filePath
+func LoadSnapshot(filePath string) (*Snapshot, error) {
+	data, err := ioutil.ReadFile(filePath)
+	if os.IsNotExist(err) {
+		return nil, ErrNoSnapshot
+	} else if err != nil {
+		return nil, err
+	}
+	snapshot := &Snapshot{}
+	if err := json.Unmarshal(data, snapshot); err != nil {
+		return nil, fmt.Errorf("%s: %s", ErrSnapshotCorrupt, err)
+	}
+	return snapshot, nil
+}
+
+// Save writes the snapshot to filePath. The previous snapshot at filePath is replaced atomically, so that it
+// is left whole if Save is interrupted
+func (s *Snapshot) Save(filePath string) error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	tmpPath := filePath + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, filePath)
+}
+
+// pollEntries returns the entries of the snapshot keyed by their full path, as returned by scanTree
+func (s *Snapshot) pollEntries() map[string]pollEntry {
+	entries := make(map[string]pollEntry, len(s.Entries))
+	for relative, entry := range s.Entries {
+		entries[path.Join(s.Root, relative)] = pollEntry{
+			ino:   entry.Inode,
+			size:  entry.Size,
+			mtime: entry.ModTime,
+			mode:  entry.Mode,
+			hash:  entry.Hash,
+		}
+	}
+	return entries
+}
+
+// SnapshotStore keeps the snapshot of a directory tree in a file, so that the changes made to the tree while
+// nothing was watching it can be found the next time it is watched, see Watcher.CatchUp
+type SnapshotStore struct {
+	// The file the snapshot is kept in
+	File string
+	// The directory the snapshots are taken of
+	Root string
+	// How the snapshots are taken
+	Options SnapshotOptions
+}
+
+// NewSnapshotStore returns a SnapshotStore keeping the snapshot of rootPath in file
+func NewSnapshotStore(file string, rootPath string, opts SnapshotOptions) *SnapshotStore {
+	return &SnapshotStore{File: file, Root: path.Clean(rootPath), Options: opts}
+}
+
+// Save takes a snapshot of the tree and writes it to the store's file. Call it at shutdown, or periodically
+// with Watcher.SaveSnapshotEvery
+func (s *SnapshotStore) Save() error {
+	snapshot, err := TakeSnapshot(s.Root, s.Options)
+	if err != nil {
+		return err
+	}
+	return snapshot.Save(s.File)
+}
+
+// Load returns the snapshot kept in the store, ErrNoSnapshot if there is none
+func (s *SnapshotStore) Load() (*Snapshot, error) {
+	snapshot, err := LoadSnapshot(s.File)
+	if err != nil {
+		return nil, err
+	}
+	if snapshot.Root != s.Root {
+		return nil, fmt.Errorf("%s: %q", ErrSnapshotRoot, snapshot.Root)
+	}
+	return snapshot, nil
+}
+
+// CatchUp compares the tree of store with the snapshot it keeps, and queues synthetic events describing the changes
+// made since: Create, Delete, MovedFrom and MovedTo pairs for files that kept their inode, Modified|CloseWrite and
+// AttrChange. Only the events included in mask are queued, the Watcher's default mask if mask is zero.
+// The events are returned by ReadSingleEvent, and so by Watch and WatchAndHandle, before any event read from
+// inotify: call CatchUp after starting the descriptors of the tree, so that no change is missed in between, and
+// before reading events. The current state of the tree is then saved to the store.
+// Without a saved snapshot, CatchUp only saves one. CatchUp returns the number of events queued, which passed the
+// filters given to NewWatcher.
+func (w *Watcher) CatchUp(store *SnapshotStore, mask uint32) (int, error) {
+	if mask == 0 {
+		mask = w.config.defaultMask
+	}
+	previous, err := store.Load()
+	if err != nil && err != ErrNoSnapshot {
+		return 0, err
+	}
+	current, err := TakeSnapshot(store.Root, store.Options)
+	if err != nil {
+		return 0, err
+	}
+	if previous == nil {
+		return 0, current.Save(store.File)
+	}
+
+	var cookie uint32
+	changes := diffEntries(previous.pollEntries(), current.pollEntries(), mask, func() uint32 {
+		cookie++
+		return cookie
+	})
+	root := &WatchDescriptor{Path: store.Root, Mask: mask, WatchDescriptor: -1}
+	events := make([]*FsEvent, 0, len(changes))
+	for _, change := range changes {
+		descriptor := w.GetDescriptorByPath(path.Dir(change.path))
+		if descriptor == nil {
+			descriptor = root
+		}
+		events = append(events, w.newSyntheticEvent(descriptor, change.path, change.mask, change.cookie))
+	}
+	events = w.filterEvents(events)
+	w.pendingEvents = append(w.pendingEvents, events...)
+	return len(events), current.Save(store.File)
+}
+
+// SaveSnapshotEvery saves a snapshot to store every interval until w is closed. Errors are reported to w.Errors.
+// It returns immediately
+func (w *Watcher) SaveSnapshotEvery(store *SnapshotStore, interval time.Duration) {
+	done := w.Context().Done()
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if err := store.Save(); err != nil {
+					w.reportError(err)
+				}
+			}
+		}
+	}()
+}
@@ -0,0 +1,147 @@
+package fsevents_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+	"time"
+
+	fsevents "github.com/tywkeene/go-fsevents"
+	"golang.org/x/sys/unix"
+)
+
+func snapshotTestStore(t *testing.T, opts fsevents.SnapshotOptions) (*fsevents.SnapshotStore, func()) {
+	dir, err := ioutil.TempDir("", "fsevents-snapshot")
+	assert(t, (err == nil), err)
+	return fsevents.NewSnapshotStore(filepath.Join(dir, "snapshot.json"), testRootDir, opts), func() { os.RemoveAll(dir) }
+}
+
+func TestCatchUp(t *testing.T) {
+	setupDirs([]string{testRootDir})
+	defer teardownDirs([]string{testRootDir})
+	store, cleanup := snapshotTestStore(t, fsevents.SnapshotOptions{})
+	defer cleanup()
+
+	for _, name := range []string{"removed", "renamed", "changed"} {
+		writeRandomFile(path.Join(testRootDir, name))
+	}
+	assert(t, (store.Save() == nil), fmt.Errorf("Save should not have returned an error"))
+
+	// Changes made while nothing was watching. "created" is created first so that it cannot reuse the inode of
+	// "removed", which would be reported as a move
+	writeRandomFile(path.Join(testRootDir, "created"))
+	os.Remove(path.Join(testRootDir, "removed"))
+	os.Rename(path.Join(testRootDir, "renamed"), path.Join(testRootDir, "renamed.new"))
+	ioutil.WriteFile(path.Join(testRootDir, "changed"), []byte("changed"), 0644)
+
+	w := flagsTestWatcher(t)
+	defer w.Close()
+	// Without Open and CloseNoWrite, which CatchUp's own scan of the directory causes
+	d, err := w.AddDescriptor(testRootDir, fsevents.Create|fsevents.Delete|fsevents.Move|fsevents.Modified|fsevents.CloseWrite)
+	assert(t, (err == nil), err)
+	assert(t, (d.Start() == nil), fmt.Errorf("Start should not have returned an error"))
+	queued, err := w.CatchUp(store, 0)
+	assert(t, (err == nil), err)
+	assert(t, (queued == 5), fmt.Errorf("CatchUp should have queued 5 events, got %d", queued))
+	writeRandomFile(path.Join(testRootDir, "live"))
+
+	expected := []struct {
+		name string
+		mask uint32
+	}{
+		{"removed", fsevents.Delete},
+		{"renamed", fsevents.MovedFrom},
+		{"renamed.new", fsevents.MovedTo},
+		{"changed", fsevents.Modified | fsevents.CloseWrite},
+		{"created", fsevents.Create},
+		{"live", fsevents.Create},
+	}
+	var cookie uint32
+	for _, e := range expected {
+		event, err := readSingleEventTimeout(w, time.Second)
+		assert(t, (err == nil), err)
+		assert(t, (event.Name == e.name && event.RawEvent.Mask == e.mask),
+			fmt.Errorf("expected %q %#x, got %q %#x", e.name, e.mask, event.Name, event.RawEvent.Mask))
+		if e.mask == fsevents.MovedFrom {
+			cookie = event.RawEvent.Cookie
+		} else if e.mask == fsevents.MovedTo {
+			assert(t, (cookie != 0 && event.RawEvent.Cookie == cookie), fmt.Errorf("the move should have been paired by its cookie"))
+			// The high bit keeps synthetic cookies apart from those of inotify
+			assert(t, (cookie&(1<<31) != 0), fmt.Errorf("the cookie of a synthetic move should have its high bit set, got %#x", cookie))
+		}
+	}
+
+	// The store now holds the state CatchUp compared against. Another Watcher, since events of w are being read
+	other := flagsTestWatcher(t)
+	defer other.Close()
+	queued, err = other.CatchUp(store, fsevents.Delete|fsevents.Move)
+	assert(t, (err == nil && queued == 0), fmt.Errorf("CatchUp should have found no change, got %d %v", queued, err))
+}
+
+func TestCatchUpFiltered(t *testing.T) {
+	setupDirs([]string{testRootDir})
+	defer teardownDirs([]string{testRootDir})
+	store, cleanup := snapshotTestStore(t, fsevents.SnapshotOptions{})
+	defer cleanup()
+	assert(t, (store.Save() == nil), fmt.Errorf("Save should not have returned an error"))
+	for _, name := range []string{"kept", "filtered"} {
+		writeRandomFile(path.Join(testRootDir, name))
+	}
+
+	w, err := fsevents.NewWatcher(fsevents.WithInitFlags(unix.IN_CLOEXEC|unix.IN_NONBLOCK),
+		fsevents.WithFilter(func(event *fsevents.FsEvent) bool { return event.Name != "filtered" }))
+	assert(t, (err == nil), err)
+	defer w.Close()
+	// Only the events that passed the filters are counted
+	queued, err := w.CatchUp(store, fsevents.Create)
+	assert(t, (err == nil && queued == 1), fmt.Errorf("CatchUp should have queued 1 event, got %d %v", queued, err))
+	event, err := readSingleEventTimeout(w, time.Second)
+	assert(t, (err == nil && event.Name == "kept"), fmt.Errorf("expected the creation of kept, got %v", err))
+}
+
+func TestCatchUpWithoutSnapshot(t *testing.T) {
+	setupDirs([]string{testRootDir})
+	defer teardownDirs([]string{testRootDir})
+	store, cleanup := snapshotTestStore(t, fsevents.SnapshotOptions{})
+	defer cleanup()
+	w := flagsTestWatcher(t)
+	defer w.Close()
+
+	writeRandomFile(path.Join(testRootDir, "existing"))
+	queued, err := w.CatchUp(store, 0)
+	assert(t, (err == nil && queued == 0), fmt.Errorf("CatchUp should have queued no event, got %d %v", queued, err))
+	_, err = store.Load()
+	assert(t, (err == nil), fmt.Errorf("CatchUp should have saved a snapshot: %v", err))
+}
+
+func TestSnapshotHash(t *testing.T) {
+	setupDirs([]string{testRootDir})
+	defer teardownDirs([]string{testRootDir})
+	file := path.Join(testRootDir, "file")
+	ioutil.WriteFile(file, []byte("before"), 0644)
+	info, _ := os.Stat(file)
+
+	for _, hash := range []bool{false, true} {
+		store, cleanup := snapshotTestStore(t, fsevents.SnapshotOptions{Hash: hash})
+		defer cleanup()
+		assert(t, (store.Save() == nil), fmt.Errorf("Save should not have returned an error"))
+		snapshot, err := store.Load()
+		assert(t, (err == nil), err)
+		assert(t, (len(snapshot.Entries) == 1 && (snapshot.Entries["file"].Hash != "") == hash),
+			fmt.Errorf("the snapshot should have recorded the file, with a hash only if asked to"))
+
+		// Same size and modification time, different content
+		ioutil.WriteFile(file, []byte("after!"), 0644)
+		os.Chtimes(file, info.ModTime(), info.ModTime())
+		w := flagsTestWatcher(t)
+		queued, err := w.CatchUp(store, 0)
+		w.Close()
+		assert(t, (err == nil), err)
+		assert(t, ((queued == 1) == hash), fmt.Errorf("with Hash %t, CatchUp queued %d events", hash, queued))
+		ioutil.WriteFile(file, []byte("before"), 0644)
+		os.Chtimes(file, info.ModTime(), info.ModTime())
+	}
+}
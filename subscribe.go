@@ -0,0 +1,201 @@
+package fsevents
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	// Subscription errors
+	ErrNoSubscription     = errors.New("subscription not found")
+	ErrSubscriberTooSlow  = errors.New("subscription buffer full, subscription disconnected")
+	ErrSubscriptionClosed = errors.New("subscription closed")
+)
+
+// SubscribeOptions configures a Subscription
+type SubscribeOptions struct {
+	// Number of events the Subscription can hold before Overflow applies
+	BufferSize int
+	// What to do with an event when the buffer is full. OverflowBlock holds up every other subscriber
+	// and the reading of events, until this subscriber makes room
+	Overflow OverflowPolicy
+}
+
+// Subscription receives the events of a Watcher that pass its filter, independently of other subscriptions
+type Subscription struct {
+	sync.Mutex
+	// Receives the events of the Subscription. Closed by Unsubscribe, or when the Subscription is disconnected
+	Events <-chan *FsEvent
+	events chan *FsEvent
+	filter EventFilter
+	opts   SubscribeOptions
+	// Closed by Unsubscribe to release a publisher blocked on a full buffer
+	done      chan struct{}
+	closeOnce sync.Once
+	closed    bool
+	// Number of events dropped because of Overflow
+	dropped uint64
+	// Why the Subscription was closed
+	err error
+}
+
+// Subscribe returns a new Subscription receiving every event read by Watch, and every event of poll watches while
+// WatchAndHandle is not running, for which filter returns true. A nil filter lets every event through.
+// While a Watcher has subscriptions, events are published to them and not sent on w.Events.
+func (w *Watcher) Subscribe(filter EventFilter, opts SubscribeOptions) *Subscription {
+	if opts.BufferSize < 0 {
+		opts.BufferSize = 0
+	}
+	events := make(chan *FsEvent, opts.BufferSize)
+	s := &Subscription{
+		Events: events,
+		events: events,
+		filter: filter,
+		opts:   opts,
+		done:   make(chan struct{}),
+	}
+	w.subscriptionsLock.Lock()
+	w.subscriptions = append(w.subscriptions, s)
+	w.subscriptionsLock.Unlock()
+	return s
+}
+
+// Unsubscribe removes s from w and closes s.Events
+func (w *Watcher) Unsubscribe(s *Subscription) error {
+	if !w.removeSubscription(s) {
+		return ErrNoSubscription
+	}
+	s.close(ErrSubscriptionClosed)
+	return nil
+}
+
+// removeSubscription removes s from the subscriptions of w, returning false if it was not one of them
+func (w *Watcher) removeSubscription(s *Subscription) bool {
+	w.subscriptionsLock.Lock()
+	defer w.subscriptionsLock.Unlock()
+	for i, sub := range w.subscriptions {
+		if sub == s {
+			w.subscriptions = append(w.subscriptions[:i:i], w.subscriptions[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// close closes the Subscription's channel, recording err as the reason
+func (s *Subscription) close(err error) {
+	s.closeOnce.Do(func() {
+		close(s.done)
+		s.Lock()
+		defer s.Unlock()
+		s.closed = true
+		s.err = err
+		close(s.events)
+	})
+}
+
+// Dropped returns the number of events this Subscription dropped because its buffer was full
+func (s *Subscription) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+// Err returns why s.Events was closed: ErrSubscriptionClosed after Unsubscribe, ErrSubscriberTooSlow after the
+// Subscription was disconnected, or nil if it is still open
+func (s *Subscription) Err() error {
+	s.Lock()
+	defer s.Unlock()
+	return s.err
+}
+
+// send passes event to the Subscription according to its Overflow policy. It returns false if the Subscription
+// must be disconnected
+func (s *Subscription) send(event *FsEvent) bool {
+	s.Lock()
+	defer s.Unlock()
+	if s.closed {
+		return true
+	}
+	select {
+	case s.events <- event:
+		return true
+	default:
+	}
+
+	switch s.opts.Overflow {
+	case OverflowDropNewest:
+		atomic.AddUint64(&s.dropped, 1)
+	case OverflowDropOldest:
+		if cap(s.events) == 0 {
+			// Nothing to drop but the event itself
+			atomic.AddUint64(&s.dropped, 1)
+			return true
+		}
+		for {
+			select {
+			case <-s.events:
+				atomic.AddUint64(&s.dropped, 1)
+			default:
+			}
+			select {
+			case s.events <- event:
+				return true
+			default:
+			}
+		}
+	case OverflowDisconnect:
+		atomic.AddUint64(&s.dropped, 1)
+		return false
+	default:
+		select {
+		case s.events <- event:
+		case <-s.done:
+		}
+	}
+	return true
+}
+
+// unsubscribeAll closes every Subscription of w
+func (w *Watcher) unsubscribeAll() {
+	w.subscriptionsLock.Lock()
+	subscriptions := w.subscriptions
+	w.subscriptions = nil
+	w.subscriptionsLock.Unlock()
+	for _, s := range subscriptions {
+		s.close(ErrSubscriptionClosed)
+	}
+}
+
+// hasSubscriptions returns true if w has at least one Subscription
+func (w *Watcher) hasSubscriptions() bool {
+	w.subscriptionsLock.Lock()
+	defer w.subscriptionsLock.Unlock()
+	return len(w.subscriptions) > 0
+}
+
+// publish passes event to every Subscription whose filter it passes
+func (w *Watcher) publish(event *FsEvent) {
+	w.subscriptionsLock.Lock()
+	subscriptions := w.subscriptions
+	w.subscriptionsLock.Unlock()
+
+	for _, s := range subscriptions {
+		if s.filter != nil && !s.filter(event) {
+			continue
+		}
+		if !s.send(event) {
+			w.removeSubscription(s)
+			s.close(ErrSubscriberTooSlow)
+			w.logf("fsevents: subscription buffer full, disconnected subscription")
+		}
+	}
+}
+
+// emit publishes event to the subscriptions of w if there are any, and sends it on w.Events otherwise
+func (w *Watcher) emit(event *FsEvent) {
+	if w.hasSubscriptions() {
+		w.publish(event)
+		return
+	}
+	w.sendEvent(event)
+}
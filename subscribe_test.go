@@ -0,0 +1,100 @@
+package fsevents_test
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	fsevents "github.com/tywkeene/go-fsevents"
+)
+
+func subscribeTestWatcher(t *testing.T) *fsevents.Watcher {
+	w, err := fsevents.NewWatcher()
+	assert(t, (err == nil), err)
+	d, err := w.AddDescriptor(testRootDir, fsevents.CloseWrite)
+	assert(t, (err == nil), err)
+	assert(t, (d.Start() == nil), fmt.Errorf("Start should not have returned an error"))
+	return w
+}
+
+func receiveTimeout(s *fsevents.Subscription, timeout time.Duration) (*fsevents.FsEvent, bool) {
+	select {
+	case event, ok := <-s.Events:
+		return event, ok
+	case <-time.After(timeout):
+		return nil, false
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	setupDirs([]string{testRootDir})
+	defer teardownDirs([]string{testRootDir})
+
+	w := subscribeTestWatcher(t)
+	defer w.Close()
+
+	all := w.Subscribe(nil, fsevents.SubscribeOptions{BufferSize: 4})
+	goFiles := w.Subscribe(func(event *fsevents.FsEvent) bool {
+		return strings.HasSuffix(event.Path, ".go")
+	}, fsevents.SubscribeOptions{BufferSize: 4})
+	go w.Watch()
+
+	writeRandomFile(path.Join(testRootDir, "a.md"))
+	writeRandomFile(path.Join(testRootDir, "b.go"))
+
+	for _, name := range []string{"a.md", "b.go"} {
+		event, ok := receiveTimeout(all, 5*time.Second)
+		assert(t, (ok && event.Name == name), fmt.Errorf("subscription should have received %q", name))
+	}
+	event, ok := receiveTimeout(goFiles, 5*time.Second)
+	assert(t, (ok && event.Name == "b.go"), fmt.Errorf("filtered subscription should have received b.go"))
+
+	assert(t, (w.Unsubscribe(goFiles) == nil), fmt.Errorf("Unsubscribe should not have returned an error"))
+	assert(t, (w.Unsubscribe(goFiles) == fsevents.ErrNoSubscription), fmt.Errorf("Unsubscribe should have returned ErrNoSubscription"))
+	_, ok = <-goFiles.Events
+	assert(t, (!ok), fmt.Errorf("Unsubscribe should have closed the subscription's channel"))
+	assert(t, (goFiles.Err() == fsevents.ErrSubscriptionClosed), fmt.Errorf("Err should have returned ErrSubscriptionClosed"))
+
+	writeRandomFile(path.Join(testRootDir, "c.go"))
+	event, ok = receiveTimeout(all, 5*time.Second)
+	assert(t, (ok && event.Name == "c.go"), fmt.Errorf("remaining subscription should have received c.go"))
+}
+
+func TestSubscribeOverflow(t *testing.T) {
+	setupDirs([]string{testRootDir})
+	defer teardownDirs([]string{testRootDir})
+
+	w := subscribeTestWatcher(t)
+	defer w.Close()
+
+	newest := w.Subscribe(nil, fsevents.SubscribeOptions{BufferSize: 1, Overflow: fsevents.OverflowDropNewest})
+	oldest := w.Subscribe(nil, fsevents.SubscribeOptions{BufferSize: 1, Overflow: fsevents.OverflowDropOldest})
+	disconnect := w.Subscribe(nil, fsevents.SubscribeOptions{BufferSize: 1, Overflow: fsevents.OverflowDisconnect})
+	// Receives every event, so that the test knows when all of them were published
+	all := w.Subscribe(nil, fsevents.SubscribeOptions{BufferSize: 3})
+	go w.Watch()
+
+	for i := 0; i < 3; i++ {
+		writeRandomFile(path.Join(testRootDir, fmt.Sprintf("overflow%d", i)))
+	}
+	for i := 0; i < 3; i++ {
+		_, ok := receiveTimeout(all, 5*time.Second)
+		assert(t, (ok), fmt.Errorf("only %d of 3 events were published", i))
+	}
+
+	event, _ := receiveTimeout(newest, time.Second)
+	assert(t, (event != nil && event.Name == "overflow0"), fmt.Errorf("drop-newest subscription should have kept the first event"))
+	assert(t, (newest.Dropped() == 2), fmt.Errorf("drop-newest subscription should have dropped 2 events, got %d", newest.Dropped()))
+
+	event, _ = receiveTimeout(oldest, time.Second)
+	assert(t, (event != nil && event.Name == "overflow2"), fmt.Errorf("drop-oldest subscription should have kept the last event"))
+	assert(t, (oldest.Dropped() == 2), fmt.Errorf("drop-oldest subscription should have dropped 2 events, got %d", oldest.Dropped()))
+
+	event, _ = receiveTimeout(disconnect, time.Second)
+	assert(t, (event != nil && event.Name == "overflow0"), fmt.Errorf("disconnected subscription should have kept the first event"))
+	_, ok := <-disconnect.Events
+	assert(t, (!ok), fmt.Errorf("subscription should have been disconnected"))
+	assert(t, (disconnect.Err() == fsevents.ErrSubscriberTooSlow), fmt.Errorf("Err should have returned ErrSubscriberTooSlow"))
+}
@@ -0,0 +1,516 @@
+package fsevents
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+var (
+	ErrBadClock      = errors.New("malformed clock")
+	ErrViewRoot      = errors.New("tree view saved for another directory")
+	ErrViewNotLoaded = errors.New("tree view could not be loaded")
+)
+
+// File types reported in FileState.Type, following find(1)
+const (
+	TypeFile      = "f"
+	TypeDir       = "d"
+	TypeSymlink   = "l"
+	TypeSocket    = "s"
+	TypePipe      = "p"
+	TypeBlock     = "b"
+	TypeCharacter = "c"
+)
+
+// FileState is the state of a file in a TreeView
+type FileState struct {
+	// Path of the file relative to the root of the TreeView
+	Name string `json:"name"`
+	// False once the file was deleted or moved away
+	Exists bool `json:"exists"`
+	// One of TypeFile, TypeDir, TypeSymlink, TypeSocket, TypePipe, TypeBlock or TypeCharacter
+	Type    string      `json:"type"`
+	Size    int64       `json:"size"`
+	Mode    os.FileMode `json:"mode"`
+	ModTime time.Time   `json:"mtime"`
+	Inode   uint64      `json:"ino"`
+	// Tick of the view's clock at which the file last changed
+	Changed uint64 `json:"changed"`
+	// Tick of the view's clock at which the file was created, or first seen
+	Created uint64 `json:"created"`
+}
+
+// TreeQuery selects the files returned by TreeView.Query
+type TreeQuery struct {
+	// Clock returned by a previous query or by TreeView.Clock. Only the files changed since are returned.
+	// Empty means every existing file
+	Since string
+	// Patterns the path of a file relative to the root must match one of, see MatchPattern. Empty means any
+	Globs []string
+	// Suffixes the name of a file must end with one of, without the dot, such as "go". Empty means any
+	Suffixes []string
+	// Types a file must be of one of, such as TypeFile. Empty means any
+	Types []string
+}
+
+// QueryResult is the answer to a TreeQuery
+type QueryResult struct {
+	// The clock to query the changes following this result with
+	Clock string `json:"clock"`
+	// True if the changes since the queried clock are unknown, because the clock is from another instance of the
+	// view, such as before the program restarted, the inotify queue overflowed since, or no clock was given, or
+	// because the files deleted after it were dropped by TreeView.PruneDeleted.
+	// Files then lists every existing file, and consumers should treat everything as changed
+	IsFreshInstance bool `json:"is_fresh_instance"`
+	// The files matching the query, ordered by path. Unless IsFreshInstance is set, files deleted since
+	// the queried clock are included, with Exists false
+	Files []FileState `json:"files"`
+}
+
+// TreeView is an in-memory view of a directory tree kept up to date by a Watcher, recording for every file the
+// tick of the view's clock at which it last changed, so that the files changed since a point in time can be
+// queried instead of subscribed to.
+//
+// Clocks are strings of the form "c:<instance>:<tick>". The instance changes whenever the view can no longer
+// tell what changed since earlier clocks: when it is created by NewTreeView, and when the inotify event queue
+// overflows, after which the tree is crawled again. A view loaded with LoadTreeView keeps its instance.
+//
+// Deleted files are kept, so that queries report their deletion, until PruneDeleted drops them.
+type TreeView struct {
+	sync.RWMutex
+	root     string
+	instance string
+	tick     uint64
+	files    map[string]*FileState
+	// Names of the files of each directory, key: relative path of the directory, "." for the root
+	children map[string]map[string]bool
+	// Tick up to which deleted files were dropped. Queries since an earlier tick get a fresh instance
+	horizon uint64
+}
+
+// treeViewState is the form a TreeView is saved in
+type treeViewState struct {
+	Root     string       `json:"root"`
+	Instance string       `json:"instance"`
+	Tick     uint64       `json:"tick"`
+	Horizon  uint64       `json:"horizon,omitempty"`
+	Files    []*FileState `json:"files"`
+}
+
+// newInstance returns an instance identifier unlikely to have been used before
+func newInstance() string {
+	return fmt.Sprintf("%d.%d", time.Now().UnixNano(), os.Getpid())
+}
+
+// fileType returns the type letter of a file mode
+func fileType(mode os.FileMode) string {
+	switch {
+	case mode.IsDir():
+		return TypeDir
+	case mode&os.ModeSymlink != 0:
+		return TypeSymlink
+	case mode&os.ModeSocket != 0:
+		return TypeSocket
+	case mode&os.ModeNamedPipe != 0:
+		return TypePipe
+	case mode&os.ModeCharDevice != 0:
+		return TypeCharacter
+	case mode&os.ModeDevice != 0:
+		return TypeBlock
+	}
+	return TypeFile
+}
+
+// NewTreeView crawls the tree at rootPath and returns a view of it, kept up to date with the events read by
+// ReadSingleEvent, Watch or WatchAndHandle, and those of poll watches, below rootPath. The tree must be watched,
+// such as with RecursiveAdd, for the view to see its changes. The view is updated before the event is returned
+// or delivered, so that a query made after receiving an event reflects it.
+func (w *Watcher) NewTreeView(rootPath string) (*TreeView, error) {
+	v := &TreeView{root: path.Clean(rootPath)}
+	if err := v.crawl(); err != nil {
+		return nil, err
+	}
+	w.addView(v)
+	return v, nil
+}
+
+// LoadTreeView loads the view of rootPath saved at file by TreeView.Save, and brings it up to date by comparing it
+// with the tree, so that the clocks it returned before keep their meaning. Without a saved view it creates a
+// new one like NewTreeView.
+func (w *Watcher) LoadTreeView(file string, rootPath string) (*TreeView, error) {
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return w.NewTreeView(rootPath)
+	} else if err != nil {
+		return nil, fmt.Errorf("%s: %s", ErrViewNotLoaded, err)
+	}
+	state := &treeViewState{}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("%s: %s", ErrViewNotLoaded, err)
+	}
+	if state.Root != path.Clean(rootPath) {
+		return nil, fmt.Errorf("%s: %q", ErrViewRoot, state.Root)
+	}
+	v := &TreeView{
+		root:     state.Root,
+		instance: state.Instance,
+		tick:     state.Tick,
+		horizon:  state.Horizon,
+		files:    make(map[string]*FileState),
+		children: make(map[string]map[string]bool),
+	}
+	previous := make(map[string]pollEntry)
+	for _, file := range state.Files {
+		v.add(file)
+		if file.Exists {
+			previous[path.Join(v.root, file.Name)] = pollEntry{
+				ino:   file.Inode,
+				size:  file.Size,
+				mtime: file.ModTime,
+				mode:  file.Mode,
+			}
+		}
+	}
+
+	// The changes made while the view was not kept up to date
+	current, err := scanTree(v.root)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", ErrViewNotLoaded, err)
+	}
+	changes := diffEntries(previous, current, AllEvents, func() uint32 { return 0 })
+	if len(changes) > 0 {
+		v.tick++
+	}
+	for _, change := range changes {
+		relative, _ := v.relative(change.path)
+		if CheckMask(Delete|MovedFrom, change.mask) {
+			v.remove(relative)
+		} else {
+			v.stat(relative)
+		}
+	}
+	w.addView(v)
+	return v, nil
+}
+
+// Save writes the view to file, see LoadTreeView
+func (v *TreeView) Save(file string) error {
+	v.RLock()
+	state := treeViewState{
+		Root:     v.root,
+		Instance: v.instance,
+		Tick:     v.tick,
+		Horizon:  v.horizon,
+		Files:    make([]*FileState, 0, len(v.files)),
+	}
+	for _, file := range v.files {
+		state.Files = append(state.Files, file)
+	}
+	data, err := json.Marshal(&state)
+	v.RUnlock()
+	if err != nil {
+		return err
+	}
+	tmpPath := file + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, file)
+}
+
+// RemoveTreeView stops updating v
+func (w *Watcher) RemoveTreeView(v *TreeView) {
+	w.viewsLock.Lock()
+	defer w.viewsLock.Unlock()
+	// Copied, since updateViews may be going through the current slice
+	views := make([]*TreeView, 0, len(w.views))
+	for _, view := range w.views {
+		if view != v {
+			views = append(views, view)
+		}
+	}
+	w.views = views
+}
+
+func (w *Watcher) addView(v *TreeView) {
+	w.viewsLock.Lock()
+	w.views = append(w.views[:len(w.views):len(w.views)], v)
+	w.viewsLock.Unlock()
+}
+
+// updateViews applies event to the tree views of the Watcher
+func (w *Watcher) updateViews(event *FsEvent) {
+	w.viewsLock.Lock()
+	views := w.views
+	w.viewsLock.Unlock()
+	for _, v := range views {
+		v.update(event)
+	}
+}
+
+// overflowViews crawls the trees of the Watcher's views again after events were lost
+func (w *Watcher) overflowViews() {
+	w.viewsLock.Lock()
+	views := w.views
+	w.viewsLock.Unlock()
+	for _, v := range views {
+		if err := v.crawl(); err != nil {
+			w.reportError(err)
+		}
+	}
+}
+
+// crawl records the state of every file of the tree as of a new instance
+func (v *TreeView) crawl() error {
+	entries, err := scanTree(v.root)
+	if err != nil {
+		return err
+	}
+	v.Lock()
+	defer v.Unlock()
+	v.instance = newInstance()
+	v.tick = 1
+	v.horizon = 0
+	v.files = make(map[string]*FileState, len(entries))
+	v.children = make(map[string]map[string]bool)
+	for entryPath, entry := range entries {
+		relative, _ := v.relative(entryPath)
+		v.add(&FileState{
+			Name:    relative,
+			Exists:  true,
+			Type:    fileType(entry.mode),
+			Size:    entry.size,
+			Mode:    entry.mode,
+			ModTime: entry.mtime,
+			Inode:   entry.ino,
+			Changed: v.tick,
+			Created: v.tick,
+		})
+	}
+	return nil
+}
+
+// add records file in the view, and in the files of its directory
+func (v *TreeView) add(file *FileState) {
+	v.files[file.Name] = file
+	dir := path.Dir(file.Name)
+	if v.children[dir] == nil {
+		v.children[dir] = make(map[string]bool)
+	}
+	v.children[dir][file.Name] = true
+}
+
+// drop forgets the file named name
+func (v *TreeView) drop(name string) {
+	delete(v.files, name)
+	dir := path.Dir(name)
+	delete(v.children[dir], name)
+	if len(v.children[dir]) == 0 {
+		delete(v.children, dir)
+	}
+}
+
+// relative returns filePath relative to the root of the view, and false if it is not below it
+func (v *TreeView) relative(filePath string) (string, bool) {
+	relative, err := filepath.Rel(v.root, path.Clean(filePath))
+	if err != nil || relative == "." || relative == ".." || strings.HasPrefix(relative, "../") {
+		return "", false
+	}
+	return relative, true
+}
+
+// update applies event to the view
+func (v *TreeView) update(event *FsEvent) {
+	if event.RawEvent == nil {
+		return
+	}
+	relative, below := v.relative(event.Path)
+	if !below {
+		return
+	}
+	mask := event.RawEvent.Mask
+	v.Lock()
+	defer v.Unlock()
+	switch {
+	case CheckMask(Delete|MovedFrom, mask):
+		v.tick++
+		v.remove(relative)
+	case CheckMask(Create|MovedTo|Modified|CloseWrite|AttrChange, mask):
+		v.tick++
+		v.stat(relative)
+		if CheckMask(Create|MovedTo, mask) && CheckMask(IsDir, mask) {
+			// Files created in the directory before it was watched, or moved along with it
+			v.crawlDir(relative)
+		}
+	}
+}
+
+// remove marks the file at relative, and everything below it, as deleted at the current tick
+func (v *TreeView) remove(relative string) {
+	if file, exists := v.files[relative]; exists && file.Exists {
+		file.Exists = false
+		file.Changed = v.tick
+	}
+	for child := range v.children[relative] {
+		v.remove(child)
+	}
+}
+
+// stat records the current state of the file at relative as changed at the current tick
+func (v *TreeView) stat(relative string) {
+	info, err := os.Lstat(path.Join(v.root, relative))
+	if err != nil {
+		v.remove(relative)
+		return
+	}
+	v.record(relative, info)
+}
+
+// record sets the state of the file at relative to info as of the current tick
+func (v *TreeView) record(relative string, info os.FileInfo) {
+	file, exists := v.files[relative]
+	if !exists || !file.Exists {
+		file = &FileState{Name: relative, Created: v.tick}
+		v.add(file)
+	}
+	file.Exists = true
+	file.Type = fileType(info.Mode())
+	file.Size = info.Size()
+	file.Mode = info.Mode()
+	file.ModTime = info.ModTime()
+	if stat, ok := info.Sys().(*unix.Stat_t); ok {
+		file.Inode = stat.Ino
+	}
+	file.Changed = v.tick
+}
+
+// crawlDir records every file below the directory at relative as changed at the current tick
+func (v *TreeView) crawlDir(relative string) {
+	entries, err := scanTree(path.Join(v.root, relative))
+	if err != nil {
+		return
+	}
+	for entryPath := range entries {
+		if name, below := v.relative(entryPath); below {
+			v.stat(name)
+		}
+	}
+}
+
+// Clock returns the current clock of the view
+func (v *TreeView) Clock() string {
+	v.RLock()
+	defer v.RUnlock()
+	return v.clock()
+}
+
+func (v *TreeView) clock() string {
+	return "c:" + v.instance + ":" + strconv.FormatUint(v.tick, 10)
+}
+
+// parseClock splits a clock into its instance and tick
+func parseClock(clock string) (string, uint64, error) {
+	sep := strings.LastIndex(clock, ":")
+	if !strings.HasPrefix(clock, "c:") || sep < 2 {
+		return "", 0, fmt.Errorf("%s: %q", ErrBadClock, clock)
+	}
+	tick, err := strconv.ParseUint(clock[sep+1:], 10, 64)
+	if err != nil {
+		return "", 0, fmt.Errorf("%s: %q", ErrBadClock, clock)
+	}
+	return clock[2:sep], tick, nil
+}
+
+// PruneDeleted drops the files deleted at or before clock, which no client will query a clock older than, and
+// returns how many were dropped. Queries since an earlier clock then get a fresh instance. A clock of another
+// instance drops nothing.
+func (v *TreeView) PruneDeleted(clock string) (int, error) {
+	instance, tick, err := parseClock(clock)
+	if err != nil {
+		return 0, err
+	}
+	v.Lock()
+	defer v.Unlock()
+	if instance != v.instance || tick <= v.horizon {
+		return 0, nil
+	}
+	if tick > v.tick {
+		tick = v.tick
+	}
+	dropped := 0
+	for name, file := range v.files {
+		if !file.Exists && file.Changed <= tick {
+			v.drop(name)
+			dropped++
+		}
+	}
+	v.horizon = tick
+	return dropped, nil
+}
+
+// Query returns the files matching q changed since q.Since
+func (v *TreeView) Query(q TreeQuery) (*QueryResult, error) {
+	var instance string
+	var since uint64
+	if q.Since != "" {
+		var err error
+		if instance, since, err = parseClock(q.Since); err != nil {
+			return nil, err
+		}
+	}
+
+	v.RLock()
+	defer v.RUnlock()
+	fresh := instance != v.instance || since < v.horizon
+	result := &QueryResult{Clock: v.clock(), IsFreshInstance: fresh, Files: make([]FileState, 0)}
+	for _, file := range v.files {
+		if (fresh && !file.Exists) || (!fresh && file.Changed <= since) {
+			continue
+		}
+		if q.matches(file) {
+			result.Files = append(result.Files, *file)
+		}
+	}
+	sort.Slice(result.Files, func(i, j int) bool { return result.Files[i].Name < result.Files[j].Name })
+	return result, nil
+}
+
+// matches returns true if file passes the globs, suffixes and types of the query
+func (q *TreeQuery) matches(file *FileState) bool {
+	if len(q.Globs) > 0 && !matchAny(q.Globs, file.Name) {
+		return false
+	}
+	if len(q.Suffixes) > 0 {
+		matched := false
+		for _, suffix := range q.Suffixes {
+			if strings.HasSuffix(file.Name, "."+suffix) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	if len(q.Types) > 0 {
+		for _, fileType := range q.Types {
+			if file.Type == fileType {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
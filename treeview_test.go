@@ -0,0 +1,168 @@
+package fsevents_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	fsevents "github.com/tywkeene/go-fsevents"
+)
+
+// drainEvents reads events from w until none arrive for a while
+func drainEvents(w *fsevents.Watcher) {
+	for {
+		if _, err := readSingleEventTimeout(w, 200*time.Millisecond); err != nil {
+			return
+		}
+	}
+}
+
+// fileNames returns the names of files, with a "-" prefix for deleted files
+func fileNames(files []fsevents.FileState) string {
+	names := make([]string, 0, len(files))
+	for _, file := range files {
+		if file.Exists {
+			names = append(names, file.Name)
+		} else {
+			names = append(names, "-"+file.Name)
+		}
+	}
+	return strings.Join(names, " ")
+}
+
+func treeViewTestWatcher(t *testing.T) *fsevents.Watcher {
+	w := flagsTestWatcher(t)
+	err := w.RecursiveAdd(testRootDir, fsevents.Create|fsevents.Delete|fsevents.Move|fsevents.CloseWrite)
+	assert(t, (err == nil), err)
+	return w
+}
+
+func TestTreeView(t *testing.T) {
+	sub := path.Join(testRootDir, "sub")
+	setupDirs([]string{testRootDir, sub})
+	defer teardownDirs([]string{testRootDir})
+	for _, name := range []string{"changed.go", "removed.txt", "sub/kept.go"} {
+		writeRandomFile(path.Join(testRootDir, name))
+	}
+	w := treeViewTestWatcher(t)
+	defer w.Close()
+	v, err := w.NewTreeView(testRootDir)
+	assert(t, (err == nil), err)
+
+	result, err := v.Query(fsevents.TreeQuery{})
+	assert(t, (err == nil), err)
+	assert(t, (result.IsFreshInstance && fileNames(result.Files) == "changed.go removed.txt sub sub/kept.go"),
+		fmt.Errorf("a query without clock should have listed every file, got %q", fileNames(result.Files)))
+	since := result.Clock
+
+	writeRandomFile(path.Join(testRootDir, "changed.go"))
+	os.Remove(path.Join(testRootDir, "removed.txt"))
+	writeRandomFile(path.Join(sub, "created.go"))
+	drainEvents(w)
+
+	result, err = v.Query(fsevents.TreeQuery{Since: since})
+	assert(t, (err == nil), err)
+	assert(t, (!result.IsFreshInstance && fileNames(result.Files) == "changed.go -removed.txt sub/created.go"),
+		fmt.Errorf("the query should have returned the changes since the clock, got %q", fileNames(result.Files)))
+	assert(t, (result.Clock != since), fmt.Errorf("the clock should have advanced"))
+
+	queries := map[string]fsevents.TreeQuery{
+		"changed.go sub/created.go": {Since: since, Suffixes: []string{"go"}},
+		"sub/created.go":            {Since: since, Globs: []string{"sub/**"}},
+		"sub":                       {Types: []string{fsevents.TypeDir}},
+		"":                          {Since: result.Clock},
+	}
+	for expected, q := range queries {
+		result, err := v.Query(q)
+		assert(t, (err == nil), err)
+		assert(t, (fileNames(result.Files) == expected), fmt.Errorf("query %+v should have returned %q, got %q", q, expected, fileNames(result.Files)))
+	}
+}
+
+func TestTreeViewClocks(t *testing.T) {
+	setupDirs([]string{testRootDir})
+	defer teardownDirs([]string{testRootDir})
+	w := treeViewTestWatcher(t)
+	defer w.Close()
+	v, err := w.NewTreeView(testRootDir)
+	assert(t, (err == nil), err)
+	other, err := w.NewTreeView(testRootDir)
+	assert(t, (err == nil), err)
+
+	result, err := v.Query(fsevents.TreeQuery{Since: other.Clock()})
+	assert(t, (err == nil && result.IsFreshInstance), fmt.Errorf("a clock of another instance should have given a fresh instance"))
+	for _, clock := range []string{"nope", "c:instance", "c:instance:tick"} {
+		_, err = v.Query(fsevents.TreeQuery{Since: clock})
+		assert(t, (err != nil && strings.HasPrefix(err.Error(), fsevents.ErrBadClock.Error())),
+			fmt.Errorf("Query should have rejected clock %q, got %v", clock, err))
+	}
+}
+
+func TestTreeViewPersist(t *testing.T) {
+	setupDirs([]string{testRootDir})
+	defer teardownDirs([]string{testRootDir})
+	dir, err := ioutil.TempDir("", "fsevents-view")
+	assert(t, (err == nil), err)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "view.json")
+	writeRandomFile(path.Join(testRootDir, "existing"))
+
+	w := treeViewTestWatcher(t)
+	v, err := w.LoadTreeView(file, testRootDir)
+	assert(t, (err == nil), err)
+	since := v.Clock()
+	assert(t, (v.Save(file) == nil), fmt.Errorf("Save should not have returned an error"))
+	w.Close()
+
+	// Changed while no view was kept
+	writeRandomFile(path.Join(testRootDir, "offline"))
+
+	w = treeViewTestWatcher(t)
+	defer w.Close()
+	v, err = w.LoadTreeView(file, testRootDir)
+	assert(t, (err == nil), err)
+	result, err := v.Query(fsevents.TreeQuery{Since: since})
+	assert(t, (err == nil), err)
+	assert(t, (!result.IsFreshInstance && fileNames(result.Files) == "offline"),
+		fmt.Errorf("the loaded view should have found the offline change, got %q fresh %t", fileNames(result.Files), result.IsFreshInstance))
+
+	_, err = w.LoadTreeView(file, path.Join(testRootDir, "elsewhere"))
+	assert(t, (err != nil && strings.HasPrefix(err.Error(), fsevents.ErrViewRoot.Error())),
+		fmt.Errorf("LoadTreeView should have refused a view of another directory, got %v", err))
+}
+
+func TestTreeViewPruneDeleted(t *testing.T) {
+	sub := path.Join(testRootDir, "sub")
+	setupDirs([]string{testRootDir, sub})
+	defer teardownDirs([]string{testRootDir})
+	for _, name := range []string{"first", "second", "sub/file"} {
+		writeRandomFile(path.Join(testRootDir, name))
+	}
+	w := treeViewTestWatcher(t)
+	defer w.Close()
+	v, err := w.NewTreeView(testRootDir)
+	assert(t, (err == nil), err)
+	before := v.Clock()
+
+	os.RemoveAll(sub)
+	os.Remove(path.Join(testRootDir, "first"))
+	drainEvents(w)
+	pruned := v.Clock()
+	os.Remove(path.Join(testRootDir, "second"))
+	drainEvents(w)
+
+	// Only the files deleted up to the clock are dropped
+	dropped, err := v.PruneDeleted(pruned)
+	assert(t, (err == nil && dropped == 3), fmt.Errorf("PruneDeleted should have dropped 3 files, got %d %v", dropped, err))
+	result, err := v.Query(fsevents.TreeQuery{Since: pruned})
+	assert(t, (err == nil), err)
+	assert(t, (!result.IsFreshInstance && fileNames(result.Files) == "-second"),
+		fmt.Errorf("the deletion after the clock should have been kept, got %q", fileNames(result.Files)))
+	result, err = v.Query(fsevents.TreeQuery{Since: before})
+	assert(t, (err == nil && result.IsFreshInstance), fmt.Errorf("a clock before the pruned deletions should have given a fresh instance"))
+}
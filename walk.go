@@ -0,0 +1,353 @@
+package fsevents
+
+import (
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Size of the buffer handed to getdents64. Large enough to read most directories in one call
+const direntBufferSize = 32 * 1024
+
+// Directory modification times are taken from a coarse clock. A directory whose modification time is within
+// racyWindow of the time it was listed may have changed after the listing without its modification time changing.
+const racyWindow = 20 * time.Millisecond
+
+// Offsets of the fields of struct linux_dirent64
+const (
+	direntReclenOffset = 16
+	direntTypeOffset   = 18
+	direntNameOffset   = 19
+)
+
+// WalkProgress describes how far a parallel RecursiveAddWithOptions has got
+type WalkProgress struct {
+	// Descriptors added and started so far
+	DirsAdded int
+	// Poll watches added so far
+	DirsPolled int
+	// Directory entries seen so far, files included
+	Entries int
+	// Directories skipped so far
+	Skipped int
+	// Directories waiting to be listed
+	Queued int
+}
+
+// readSubdirs lists the directories directly below the open directory fd using getdents64,
+// relying on d_type so that entries do not need to be stat'd one by one
+func readSubdirs(fd int, dirPath string) (dirs []string, entries int, err error) {
+	buf := make([]byte, direntBufferSize)
+	for {
+		n, err := unix.Getdents(fd, buf)
+		if err != nil {
+			return nil, entries, &os.PathError{Op: "getdents", Path: dirPath, Err: err}
+		}
+		if n <= 0 {
+			return dirs, entries, nil
+		}
+		for off := 0; off < n; {
+			reclen := int(nativeEndian.Uint16(buf[off+direntReclenOffset:]))
+			if reclen == 0 || off+reclen > n {
+				break
+			}
+			typ := buf[off+direntTypeOffset]
+			name := buf[off+direntNameOffset : off+reclen]
+			for i, c := range name {
+				if c == 0 {
+					name = name[:i]
+					break
+				}
+			}
+			off += reclen
+
+			if string(name) == "." || string(name) == ".." {
+				continue
+			}
+			entries++
+			childPath := path.Join(dirPath, string(name))
+			if typ == unix.DT_UNKNOWN {
+				// Some filesystems don't fill in d_type
+				var stat unix.Stat_t
+				if err := unix.Lstat(childPath, &stat); err != nil {
+					continue
+				}
+				if stat.Mode&unix.S_IFMT == unix.S_IFDIR {
+					typ = unix.DT_DIR
+				}
+			}
+			if typ == unix.DT_DIR {
+				dirs = append(dirs, childPath)
+			}
+		}
+	}
+}
+
+// walkJob is a directory waiting to be added by a walk
+type walkJob struct {
+	path  string
+	depth int
+	// Identity of the directory, filled in by RecursiveOptions.enter
+	id fileID
+	// Identities of the directories above it, up to the root of the walk
+	ancestors []fileID
+}
+
+// listing records when a directory was listed, and its modification time at that point
+type listing struct {
+	job      walkJob
+	mtime    int64
+	listedAt int64
+}
+
+// stale returns true if the directory may have changed since it was listed, given its current modification time
+func (l listing) stale(mtime int64) bool {
+	return mtime != l.mtime || l.mtime+int64(racyWindow) >= l.listedAt
+}
+
+// visitOutcome describes what a walker did with a directory
+type visitOutcome int
+
+const (
+	visitAdded visitOutcome = iota
+	visitPolled
+	visitBoundary
+	visitFailed
+)
+
+// walker adds the directories of a tree with a bounded pool of goroutines
+type walker struct {
+	sync.Mutex
+	w       *Watcher
+	mask    uint32
+	root    string
+	rootDev uint64
+	opts    RecursiveOptions
+	// Signalled when jobs are queued or the walk is over
+	cond *sync.Cond
+	// Directories waiting to be added
+	queue []walkJob
+	// Jobs queued or being worked on
+	pending int
+	// Every directory ever queued, key: path
+	seen map[string]bool
+	// Every directory that was listed, key: path
+	listed   map[string]listing
+	result   *RecursiveResult
+	progress WalkProgress
+	// The error that stopped the walk, if any
+	err error
+}
+
+func (wk *walker) push(job walkJob) {
+	wk.seen[job.path] = true
+	wk.queue = append(wk.queue, job)
+	wk.pending++
+	wk.progress.Queued = len(wk.queue)
+	wk.cond.Signal()
+}
+
+// work takes jobs from the queue until it is empty and nothing is being worked on, or the walk failed
+func (wk *walker) work() {
+	wk.Lock()
+	defer wk.Unlock()
+	for {
+		for len(wk.queue) == 0 && wk.pending > 0 && wk.err == nil {
+			wk.cond.Wait()
+		}
+		if wk.pending == 0 || wk.err != nil {
+			wk.cond.Broadcast()
+			return
+		}
+		job := wk.queue[len(wk.queue)-1]
+		wk.queue = wk.queue[:len(wk.queue)-1]
+		wk.progress.Queued = len(wk.queue)
+
+		wk.Unlock()
+		outcome, children, listed, entries, err := wk.visit(&job)
+		wk.Lock()
+
+		wk.pending--
+		wk.progress.Entries += entries
+		switch {
+		case err == ErrDescLoop:
+			wk.result.Skipped = append(wk.result.Skipped, SkippedPath{Path: job.path, Err: err})
+			wk.progress.Skipped++
+		case err != nil && job.path != wk.root && wk.opts.skip(job.path, err):
+			skipped := SkippedPath{Path: job.path, Err: err}
+			wk.result.Skipped = append(wk.result.Skipped, skipped)
+			wk.progress.Skipped++
+			wk.w.reportSkipped(skipped)
+		case err != nil:
+			if wk.err == nil {
+				wk.err = recursiveAddError(wk.root, job.path, err)
+			}
+		case outcome == visitBoundary:
+			wk.result.Boundaries = append(wk.result.Boundaries, job.path)
+		case outcome == visitPolled:
+			wk.result.Polled = append(wk.result.Polled, job.path)
+			wk.progress.DirsPolled++
+		default:
+			wk.result.Added = append(wk.result.Added, job.path)
+			wk.listed[job.path] = listed
+			wk.progress.DirsAdded++
+			for _, child := range children {
+				wk.push(job.child(child))
+			}
+		}
+		if wk.opts.Progress != nil {
+			wk.opts.Progress(wk.progress)
+		}
+		if wk.pending == 0 {
+			wk.cond.Broadcast()
+		}
+	}
+}
+
+// visit adds a single directory. The watch is started before the directory is listed, so that a directory created
+// after the listing is reported by inotify, and one created before it is in the listing.
+func (wk *walker) visit(job *walkJob) (outcome visitOutcome, children []string, l listing, entries int, err error) {
+	enter, err := wk.opts.enter(job, wk.rootDev)
+	if err != nil {
+		return visitFailed, nil, l, 0, err
+	}
+	if !enter {
+		return visitBoundary, nil, l, 0, nil
+	}
+	if (wk.opts.MaxDepth > 0 && job.depth > wk.opts.MaxDepth) || wk.w.pollInstead(job) {
+		// Only queued beyond MaxDepth when PollBelowMaxDepth is set
+		if err := wk.w.AddPollWatch(job.path, wk.mask); err != nil {
+			return visitFailed, nil, l, 0, err
+		}
+		return visitPolled, nil, l, 0, nil
+	}
+
+	fd, err := unix.Open(job.path, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return visitFailed, nil, l, 0, &os.PathError{Op: "open", Path: job.path, Err: err}
+	}
+	defer unix.Close(fd)
+
+	// Identified by enter already
+	d, err := wk.w.addDescriptor(job.path, wk.mask, 0, job.id)
+	if err != nil {
+		return visitFailed, nil, l, 0, err
+	}
+	// Started under the lock, since events of the Watcher may be read meanwhile
+	wk.w.Lock()
+	err = d.start()
+	if err != nil {
+		delete(wk.w.Descriptors, job.path)
+	}
+	wk.w.Unlock()
+	if err != nil {
+		return visitFailed, nil, l, 0, err
+	}
+
+	children, entries, l, err = listSubdirs(fd, *job)
+	if err != nil {
+		wk.w.rollback(&RecursiveResult{Added: []string{job.path}})
+		return visitFailed, nil, l, entries, err
+	}
+	if wk.opts.MaxDepth > 0 && job.depth+1 > wk.opts.MaxDepth && !wk.opts.PollBelowMaxDepth {
+		children = nil
+	}
+	return visitAdded, children, l, entries, nil
+}
+
+// listSubdirs lists the directories directly below the open directory fd of job and records when it was listed
+func listSubdirs(fd int, job walkJob) ([]string, int, listing, error) {
+	l := listing{job: job, listedAt: time.Now().UnixNano()}
+	var stat unix.Stat_t
+	if err := unix.Fstat(fd, &stat); err == nil {
+		l.mtime = stat.Mtim.Nano()
+	}
+	children, entries, err := readSubdirs(fd, job.path)
+	return children, entries, l, err
+}
+
+// run works through the queue with opts.Workers goroutines
+func (wk *walker) run() {
+	var wg sync.WaitGroup
+	for i := 0; i < wk.opts.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			wk.work()
+		}()
+	}
+	wg.Wait()
+}
+
+// rescan queues the subdirectories that were created in listed directories after they were listed
+// and have not been added yet. It returns false if there was nothing to queue.
+func (wk *walker) rescan() bool {
+	wk.Lock()
+	defer wk.Unlock()
+	queued := false
+	for dirPath, l := range wk.listed {
+		var stat unix.Stat_t
+		if err := unix.Stat(dirPath, &stat); err != nil || !l.stale(stat.Mtim.Nano()) {
+			continue
+		}
+
+		fd, err := unix.Open(dirPath, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+		if err != nil {
+			continue
+		}
+		children, _, relisted, err := listSubdirs(fd, l.job)
+		unix.Close(fd)
+		if err != nil {
+			continue
+		}
+		wk.listed[dirPath] = relisted
+		for _, child := range children {
+			if wk.seen[child] || wk.w.DescriptorExists(child) {
+				continue
+			}
+			job := l.job.child(child)
+			if wk.opts.MaxDepth > 0 && job.depth > wk.opts.MaxDepth && !wk.opts.PollBelowMaxDepth {
+				continue
+			}
+			wk.push(job)
+			queued = true
+		}
+	}
+	return queued
+}
+
+// walkParallel is RecursiveAddWithOptions for opts.Workers > 1
+func (w *Watcher) walkParallel(rootPath string, mask uint32, opts RecursiveOptions) (*RecursiveResult, error) {
+	wk := &walker{
+		w:      w,
+		mask:   mask,
+		root:   rootPath,
+		opts:   opts,
+		result: newRecursiveResult(),
+		seen:   make(map[string]bool),
+		listed: make(map[string]listing),
+	}
+	rootDev, err := opts.rootDevice(rootPath)
+	if err != nil {
+		return wk.result, err
+	}
+	wk.rootDev = rootDev
+	wk.cond = sync.NewCond(&wk.Mutex)
+	wk.push(walkJob{path: rootPath, depth: 1})
+
+	for {
+		wk.run()
+		if wk.err != nil {
+			if opts.Atomic {
+				w.rollback(wk.result)
+			}
+			return wk.result, wk.err
+		}
+		if !wk.rescan() {
+			return wk.result, nil
+		}
+	}
+}
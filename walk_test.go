@@ -0,0 +1,113 @@
+package fsevents_test
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"testing"
+
+	fsevents "github.com/tywkeene/go-fsevents"
+)
+
+// walkTestDirs returns a tree of 1 + width + width*width directories below testRootDir
+func walkTestDirs(width int) []string {
+	dirs := []string{testRootDir}
+	for i := 0; i < width; i++ {
+		dir := path.Join(testRootDir, fmt.Sprintf("d%d", i))
+		dirs = append(dirs, dir)
+		for j := 0; j < width; j++ {
+			dirs = append(dirs, path.Join(dir, fmt.Sprintf("d%d", j)))
+		}
+	}
+	return dirs
+}
+
+func TestParallelRecursiveAdd(t *testing.T) {
+	testDirs := walkTestDirs(8)
+	setupDirs(testDirs)
+	defer teardownDirs(testDirs)
+	err := writeRandomFile(path.Join(testRootDir, "file"))
+	assert(t, (err == nil), err)
+
+	w, err := fsevents.NewWatcher()
+	assert(t, (err == nil), err)
+	defer w.Close()
+
+	var last fsevents.WalkProgress
+	calls := 0
+	opts := fsevents.RecursiveOptions{
+		Workers: 4,
+		Progress: func(p fsevents.WalkProgress) {
+			last = p
+			calls++
+		},
+	}
+	result, err := w.RecursiveAddWithOptions(testRootDir, fsevents.AllEvents, opts)
+	assert(t, (err == nil), err)
+	assert(t, (len(result.Added) == len(testDirs)), fmt.Errorf("RecursiveAddWithOptions should have added %d descriptors, got %d", len(testDirs), len(result.Added)))
+	assert(t, (int(w.GetRunningDescriptors()) == len(testDirs)), fmt.Errorf("Count of running descriptors is not equal to number of directories"))
+	assert(t, (calls == len(testDirs)), fmt.Errorf("Progress should have been called %d times, got %d", len(testDirs), calls))
+	assert(t, (last.DirsAdded == len(testDirs)), fmt.Errorf("Progress should have reported %d directories added, got %d", len(testDirs), last.DirsAdded))
+	assert(t, (last.Entries == len(testDirs)), fmt.Errorf("Progress should have reported %d entries, got %d", len(testDirs), last.Entries))
+	assert(t, (last.Queued == 0), fmt.Errorf("Progress should have reported an empty queue"))
+}
+
+func TestParallelRecursiveAddCreatedDuringWalk(t *testing.T) {
+	testDirs := walkTestDirs(2)
+	setupDirs(testDirs)
+	defer teardownDirs(testDirs)
+
+	w, err := fsevents.NewWatcher()
+	assert(t, (err == nil), err)
+	defer w.Close()
+
+	// The root is always listed first, so a directory created after that is not in its listing
+	late := path.Join(testRootDir, "late")
+	opts := fsevents.RecursiveOptions{
+		Workers: 2,
+		Progress: func(p fsevents.WalkProgress) {
+			if p.DirsAdded == 1 {
+				os.Mkdir(late, 0777)
+			}
+		},
+	}
+	result, err := w.RecursiveAddWithOptions(testRootDir, fsevents.AllEvents, opts)
+	assert(t, (err == nil), err)
+	assert(t, (len(result.Added) == len(testDirs)+1), fmt.Errorf("RecursiveAddWithOptions should have added %d descriptors, got %d", len(testDirs)+1, len(result.Added)))
+	assert(t, (w.DescriptorExists(late)), fmt.Errorf("RecursiveAddWithOptions should have added the directory created during the walk"))
+}
+
+func TestParallelRecursiveAddAtomic(t *testing.T) {
+	testDirs := walkTestDirs(4)
+	setupDirs(testDirs)
+	defer teardownDirs(testDirs)
+
+	w, err := fsevents.NewWatcher()
+	assert(t, (err == nil), err)
+	defer w.Close()
+
+	_, err = w.AddDescriptor(path.Join(testRootDir, "d2", "d3"), fsevents.AllEvents)
+	assert(t, (err == nil), err)
+
+	result, err := w.RecursiveAddWithOptions(testRootDir, fsevents.AllEvents, fsevents.RecursiveOptions{Workers: 4, Atomic: true})
+	assert(t, (err != nil), fmt.Errorf("RecursiveAddWithOptions should have returned an error"))
+	assert(t, (result.RolledBack), fmt.Errorf("RecursiveAddWithOptions should have rolled back"))
+	assert(t, (w.GetRunningDescriptors() == 0), fmt.Errorf("RecursiveAddWithOptions should not have left running descriptors behind"))
+	assert(t, (len(w.ListDescriptors()) == 1), fmt.Errorf("RecursiveAddWithOptions should only have removed the descriptors it added"))
+}
+
+func TestParallelRecursiveAddMaxDepth(t *testing.T) {
+	testDirs := walkTestDirs(3)
+	setupDirs(testDirs)
+	defer teardownDirs(testDirs)
+
+	w, err := fsevents.NewWatcher()
+	assert(t, (err == nil), err)
+	defer w.Close()
+
+	opts := fsevents.RecursiveOptions{Workers: 3, MaxDepth: 2, PollBelowMaxDepth: true}
+	result, err := w.RecursiveAddWithOptions(testRootDir, fsevents.AllEvents, opts)
+	assert(t, (err == nil), err)
+	assert(t, (len(result.Added) == 4), fmt.Errorf("RecursiveAddWithOptions should have added 4 descriptors, got %d", len(result.Added)))
+	assert(t, (len(result.Polled) == 9), fmt.Errorf("RecursiveAddWithOptions should have added 9 poll watches, got %d", len(result.Polled)))
+}